@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/csvio"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/dump"
+	"storage-layer/pkg/layer"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbtool <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  import   load a CSV file into a table")
+	fmt.Fprintln(os.Stderr, "  export   write a table to a CSV file")
+	fmt.Fprintln(os.Stderr, "  dump     write the whole database to a JSON Lines archive")
+	fmt.Fprintln(os.Stderr, "  restore  rebuild a new storage directory from a dump")
+	fmt.Fprintln(os.Stderr, "  backup   copy the storage directory page by page")
+	fmt.Fprintln(os.Stderr, "  analyze  compute and store column statistics for a table")
+	fmt.Fprintln(os.Stderr, "  rekey    encrypt the database again with the current key")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = runImport(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "restore":
+		err = runRestore(os.Args[2:])
+	case "backup":
+		err = runBackup(os.Args[2:])
+	case "analyze":
+		err = runAnalyze(os.Args[2:])
+	case "rekey":
+		err = runRekey(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s failed: %v", os.Args[1], err)
+	}
+}
+
+func keyFileFlag(flags *flag.FlagSet) *string {
+	return flags.String("key-file", "", "encryption keys, one \"<id> <hex key>\" per line with the current key last")
+}
+
+// withKeys returns opts with the keys in keyFile if it is set.
+func withKeys(keyFile string, opts layer.Options) (layer.Options, error) {
+	if keyFile != "" {
+		keys, err := crypt.ReadKeyFile(keyFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Keys = keys
+	}
+	return opts, nil
+}
+
+// openStorage opens a database, encrypted with the keys in keyFile if it
+// is set.
+func openStorage(dbDir, keyFile string, opts layer.Options) (*layer.FileStorageLayer, error) {
+	opts, err := withKeys(keyFile, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.OpenWithOptions(dbDir, opts); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	tableName := flags.String("table", "", "target table")
+	inputPath := flags.String("file", "", "CSV file to read (default stdin)")
+	rejectPath := flags.String("rejects", "", "file receiving rows that fail to import")
+	nullMarker := flags.String("null", "NULL", "field value that represents NULL")
+	delimiter := flags.String("delim", ",", "field delimiter")
+	header := flags.Bool("header", true, "first line is a header naming the columns")
+	batchSize := flags.Int("batch", 1000, "rows per insert batch")
+	syncPolicy := flags.String("sync", "per-write", "when writes are synced: per-write, per-flush, group-commit or none")
+	flags.Parse(args)
+
+	if *tableName == "" {
+		return fmt.Errorf("-table is required")
+	}
+
+	opts := csvio.DefaultImportOptions()
+	opts.NullMarker = *nullMarker
+	opts.HasHeader = *header
+	opts.BatchSize = *batchSize
+	if len(*delimiter) != 1 {
+		return fmt.Errorf("-delim must be a single character")
+	}
+	opts.Delimiter = rune((*delimiter)[0])
+
+	input := os.Stdin
+	if *inputPath != "" {
+		file, err := os.Open(*inputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	if *rejectPath != "" {
+		file, err := os.Create(*rejectPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		opts.Rejects = file
+	}
+
+	storageOpts := layer.DefaultOptions()
+	policy, err := disk.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		return err
+	}
+	storageOpts.Durability.Policy = policy
+
+	storage, err := openStorage(*dbDir, *keyFile, storageOpts)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	result, err := csvio.Import(storage, *tableName, input, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d rows, rejected %d rows\n", result.Imported, result.Rejected)
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	tableName := flags.String("table", "", "source table")
+	outputPath := flags.String("file", "", "CSV file to write (default stdout)")
+	nullMarker := flags.String("null", "NULL", "field value written for NULL")
+	delimiter := flags.String("delim", ",", "field delimiter")
+	header := flags.Bool("header", true, "write a header line")
+	flags.Parse(args)
+
+	if *tableName == "" {
+		return fmt.Errorf("-table is required")
+	}
+
+	opts := csvio.DefaultExportOptions()
+	opts.NullMarker = *nullMarker
+	opts.WithHeader = *header
+	if len(*delimiter) != 1 {
+		return fmt.Errorf("-delim must be a single character")
+	}
+	opts.Delimiter = rune((*delimiter)[0])
+
+	output := os.Stdout
+	if *outputPath != "" {
+		file, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	storage, err := openStorage(*dbDir, *keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return csvio.Export(storage, *tableName, output, opts)
+}
+
+func runDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	outputPath := flags.String("file", "", "archive to write (default stdout)")
+	flags.Parse(args)
+
+	output := os.Stdout
+	if *outputPath != "" {
+		file, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	storage, err := openStorage(*dbDir, *keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return dump.Dump(storage, output)
+}
+
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbDir := flags.String("db", "", "new storage directory to create")
+	keyFile := keyFileFlag(flags)
+	inputPath := flags.String("file", "", "archive to read (default stdin)")
+	flags.Parse(args)
+
+	if *dbDir == "" {
+		return fmt.Errorf("-db is required")
+	}
+
+	input := os.Stdin
+	if *inputPath != "" {
+		file, err := os.Open(*inputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	// The keys encrypt the new database; the archive itself is plain
+	opts, err := withKeys(*keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	return dump.Restore(input, *dbDir, opts)
+}
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	destDir := flags.String("dest", "", "empty directory receiving the backup")
+	flags.Parse(args)
+
+	if *destDir == "" {
+		return fmt.Errorf("-dest is required")
+	}
+
+	storage, err := openStorage(*dbDir, *keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return storage.Backup(*destDir)
+}
+
+func runAnalyze(args []string) error {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	tableName := flags.String("table", "", "table to analyze")
+	samplePages := flags.Int("sample", layer.DefaultAnalyzeOptions().SamplePages, "number of pages to sample (0 reads all)")
+	buckets := flags.Int("buckets", layer.DefaultAnalyzeOptions().HistogramBuckets, "histogram buckets per column")
+	flags.Parse(args)
+
+	if *tableName == "" {
+		return fmt.Errorf("-table is required")
+	}
+
+	storage, err := openStorage(*dbDir, *keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	stats, err := storage.AnalyzeWithOptions(*tableName, layer.AnalyzeOptions{
+		SamplePages:      *samplePages,
+		HistogramBuckets: *buckets,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(stats)
+}
+
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	dbDir := flags.String("db", "./storage", "storage directory")
+	keyFile := keyFileFlag(flags)
+	flags.Parse(args)
+
+	if *keyFile == "" {
+		return fmt.Errorf("-key-file is required")
+	}
+
+	storage, err := openStorage(*dbDir, *keyFile, layer.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return storage.Rekey()
+}
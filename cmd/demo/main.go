@@ -25,6 +25,7 @@ func main() {
 			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
 			{Name: "age", Type: record.TypeInt, Nullable: true},
 		},
+		PrimaryKey: []string{"id"},
 	}
 
 	if err := storage.CreateTable("users", schema); err != nil {
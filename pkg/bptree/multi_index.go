@@ -0,0 +1,89 @@
+package bptree
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/record"
+	"sync"
+)
+
+// MultiIndex maps key column values to every record ID holding them. It
+// backs lookups of referencing rows for foreign keys.
+type MultiIndex struct {
+	name      string
+	columns   []string
+	positions []int
+	entries   map[string]map[int]struct{}
+	mutex     sync.RWMutex
+}
+
+func NewMultiIndex(name string, schema record.Schema, columns []string) (*MultiIndex, error) {
+	positions := make([]int, len(columns))
+	for i, colName := range columns {
+		positions[i] = schema.ColumnIndex(colName)
+		if positions[i] < 0 {
+			return nil, fmt.Errorf("column %s does not exist", colName)
+		}
+	}
+
+	return &MultiIndex{
+		name:      name,
+		columns:   columns,
+		positions: positions,
+		entries:   make(map[string]map[int]struct{}),
+	}, nil
+}
+
+func (mi *MultiIndex) Name() string {
+	return mi.name
+}
+
+func (mi *MultiIndex) Columns() []string {
+	return mi.columns
+}
+
+// Key encodes the key columns of a full row. The second result is false if
+// any key column is NULL.
+func (mi *MultiIndex) Key(values []interface{}) (string, bool) {
+	key := make([]interface{}, len(mi.positions))
+	for i, pos := range mi.positions {
+		key[i] = values[pos]
+	}
+	return EncodeKey(key)
+}
+
+// Lookup returns the IDs of all records with the given key in ascending
+// order.
+func (mi *MultiIndex) Lookup(key string) []int {
+	mi.mutex.RLock()
+	defer mi.mutex.RUnlock()
+
+	ids := make([]int, 0, len(mi.entries[key]))
+	for id := range mi.entries[key] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (mi *MultiIndex) Insert(key string, id int) {
+	mi.mutex.Lock()
+	defer mi.mutex.Unlock()
+
+	ids, exists := mi.entries[key]
+	if !exists {
+		ids = make(map[int]struct{})
+		mi.entries[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (mi *MultiIndex) Delete(key string, id int) {
+	mi.mutex.Lock()
+	defer mi.mutex.Unlock()
+
+	delete(mi.entries[key], id)
+	if len(mi.entries[key]) == 0 {
+		delete(mi.entries, key)
+	}
+}
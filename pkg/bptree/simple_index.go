@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/vfs"
+	"strconv"
 	"sync"
 )
 
@@ -16,34 +20,62 @@ type RecordID struct {
 type SimpleIndex struct {
 	tableName string
 	basePath  string
+	fs        vfs.FileSystem
+	cipher    *crypt.Cipher
 	index     map[int]RecordID
-	nextID    int
-	mutex     sync.RWMutex
+	// byRID maps physical locations back to record IDs
+	byRID  map[RecordID]int
+	nextID int
+	// version counts the changes made to the index
+	version uint64
+	mutex   sync.RWMutex
+}
+
+func IndexFileName(tableName string) string {
+	return tableName + ".idx"
 }
 
 func NewSimpleIndex(tableName, basePath string) *SimpleIndex {
+	return NewSimpleIndexFS(tableName, basePath, vfs.OS{})
+}
+
+// NewSimpleIndexFS returns an index that is saved in fsys.
+func NewSimpleIndexFS(tableName, basePath string, fsys vfs.FileSystem) *SimpleIndex {
 	return &SimpleIndex{
 		tableName: tableName,
 		basePath:  basePath,
+		fs:        fsys,
 		index:     make(map[int]RecordID),
+		byRID:     make(map[RecordID]int),
 		nextID:    1,
 	}
 }
 
+// SetCipher encrypts the index file with c, and expects it encrypted on
+// Load.
+func (si *SimpleIndex) SetCipher(c *crypt.Cipher) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.cipher = c
+}
+
 func (si *SimpleIndex) Load() error {
 	si.mutex.Lock()
 	defer si.mutex.Unlock()
 
-	indexPath := filepath.Join(si.basePath, si.tableName+".idx")
+	indexPath := filepath.Join(si.basePath, IndexFileName(si.tableName))
 
-	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
+	data, err := vfs.ReadFile(si.fs, indexPath)
+	if os.IsNotExist(err) {
 		return nil
 	}
-
-	data, err := os.ReadFile(indexPath)
 	if err != nil {
 		return fmt.Errorf("failed to read index: %v", err)
 	}
+	if data, err = si.cipher.OpenFile(IndexFileName(si.tableName), data); err != nil {
+		return fmt.Errorf("failed to read index: %v", err)
+	}
 
 	var indexData struct {
 		Index  map[int]RecordID `json:"index"`
@@ -55,31 +87,80 @@ func (si *SimpleIndex) Load() error {
 	}
 
 	si.index = indexData.Index
+	if si.index == nil {
+		si.index = make(map[int]RecordID)
+	}
 	si.nextID = indexData.NextID
 
+	si.byRID = make(map[RecordID]int, len(si.index))
+	for id, rid := range si.index {
+		si.byRID[rid] = id
+	}
+	si.version++
+
 	return nil
 }
 
 func (si *SimpleIndex) Save() error {
+	indexPath := filepath.Join(si.basePath, IndexFileName(si.tableName))
+
+	data, err := si.Encode()
+	if err != nil {
+		return err
+	}
+
+	return vfs.WriteFile(si.fs, indexPath, data, false)
+}
+
+// Encode returns the index in its on-disk format.
+func (si *SimpleIndex) Encode() ([]byte, error) {
 	si.mutex.RLock()
 	defer si.mutex.RUnlock()
 
-	indexPath := filepath.Join(si.basePath, si.tableName+".idx")
-
-	indexData := struct {
-		Index  map[int]RecordID `json:"index"`
-		NextID int              `json:"next_id"`
-	}{
-		Index:  si.index,
-		NextID: si.nextID,
+	// Written by hand because encoding/json is slow for large indexes. The
+	// result is the same as marshalling {"index": ..., "next_id": ...}.
+	ids := make([]int, 0, len(si.index))
+	for id := range si.index {
+		ids = append(ids, id)
 	}
+	sort.Ints(ids)
 
-	data, err := json.MarshalIndent(indexData, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal index: %v", err)
+	data := make([]byte, 0, 16+len(ids)*32)
+	data = append(data, `{"index":{`...)
+	for i, id := range ids {
+		rid := si.index[id]
+		if i > 0 {
+			data = append(data, ',')
+		}
+		data = append(data, '"')
+		data = strconv.AppendInt(data, int64(id), 10)
+		data = append(data, `":{"page_id":`...)
+		data = strconv.AppendInt(data, int64(rid.PageID), 10)
+		data = append(data, `,"slot_id":`...)
+		data = strconv.AppendInt(data, int64(rid.SlotID), 10)
+		data = append(data, '}')
 	}
+	data = append(data, `},"next_id":`...)
+	data = strconv.AppendInt(data, int64(si.nextID), 10)
+	data = append(data, '}')
 
-	return os.WriteFile(indexPath, data, 0644)
+	return si.cipher.SealFile(IndexFileName(si.tableName), data)
+}
+
+// Version changes whenever the index does, so a caller that saved it can
+// tell whether it needs saving again.
+func (si *SimpleIndex) Version() uint64 {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	return si.version
+}
+
+func (si *SimpleIndex) Count() int {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	return len(si.index)
 }
 
 func (si *SimpleIndex) Insert(rid RecordID) (int, error) {
@@ -88,11 +169,37 @@ func (si *SimpleIndex) Insert(rid RecordID) (int, error) {
 
 	id := si.nextID
 	si.index[id] = rid
+	si.byRID[rid] = id
 	si.nextID++
+	si.version++
 
 	return id, nil
 }
 
+// InsertBatch indexes records under consecutive IDs and returns the first.
+func (si *SimpleIndex) InsertBatch(rids []RecordID) int {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	first := si.nextID
+	for _, rid := range rids {
+		si.index[si.nextID] = rid
+		si.byRID[rid] = si.nextID
+		si.nextID++
+	}
+	si.version++
+
+	return first
+}
+
+// NextID returns the ID the next inserted record will get.
+func (si *SimpleIndex) NextID() int {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	return si.nextID
+}
+
 func (si *SimpleIndex) Search(id int) (RecordID, bool) {
 	si.mutex.RLock()
 	defer si.mutex.RUnlock()
@@ -105,11 +212,14 @@ func (si *SimpleIndex) Delete(id int) error {
 	si.mutex.Lock()
 	defer si.mutex.Unlock()
 
-	if _, exists := si.index[id]; !exists {
+	rid, exists := si.index[id]
+	if !exists {
 		return fmt.Errorf("record id %d not found", id)
 	}
 
 	delete(si.index, id)
+	delete(si.byRID, rid)
+	si.version++
 	return nil
 }
 
@@ -117,14 +227,27 @@ func (si *SimpleIndex) Update(id int, rid RecordID) error {
 	si.mutex.Lock()
 	defer si.mutex.Unlock()
 
-	if _, exists := si.index[id]; !exists {
+	oldRID, exists := si.index[id]
+	if !exists {
 		return fmt.Errorf("record id %d not found", id)
 	}
 
+	delete(si.byRID, oldRID)
 	si.index[id] = rid
+	si.byRID[rid] = id
+	si.version++
 	return nil
 }
 
+// SearchRID returns the ID of the record stored at rid.
+func (si *SimpleIndex) SearchRID(rid RecordID) (int, bool) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	id, exists := si.byRID[rid]
+	return id, exists
+}
+
 func (si *SimpleIndex) GetAllRecords() map[int]RecordID {
 	si.mutex.RLock()
 	defer si.mutex.RUnlock()
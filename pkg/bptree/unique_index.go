@@ -0,0 +1,126 @@
+package bptree
+
+import (
+	"fmt"
+	"math"
+	"storage-layer/pkg/record"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UniqueIndex maps the values of a set of key columns to the logical record
+// ID holding them. Keys containing a NULL are not indexed, so any number of
+// rows may have a NULL in a unique column.
+type UniqueIndex struct {
+	name      string
+	columns   []string
+	positions []int
+	entries   map[string]int
+	mutex     sync.RWMutex
+}
+
+func NewUniqueIndex(name string, schema record.Schema, columns []string) (*UniqueIndex, error) {
+	positions := make([]int, len(columns))
+	for i, colName := range columns {
+		positions[i] = schema.ColumnIndex(colName)
+		if positions[i] < 0 {
+			return nil, fmt.Errorf("column %s does not exist", colName)
+		}
+	}
+
+	return &UniqueIndex{
+		name:      name,
+		columns:   columns,
+		positions: positions,
+		entries:   make(map[string]int),
+	}, nil
+}
+
+func (ui *UniqueIndex) Name() string {
+	return ui.name
+}
+
+func (ui *UniqueIndex) Columns() []string {
+	return ui.columns
+}
+
+// KeyValues picks the key columns out of a full row.
+func (ui *UniqueIndex) KeyValues(values []interface{}) []interface{} {
+	key := make([]interface{}, len(ui.positions))
+	for i, pos := range ui.positions {
+		key[i] = values[pos]
+	}
+	return key
+}
+
+// Key encodes the key columns of a full row. The second result is false if
+// any key column is NULL.
+func (ui *UniqueIndex) Key(values []interface{}) (string, bool) {
+	return EncodeKey(ui.KeyValues(values))
+}
+
+func (ui *UniqueIndex) Lookup(key string) (int, bool) {
+	ui.mutex.RLock()
+	defer ui.mutex.RUnlock()
+
+	id, exists := ui.entries[key]
+	return id, exists
+}
+
+func (ui *UniqueIndex) Insert(key string, id int) error {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+
+	if existing, exists := ui.entries[key]; exists && existing != id {
+		return fmt.Errorf("duplicate key in index %s", ui.name)
+	}
+
+	ui.entries[key] = id
+	return nil
+}
+
+func (ui *UniqueIndex) Delete(key string) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+
+	delete(ui.entries, key)
+}
+
+func (ui *UniqueIndex) Count() int {
+	ui.mutex.RLock()
+	defer ui.mutex.RUnlock()
+
+	return len(ui.entries)
+}
+
+// EncodeKey turns key values into a string that is equal for equal keys.
+func EncodeKey(values []interface{}) (string, bool) {
+	var sb strings.Builder
+
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			return "", false
+		case int:
+			sb.WriteString("i")
+			sb.WriteString(strconv.Itoa(v))
+		case float64:
+			if v == 0 {
+				v = 0 // fold -0 into 0
+			}
+			sb.WriteString("f")
+			sb.WriteString(strconv.FormatUint(math.Float64bits(v), 16))
+		case string:
+			sb.WriteString("s")
+			sb.WriteString(strconv.Itoa(len(v)))
+			sb.WriteString(":")
+			sb.WriteString(v)
+		default:
+			sb.WriteString(fmt.Sprintf("?%v", v))
+		}
+		sb.WriteString("|")
+	}
+
+	return sb.String(), true
+}
@@ -2,60 +2,249 @@ package catalog
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"storage-layer/pkg/crypt"
 	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
 	"sync"
 )
 
+const (
+	MetaFileName = "tables.meta"
+
+	// Version 1 was a bare map of table name to schema, version 2 had no
+	// checksum
+	formatVersion = 3
+
+	prevSuffix = ".prev"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type CatalogManager struct {
-	basePath string
-	schemas  map[string]record.Schema
-	mutex    sync.RWMutex
+	basePath   string
+	fs         vfs.FileSystem
+	cipher     *crypt.Cipher
+	schemas    map[string]record.Schema
+	statistics map[string]TableStatistics
+	sequences  map[string]*sequence
+	version    uint64
+	mutex      sync.RWMutex
+}
+
+// catalogEnvelope wraps the catalog with its checksum, computed over the
+// exact bytes of Catalog.
+type catalogEnvelope struct {
+	FormatVersion int             `json:"format_version"`
+	Version       uint64          `json:"version"`
+	Checksum      uint32          `json:"checksum"`
+	Catalog       json.RawMessage `json:"catalog"`
+}
+
+type catalogFile struct {
+	FormatVersion int                        `json:"format_version,omitempty"`
+	Tables        map[string]record.Schema   `json:"tables"`
+	Statistics    map[string]TableStatistics `json:"statistics,omitempty"`
+	Sequences     map[string]*sequence       `json:"sequences,omitempty"`
 }
 
 func NewCatalogManager(basePath string) *CatalogManager {
+	return NewCatalogManagerFS(basePath, vfs.OS{})
+}
+
+// NewCatalogManagerFS returns a CatalogManager that keeps the catalog in
+// fsys.
+func NewCatalogManagerFS(basePath string, fsys vfs.FileSystem) *CatalogManager {
 	return &CatalogManager{
-		basePath: basePath,
-		schemas:  make(map[string]record.Schema),
+		basePath:   basePath,
+		fs:         fsys,
+		schemas:    make(map[string]record.Schema),
+		statistics: make(map[string]TableStatistics),
+		sequences:  make(map[string]*sequence),
 	}
 }
 
+// SetCipher encrypts the catalog file with c from the next Save, and
+// expects it encrypted from the next Load.
+func (cm *CatalogManager) SetCipher(c *crypt.Cipher) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	cm.cipher = c
+}
+
 func (cm *CatalogManager) Load() error {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
-	metaPath := filepath.Join(cm.basePath, "tables.meta")
+	metaPath := filepath.Join(cm.basePath, MetaFileName)
 
-	// If meta file doesn't exist, start with empty catalog
-	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
-		return nil
+	file, version, err := readCatalogFile(cm.fs, cm.cipher, metaPath)
+	fellBack := false
+	if errors.Is(err, crypt.ErrWrongKey) || errors.Is(err, crypt.ErrNoKey) {
+		// Not damage, and the previous generation would not be read
+		// either
+		return fmt.Errorf("failed to load catalog: %v", err)
 	}
-
-	data, err := os.ReadFile(metaPath)
 	if err != nil {
-		return fmt.Errorf("failed to read catalog: %v", err)
+		// A damaged catalog falls back to the generation before it. Save
+		// never leaves a damaged file behind, so this is only for damage
+		// from outside, and the last change may be lost. A lost sequence
+		// reservation is made up for by moving every sequence past the
+		// next batch.
+		prevFile, prevVersion, prevErr := readCatalogFile(cm.fs, cm.cipher, metaPath+prevSuffix)
+		if prevErr != nil {
+			if os.IsNotExist(err) && os.IsNotExist(prevErr) {
+				return nil
+			}
+			if os.IsNotExist(err) {
+				err = prevErr
+			}
+			return fmt.Errorf("failed to load catalog: %v", err)
+		}
+		file, version = prevFile, prevVersion
+		fellBack = true
+	}
+
+	if file.FormatVersion > formatVersion {
+		return fmt.Errorf("catalog format version %d is newer than supported version %d", file.FormatVersion, formatVersion)
 	}
 
-	var schemas map[string]record.Schema
-	if err := json.Unmarshal(data, &schemas); err != nil {
-		return fmt.Errorf("failed to unmarshal catalog: %v", err)
+	cm.version = version
+	cm.schemas = file.Tables
+	if cm.schemas == nil {
+		cm.schemas = make(map[string]record.Schema)
+	}
+
+	cm.statistics = make(map[string]TableStatistics)
+	for tableName, stats := range file.Statistics {
+		if schema, exists := cm.schemas[tableName]; exists {
+			cm.statistics[tableName] = stats.normalize(schema)
+		}
+	}
+
+	cm.sequences = make(map[string]*sequence)
+	for name, seq := range file.Sequences {
+		if fellBack {
+			// The lost generation may have reserved the next batch of
+			// values, and handed some out
+			seq.reserveBatch()
+		}
+		// Values up to Reserved may have been handed out before a crash
+		seq.last, seq.called = seq.Reserved, seq.Called
+		cm.sequences[name] = seq
 	}
 
-	cm.schemas = schemas
 	return nil
 }
 
+// readCatalogFile reads and verifies one generation of the catalog. Errors
+// for a missing file satisfy os.IsNotExist.
+func readCatalogFile(fsys vfs.FileSystem, c *crypt.Cipher, path string) (catalogFile, uint64, error) {
+	data, err := vfs.ReadFile(fsys, path)
+	if err != nil {
+		return catalogFile{}, 0, err
+	}
+	// Both generations are sealed under the name of the current one
+	if data, err = c.OpenFile(MetaFileName, data); err != nil {
+		return catalogFile{}, 0, err
+	}
+
+	var envelope catalogEnvelope
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.FormatVersion >= 3 {
+		if crc32.Checksum(envelope.Catalog, crcTable) != envelope.Checksum {
+			return catalogFile{}, 0, fmt.Errorf("%s: checksum mismatch", filepath.Base(path))
+		}
+
+		var file catalogFile
+		if err := json.Unmarshal(envelope.Catalog, &file); err != nil {
+			return catalogFile{}, 0, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		file.FormatVersion = envelope.FormatVersion
+		return file, envelope.Version, nil
+	}
+
+	// Older formats have no checksum
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil || file.FormatVersion == 0 {
+		var schemas map[string]record.Schema
+		if err := json.Unmarshal(data, &schemas); err != nil {
+			return catalogFile{}, 0, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		file = catalogFile{FormatVersion: 1, Tables: schemas}
+	}
+	return file, 0, nil
+}
+
+// Save writes the catalog so that a crash at any point leaves a complete
+// catalog behind: the new generation goes to a temporary file first, the
+// current one is kept as the previous generation, and the directory is
+// synced after the renames.
 func (cm *CatalogManager) Save() error {
-	metaPath := filepath.Join(cm.basePath, "tables.meta")
+	metaPath := filepath.Join(cm.basePath, MetaFileName)
+	tempPath := metaPath + ".tmp"
 
-	data, err := json.MarshalIndent(cm.schemas, "", "  ")
+	data, err := cm.encode()
 	if err != nil {
-		return fmt.Errorf("failed to marshal catalog: %v", err)
+		return err
+	}
+
+	if err := vfs.WriteFile(cm.fs, tempPath, data, true); err != nil {
+		return fmt.Errorf("failed to write catalog: %v", err)
+	}
+
+	if err := cm.fs.Rename(metaPath, metaPath+prevSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to keep previous catalog: %v", err)
+	}
+	if err := cm.fs.Rename(tempPath, metaPath); err != nil {
+		return fmt.Errorf("failed to replace catalog: %v", err)
 	}
 
-	return os.WriteFile(metaPath, data, 0644)
+	return cm.fs.SyncDir(cm.basePath)
+}
+
+// Encode returns the catalog in its on-disk format.
+func (cm *CatalogManager) Encode() ([]byte, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.encode()
+}
+
+func (cm *CatalogManager) encode() ([]byte, error) {
+	file := catalogFile{
+		Tables:     cm.schemas,
+		Statistics: cm.statistics,
+		Sequences:  cm.sequences,
+	}
+
+	contents, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal catalog: %v", err)
+	}
+
+	// The envelope is written by hand because encoding/json would reformat
+	// the checksummed contents
+	checksum := crc32.Checksum(contents, crcTable)
+	data := fmt.Appendf(nil, "{\"format_version\": %d, \"version\": %d, \"checksum\": %d, \"catalog\": ",
+		formatVersion, cm.version, checksum)
+	data = append(data, contents...)
+	data = append(data, "}\n"...)
+	return cm.cipher.SealFile(MetaFileName, data)
+}
+
+// Version is bumped by every schema change, so callers can tell whether
+// schema information they cached is still current.
+func (cm *CatalogManager) Version() uint64 {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.version
 }
 
 func (cm *CatalogManager) CreateTable(tableName string, schema record.Schema) error {
@@ -66,7 +255,36 @@ func (cm *CatalogManager) CreateTable(tableName string, schema record.Schema) er
 		return fmt.Errorf("table %s already exists", tableName)
 	}
 
+	if IsSystemTable(tableName) {
+		return fmt.Errorf("table name %s is reserved for a system table", tableName)
+	}
+
+	if err := schema.Validate(); err != nil {
+		return fmt.Errorf("invalid schema for table %s: %v", tableName, err)
+	}
+
+	if err := cm.validateForeignKeys(tableName, schema); err != nil {
+		return fmt.Errorf("invalid schema for table %s: %v", tableName, err)
+	}
+
+	var sequences []string
+	for _, col := range schema.Columns {
+		if col.AutoIncrement {
+			name := SequenceName(tableName, col.Name)
+			if _, exists := cm.sequences[name]; exists {
+				return fmt.Errorf("sequence %s already exists", name)
+			}
+			sequences = append(sequences, name)
+		}
+	}
+	for _, name := range sequences {
+		if err := cm.createSequence(name, DefaultSequenceOptions()); err != nil {
+			return err
+		}
+	}
+
 	cm.schemas[tableName] = schema
+	cm.version++
 	return cm.Save()
 }
 
@@ -75,6 +293,9 @@ func (cm *CatalogManager) GetSchema(tableName string) (record.Schema, error) {
 	defer cm.mutex.RUnlock()
 
 	schema, exists := cm.schemas[tableName]
+	if !exists {
+		schema, exists = systemSchemas[tableName]
+	}
 	if !exists {
 		return record.Schema{}, fmt.Errorf("table %s does not exist", tableName)
 	}
@@ -87,6 +308,9 @@ func (cm *CatalogManager) TableExists(tableName string) bool {
 	defer cm.mutex.RUnlock()
 
 	_, exists := cm.schemas[tableName]
+	if !exists {
+		_, exists = systemSchemas[tableName]
+	}
 	return exists
 }
 
@@ -100,3 +324,36 @@ func (cm *CatalogManager) ListTables() []string {
 	}
 	return tables
 }
+
+// validateForeignKeys checks that every foreign key refers to a primary or
+// unique key of an existing table with matching column types.
+func (cm *CatalogManager) validateForeignKeys(tableName string, schema record.Schema) error {
+	for _, fk := range schema.ForeignKeys {
+		refSchema, exists := cm.schemas[fk.RefTable]
+		if fk.RefTable == tableName {
+			refSchema, exists = schema, true
+		}
+		if !exists {
+			return fmt.Errorf("referenced table %s does not exist", fk.RefTable)
+		}
+
+		for i, refName := range fk.RefColumns {
+			refIdx := refSchema.ColumnIndex(refName)
+			if refIdx < 0 {
+				return fmt.Errorf("referenced column %s.%s does not exist", fk.RefTable, refName)
+			}
+			col := schema.Columns[schema.ColumnIndex(fk.Columns[i])]
+			if col.Type != refSchema.Columns[refIdx].Type {
+				return fmt.Errorf("column %s has type %s but references %s.%s of type %s",
+					col.Name, col.Type, fk.RefTable, refName, refSchema.Columns[refIdx].Type)
+			}
+		}
+
+		if !refSchema.IsUniqueKey(fk.RefColumns) {
+			return fmt.Errorf("referenced columns (%s) are not a primary or unique key of %s",
+				strings.Join(fk.RefColumns, ", "), fk.RefTable)
+		}
+	}
+
+	return nil
+}
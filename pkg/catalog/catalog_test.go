@@ -0,0 +1,195 @@
+package catalog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+var testSchema = record.Schema{
+	Columns: []record.Column{
+		{Name: "id", Type: record.TypeInt, Nullable: false},
+	},
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "catalog_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cm := NewCatalogManager(tempDir)
+	if err := cm.Load(); err != nil {
+		t.Fatalf("Failed to load empty catalog: %v", err)
+	}
+
+	for _, tableName := range []string{"a", "b"} {
+		if err := cm.CreateTable(tableName, testSchema); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	if err := cm.CreateSequence("seq", DefaultSequenceOptions()); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+	if cm.Version() != 3 {
+		t.Errorf("Expected version 3 after three schema changes, got %d", cm.Version())
+	}
+
+	// Handing out sequence values is not a schema change
+	if _, err := cm.NextVal("seq"); err != nil {
+		t.Fatalf("NextVal failed: %v", err)
+	}
+	if cm.Version() != 3 {
+		t.Errorf("Expected NextVal to keep version 3, got %d", cm.Version())
+	}
+
+	loaded := NewCatalogManager(tempDir)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+	if !loaded.TableExists("a") || !loaded.TableExists("b") || loaded.Version() != 3 {
+		t.Errorf("Loaded catalog has tables %v and version %d", loaded.ListTables(), loaded.Version())
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, MetaFileName+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file to be left behind")
+	}
+}
+
+func TestLoadFallsBackToPreviousGeneration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "catalog_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	metaPath := filepath.Join(tempDir, MetaFileName)
+
+	cm := NewCatalogManager(tempDir)
+	if err := cm.CreateTable("a", testSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := cm.CreateTable("b", testSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("Failed to read catalog: %v", err)
+	}
+
+	damage := map[string][]byte{
+		"truncated": data[:len(data)/2],
+		"empty":     {},
+		// Still valid JSON, but the checksum no longer matches
+		"renamed table": bytes.Replace(data, []byte(`"b": {`), []byte(`"c": {`), 1),
+	}
+
+	if bytes.Equal(damage["renamed table"], data) {
+		t.Fatalf("Expected table b in the catalog file")
+	}
+
+	for name, damaged := range damage {
+		if err := os.WriteFile(metaPath, damaged, 0644); err != nil {
+			t.Fatalf("Failed to damage catalog: %v", err)
+		}
+
+		loaded := NewCatalogManager(tempDir)
+		if err := loaded.Load(); err != nil {
+			t.Errorf("%s: expected a fallback to the previous generation, got %v", name, err)
+			continue
+		}
+		if !loaded.TableExists("a") || loaded.TableExists("b") || loaded.Version() != 1 {
+			t.Errorf("%s: expected the previous generation with only table a, got %v (version %d)", name, loaded.ListTables(), loaded.Version())
+		}
+	}
+
+	// A crash between the two renames leaves only the previous generation
+	os.Remove(metaPath)
+	loaded := NewCatalogManager(tempDir)
+	if err := loaded.Load(); err != nil || !loaded.TableExists("a") {
+		t.Errorf("Expected the previous generation to load, got %v", err)
+	}
+
+	// Without a usable generation Load fails rather than starting empty
+	os.WriteFile(metaPath, []byte("{"), 0644)
+	os.WriteFile(metaPath+".prev", []byte("{"), 0644)
+	if err := NewCatalogManager(tempDir).Load(); err == nil {
+		t.Errorf("Expected loading a damaged catalog without a fallback to fail")
+	}
+}
+
+func TestLoadVersion2Catalog(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "catalog_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	legacy := `{"format_version": 2, "tables": {"users": {"Columns": [{"Name": "id", "Type": "INT", "Length": 0, "Nullable": false}]}}}`
+	if err := os.WriteFile(filepath.Join(tempDir, MetaFileName), []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write catalog: %v", err)
+	}
+
+	cm := NewCatalogManager(tempDir)
+	if err := cm.Load(); err != nil {
+		t.Fatalf("Failed to load version 2 catalog: %v", err)
+	}
+	if !cm.TableExists("users") {
+		t.Errorf("Expected table users, got %v", cm.ListTables())
+	}
+}
+
+func TestFallbackSkipsReservedSequenceValues(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SequenceOptions
+		// calls is how many values are handed out; the last batch is
+		// reserved by the last save
+		calls int
+	}{
+		{"ascending", SequenceOptions{Start: 1, Increment: 1, Cache: 4}, 5},
+		{"descending", SequenceOptions{Start: 100, Increment: -2, Cache: 4}, 9},
+		{"first batch", SequenceOptions{Start: 1, Increment: 1, Cache: 4}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "catalog_test")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			cm := NewCatalogManager(tempDir)
+			if err := cm.CreateSequence("seq", tt.opts); err != nil {
+				t.Fatalf("Failed to create sequence: %v", err)
+			}
+			handedOut := make(map[int]bool)
+			for i := 0; i < tt.calls; i++ {
+				value, err := cm.NextVal("seq")
+				if err != nil {
+					t.Fatalf("NextVal failed: %v", err)
+				}
+				handedOut[value] = true
+			}
+			os.WriteFile(filepath.Join(tempDir, MetaFileName), []byte("{"), 0644)
+
+			loaded := NewCatalogManager(tempDir)
+			if err := loaded.Load(); err != nil {
+				t.Fatalf("Expected a fallback to the previous generation, got %v", err)
+			}
+			for i := 0; i < 2*tt.opts.Cache; i++ {
+				value, err := loaded.NextVal("seq")
+				if err != nil {
+					t.Fatalf("NextVal failed: %v", err)
+				}
+				if handedOut[value] {
+					t.Errorf("Handed out %d again after the fallback", value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package catalog
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type SequenceOptions struct {
+	Start     int `json:"start"`
+	Increment int `json:"increment"`
+	// Cache is how many values are reserved per catalog write
+	Cache int `json:"cache"`
+}
+
+func DefaultSequenceOptions() SequenceOptions {
+	return SequenceOptions{Start: 1, Increment: 1, Cache: 32}
+}
+
+// SequenceState describes a sequence. Last is the value most recently
+// handed out and is only meaningful if Called is set.
+type SequenceState struct {
+	Options SequenceOptions
+	Last    int
+	Called  bool
+}
+
+// sequence values are handed out from memory up to Reserved, which is
+// saved before any value beyond it is used. After a crash the sequence
+// continues after Reserved, so values may be skipped but never repeated.
+type sequence struct {
+	Options  SequenceOptions `json:"options"`
+	Reserved int             `json:"reserved"`
+	Called   bool            `json:"called"`
+
+	last   int
+	called bool
+}
+
+// SequenceUse is a value taken from a sequence, kept so that it can be
+// given back if the row it went to is not written.
+type SequenceUse struct {
+	name  string
+	value int
+
+	// what the sequence had handed out before
+	last   int
+	called bool
+}
+
+// SequenceName is the sequence behind an AUTO_INCREMENT column.
+func SequenceName(tableName, column string) string {
+	return tableName + "_" + column + "_seq"
+}
+
+func (cm *CatalogManager) CreateSequence(name string, opts SequenceOptions) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if err := cm.createSequence(name, opts); err != nil {
+		return err
+	}
+	cm.version++
+	return cm.Save()
+}
+
+func (cm *CatalogManager) createSequence(name string, opts SequenceOptions) error {
+	if name == "" {
+		return fmt.Errorf("sequence name cannot be empty")
+	}
+	if _, exists := cm.sequences[name]; exists {
+		return fmt.Errorf("sequence %s already exists", name)
+	}
+	if opts.Increment == 0 {
+		return fmt.Errorf("sequence %s: increment cannot be zero", name)
+	}
+	if opts.Cache < 1 {
+		return fmt.Errorf("sequence %s: cache must be at least 1", name)
+	}
+	if opts.Start < math.MinInt32 || opts.Start > math.MaxInt32 {
+		return fmt.Errorf("sequence %s: start %d out of range", name, opts.Start)
+	}
+
+	cm.sequences[name] = &sequence{Options: opts}
+	return nil
+}
+
+// NextVal returns the next value of a sequence, saving the catalog when the
+// cached values run out.
+func (cm *CatalogManager) NextVal(name string) (int, error) {
+	value, _, err := cm.TakeNextVal(name)
+	return value, err
+}
+
+// TakeNextVal is NextVal for a value that may have to be given back.
+func (cm *CatalogManager) TakeNextVal(name string) (int, SequenceUse, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	seq, exists := cm.sequences[name]
+	if !exists {
+		return 0, SequenceUse{}, fmt.Errorf("sequence %s does not exist", name)
+	}
+
+	step := int64(seq.Options.Increment)
+	next := int64(seq.Options.Start)
+	if seq.called {
+		next = int64(seq.last) + step
+	}
+	if next < math.MinInt32 || next > math.MaxInt32 {
+		return 0, SequenceUse{}, fmt.Errorf("sequence %s reached its limit", name)
+	}
+
+	if !seq.Called || pastReserved(seq, int(next)) {
+		oldReserved, oldCalled := seq.Reserved, seq.Called
+		seq.Reserved, seq.Called = clampInt32(next+step*int64(seq.Options.Cache-1)), true
+		if err := cm.Save(); err != nil {
+			seq.Reserved, seq.Called = oldReserved, oldCalled
+			return 0, SequenceUse{}, fmt.Errorf("failed to save sequence %s: %v", name, err)
+		}
+	}
+
+	use := SequenceUse{name: name, value: int(next), last: seq.last, called: seq.called}
+	seq.last, seq.called = int(next), true
+	return seq.last, use, nil
+}
+
+// SetVal makes value the last value handed out, so NextVal continues after
+// it.
+func (cm *CatalogManager) SetVal(name string, value int) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	seq, exists := cm.sequences[name]
+	if !exists {
+		return fmt.Errorf("sequence %s does not exist", name)
+	}
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return fmt.Errorf("sequence %s: value %d out of range", name, value)
+	}
+
+	seq.last, seq.called = value, true
+	seq.Reserved, seq.Called = value, true
+	return cm.Save()
+}
+
+// AdvanceSequence moves a sequence past value if it has not got there yet.
+// It keeps AUTO_INCREMENT columns from handing out values that were
+// inserted explicitly.
+func (cm *CatalogManager) AdvanceSequence(name string, value int) error {
+	_, err := cm.TakeAdvance(name, value)
+	return err
+}
+
+// TakeAdvance is AdvanceSequence for a value that may have to be given
+// back. If the sequence is already past value there is nothing to give
+// back, and the use is empty.
+func (cm *CatalogManager) TakeAdvance(name string, value int) (SequenceUse, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	seq, exists := cm.sequences[name]
+	if !exists {
+		return SequenceUse{}, fmt.Errorf("sequence %s does not exist", name)
+	}
+
+	ascending := seq.Options.Increment > 0
+	if seq.called && (value <= seq.last) == ascending {
+		return SequenceUse{}, nil
+	}
+	if !seq.called && (value < seq.Options.Start) == ascending {
+		return SequenceUse{}, nil
+	}
+
+	use := SequenceUse{name: name, value: value, last: seq.last, called: seq.called}
+	seq.last, seq.called = value, true
+	if seq.Called && !pastReserved(seq, value) {
+		return use, nil
+	}
+	seq.Reserved, seq.Called = value, true
+	if err := cm.Save(); err != nil {
+		return SequenceUse{}, err
+	}
+	return use, nil
+}
+
+// GiveBack returns values taken for rows that were not written, newest
+// first. A value is only given back while it is still the last one its
+// sequence handed out; once a later value has been taken it stays a gap.
+// Reservations are kept, so nothing is handed out twice after a crash.
+func (cm *CatalogManager) GiveBack(uses []SequenceUse) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for i := len(uses) - 1; i >= 0; i-- {
+		use := uses[i]
+		seq, exists := cm.sequences[use.name]
+		if !exists || !seq.called || seq.last != use.value {
+			continue
+		}
+		seq.last, seq.called = use.last, use.called
+	}
+}
+
+func (cm *CatalogManager) GetSequence(name string) (SequenceState, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	seq, exists := cm.sequences[name]
+	if !exists {
+		return SequenceState{}, fmt.Errorf("sequence %s does not exist", name)
+	}
+	return SequenceState{Options: seq.Options, Last: seq.last, Called: seq.called}, nil
+}
+
+func (cm *CatalogManager) ListSequences() []string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	names := make([]string, 0, len(cm.sequences))
+	for name := range cm.sequences {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reserveBatch moves Reserved past the values a NextVal would reserve next.
+func (seq *sequence) reserveBatch() {
+	last := int64(seq.Options.Start) - int64(seq.Options.Increment)
+	if seq.Called {
+		last = int64(seq.Reserved)
+	}
+	seq.Reserved, seq.Called = clampInt32(last+int64(seq.Options.Increment)*int64(seq.Options.Cache)), true
+}
+
+func clampInt32(v int64) int {
+	if v > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if v < math.MinInt32 {
+		return math.MinInt32
+	}
+	return int(v)
+}
+
+func pastReserved(seq *sequence, value int) bool {
+	if seq.Options.Increment > 0 {
+		return value > seq.Reserved
+	}
+	return value < seq.Reserved
+}
@@ -0,0 +1,74 @@
+package catalog
+
+import (
+	"fmt"
+	"storage-layer/pkg/record"
+	"time"
+)
+
+type TableStatistics struct {
+	RowCount     int                `json:"row_count"`
+	PageCount    int                `json:"page_count"`
+	SampledPages int                `json:"sampled_pages"`
+	SampledRows  int                `json:"sampled_rows"`
+	AnalyzedAt   time.Time          `json:"analyzed_at"`
+	Columns      []ColumnStatistics `json:"columns"`
+}
+
+type ColumnStatistics struct {
+	Name          string      `json:"name"`
+	NullFraction  float64     `json:"null_fraction"`
+	DistinctCount float64     `json:"distinct_count"`
+	Min           interface{} `json:"min"`
+	Max           interface{} `json:"max"`
+	// Histogram holds the bucket boundaries of an equi-depth histogram:
+	// bucket i covers [Histogram[i], Histogram[i+1]] and all buckets hold
+	// roughly the same number of rows.
+	Histogram []interface{} `json:"histogram,omitempty"`
+}
+
+func (cm *CatalogManager) SetStatistics(tableName string, stats TableStatistics) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if _, exists := cm.schemas[tableName]; !exists {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	cm.statistics[tableName] = stats
+	return cm.Save()
+}
+
+func (cm *CatalogManager) GetStatistics(tableName string) (TableStatistics, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	stats, exists := cm.statistics[tableName]
+	return stats, exists
+}
+
+// normalize restores the Go types of values that JSON decoding turned into
+// float64.
+func (ts TableStatistics) normalize(schema record.Schema) TableStatistics {
+	for i, colStats := range ts.Columns {
+		idx := schema.ColumnIndex(colStats.Name)
+		if idx < 0 || schema.Columns[idx].Type != record.TypeInt {
+			continue
+		}
+
+		colStats.Min = toInt(colStats.Min)
+		colStats.Max = toInt(colStats.Max)
+		for j, bound := range colStats.Histogram {
+			colStats.Histogram[j] = toInt(bound)
+		}
+		ts.Columns[i] = colStats
+	}
+	return ts
+}
+
+func toInt(value interface{}) interface{} {
+	if f, ok := value.(float64); ok {
+		return int(f)
+	}
+	return value
+}
@@ -0,0 +1,75 @@
+package catalog
+
+import (
+	"sort"
+	"storage-layer/pkg/record"
+)
+
+// System tables describe the catalog as ordinary, read-only tables. Their
+// schemas are built in and their contents are maintained by the storage
+// layer. Only their own names are reserved.
+//
+// They are a copy: the catalog itself is kept in MetaFileName, and
+// CatalogManager never reads the system tables back.
+const (
+	TablesTable  = "__tables"
+	ColumnsTable = "__columns"
+	IndexesTable = "__indexes"
+)
+
+// systemTextLength is the longest string a schema allows, so that anything
+// the catalog accepts can be described.
+const systemTextLength = 65535
+
+var systemSchemas = map[string]record.Schema{
+	TablesTable: {
+		Columns: []record.Column{
+			{Name: "name", Type: record.TypeString, Length: systemTextLength},
+			{Name: "column_count", Type: record.TypeInt},
+			{Name: "system", Type: record.TypeInt},
+		},
+		PrimaryKey: []string{"name"},
+	},
+	ColumnsTable: {
+		Columns: []record.Column{
+			{Name: "table_name", Type: record.TypeString, Length: systemTextLength},
+			{Name: "position", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: systemTextLength},
+			{Name: "type", Type: record.TypeString, Length: 16},
+			{Name: "length", Type: record.TypeInt},
+			{Name: "nullable", Type: record.TypeInt},
+			{Name: "default", Type: record.TypeString, Length: systemTextLength, Nullable: true},
+			{Name: "generated", Type: record.TypeString, Length: systemTextLength, Nullable: true},
+			{Name: "auto_increment", Type: record.TypeInt},
+		},
+		PrimaryKey: []string{"table_name", "position"},
+	},
+	IndexesTable: {
+		Columns: []record.Column{
+			{Name: "name", Type: record.TypeString, Length: systemTextLength},
+			{Name: "table_name", Type: record.TypeString, Length: systemTextLength},
+			{Name: "kind", Type: record.TypeString, Length: 16},
+			{Name: "columns", Type: record.TypeString, Length: systemTextLength},
+			{Name: "ref_table", Type: record.TypeString, Length: systemTextLength, Nullable: true},
+			{Name: "ref_columns", Type: record.TypeString, Length: systemTextLength, Nullable: true},
+		},
+		// Like the constraints they belong to, indexes are named per table
+		PrimaryKey: []string{"table_name", "name"},
+	},
+}
+
+func IsSystemTable(tableName string) bool {
+	_, exists := systemSchemas[tableName]
+	return exists
+}
+
+// SystemTables lists the system tables in name order. They are not included
+// in ListTables.
+func SystemTables() []string {
+	names := make([]string, 0, len(systemSchemas))
+	for name := range systemSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
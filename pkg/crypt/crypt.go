@@ -0,0 +1,166 @@
+// Package crypt encrypts data at rest with AES-GCM, under keys supplied by
+// a KeyProvider.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrWrongKey is returned for data that does not decrypt: it was encrypted
+// with another key, or it was damaged.
+var ErrWrongKey = errors.New("wrong encryption key or corrupted data")
+
+// ErrNoKey is returned for encrypted data read without a key.
+var ErrNoKey = errors.New("data is encrypted and no key was given")
+
+const (
+	keyIDSize = 4
+	nonceSize = 12
+	tagSize   = 16
+
+	// Overhead is what Seal adds to the plaintext: the ID of the key, the
+	// nonce and the authentication tag.
+	Overhead = keyIDSize + nonceSize + tagSize
+)
+
+// Cipher seals data with the current key of its provider and opens data
+// sealed with any key the provider still has. The ID of the key is stored
+// with the data, so keys can be rotated without rewriting what exists.
+// Nonces are random, so a key should be rotated well before it has sealed
+// 2^32 messages.
+type Cipher struct {
+	keys  KeyProvider
+	mutex sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+// NewCipher returns a Cipher using keys, or nil for no encryption if keys
+// is nil. Files read and written through a nil Cipher are left as they
+// are.
+func NewCipher(keys KeyProvider) *Cipher {
+	if keys == nil {
+		return nil
+	}
+	return &Cipher{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+func (c *Cipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if aead, exists := c.aeads[id]; exists {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// Seal appends plaintext encrypted and authenticated together with ad to
+// dst. The same ad must be given to Open.
+func (c *Cipher) Seal(dst, plaintext, ad []byte) ([]byte, error) {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %v", err)
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	start := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, id)
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[start+keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// Open appends the plaintext of sealed to dst. It fails with an error
+// wrapping ErrWrongKey unless sealed was made by Seal with the same ad and
+// a key the provider has.
+func (c *Cipher) Open(dst, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrWrongKey
+	}
+	id := KeyID(sealed)
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %v", ErrWrongKey, id, err)
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[keyIDSize : keyIDSize+nonceSize]
+	data, err := aead.Open(dst, nonce, sealed[keyIDSize+nonceSize:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d", ErrWrongKey, id)
+	}
+	return data, nil
+}
+
+// KeyID returns the ID of the key sealed was sealed with.
+func KeyID(sealed []byte) uint32 {
+	return binary.LittleEndian.Uint32(sealed)
+}
+
+// Whole files start with fileMagic when they are sealed. Unsealed files
+// are JSON, which cannot start with it.
+var fileMagic = []byte("SLE1")
+
+// IsSealed reports whether the contents of a file were sealed by SealFile.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, fileMagic)
+}
+
+// SealFile returns the sealed contents of the file name, which is its
+// base name so that the file can be moved to another directory.
+func (c *Cipher) SealFile(name string, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	return c.Seal(append([]byte(nil), fileMagic...), data, []byte(name))
+}
+
+// OpenFile returns the contents of a file written by SealFile. An empty
+// file stays empty. Without a Cipher, a sealed file is an error; with one,
+// an unsealed file is, so plaintext cannot be slipped into an encrypted
+// database.
+func (c *Cipher) OpenFile(name string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	if c == nil {
+		if IsSealed(data) {
+			return nil, fmt.Errorf("%s: %w", name, ErrNoKey)
+		}
+		return data, nil
+	}
+
+	if !IsSealed(data) {
+		return nil, fmt.Errorf("%s is not encrypted", name)
+	}
+	plain, err := c.Open(nil, data[len(fileMagic):], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return plain, nil
+}
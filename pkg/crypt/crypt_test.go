@@ -0,0 +1,157 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testRing(t *testing.T) *KeyRing {
+	t.Helper()
+
+	ring := NewKeyRing()
+	if err := ring.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	return ring
+}
+
+func TestSealOpen(t *testing.T) {
+	ring := testRing(t)
+	c := NewCipher(ring)
+
+	plaintext := []byte("hello, world")
+	sealed, err := c.Seal([]byte("prefix"), plaintext, []byte("ad"))
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	sealed = sealed[len("prefix"):]
+	if len(sealed) != len(plaintext)+Overhead || KeyID(sealed) != 1 {
+		t.Fatalf("Unexpected sealed data of %d bytes with key %d", len(sealed), KeyID(sealed))
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Errorf("Sealed data contains the plaintext")
+	}
+
+	data, err := c.Open(nil, sealed, []byte("ad"))
+	if err != nil || !bytes.Equal(data, plaintext) {
+		t.Fatalf("Open did not return the plaintext: %v", err)
+	}
+
+	if _, err := c.Open(nil, sealed, []byte("other")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for other associated data, got %v", err)
+	}
+	damaged := append([]byte(nil), sealed...)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := c.Open(nil, damaged, []byte("ad")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for damaged data, got %v", err)
+	}
+	if _, err := c.Open(nil, sealed[:Overhead-1], []byte("ad")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for short data, got %v", err)
+	}
+
+	other := NewKeyRing()
+	other.Add(1, bytes.Repeat([]byte{2}, 32))
+	if _, err := NewCipher(other).Open(nil, sealed, []byte("ad")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for another key, got %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ring := testRing(t)
+	c := NewCipher(ring)
+
+	old, _ := c.Seal(nil, []byte("old"), nil)
+	id, err := ring.Rotate(bytes.Repeat([]byte{2}, 16))
+	if err != nil || id != 2 {
+		t.Fatalf("Expected rotation to key 2, got %d: %v", id, err)
+	}
+	sealed, _ := c.Seal(nil, []byte("new"), nil)
+	if KeyID(sealed) != 2 {
+		t.Errorf("Expected new data to be sealed with key 2, got %d", KeyID(sealed))
+	}
+	if data, err := c.Open(nil, old, nil); err != nil || string(data) != "old" {
+		t.Errorf("Data sealed before rotating does not open: %v", err)
+	}
+
+	if err := ring.Remove(2); err == nil {
+		t.Errorf("Expected removing the current key to fail")
+	}
+	if err := ring.Remove(1); err != nil {
+		t.Fatalf("Failed to remove key 1: %v", err)
+	}
+	if _, err := c.Open(nil, old, nil); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey once the key is removed, got %v", err)
+	}
+
+	if err := ring.Add(2, bytes.Repeat([]byte{3}, 32)); err == nil {
+		t.Errorf("Expected reusing a key ID to fail")
+	}
+	if err := ring.Add(0, bytes.Repeat([]byte{3}, 32)); err == nil {
+		t.Errorf("Expected key ID 0 to be rejected")
+	}
+	if err := ring.Add(3, []byte("short")); err == nil {
+		t.Errorf("Expected a short key to be rejected")
+	}
+}
+
+func TestSealFile(t *testing.T) {
+	c := NewCipher(testRing(t))
+	var none *Cipher
+
+	sealed, err := c.SealFile("tables.meta", []byte(`{"a":1}`))
+	if err != nil || !IsSealed(sealed) {
+		t.Fatalf("SealFile did not seal: %v", err)
+	}
+	if data, err := c.OpenFile("tables.meta", sealed); err != nil || string(data) != `{"a":1}` {
+		t.Errorf("OpenFile did not return the contents: %v", err)
+	}
+	if _, err := c.OpenFile("other.meta", sealed); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected a file under another name to fail, got %v", err)
+	}
+	if _, err := none.OpenFile("tables.meta", sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected ErrNoKey without a cipher, got %v", err)
+	}
+	if _, err := c.OpenFile("tables.meta", []byte(`{"a":1}`)); err == nil {
+		t.Errorf("Expected an unsealed file to be rejected")
+	}
+
+	if data, _ := none.SealFile("tables.meta", []byte("x")); string(data) != "x" {
+		t.Errorf("Expected a nil cipher to leave files alone")
+	}
+	if data, err := c.OpenFile("tables.meta", nil); err != nil || len(data) != 0 {
+		t.Errorf("Expected an empty file to stay empty: %v", err)
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "crypt_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "keys")
+	contents := "# old key\n1 " + string(bytes.Repeat([]byte("01"), 32)) + "\n\n2 " + string(bytes.Repeat([]byte("02"), 16)) + "\n"
+	os.WriteFile(path, []byte(contents), 0600)
+
+	ring, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatalf("ReadKeyFile failed: %v", err)
+	}
+	if id, key, _ := ring.CurrentKey(); id != 2 || !bytes.Equal(key, bytes.Repeat([]byte{2}, 16)) {
+		t.Errorf("Expected key 2 to be current, got %d", id)
+	}
+	if key, err := ring.Key(1); err != nil || !bytes.Equal(key, bytes.Repeat([]byte{1}, 32)) {
+		t.Errorf("Key 1 was not read: %v", err)
+	}
+
+	for _, bad := range []string{"", "1\n", "x 0101\n", "1 zz\n", "1 0101\n"} {
+		os.WriteFile(path, []byte(bad), 0600)
+		if _, err := ReadKeyFile(path); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
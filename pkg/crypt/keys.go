@@ -0,0 +1,154 @@
+package crypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider supplies AES keys of 16, 24 or 32 bytes. Each key has an ID,
+// stored with the data it encrypts, so an ID must never be reused for
+// another key. ID 0 is reserved.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new data with.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given ID, which may be an older one.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory. Rotating it makes a
+// new key current while the older ones still decrypt what they encrypted;
+// an older key can be removed once everything has been encrypted again.
+type KeyRing struct {
+	mutex   sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32][]byte)}
+}
+
+func checkKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("invalid key length %d, want 16, 24 or 32 bytes", len(key))
+}
+
+// Add adds a key under id and makes it the current key.
+func (r *KeyRing) Add(id uint32, key []byte) error {
+	if id == 0 {
+		return fmt.Errorf("key ID 0 is reserved")
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.keys[id]; exists {
+		return fmt.Errorf("key %d already exists", id)
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	r.current = id
+	return nil
+}
+
+// Rotate adds a key under the next free ID and makes it the current key.
+func (r *KeyRing) Rotate(key []byte) (uint32, error) {
+	r.mutex.RLock()
+	id := uint32(1)
+	for existing := range r.keys {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	r.mutex.RUnlock()
+
+	return id, r.Add(id, key)
+}
+
+// Remove drops a key that no data is encrypted with any more. The current
+// key cannot be removed.
+func (r *KeyRing) Remove(id uint32) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id == r.current {
+		return fmt.Errorf("cannot remove the current key %d", id)
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.current == 0 {
+		return 0, nil, fmt.Errorf("key ring is empty")
+	}
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, exists := r.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("key %d is not in the key ring", id)
+	}
+	return key, nil
+}
+
+// ReadKeyFile loads a key ring from a file with a key per line, as its ID
+// and the key in hex. The last key is the current one. Blank lines and
+// lines starting with # are skipped.
+func ReadKeyFile(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ring := NewKeyRing()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key ID and a hex key", path, lineNo)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key ID: %v", path, lineNo, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, lineNo, err)
+		}
+		if err := ring.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := ring.CurrentKey(); err != nil {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return ring, nil
+}
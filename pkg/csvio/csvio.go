@@ -0,0 +1,328 @@
+package csvio
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"storage-layer/pkg/layer"
+	"storage-layer/pkg/record"
+	"strings"
+)
+
+type ImportOptions struct {
+	Delimiter  rune
+	HasHeader  bool
+	NullMarker string
+	BatchSize  int
+	// ColumnMap renames CSV header fields to schema column names
+	ColumnMap map[string]string
+	// Rejects receives rows that could not be imported, followed by the
+	// error. A row that is not valid CSV is written as a single field
+	// holding its text.
+	Rejects io.Writer
+}
+
+type ExportOptions struct {
+	Delimiter  rune
+	WithHeader bool
+	NullMarker string
+}
+
+type ImportResult struct {
+	Imported int
+	Rejected int
+}
+
+func DefaultImportOptions() ImportOptions {
+	return ImportOptions{
+		Delimiter:  ',',
+		HasHeader:  true,
+		NullMarker: "NULL",
+		BatchSize:  1000,
+	}
+}
+
+func DefaultExportOptions() ExportOptions {
+	return ExportOptions{
+		Delimiter:  ',',
+		WithHeader: true,
+		NullMarker: "NULL",
+	}
+}
+
+func Import(storage *layer.FileStorageLayer, tableName string, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	schema, err := storage.GetSchema(tableName)
+	if err != nil {
+		return result, err
+	}
+
+	input := &rawRecorder{r: r}
+	reader := csv.NewReader(input)
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+
+	var rejects *csv.Writer
+	if opts.Rejects != nil {
+		rejects = csv.NewWriter(opts.Rejects)
+		if opts.Delimiter != 0 {
+			rejects.Comma = opts.Delimiter
+		}
+		defer rejects.Flush()
+	}
+	reject := func(fields []string, rowErr error) error {
+		result.Rejected++
+		if rejects == nil {
+			return nil
+		}
+		if err := rejects.Write(append(fields, rowErr.Error())); err != nil {
+			return fmt.Errorf("failed to write reject file: %v", err)
+		}
+		return nil
+	}
+
+	// mapping[i] is the schema column for CSV field i
+	mapping := make([]int, len(schema.Columns))
+	for i := range mapping {
+		mapping[i] = i
+	}
+
+	if opts.HasHeader {
+		header, err := reader.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read header: %v", err)
+		}
+		input.take(reader.InputOffset())
+
+		mapping, err = mapHeader(schema, header, opts.ColumnMap)
+		if err != nil {
+			return result, err
+		}
+
+		if rejects != nil {
+			if err := rejects.Write(append(header, "error")); err != nil {
+				return result, fmt.Errorf("failed to write reject file: %v", err)
+			}
+		}
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	type pendingRow struct {
+		fields []string
+		data   []byte
+	}
+	batch := make([]pendingRow, 0, batchSize)
+	records := make([][]byte, 0, batchSize)
+
+	// A batch is inserted as a whole or not at all. When it fails, its rows
+	// are inserted one at a time so that only the failing ones are rejected.
+	insertBatch := func() error {
+		records = records[:0]
+		for _, row := range batch {
+			records = append(records, row.data)
+		}
+		if _, err := storage.InsertBatch(tableName, records); err == nil {
+			result.Imported += len(batch)
+		} else {
+			for _, row := range batch {
+				if _, err := storage.Insert(tableName, row.data); err != nil {
+					if err := reject(row.fields, err); err != nil {
+						return err
+					}
+					continue
+				}
+				result.Imported++
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		raw := input.take(reader.InputOffset())
+		if err != nil {
+			// Malformed quoting and similar errors affect only this row,
+			// which is rejected as it was written
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				if err := reject([]string{strings.TrimRight(string(raw), "\r\n")}, err); err != nil {
+					return result, err
+				}
+				continue
+			}
+			return result, fmt.Errorf("failed to read row %d: %v", line, err)
+		}
+
+		data, err := convertRow(schema, mapping, fields, opts.NullMarker)
+		if err != nil {
+			if err := reject(fields, err); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		batch = append(batch, pendingRow{fields: fields, data: data})
+		if len(batch) >= batchSize {
+			if err := insertBatch(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := insertBatch(); err != nil {
+			return result, err
+		}
+	}
+
+	if result.Imported > 0 {
+		if err := storage.Flush(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// rawRecorder keeps the input read by a CSV reader until its rows are
+// taken, so that a row that does not parse can be rejected as written.
+type rawRecorder struct {
+	r   io.Reader
+	buf []byte
+	// offset is the input offset of buf[0]
+	offset int64
+}
+
+func (rr *rawRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the input before offset end that has not been taken yet.
+func (rr *rawRecorder) take(end int64) []byte {
+	n := int(end - rr.offset)
+	raw := append([]byte(nil), rr.buf[:n]...)
+	rr.buf = append(rr.buf[:0], rr.buf[n:]...)
+	rr.offset = end
+	return raw
+}
+
+func Export(storage *layer.FileStorageLayer, tableName string, w io.Writer, opts ExportOptions) error {
+	schema, err := storage.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	rows, err := storage.Scan(tableName, nil)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if opts.Delimiter != 0 {
+		writer.Comma = opts.Delimiter
+	}
+
+	if opts.WithHeader {
+		header := make([]string, len(schema.Columns))
+		for i, col := range schema.Columns {
+			header[i] = col.Name
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+	}
+
+	fields := make([]string, len(schema.Columns))
+	for _, data := range rows {
+		values, err := record.Deserialize(schema, data)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize row: %v", err)
+		}
+
+		for i, col := range schema.Columns {
+			if values[i] == nil {
+				fields[i] = opts.NullMarker
+				continue
+			}
+			fields[i], err = record.FormatValue(col, values[i])
+			if err != nil {
+				return fmt.Errorf("failed to format column %s: %v", col.Name, err)
+			}
+		}
+
+		if err := writer.Write(fields); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func mapHeader(schema record.Schema, header []string, columnMap map[string]string) ([]int, error) {
+	mapping := make([]int, len(header))
+	seen := make(map[int]bool)
+
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if mapped, ok := columnMap[name]; ok {
+			name = mapped
+		}
+
+		mapping[i] = -1
+		for j, col := range schema.Columns {
+			if strings.EqualFold(col.Name, name) {
+				mapping[i] = j
+				break
+			}
+		}
+
+		if mapping[i] == -1 {
+			return nil, fmt.Errorf("unknown column %s in header", name)
+		}
+		if seen[mapping[i]] {
+			return nil, fmt.Errorf("column %s appears more than once in header", name)
+		}
+		seen[mapping[i]] = true
+	}
+
+	return mapping, nil
+}
+
+func convertRow(schema record.Schema, mapping []int, fields []string, nullMarker string) ([]byte, error) {
+	if len(fields) != len(mapping) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(mapping), len(fields))
+	}
+
+	// Columns absent from the CSV stay nil and must be nullable
+	values := make([]interface{}, len(schema.Columns))
+	for i, field := range fields {
+		colIdx := mapping[i]
+		if field == nullMarker {
+			continue
+		}
+
+		value, err := record.ParseValue(schema.Columns[colIdx], field)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", schema.Columns[colIdx].Name, err)
+		}
+		values[colIdx] = value
+	}
+
+	return record.Serialize(schema, values)
+}
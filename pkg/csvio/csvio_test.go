@@ -0,0 +1,136 @@
+package csvio
+
+import (
+	"bytes"
+	"os"
+	"storage-layer/pkg/layer"
+	"storage-layer/pkg/record"
+	"strings"
+	"testing"
+)
+
+func TestImportExport(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "csvio_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "name", Type: record.TypeString, Length: 20, Nullable: false},
+			{Name: "score", Type: record.TypeFloat, Nullable: true},
+		},
+	}
+	if err := storage.CreateTable("people", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Header order differs from the schema, and two rows are invalid
+	input := "Name,ID,score\n" +
+		"\"Smith, Alice\",1,9.5\n" +
+		"Bob,-2,NULL\n" +
+		"Carol,not-a-number,1\n" +
+		"NULL,4,2\n"
+
+	var rejects bytes.Buffer
+	opts := DefaultImportOptions()
+	opts.BatchSize = 1
+	opts.Rejects = &rejects
+
+	result, err := Import(storage, "people", strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Imported != 2 || result.Rejected != 2 {
+		t.Errorf("Expected 2 imported and 2 rejected, got %+v", result)
+	}
+	if !strings.Contains(rejects.String(), "Carol") || !strings.Contains(rejects.String(), "cannot be null") {
+		t.Errorf("Unexpected reject file contents: %q", rejects.String())
+	}
+
+	var output bytes.Buffer
+	if err := Export(storage, "people", &output, DefaultExportOptions()); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 || lines[0] != "id,name,score" {
+		t.Fatalf("Unexpected export output: %q", output.String())
+	}
+
+	exported := strings.Join(lines[1:], "\n")
+	if !strings.Contains(exported, "1,\"Smith, Alice\",9.5") || !strings.Contains(exported, "-2,Bob,NULL") {
+		t.Errorf("Unexpected exported rows: %q", exported)
+	}
+}
+
+func TestImportRejectsFailedRows(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "csvio_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 20},
+		},
+		PrimaryKey: []string{"id"},
+	}
+	if err := storage.CreateTable("people", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// The second batch holds a duplicate key, and one line is not valid CSV
+	input := "id,name\n" +
+		"1,Alice\n" +
+		"2,Bob\n" +
+		"3,Carol\n" +
+		"1,Dave\n" +
+		"4,\"Er\"in\n" +
+		"5,Frank\n"
+
+	var rejects bytes.Buffer
+	opts := DefaultImportOptions()
+	opts.BatchSize = 3
+	opts.Rejects = &rejects
+
+	result, err := Import(storage, "people", strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Imported != 4 || result.Rejected != 2 {
+		t.Errorf("Expected 4 imported and 2 rejected, got %+v", result)
+	}
+	if rows, _ := storage.Scan("people", nil); len(rows) != 4 {
+		t.Errorf("Expected 4 rows in the table, got %d", len(rows))
+	}
+
+	lines := strings.Split(strings.TrimSpace(rejects.String()), "\n")
+	if len(lines) != 3 || lines[0] != "id,name,error" {
+		t.Fatalf("Unexpected reject file contents: %q", rejects.String())
+	}
+	// The malformed line is rejected as it is read, the duplicate once its
+	// batch fails
+	if !strings.HasPrefix(lines[1], `"4,""Er""in",`) || !strings.Contains(lines[1], "line 6") {
+		t.Errorf("Expected the malformed line as written with its line number, got %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "1,Dave,") {
+		t.Errorf("Expected the duplicate row to be rejected alone, got %q", lines[2])
+	}
+}
@@ -0,0 +1,616 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sort"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/vfs"
+	"sync"
+)
+
+// Codec compresses the pages of a table file.
+type Codec interface {
+	Name() string
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) []byte
+	// Decompress fills dst, which is exactly as long as the original.
+	Decompress(dst, src []byte) error
+}
+
+// codecs are stored in compressed files by ID, so IDs must not change.
+var codecs = []Codec{1: flateCodec{}, 2: lzCodec{}}
+
+// CodecNames returns the names accepted by SetCompression.
+func CodecNames() []string {
+	var names []string
+	for _, codec := range codecs {
+		if codec != nil {
+			names = append(names, codec.Name())
+		}
+	}
+	return names
+}
+
+func codecByName(name string) (byte, Codec, error) {
+	for id, codec := range codecs {
+		if codec != nil && codec.Name() == name {
+			return byte(id), codec, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("unknown compression %q", name)
+}
+
+// ValidCompression checks a compression name; the empty name means none.
+func ValidCompression(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, _, err := codecByName(name)
+	return err
+}
+
+type flateCodec struct{}
+
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() interface{} {
+		return flate.NewReader(nil)
+	}}
+)
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(buf)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (flateCodec) Decompress(dst, src []byte) error {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return fmt.Errorf("flate: %v", err)
+	}
+	return nil
+}
+
+// A compressed table file starts with a header naming the codec, followed
+// by extents appended as pages are written. An extent holds one page and a
+// later extent for the same page supersedes the earlier one, so the map
+// from page IDs to extents is rebuilt by reading the file when it is
+// opened. Plain table files cannot be mistaken for compressed ones, since
+// they start with the ID of page 0. In an encrypted file the data of each
+// extent is sealed after compression.
+var compressedMagic = []byte("SLZ1")
+
+const (
+	// compressedHeaderSize covers the magic, the codec ID and the flags
+	compressedHeaderSize = 8
+	compressedEncrypted  = 1 << 0
+
+	// extentHeaderSize covers the page ID, the data length, the checksum of
+	// the data and whether the data is compressed
+	extentHeaderSize = 13
+
+	extentStored     = 0
+	extentCompressed = 1
+
+	// Compaction waits until superseded extents take more room than live
+	// ones, and at least this much
+	compactMinDead = 1 << 20
+)
+
+var extentCRC = crc32.MakeTable(crc32.Castagnoli)
+
+type extent struct {
+	// offset is where the data starts, after the extent header
+	offset int64
+	length uint32
+	kind   byte
+}
+
+// compressedTable maps the pages of a compressed table file to extents.
+// Its mutex is held across appends, which therefore go one at a time.
+type compressedTable struct {
+	tableName string
+	codecID   byte
+	codec     Codec
+	// cipher is nil for a file that is not encrypted
+	cipher *crypt.Cipher
+
+	mutex   sync.Mutex
+	extents map[int32]extent
+	// pages is one past the highest page ID with an extent
+	pages int32
+	end   int64
+	// stored counts the bytes of live extents, dead those of superseded
+	// ones
+	stored int64
+	dead   int64
+}
+
+type CompressionStats struct {
+	// Codec is empty for a table stored uncompressed
+	Codec string
+	Pages int
+	// LogicalBytes is the size of the pages uncompressed, StoredBytes the
+	// size of their extents, and FileBytes also counts the superseded
+	// extents not yet compacted away
+	LogicalBytes int64
+	StoredBytes  int64
+	FileBytes    int64
+}
+
+// Ratio is the logical size over the stored size.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+// SetCompression chooses the codec for the file of a table, or none for
+// the empty name. It only applies when the file is created: an existing
+// file keeps the format it was written in.
+func (dm *DiskManager) SetCompression(tableName, codec string) error {
+	if err := ValidCompression(codec); err != nil {
+		return err
+	}
+
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if codec == "" {
+		delete(dm.compression, tableName)
+	} else {
+		dm.compression[tableName] = codec
+	}
+	return nil
+}
+
+// initCompressed sets up a compressed table file as it is opened: a new
+// file gets the header, and an existing one has its extents read. It
+// returns the page count of the table.
+func (dm *DiskManager) initCompressed(tableName string, file vfs.File) (int32, error) {
+	size, err := file.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if size == 0 {
+		id, codec, _ := codecByName(dm.compression[tableName])
+		ct := &compressedTable{
+			tableName: tableName,
+			codecID:   id,
+			codec:     codec,
+			cipher:    dm.cipher,
+			extents:   make(map[int32]extent),
+			end:       compressedHeaderSize,
+		}
+		// Without its header the file would read as a plain one after a crash
+		if _, err := file.WriteAt(ct.header(), 0); err != nil {
+			return 0, err
+		}
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+		dm.compressed[tableName] = ct
+		return 0, nil
+	}
+
+	header := make([]byte, compressedHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	id := header[4]
+	if int(id) >= len(codecs) || codecs[id] == nil {
+		return 0, fmt.Errorf("table %s is compressed with unknown codec %d", tableName, id)
+	}
+	if err := dm.checkEncrypted(tableName, header[5]&compressedEncrypted != 0); err != nil {
+		return 0, err
+	}
+	ct := &compressedTable{
+		tableName: tableName,
+		codecID:   id,
+		codec:     codecs[id],
+		cipher:    dm.cipher,
+		extents:   make(map[int32]extent),
+	}
+	if err := ct.load(file, size); err != nil {
+		return 0, fmt.Errorf("failed to read extents of table %s: %v", tableName, err)
+	}
+	dm.compressed[tableName] = ct
+	return ct.pages, nil
+}
+
+func (ct *compressedTable) header() []byte {
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	header[4] = ct.codecID
+	if ct.cipher != nil {
+		header[5] |= compressedEncrypted
+	}
+	return header
+}
+
+// load reads the extent headers. Extents after the first damaged one were
+// written after the last sync, so the file is cut there and the flush
+// journal writes them again.
+func (ct *compressedTable) load(file vfs.File, size int64) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(file, compressedHeaderSize, size-compressedHeaderSize), 64*1024)
+	offset := int64(compressedHeaderSize)
+	header := make([]byte, extentHeaderSize)
+	data := make([]byte, PageSize+crypt.Overhead)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		pageID := int32(binary.LittleEndian.Uint32(header[0:4]))
+		length := binary.LittleEndian.Uint32(header[4:8])
+		kind := header[12]
+		if pageID < 0 || length == 0 || int(length) > len(data) || kind > extentCompressed {
+			break
+		}
+		if _, err := io.ReadFull(r, data[:length]); err != nil {
+			break
+		}
+		if crc32.Checksum(data[:length], extentCRC) != binary.LittleEndian.Uint32(header[8:12]) {
+			break
+		}
+
+		ct.add(pageID, extent{offset: offset + extentHeaderSize, length: length, kind: kind})
+		offset += extentHeaderSize + int64(length)
+	}
+
+	ct.end = offset
+	if offset < size {
+		return file.Truncate(offset)
+	}
+	return nil
+}
+
+// add records an extent as the current one for its page. Called with
+// ct.mutex held, or before the table is shared.
+func (ct *compressedTable) add(pageID int32, e extent) {
+	if old, exists := ct.extents[pageID]; exists {
+		ct.stored -= extentHeaderSize + int64(old.length)
+		ct.dead += extentHeaderSize + int64(old.length)
+	}
+	ct.extents[pageID] = e
+	if pageID >= ct.pages {
+		ct.pages = pageID + 1
+	}
+	ct.stored += extentHeaderSize + int64(e.length)
+}
+
+func (ct *compressedTable) readPage(file vfs.File, pageID int32) ([]byte, error) {
+	ct.mutex.Lock()
+	e, exists := ct.extents[pageID]
+	pages := ct.pages
+	ct.mutex.Unlock()
+	if !exists {
+		// As a plain file reads a page never written, in a hole or past
+		// its end
+		if pageID >= 0 && pageID < pages {
+			return make([]byte, PageSize), nil
+		}
+		return nil, io.EOF
+	}
+
+	stored := make([]byte, e.length)
+	if _, err := file.ReadAt(stored, e.offset); err != nil {
+		return nil, err
+	}
+	if ct.cipher != nil {
+		var err error
+		if stored, err = ct.cipher.Open(nil, stored, pageAD(ct.tableName, pageID)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt page %d of table %s: %w", pageID, ct.tableName, err)
+		}
+	}
+
+	if e.kind == extentStored {
+		if len(stored) != PageSize {
+			return nil, fmt.Errorf("page %d of table %s has %d bytes", pageID, ct.tableName, len(stored))
+		}
+		return stored, nil
+	}
+	data := make([]byte, PageSize)
+	if err := ct.codec.Decompress(data, stored); err != nil {
+		return nil, fmt.Errorf("failed to decompress page %d: %v", pageID, err)
+	}
+	return data, nil
+}
+
+// appendPages writes pages as new extents at the end of the file, in a
+// single write. A failed write leaves the end where it was, so the next
+// append overwrites whatever part of it reached the file.
+func (ct *compressedTable) appendPages(file vfs.File, pages []PageWrite) error {
+	var buf, compressed []byte
+	extents := make([]extent, len(pages))
+	for i, pw := range pages {
+		compressed = ct.codec.Compress(compressed[:0], pw.Data)
+		kind := byte(extentCompressed)
+		data := compressed
+		if len(compressed) >= PageSize {
+			data = pw.Data
+			kind = extentStored
+		}
+
+		start := len(buf)
+		buf = append(buf, make([]byte, extentHeaderSize)...)
+		if ct.cipher != nil {
+			var err error
+			if buf, err = ct.cipher.Seal(buf, data, pageAD(ct.tableName, pw.PageID)); err != nil {
+				return err
+			}
+		} else {
+			buf = append(buf, data...)
+		}
+
+		data = buf[start+extentHeaderSize:]
+		header := buf[start : start+extentHeaderSize]
+		binary.LittleEndian.PutUint32(header[0:4], uint32(pw.PageID))
+		binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+		binary.LittleEndian.PutUint32(header[8:12], crc32.Checksum(data, extentCRC))
+		header[12] = kind
+		extents[i] = extent{offset: int64(start + extentHeaderSize), length: uint32(len(data)), kind: kind}
+	}
+
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	if _, err := file.WriteAt(buf, ct.end); err != nil {
+		return err
+	}
+	for i, pw := range pages {
+		extents[i].offset += ct.end
+		ct.add(pw.PageID, extents[i])
+	}
+	ct.end += int64(len(buf))
+	return nil
+}
+
+func (ct *compressedTable) truncate(file vfs.File) error {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	if err := file.Truncate(compressedHeaderSize); err != nil {
+		return err
+	}
+	ct.extents = make(map[int32]extent)
+	ct.pages = 0
+	ct.end = compressedHeaderSize
+	ct.stored = 0
+	ct.dead = 0
+	return nil
+}
+
+// truncatePages drops the extents of the pages from pageCount on. They must
+// be at the end of the file, as the file is cut before the first of them.
+func (ct *compressedTable) truncatePages(file vfs.File, pageCount int32) error {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	cut := ct.end
+	for pageID, e := range ct.extents {
+		if pageID >= pageCount && e.offset-extentHeaderSize < cut {
+			cut = e.offset - extentHeaderSize
+		}
+	}
+	for pageID, e := range ct.extents {
+		if pageID < pageCount && e.offset > cut {
+			return fmt.Errorf("page %d of table %s was written after the pages to truncate", pageID, ct.tableName)
+		}
+	}
+
+	if err := file.Truncate(cut); err != nil {
+		return err
+	}
+	for pageID, e := range ct.extents {
+		if pageID >= pageCount {
+			ct.stored -= extentHeaderSize + int64(e.length)
+			delete(ct.extents, pageID)
+		}
+	}
+	// Whatever is left before the cut and not stored is superseded
+	ct.dead = cut - compressedHeaderSize - ct.stored
+	ct.pages = pageCount
+	ct.end = cut
+	return nil
+}
+
+func (ct *compressedTable) needsCompaction() bool {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	return ct.dead >= compactMinDead && ct.dead > ct.stored
+}
+
+// CompressionStats reports how the pages of a table are stored. Tables
+// stored uncompressed report their plain size.
+func (dm *DiskManager) CompressionStats(tableName string) (CompressionStats, error) {
+	file, err := dm.lockFile(tableName)
+	if err != nil {
+		return CompressionStats{}, err
+	}
+	defer dm.mutex.RUnlock()
+
+	size, err := file.Size()
+	if err != nil {
+		return CompressionStats{}, err
+	}
+
+	ct := dm.compressed[tableName]
+	if ct == nil {
+		pages := int(size / PageSize)
+		if dm.encrypted[tableName] {
+			pages = int((size - encryptedHeaderSize) / encryptedSlotSize)
+		}
+		return CompressionStats{
+			Pages:        pages,
+			LogicalBytes: int64(pages) * PageSize,
+			StoredBytes:  size,
+			FileBytes:    size,
+		}, nil
+	}
+
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	return CompressionStats{
+		Codec:        ct.codec.Name(),
+		Pages:        len(ct.extents),
+		LogicalBytes: int64(len(ct.extents)) * PageSize,
+		StoredBytes:  compressedHeaderSize + ct.stored,
+		FileBytes:    size,
+	}, nil
+}
+
+// Compact rewrites the file of a compressed table without its superseded
+// extents. The new file replaces the old one by a rename, so a crash
+// leaves one or the other.
+func (dm *DiskManager) Compact(tableName string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return err
+	}
+	ct := dm.compressed[tableName]
+	if ct == nil {
+		return nil
+	}
+
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	return dm.rewriteCompressed(tableName, file, ct, nil)
+}
+
+// rewriteCompressed replaces the file of a compressed table with one
+// holding only the live extents, with their data passed through reseal if
+// it is given. Called with dm.mutex held exclusively and ct.mutex held.
+func (dm *DiskManager) rewriteCompressed(tableName string, file vfs.File, ct *compressedTable, reseal func(pageID int32, data []byte) ([]byte, error)) error {
+	pageIDs := make([]int32, 0, len(ct.extents))
+	for pageID := range ct.extents {
+		pageIDs = append(pageIDs, pageID)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+
+	buf := make([]byte, compressedHeaderSize, compressedHeaderSize+ct.stored)
+	copy(buf, ct.header())
+	extents := make(map[int32]extent, len(pageIDs))
+	stored := make([]byte, PageSize+crypt.Overhead)
+	for _, pageID := range pageIDs {
+		e := ct.extents[pageID]
+		header := make([]byte, extentHeaderSize)
+		data := stored[:e.length]
+		if _, err := file.ReadAt(header, e.offset-extentHeaderSize); err != nil {
+			return fmt.Errorf("failed to read page %d: %v", pageID, err)
+		}
+		if _, err := file.ReadAt(data, e.offset); err != nil {
+			return fmt.Errorf("failed to read page %d: %v", pageID, err)
+		}
+		if reseal != nil {
+			var err error
+			if data, err = reseal(pageID, data); err != nil {
+				return fmt.Errorf("failed to encrypt page %d again: %v", pageID, err)
+			}
+			binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+			binary.LittleEndian.PutUint32(header[8:12], crc32.Checksum(data, extentCRC))
+		}
+
+		buf = append(buf, header...)
+		extents[pageID] = extent{offset: int64(len(buf)), length: uint32(len(data)), kind: e.kind}
+		buf = append(buf, data...)
+	}
+
+	if err := dm.replaceFile(tableName, file, buf); err != nil {
+		return err
+	}
+
+	ct.extents = extents
+	ct.end = int64(len(buf))
+	ct.stored = ct.end - compressedHeaderSize
+	ct.dead = 0
+	return nil
+}
+
+// replaceFile makes data the contents of the file of a table, through a
+// new file renamed over the old one, so a crash leaves one or the other.
+// Called with dm.mutex held exclusively.
+func (dm *DiskManager) replaceFile(tableName string, file vfs.File, data []byte) error {
+	path := filepath.Join(dm.basePath, TableFileName(tableName))
+	tempPath := path + ".rewrite"
+	if err := vfs.WriteFile(dm.fs, tempPath, data, true); err != nil {
+		return err
+	}
+	if err := dm.fs.Rename(tempPath, path); err != nil {
+		return err
+	}
+	if err := dm.fs.SyncDir(dm.basePath); err != nil {
+		return err
+	}
+
+	// The old handle still refers to the replaced file
+	file.Close()
+	newFile, err := dm.fs.OpenFile(path, 0)
+	if err != nil {
+		// The next getFile opens it again
+		delete(dm.files, tableName)
+		delete(dm.compressed, tableName)
+		return err
+	}
+	dm.files[tableName] = newFile
+
+	// Everything written so far is in the new file, which is synced
+	dm.syncMutex.Lock()
+	delete(dm.unsynced, tableName)
+	dm.syncMutex.Unlock()
+	return nil
+}
+
+// compactAll compacts the compressed tables whose files are mostly
+// superseded extents.
+func (dm *DiskManager) compactAll() error {
+	dm.mutex.RLock()
+	var tables []string
+	for tableName, ct := range dm.compressed {
+		if ct.needsCompaction() {
+			tables = append(tables, tableName)
+		}
+	}
+	dm.mutex.RUnlock()
+
+	sort.Strings(tables)
+	for _, tableName := range tables {
+		if err := dm.Compact(tableName); err != nil {
+			return fmt.Errorf("failed to compact table %s: %v", tableName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+// testPage returns a page that compresses about as well as a page of
+// records does.
+func testPage(seed int) []byte {
+	data := make([]byte, 0, PageSize)
+	for i := 0; len(data) < PageSize; i++ {
+		data = append(data, fmt.Sprintf("record %d of page %d; ", i, seed)...)
+	}
+	return data[:PageSize]
+}
+
+func TestCodecs(t *testing.T) {
+	random := make([]byte, PageSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"zeros":  make([]byte, PageSize),
+		"text":   testPage(1),
+		"random": random,
+		"short":  []byte("abc"),
+		"empty":  {},
+	}
+
+	for _, name := range CodecNames() {
+		_, codec, _ := codecByName(name)
+		for inputName, input := range inputs {
+			t.Run(name+"/"+inputName, func(t *testing.T) {
+				compressed := codec.Compress([]byte("prefix"), input)
+				if !bytes.HasPrefix(compressed, []byte("prefix")) {
+					t.Fatalf("Compress did not append to dst")
+				}
+
+				data := make([]byte, len(input))
+				if err := codec.Decompress(data, compressed[len("prefix"):]); err != nil {
+					t.Fatalf("Decompress failed: %v", err)
+				}
+				if !bytes.Equal(data, input) {
+					t.Errorf("Round trip changed the data")
+				}
+				if inputName == "text" && len(compressed) > PageSize/2 {
+					t.Errorf("Expected text to compress at least 2x, got %d bytes", len(compressed))
+				}
+			})
+		}
+	}
+
+	if err := ValidCompression("zstd"); err == nil {
+		t.Errorf("Expected an unknown codec to be rejected")
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	for _, name := range CodecNames() {
+		t.Run(name, func(t *testing.T) {
+			fsys := vfs.NewMemFS()
+			dm := NewDiskManagerFS("/db", fsys)
+			if err := dm.Open(); err != nil {
+				t.Fatalf("Failed to open disk manager: %v", err)
+			}
+			if err := dm.SetCompression("t", name); err != nil {
+				t.Fatalf("SetCompression failed: %v", err)
+			}
+
+			random := make([]byte, PageSize)
+			rand.New(rand.NewSource(1)).Read(random)
+
+			first, _ := dm.AllocatePages("t", 4)
+			if err := dm.WritePage("t", first, testPage(0)); err != nil {
+				t.Fatalf("Failed to write page: %v", err)
+			}
+			if err := dm.WritePages("t", first+2, append(testPage(1), random...)); err != nil {
+				t.Fatalf("Failed to write pages: %v", err)
+			}
+			// Page 1 is left unwritten
+			if err := dm.WriteBatch("t", []PageWrite{{PageID: 0, Data: testPage(10)}}); err != nil {
+				t.Fatalf("Failed to write batch: %v", err)
+			}
+
+			check := func(dm *DiskManager) {
+				t.Helper()
+				want := [][]byte{testPage(10), make([]byte, PageSize), testPage(1), random}
+				for pageID, expected := range want {
+					data, err := dm.ReadPage("t", int32(pageID))
+					if err != nil {
+						t.Fatalf("Failed to read page %d: %v", pageID, err)
+					}
+					if !bytes.Equal(data, expected) {
+						t.Errorf("Page %d does not match what was written", pageID)
+					}
+				}
+				if _, err := dm.ReadPage("t", 4); err != io.EOF {
+					t.Errorf("Expected io.EOF past the last page, got %v", err)
+				}
+			}
+			check(dm)
+
+			stats, err := dm.CompressionStats("t")
+			if err != nil {
+				t.Fatalf("CompressionStats failed: %v", err)
+			}
+			if stats.Codec != name || stats.Pages != 3 || stats.LogicalBytes != 3*PageSize {
+				t.Errorf("Unexpected stats %+v", stats)
+			}
+			if stats.StoredBytes >= stats.LogicalBytes || stats.FileBytes <= stats.StoredBytes {
+				t.Errorf("Expected compressed pages and a superseded extent, got %+v", stats)
+			}
+
+			if err := dm.Compact("t"); err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+			check(dm)
+			if stats, _ := dm.CompressionStats("t"); stats.FileBytes != stats.StoredBytes {
+				t.Errorf("Expected compaction to drop superseded extents, got %+v", stats)
+			}
+			dm.Close()
+
+			// The format is read from the file, whatever the configuration
+			dm = NewDiskManagerFS("/db", fsys)
+			defer dm.Close()
+			check(dm)
+			if count := dm.GetPageCount("t"); count != 4 {
+				t.Errorf("Expected a page count of 4 after reopening, got %d", count)
+			}
+
+			if err := dm.Truncate("t"); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if stats, _ := dm.CompressionStats("t"); stats.Pages != 0 || stats.FileBytes != compressedHeaderSize {
+				t.Errorf("Expected an empty table after Truncate, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCompressedTornTail(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	dm := NewDiskManagerFS("/db", fsys)
+	dm.Open()
+	dm.SetCompression("t", "lz")
+	for pageID := int32(0); pageID < 3; pageID++ {
+		dm.AllocatePage("t")
+		if err := dm.WritePage("t", pageID, testPage(int(pageID))); err != nil {
+			t.Fatalf("Failed to write page: %v", err)
+		}
+	}
+	stats, _ := dm.CompressionStats("t")
+	dm.Close()
+
+	// Cut the last extent short, as a crash during its write would
+	file, err := fsys.OpenFile("/db/t.tbl", 0)
+	if err != nil {
+		t.Fatalf("Failed to open table file: %v", err)
+	}
+	file.Truncate(stats.FileBytes - 10)
+	file.Close()
+
+	dm = NewDiskManagerFS("/db", fsys)
+	defer dm.Close()
+	if count := dm.GetPageCount("t"); count != 2 {
+		t.Fatalf("Expected the torn page to be dropped, got %d pages", count)
+	}
+	for pageID := int32(0); pageID < 2; pageID++ {
+		data, err := dm.ReadPage("t", pageID)
+		if err != nil || !bytes.Equal(data, testPage(int(pageID))) {
+			t.Errorf("Page %d did not survive: %v", pageID, err)
+		}
+	}
+
+	// The next write goes where the torn extent was
+	dm.AllocatePage("t")
+	if err := dm.WritePage("t", 2, testPage(7)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	if data, err := dm.ReadPage("t", 2); err != nil || !bytes.Equal(data, testPage(7)) {
+		t.Errorf("Rewritten page does not match: %v", err)
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	dm := NewDiskManagerFS("/db", vfs.NewMemFS())
+	dm.Open()
+	defer dm.Close()
+	dm.SetDurability(Durability{Policy: SyncPerFlush})
+	dm.SetCompression("t", "flate")
+
+	random := make([]byte, PageSize)
+	rng := rand.New(rand.NewSource(1))
+	dm.AllocatePage("t")
+	// Incompressible pages are stored as they are, so each rewrite leaves
+	// a page of dead bytes
+	for i := 0; i < compactMinDead/PageSize+2; i++ {
+		rng.Read(random)
+		if err := dm.WritePage("t", 0, random); err != nil {
+			t.Fatalf("Failed to write page: %v", err)
+		}
+	}
+	if err := dm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	stats, _ := dm.CompressionStats("t")
+	if stats.FileBytes != stats.StoredBytes || stats.Pages != 1 {
+		t.Errorf("Expected Sync to compact the table, got %+v", stats)
+	}
+	if data, err := dm.ReadPage("t", 0); err != nil || !bytes.Equal(data, random) {
+		t.Errorf("Page does not match the last write: %v", err)
+	}
+}
+
+func TestCompressionStatsPlain(t *testing.T) {
+	dm := NewDiskManagerFS("/db", vfs.NewMemFS())
+	dm.Open()
+	defer dm.Close()
+
+	dm.AllocatePages("t", 2)
+	dm.WritePages("t", 0, make([]byte, 2*PageSize))
+
+	stats, err := dm.CompressionStats("t")
+	if err != nil {
+		t.Fatalf("CompressionStats failed: %v", err)
+	}
+	if stats.Codec != "" || stats.Pages != 2 || stats.Ratio() != 1 {
+		t.Errorf("Unexpected stats for a plain table: %+v", stats)
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	page := testPage(1)
+	for _, name := range CodecNames() {
+		_, codec, _ := codecByName(name)
+		compressed := codec.Compress(nil, page)
+		b.Run(name+"/compress", func(b *testing.B) {
+			b.SetBytes(PageSize)
+			buf := make([]byte, 0, 2*PageSize)
+			for i := 0; i < b.N; i++ {
+				codec.Compress(buf[:0], page)
+			}
+		})
+		b.Run(name+"/decompress", func(b *testing.B) {
+			b.SetBytes(PageSize)
+			data := make([]byte, PageSize)
+			for i := 0; i < b.N; i++ {
+				codec.Decompress(data, compressed)
+			}
+		})
+	}
+}
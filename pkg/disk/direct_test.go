@@ -0,0 +1,112 @@
+package disk
+
+import (
+	"bytes"
+	"os"
+	"storage-layer/pkg/vfs"
+	"syscall"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "direct_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	dm.SetDirectIO(true)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	t.Logf("direct I/O in use: %v", dm.DirectIO("t"))
+
+	// Slicing one byte in makes the buffers unaligned
+	page := func(fill byte) []byte {
+		buf := make([]byte, PageSize+1)[1:]
+		for i := range buf {
+			buf[i] = fill + byte(i%7)
+		}
+		return buf
+	}
+	want := make(map[int32][]byte)
+
+	first, _ := dm.AllocatePages("t", 8)
+	want[first] = page(1)
+	if err := dm.WritePage("t", first, want[first]); err != nil {
+		t.Fatalf("WritePage failed: %v", err)
+	}
+
+	run := make([]byte, 3*PageSize+1)[1:]
+	for i := int32(0); i < 3; i++ {
+		want[first+1+i] = page(byte(10 + i))
+		copy(run[i*PageSize:], want[first+1+i])
+	}
+	if err := dm.WritePages("t", first+1, run); err != nil {
+		t.Fatalf("WritePages failed: %v", err)
+	}
+
+	var batch []PageWrite
+	for _, pageID := range []int32{first + 7, first + 4, first + 5} {
+		want[pageID] = page(byte(20 + pageID))
+		batch = append(batch, PageWrite{PageID: pageID, Data: want[pageID]})
+	}
+	if err := dm.WriteBatch("t", batch); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if err := dm.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	for pageID, data := range want {
+		got, err := dm.ReadPage("t", pageID)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageID, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Page %d does not match", pageID)
+		}
+	}
+}
+
+// rejectDirect fails every open with O_DIRECT the way file systems without
+// support for it do.
+type rejectDirect struct {
+	vfs.FileSystem
+}
+
+func (r rejectDirect) OpenFile(name string, flag int) (vfs.File, error) {
+	if flag&vfs.O_DIRECT != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	return r.FileSystem.OpenFile(name, flag)
+}
+
+func TestDirectIOFallback(t *testing.T) {
+	if !vfs.DirectSupported {
+		t.Skip("O_DIRECT is not available on this platform")
+	}
+
+	dm := NewDiskManagerFS("/db", rejectDirect{vfs.NewMemFS()})
+	dm.SetDirectIO(true)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	pageID, _ := dm.AllocatePage("t")
+	data := bytes.Repeat([]byte{7}, PageSize)
+	if err := dm.WritePage("t", pageID, data); err != nil {
+		t.Fatalf("WritePage failed: %v", err)
+	}
+	got, err := dm.ReadPage("t", pageID)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the page back, got error %v", err)
+	}
+	if dm.DirectIO("t") {
+		t.Errorf("Expected buffered I/O after O_DIRECT was rejected")
+	}
+}
@@ -1,26 +1,87 @@
 package disk
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/vfs"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 const PageSize = 4096
 
 type DiskManager struct {
 	basePath    string
-	files       map[string]*os.File
+	fs          vfs.FileSystem
+	files       map[string]vfs.File
 	pageCounter map[string]int32
+	snapshot    *Snapshot
 	mutex       sync.RWMutex
+
+	// directIO opens table files with O_DIRECT; direct records the files
+	// that got it
+	directIO bool
+	direct   map[string]bool
+
+	// mmap reads pages from maps, the read-only mappings of the table
+	// files
+	mmap       bool
+	maps       map[string]*mapping
+	unmappable map[string]bool
+
+	// raMutex guards the read-ahead settings and state
+	raMutex        sync.Mutex
+	readAheadPages int32
+	readAheads     map[string]*readAheadState
+	raReads        atomic.Int64
+	raPages        atomic.Int64
+	// raReading counts the windows being read, which Close and Truncate
+	// wait for
+	raReading sync.WaitGroup
+
+	durability Durability
+	// syncMutex guards durability, unsynced and group
+	syncMutex sync.Mutex
+	unsynced  map[string]vfs.File
+	group     *syncGroup
+
+	// compression holds the codec to create the file of a table with, and
+	// compressed the extents of the files opened compressed
+	compression map[string]string
+	compressed  map[string]*compressedTable
+
+	// cipher encrypts the pages of new table files, and encrypted records
+	// the files opened with pages in encrypted slots
+	cipher    *crypt.Cipher
+	encrypted map[string]bool
 }
 
 func NewDiskManager(basePath string) *DiskManager {
+	return NewDiskManagerFS(basePath, vfs.OS{})
+}
+
+// NewDiskManagerFS returns a DiskManager that keeps its files in fsys.
+func NewDiskManagerFS(basePath string, fsys vfs.FileSystem) *DiskManager {
 	return &DiskManager{
 		basePath:    basePath,
-		files:       make(map[string]*os.File),
+		fs:          fsys,
+		files:       make(map[string]vfs.File),
 		pageCounter: make(map[string]int32),
+		direct:      make(map[string]bool),
+		maps:        make(map[string]*mapping),
+		unmappable:  make(map[string]bool),
+		readAheads:  make(map[string]*readAheadState),
+		durability:  DefaultDurability(),
+		unsynced:    make(map[string]vfs.File),
+		compression: make(map[string]string),
+		compressed:  make(map[string]*compressedTable),
+		encrypted:   make(map[string]bool),
 	}
 }
 
@@ -29,59 +90,266 @@ func (dm *DiskManager) Open() error {
 	defer dm.mutex.Unlock()
 
 	// Create base directory if it doesn't exist
-	return os.MkdirAll(dm.basePath, 0755)
+	return dm.fs.MkdirAll(dm.basePath)
 }
 
 func (dm *DiskManager) Close() error {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 
+	dm.syncMutex.Lock()
+	unsynced := dm.unsynced
+	dm.unsynced = make(map[string]vfs.File)
+	dm.syncMutex.Unlock()
+
+	for tableName, file := range unsynced {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync table %s: %v", tableName, err)
+		}
+	}
+
+	dm.unmapAll()
+	dm.raMutex.Lock()
+	dm.readAheads = make(map[string]*readAheadState)
+	dm.raMutex.Unlock()
+	dm.raReading.Wait()
+
 	for _, file := range dm.files {
 		if err := file.Close(); err != nil {
 			return err
 		}
 	}
-	dm.files = make(map[string]*os.File)
+	dm.files = make(map[string]vfs.File)
+	dm.pageCounter = make(map[string]int32)
+	dm.compressed = make(map[string]*compressedTable)
+	dm.encrypted = make(map[string]bool)
 	return nil
 }
 
-func (dm *DiskManager) getFile(tableName string) (*os.File, error) {
+func (dm *DiskManager) getFile(tableName string) (vfs.File, error) {
 	if file, exists := dm.files[tableName]; exists {
 		return file, nil
 	}
 
-	filePath := filepath.Join(dm.basePath, tableName+".tbl")
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	filePath := filepath.Join(dm.basePath, TableFileName(tableName))
+	file, err := dm.openFile(tableName, filePath, os.O_CREATE|os.O_EXCL)
+	if os.IsExist(err) {
+		file, err = dm.openFile(tableName, filePath, 0)
+	} else if err == nil {
+		// The new file would not survive a crash without its directory entry
+		if err := dm.fs.SyncDir(dm.basePath); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	format, err := dm.fileFormat(tableName, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Compressed and encrypted files are not laid out in aligned pages, so
+	// they are buffered
+	if format != formatPlain && dm.direct[tableName] {
+		file.Close()
+		if file, err = dm.fs.OpenFile(filePath, 0); err != nil {
+			return nil, err
+		}
+		dm.direct[tableName] = false
+	}
+
+	var pageCount int32
+	switch format {
+	case formatCompressed:
+		pageCount, err = dm.initCompressed(tableName, file)
+	case formatEncrypted:
+		pageCount, err = dm.initEncrypted(tableName, file)
+	default:
+		var size int64
+		if size, err = file.Size(); err == nil {
+			err = dm.checkEncrypted(tableName, false)
+			pageCount = int32(size / PageSize)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	dm.files[tableName] = file
 
 	// Initialize page counter if not exists
 	if _, exists := dm.pageCounter[tableName]; !exists {
-		stat, err := file.Stat()
+		dm.pageCounter[tableName] = pageCount
+	}
+
+	return file, nil
+}
+
+type fileFormat int
+
+const (
+	formatPlain fileFormat = iota
+	formatCompressed
+	formatEncrypted
+)
+
+// fileFormat tells how the file of a table is laid out, from its header.
+// A new file gets the layout configured for the table.
+func (dm *DiskManager) fileFormat(tableName string, file vfs.File) (fileFormat, error) {
+	size, err := file.Size()
+	if err != nil {
+		return formatPlain, err
+	}
+	if size == 0 {
+		if _, exists := dm.compression[tableName]; exists {
+			return formatCompressed, nil
+		}
+		if dm.cipher != nil {
+			return formatEncrypted, nil
+		}
+		return formatPlain, nil
+	}
+
+	// Read through an aligned buffer in case the file uses direct I/O
+	buf := alignedPages.Get().(*[]byte)
+	defer alignedPages.Put(buf)
+	n, err := file.ReadAt(*buf, 0)
+	if err != nil && err != io.EOF {
+		return formatPlain, err
+	}
+	switch {
+	case n >= compressedHeaderSize && bytes.Equal((*buf)[:4], compressedMagic):
+		return formatCompressed, nil
+	case n >= encryptedHeaderSize && bytes.Equal((*buf)[:4], encryptedMagic):
+		return formatEncrypted, nil
+	}
+	return formatPlain, nil
+}
+
+// openFile opens a table file, with O_DIRECT if direct I/O is on. A file
+// system that rejects O_DIRECT turns direct I/O off for good.
+func (dm *DiskManager) openFile(tableName, filePath string, flag int) (vfs.File, error) {
+	if dm.directIO {
+		file, err := dm.fs.OpenFile(filePath, flag|vfs.O_DIRECT)
+		if !errors.Is(err, syscall.EINVAL) {
+			dm.direct[tableName] = err == nil
+			return file, err
+		}
+		dm.directIO = false
+		// The rejected open may have created the file already
+		flag &^= os.O_EXCL
+	}
+	return dm.fs.OpenFile(filePath, flag)
+}
+
+// SetDirectIO asks for table files to be opened with O_DIRECT, bypassing
+// the operating system's page cache. It applies to files opened later, so
+// it belongs right after the disk manager is created. Where O_DIRECT is not
+// available the files are opened buffered; see DirectIO.
+func (dm *DiskManager) SetDirectIO(enabled bool) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dm.directIO = enabled && vfs.DirectSupported
+}
+
+// DirectIO reports whether the file of a table was opened with O_DIRECT.
+func (dm *DiskManager) DirectIO(tableName string) bool {
+	if _, err := dm.lockFile(tableName); err != nil {
+		return false
+	}
+	defer dm.mutex.RUnlock()
+
+	return dm.direct[tableName]
+}
+
+// alignedPages holds page buffers for direct I/O, whose buffers must be
+// aligned.
+var alignedPages = sync.Pool{
+	New: func() interface{} {
+		buf := vfs.AlignedBuffer(PageSize)
+		return &buf
+	},
+}
+
+// aligned returns data itself, or an aligned copy if the file of the table
+// uses direct I/O and data is not aligned.
+func (dm *DiskManager) aligned(tableName string, data []byte) []byte {
+	if !dm.direct[tableName] || vfs.IsAligned(data) {
+		return data
+	}
+	buf := vfs.AlignedBuffer(len(data))
+	copy(buf, data)
+	return buf
+}
+
+// lockFile returns the open file of a table with the lock held shared.
+// Reads and writes of pages share the lock, since they use positional I/O
+// and the layer above never writes a page while it is read. Opening a file
+// needs the lock exclusively, since it changes the file table.
+func (dm *DiskManager) lockFile(tableName string) (vfs.File, error) {
+	for {
+		dm.mutex.RLock()
+		if file, exists := dm.files[tableName]; exists {
+			return file, nil
+		}
+		dm.mutex.RUnlock()
+
+		dm.mutex.Lock()
+		_, err := dm.getFile(tableName)
+		dm.mutex.Unlock()
 		if err != nil {
 			return nil, err
 		}
-		dm.pageCounter[tableName] = int32(stat.Size() / PageSize)
 	}
-
-	return file, nil
 }
 
 func (dm *DiskManager) ReadPage(tableName string, pageID int32) ([]byte, error) {
-	dm.mutex.RLock()
+	if err := dm.lockPage(tableName, pageID); err != nil {
+		return nil, err
+	}
 	defer dm.mutex.RUnlock()
 
+	return dm.readPage(tableName, pageID)
+}
+
+func (dm *DiskManager) readPage(tableName string, pageID int32) ([]byte, error) {
 	file, err := dm.getFile(tableName)
 	if err != nil {
 		return nil, err
 	}
 
+	if ct := dm.compressed[tableName]; ct != nil {
+		return ct.readPage(file, pageID)
+	}
+	if dm.encrypted[tableName] {
+		return dm.readEncrypted(tableName, file, pageID)
+	}
+	if mapped := dm.mappedPage(tableName, pageID); mapped != nil {
+		return append([]byte(nil), mapped...), nil
+	}
+	if ahead := dm.readAhead(tableName, file, pageID); ahead != nil {
+		return append([]byte(nil), ahead...), nil
+	}
+
 	data := make([]byte, PageSize)
 	offset := int64(pageID) * PageSize
 
+	if dm.direct[tableName] && !vfs.IsAligned(data) {
+		buf := alignedPages.Get().(*[]byte)
+		defer alignedPages.Put(buf)
+
+		if _, err := file.ReadAt(*buf, offset); err != nil {
+			return nil, err
+		}
+		copy(data, *buf)
+		return data, nil
+	}
+
 	_, err = file.ReadAt(data, offset)
 	if err != nil {
 		return nil, err
@@ -91,17 +359,42 @@ func (dm *DiskManager) ReadPage(tableName string, pageID int32) ([]byte, error)
 }
 
 func (dm *DiskManager) WritePage(tableName string, pageID int32, data []byte) error {
-	dm.mutex.Lock()
-	defer dm.mutex.Unlock()
-
 	if len(data) != PageSize {
 		return fmt.Errorf("page data must be exactly %d bytes", PageSize)
 	}
 
-	file, err := dm.getFile(tableName)
+	file, err := dm.lockFile(tableName)
 	if err != nil {
 		return err
 	}
+	defer dm.mutex.RUnlock()
+
+	if dm.snapshot != nil {
+		if err := dm.snapshot.preserve(tableName, pageID); err != nil {
+			return err
+		}
+	}
+	dm.dropReadAhead(tableName, pageID, 1)
+
+	if ct := dm.compressed[tableName]; ct != nil {
+		if err := ct.appendPages(file, []PageWrite{{PageID: pageID, Data: data}}); err != nil {
+			return err
+		}
+		return dm.written(tableName, file, len(data))
+	}
+	if dm.encrypted[tableName] {
+		if err := dm.writeEncrypted(tableName, file, pageID, data); err != nil {
+			return err
+		}
+		return dm.written(tableName, file, len(data))
+	}
+
+	if dm.direct[tableName] && !vfs.IsAligned(data) {
+		buf := alignedPages.Get().(*[]byte)
+		defer alignedPages.Put(buf)
+		copy(*buf, data)
+		data = *buf
+	}
 
 	offset := int64(pageID) * PageSize
 	_, err = file.WriteAt(data, offset)
@@ -109,7 +402,7 @@ func (dm *DiskManager) WritePage(tableName string, pageID int32, data []byte) er
 		return err
 	}
 
-	return file.Sync()
+	return dm.written(tableName, file, len(data))
 }
 
 func (dm *DiskManager) AllocatePage(tableName string) (int32, error) {
@@ -127,8 +420,155 @@ func (dm *DiskManager) AllocatePage(tableName string) (int32, error) {
 	return pageID, nil
 }
 
+// AllocatePages reserves count consecutive pages and returns the first.
+func (dm *DiskManager) AllocatePages(tableName string, count int) (int32, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if _, err := dm.getFile(tableName); err != nil {
+		return -1, err
+	}
+
+	first := dm.pageCounter[tableName]
+	dm.pageCounter[tableName] += int32(count)
+
+	return first, nil
+}
+
+// WritePages writes consecutive pages starting at firstPageID with a single
+// write.
+func (dm *DiskManager) WritePages(tableName string, firstPageID int32, data []byte) error {
+	if len(data) == 0 || len(data)%PageSize != 0 {
+		return fmt.Errorf("page data must be a non-zero multiple of %d bytes", PageSize)
+	}
+
+	file, err := dm.lockFile(tableName)
+	if err != nil {
+		return err
+	}
+	defer dm.mutex.RUnlock()
+
+	if dm.snapshot != nil {
+		for i := 0; i < len(data)/PageSize; i++ {
+			if err := dm.snapshot.preserve(tableName, firstPageID+int32(i)); err != nil {
+				return err
+			}
+		}
+	}
+	dm.dropReadAhead(tableName, firstPageID, len(data)/PageSize)
+
+	if ct := dm.compressed[tableName]; ct != nil {
+		pages := make([]PageWrite, len(data)/PageSize)
+		for i := range pages {
+			pages[i] = PageWrite{PageID: firstPageID + int32(i), Data: data[i*PageSize : (i+1)*PageSize]}
+		}
+		if err := ct.appendPages(file, pages); err != nil {
+			return err
+		}
+		return dm.written(tableName, file, len(data))
+	}
+	if dm.encrypted[tableName] {
+		if err := dm.writeEncrypted(tableName, file, firstPageID, data); err != nil {
+			return err
+		}
+		return dm.written(tableName, file, len(data))
+	}
+
+	if _, err := file.WriteAt(dm.aligned(tableName, data), int64(firstPageID)*PageSize); err != nil {
+		return err
+	}
+
+	return dm.written(tableName, file, len(data))
+}
+
+// Truncate removes all pages of a table.
+func (dm *DiskManager) Truncate(tableName string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.snapshot != nil {
+		if _, exists := dm.snapshot.pageCounts[tableName]; exists {
+			return fmt.Errorf("cannot truncate table %s while a snapshot is in progress", tableName)
+		}
+	}
+
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return err
+	}
+
+	dm.unmap(tableName)
+	dm.dropReadAhead(tableName, 0, -1)
+	dm.raReading.Wait()
+	if ct := dm.compressed[tableName]; ct != nil {
+		if err := ct.truncate(file); err != nil {
+			return err
+		}
+	} else if dm.encrypted[tableName] {
+		if err := file.Truncate(encryptedHeaderSize); err != nil {
+			return err
+		}
+	} else if err := file.Truncate(0); err != nil {
+		return err
+	}
+	dm.pageCounter[tableName] = 0
+
+	return dm.written(tableName, file, 0)
+}
+
+// TruncatePages cuts a table down to its first pageCount pages, releasing
+// the pages allocated past them along with anything written to them, as
+// for a bulk load that failed part way.
+func (dm *DiskManager) TruncatePages(tableName string, pageCount int32) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.snapshot != nil {
+		if count, exists := dm.snapshot.pageCounts[tableName]; exists && pageCount < count {
+			return fmt.Errorf("cannot truncate table %s while a snapshot is in progress", tableName)
+		}
+	}
+
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return err
+	}
+	if pageCount < 0 || pageCount > dm.pageCounter[tableName] {
+		return fmt.Errorf("table %s has %d pages, cannot truncate it to %d", tableName, dm.pageCounter[tableName], pageCount)
+	}
+
+	dm.unmap(tableName)
+	dm.dropReadAhead(tableName, 0, -1)
+	dm.raReading.Wait()
+	if ct := dm.compressed[tableName]; ct != nil {
+		if err := ct.truncatePages(file, pageCount); err != nil {
+			return err
+		}
+	} else {
+		size := int64(pageCount) * PageSize
+		if dm.encrypted[tableName] {
+			size = slotOffset(pageCount)
+		}
+		current, err := file.Size()
+		if err != nil {
+			return err
+		}
+		if current > size {
+			if err := file.Truncate(size); err != nil {
+				return err
+			}
+		}
+	}
+	dm.pageCounter[tableName] = pageCount
+
+	return dm.written(tableName, file, 0)
+}
+
 func (dm *DiskManager) GetPageCount(tableName string) int32 {
-	dm.mutex.RLock()
+	// The counter is set up when the table file is first opened
+	if _, err := dm.lockFile(tableName); err != nil {
+		return 0
+	}
 	defer dm.mutex.RUnlock()
 
 	return dm.pageCounter[tableName]
@@ -2,8 +2,11 @@ package disk
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"storage-layer/pkg/vfs"
+	"sync"
 	"testing"
 )
 
@@ -59,3 +62,100 @@ func TestDiskManager(t *testing.T) {
 		t.Errorf("Expected file %s to exist", expectedFile)
 	}
 }
+
+func TestConcurrentReadPage(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "disk_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	tables := []string{"a", "b", "c"}
+	for _, tableName := range tables {
+		pageID, _ := dm.AllocatePage(tableName)
+		if err := dm.WritePage(tableName, pageID, bytes.Repeat([]byte(tableName), PageSize)); err != nil {
+			t.Fatalf("Failed to write page: %v", err)
+		}
+	}
+	dm.Close()
+
+	// A fresh disk manager opens the files from concurrent reads
+	dm = NewDiskManager(tempDir)
+	defer dm.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(tableName string) {
+			defer wg.Done()
+			data, err := dm.ReadPage(tableName, 0)
+			if err != nil || data[0] != tableName[0] {
+				t.Errorf("ReadPage(%s) = %v", tableName, err)
+			}
+		}(tables[i%len(tables)])
+	}
+	wg.Wait()
+}
+
+func TestTruncatePages(t *testing.T) {
+	formats := map[string]func(dm *DiskManager){
+		"plain":      func(dm *DiskManager) {},
+		"compressed": func(dm *DiskManager) { dm.SetCompression("t", "flate") },
+		"encrypted": func(dm *DiskManager) {
+			_, c := testCipher(t)
+			dm.SetCipher(c)
+		},
+	}
+
+	for name, setFormat := range formats {
+		t.Run(name, func(t *testing.T) {
+			fsys := vfs.NewMemFS()
+			open := func() *DiskManager {
+				dm := NewDiskManagerFS("/db", fsys)
+				setFormat(dm)
+				if err := dm.Open(); err != nil {
+					t.Fatalf("Failed to open disk manager: %v", err)
+				}
+				return dm
+			}
+
+			dm := open()
+			dm.AllocatePages("t", 2)
+			dm.WritePages("t", 0, append(testPage(0), testPage(1)...))
+			dm.AllocatePages("t", 3)
+			dm.WritePages("t", 2, append(testPage(2), testPage(3)...))
+
+			if err := dm.TruncatePages("t", 6); err == nil {
+				t.Errorf("Expected truncating past the last page to fail")
+			}
+			if err := dm.TruncatePages("t", 2); err != nil {
+				t.Fatalf("TruncatePages failed: %v", err)
+			}
+			if count := dm.GetPageCount("t"); count != 2 {
+				t.Errorf("Expected 2 pages, got %d", count)
+			}
+			if _, err := dm.ReadPage("t", 2); err != io.EOF {
+				t.Errorf("Expected io.EOF for a released page, got %v", err)
+			}
+			dm.Close()
+
+			dm = open()
+			defer dm.Close()
+			if count := dm.GetPageCount("t"); count != 2 {
+				t.Errorf("Expected 2 pages after reopening, got %d", count)
+			}
+			if data, err := dm.ReadPage("t", 1); err != nil || !bytes.Equal(data, testPage(1)) {
+				t.Errorf("Expected page 1 to survive the truncation (%v)", err)
+			}
+
+			// The released pages are allocated again
+			if first, _ := dm.AllocatePages("t", 1); first != 2 {
+				t.Errorf("Expected page 2 to be allocated next, got %d", first)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package disk
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/vfs"
+	"time"
+)
+
+// SyncPolicy decides when page writes are synced to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncPerWrite syncs the file after every write
+	SyncPerWrite SyncPolicy = iota
+	// SyncPerFlush leaves writes unsynced until Sync is called
+	SyncPerFlush
+	// SyncGroupCommit makes concurrent writes wait for one shared sync,
+	// done when the group window has passed or the group has written
+	// GroupBytes, whichever comes first
+	SyncGroupCommit
+	// SyncNone never syncs, for scratch data that need not survive a crash
+	SyncNone
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncPerWrite:
+		return "per-write"
+	case SyncPerFlush:
+		return "per-flush"
+	case SyncGroupCommit:
+		return "group-commit"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// ParseSyncPolicy accepts the names returned by SyncPolicy.String.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncPerWrite, SyncPerFlush, SyncGroupCommit, SyncNone} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", name)
+}
+
+type Durability struct {
+	Policy SyncPolicy
+	// GroupWindow and GroupBytes bound a group under SyncGroupCommit
+	GroupWindow time.Duration
+	GroupBytes  int64
+}
+
+func DefaultDurability() Durability {
+	return Durability{
+		Policy:      SyncPerWrite,
+		GroupWindow: 2 * time.Millisecond,
+		GroupBytes:  1 << 20,
+	}
+}
+
+// syncGroup is the set of files written by the writes waiting for the same
+// group commit.
+type syncGroup struct {
+	files map[string]vfs.File
+	bytes int64
+	done  chan struct{}
+	err   error
+}
+
+// SetDurability changes the sync policy for writes made from now on.
+func (dm *DiskManager) SetDurability(d Durability) {
+	defaults := DefaultDurability()
+	if d.GroupWindow <= 0 {
+		d.GroupWindow = defaults.GroupWindow
+	}
+	if d.GroupBytes <= 0 {
+		d.GroupBytes = defaults.GroupBytes
+	}
+
+	dm.syncMutex.Lock()
+	defer dm.syncMutex.Unlock()
+
+	dm.durability = d
+}
+
+func (dm *DiskManager) Durability() Durability {
+	dm.syncMutex.Lock()
+	defer dm.syncMutex.Unlock()
+
+	return dm.durability
+}
+
+// written applies the sync policy to a write of n bytes to the file of a
+// table. It is called with dm.mutex held, so the file stays open.
+func (dm *DiskManager) written(tableName string, file vfs.File, n int) error {
+	dm.syncMutex.Lock()
+
+	switch dm.durability.Policy {
+	case SyncPerWrite:
+		dm.syncMutex.Unlock()
+		return file.Sync()
+
+	case SyncPerFlush:
+		dm.unsynced[tableName] = file
+		dm.syncMutex.Unlock()
+		return nil
+
+	case SyncGroupCommit:
+		g := dm.group
+		if g == nil {
+			g = &syncGroup{files: make(map[string]vfs.File), done: make(chan struct{})}
+			dm.group = g
+			time.AfterFunc(dm.durability.GroupWindow, func() { dm.commitGroup(g) })
+		}
+		g.files[tableName] = file
+		g.bytes += int64(n)
+		full := g.bytes >= dm.durability.GroupBytes
+		dm.syncMutex.Unlock()
+
+		if full {
+			dm.commitGroup(g)
+		}
+		<-g.done
+		return g.err
+	}
+
+	dm.syncMutex.Unlock()
+	return nil
+}
+
+// commitGroup syncs the files of a group once and releases its writers. A
+// later group can fill up while this one is syncing.
+func (dm *DiskManager) commitGroup(g *syncGroup) {
+	dm.syncMutex.Lock()
+	if dm.group != g {
+		dm.syncMutex.Unlock()
+		return
+	}
+	dm.group = nil
+	dm.syncMutex.Unlock()
+
+	for tableName, file := range g.files {
+		if err := file.Sync(); err != nil && g.err == nil {
+			g.err = fmt.Errorf("failed to sync table %s: %v", tableName, err)
+		}
+	}
+	close(g.done)
+}
+
+// PageWrite is one page of a WriteBatch.
+type PageWrite struct {
+	PageID int32
+	Data   []byte
+}
+
+// WriteBatch writes pages of a table, merging runs of consecutive pages
+// into single writes. The sync policy applies to the batch as a whole:
+// SyncPerWrite syncs after each merged write, SyncGroupCommit waits for the
+// group the batch joins, and SyncPerFlush leaves the file for Sync.
+func (dm *DiskManager) WriteBatch(tableName string, pages []PageWrite) error {
+	for _, pw := range pages {
+		if len(pw.Data) != PageSize {
+			return fmt.Errorf("page data must be exactly %d bytes", PageSize)
+		}
+	}
+
+	sorted := append([]PageWrite(nil), pages...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PageID < sorted[j].PageID })
+
+	policy := dm.Durability().Policy
+	file, err := dm.lockFile(tableName)
+	if err != nil {
+		return err
+	}
+	defer dm.mutex.RUnlock()
+
+	if ct := dm.compressed[tableName]; ct != nil {
+		for _, pw := range sorted {
+			if dm.snapshot != nil {
+				if err := dm.snapshot.preserve(tableName, pw.PageID); err != nil {
+					return err
+				}
+			}
+			dm.dropReadAhead(tableName, pw.PageID, 1)
+		}
+		if err := ct.appendPages(file, sorted); err != nil {
+			return err
+		}
+		if policy == SyncPerWrite {
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+		sorted = nil
+	}
+	encrypted := dm.encrypted[tableName]
+
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].PageID == sorted[end-1].PageID+1 {
+			end++
+		}
+
+		var data []byte
+		if dm.direct[tableName] {
+			data = vfs.AlignedBuffer((end - start) * PageSize)[:0]
+		}
+		for _, pw := range sorted[start:end] {
+			if dm.snapshot != nil {
+				if err := dm.snapshot.preserve(tableName, pw.PageID); err != nil {
+					return err
+				}
+			}
+			data = append(data, pw.Data...)
+		}
+
+		dm.dropReadAhead(tableName, sorted[start].PageID, end-start)
+		if encrypted {
+			if err := dm.writeEncrypted(tableName, file, sorted[start].PageID, data); err != nil {
+				return err
+			}
+		} else if _, err := file.WriteAt(data, int64(sorted[start].PageID)*PageSize); err != nil {
+			return err
+		}
+		if policy == SyncPerWrite {
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+
+	switch policy {
+	case SyncPerFlush:
+		dm.syncMutex.Lock()
+		dm.unsynced[tableName] = file
+		dm.syncMutex.Unlock()
+	case SyncGroupCommit:
+		return dm.written(tableName, file, len(pages)*PageSize)
+	}
+	return nil
+}
+
+// Sync makes every write not yet synced durable, syncing each written file
+// once. It does nothing under SyncNone. Compressed tables whose files have
+// grown mostly superseded extents are compacted afterwards.
+func (dm *DiskManager) Sync() error {
+	if err := dm.syncFiles(); err != nil {
+		return err
+	}
+	return dm.compactAll()
+}
+
+func (dm *DiskManager) syncFiles() error {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	dm.syncMutex.Lock()
+	files := dm.unsynced
+	dm.unsynced = make(map[string]vfs.File)
+	dm.syncMutex.Unlock()
+
+	tables := make([]string, 0, len(files))
+	for tableName := range files {
+		tables = append(tables, tableName)
+	}
+	sort.Strings(tables)
+
+	for i, tableName := range tables {
+		if err := files[tableName].Sync(); err != nil {
+			// Leave the rest for the next Sync
+			dm.syncMutex.Lock()
+			for _, name := range tables[i:] {
+				dm.unsynced[name] = files[name]
+			}
+			dm.syncMutex.Unlock()
+			return fmt.Errorf("failed to sync table %s: %v", tableName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package disk
+
+import (
+	"bytes"
+	"storage-layer/pkg/vfs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncCounter counts the file syncs made through it.
+type syncCounter struct {
+	vfs.FileSystem
+	syncs atomic.Int64
+}
+
+type countedFile struct {
+	vfs.File
+	fsys *syncCounter
+}
+
+func (c *syncCounter) OpenFile(name string, flag int) (vfs.File, error) {
+	file, err := c.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return countedFile{file, c}, nil
+}
+
+func (f countedFile) Sync() error {
+	f.fsys.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func newCountedDiskManager(t *testing.T, d Durability) (*DiskManager, *syncCounter) {
+	fsys := &syncCounter{FileSystem: vfs.NewMemFS()}
+	dm := NewDiskManagerFS("/db", fsys)
+	dm.SetDurability(d)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	return dm, fsys
+}
+
+func TestSyncPolicies(t *testing.T) {
+	tests := []struct {
+		policy     SyncPolicy
+		afterWrite int64
+		afterSync  int64
+	}{
+		{SyncPerWrite, 10, 10},
+		{SyncPerFlush, 0, 2},
+		{SyncNone, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			dm, fsys := newCountedDiskManager(t, Durability{Policy: tt.policy})
+			defer dm.Close()
+
+			data := make([]byte, PageSize)
+			for i := 0; i < 10; i++ {
+				tableName := []string{"a", "b"}[i%2]
+				pageID, _ := dm.AllocatePage(tableName)
+				if err := dm.WritePage(tableName, pageID, data); err != nil {
+					t.Fatalf("Failed to write page: %v", err)
+				}
+			}
+			// Creating the two files synced nothing but the directory
+			if got := fsys.syncs.Load(); got != tt.afterWrite {
+				t.Errorf("Expected %d syncs after the writes, got %d", tt.afterWrite, got)
+			}
+
+			if err := dm.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if got := fsys.syncs.Load(); got != tt.afterSync {
+				t.Errorf("Expected %d syncs after Sync, got %d", tt.afterSync, got)
+			}
+		})
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	const writers = 8
+
+	// The window is long enough that only the size bound ends the group
+	dm, fsys := newCountedDiskManager(t, Durability{
+		Policy:      SyncGroupCommit,
+		GroupWindow: time.Hour,
+		GroupBytes:  writers * PageSize,
+	})
+	defer dm.Close()
+
+	first, _ := dm.AllocatePages("t", writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := dm.WritePage("t", first+int32(i), make([]byte, PageSize)); err != nil {
+				t.Errorf("Failed to write page: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := fsys.syncs.Load(); got != 1 {
+		t.Errorf("Expected the writers to share one sync, got %d", got)
+	}
+
+	// A lone write is synced when the window ends
+	dm.SetDurability(Durability{Policy: SyncGroupCommit, GroupWindow: time.Millisecond, GroupBytes: 1 << 30})
+	if err := dm.WritePage("t", first, make([]byte, PageSize)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	if got := fsys.syncs.Load(); got != 2 {
+		t.Errorf("Expected a second sync after the window, got %d", got)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	// Out of order, with a gap at page 5, so two runs of pages
+	var pages []PageWrite
+	for _, i := range []int32{9, 0, 1, 2, 3, 4, 6, 8, 7} {
+		pages = append(pages, PageWrite{PageID: i, Data: bytes.Repeat([]byte{byte(i + 1)}, PageSize)})
+	}
+
+	tests := []struct {
+		policy     SyncPolicy
+		afterBatch int64
+		afterSync  int64
+	}{
+		{SyncPerWrite, 2, 2},
+		{SyncPerFlush, 0, 1},
+		{SyncGroupCommit, 1, 1},
+		{SyncNone, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			dm, fsys := newCountedDiskManager(t, Durability{Policy: tt.policy, GroupWindow: time.Millisecond})
+			defer dm.Close()
+			dm.AllocatePages("t", 10)
+
+			if err := dm.WriteBatch("t", pages); err != nil {
+				t.Fatalf("WriteBatch failed: %v", err)
+			}
+			if got := fsys.syncs.Load(); got != tt.afterBatch {
+				t.Errorf("Expected %d syncs after the batch, got %d", tt.afterBatch, got)
+			}
+			if err := dm.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if got := fsys.syncs.Load(); got != tt.afterSync {
+				t.Errorf("Expected %d syncs after Sync, got %d", tt.afterSync, got)
+			}
+			for _, pw := range pages {
+				data, err := dm.ReadPage("t", pw.PageID)
+				if err != nil {
+					t.Fatalf("Failed to read page %d: %v", pw.PageID, err)
+				}
+				if !bytes.Equal(data, pw.Data) {
+					t.Errorf("Page %d does not match", pw.PageID)
+				}
+			}
+
+			if err := dm.WriteBatch("t", []PageWrite{{PageID: 0, Data: []byte("short")}}); err == nil {
+				t.Errorf("Expected an error for a short page")
+			}
+		})
+	}
+}
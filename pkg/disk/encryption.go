@@ -0,0 +1,187 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/vfs"
+)
+
+// An encrypted table file starts with a header, followed by a slot per
+// page holding the page sealed by the cipher. Slots are larger than pages,
+// so encrypted files are neither mapped nor opened with O_DIRECT. A slot
+// of zeros is a page that was never written, since key ID 0 is reserved.
+var encryptedMagic = []byte("SLEP")
+
+const (
+	encryptedHeaderSize = 16
+	encryptedSlotSize   = PageSize + crypt.Overhead
+)
+
+// SetCipher encrypts the pages of table files created from now on with c,
+// or leaves them unencrypted if c is nil. It belongs right after the disk
+// manager is created: existing files keep the format they were written
+// in, and opening one that is encrypted without a cipher, or unencrypted
+// with one, fails.
+func (dm *DiskManager) SetCipher(c *crypt.Cipher) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dm.cipher = c
+}
+
+// checkEncrypted fails for a table file whose encryption does not match
+// the cipher.
+func (dm *DiskManager) checkEncrypted(tableName string, encrypted bool) error {
+	if encrypted && dm.cipher == nil {
+		return fmt.Errorf("table %s: %w", tableName, crypt.ErrNoKey)
+	}
+	if !encrypted && dm.cipher != nil {
+		return fmt.Errorf("table %s is not encrypted", tableName)
+	}
+	return nil
+}
+
+// pageAD is the associated data a page is sealed with. It binds the page
+// to its ID and table, so a page moved elsewhere in the file, or to
+// another table, fails to decrypt.
+func pageAD(tableName string, pageID int32) []byte {
+	ad := binary.LittleEndian.AppendUint32(nil, uint32(pageID))
+	return append(ad, tableName...)
+}
+
+// initEncrypted sets up an encrypted table file as it is opened and
+// returns the page count of the table. A slot cut short by a crash is not
+// counted.
+func (dm *DiskManager) initEncrypted(tableName string, file vfs.File) (int32, error) {
+	size, err := file.Size()
+	if err != nil {
+		return 0, err
+	}
+	if err := dm.checkEncrypted(tableName, true); err != nil {
+		return 0, err
+	}
+
+	if size == 0 {
+		header := make([]byte, encryptedHeaderSize)
+		copy(header, encryptedMagic)
+		if _, err := file.WriteAt(header, 0); err != nil {
+			return 0, err
+		}
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+		size = encryptedHeaderSize
+	}
+
+	dm.encrypted[tableName] = true
+	return int32((size - encryptedHeaderSize) / encryptedSlotSize), nil
+}
+
+func slotOffset(pageID int32) int64 {
+	return encryptedHeaderSize + int64(pageID)*encryptedSlotSize
+}
+
+// readEncrypted reads and decrypts a page. Called with dm.mutex held.
+func (dm *DiskManager) readEncrypted(tableName string, file vfs.File, pageID int32) ([]byte, error) {
+	slot := make([]byte, encryptedSlotSize)
+	if _, err := file.ReadAt(slot, slotOffset(pageID)); err != nil {
+		return nil, err
+	}
+	if crypt.KeyID(slot) == 0 {
+		return make([]byte, PageSize), nil
+	}
+
+	data, err := dm.cipher.Open(make([]byte, 0, PageSize), slot, pageAD(tableName, pageID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt page %d of table %s: %w", pageID, tableName, err)
+	}
+	return data, nil
+}
+
+// sealPages encrypts consecutive pages into consecutive slots.
+func (dm *DiskManager) sealPages(tableName string, firstPageID int32, data []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(data)/PageSize*encryptedSlotSize)
+	for i := 0; i < len(data)/PageSize; i++ {
+		var err error
+		buf, err = dm.cipher.Seal(buf, data[i*PageSize:(i+1)*PageSize], pageAD(tableName, firstPageID+int32(i)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// writeEncrypted encrypts consecutive pages and writes them with a single
+// write. Called with dm.mutex held.
+func (dm *DiskManager) writeEncrypted(tableName string, file vfs.File, firstPageID int32, data []byte) error {
+	sealed, err := dm.sealPages(tableName, firstPageID, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt pages of table %s: %v", tableName, err)
+	}
+	_, err = file.WriteAt(sealed, slotOffset(firstPageID))
+	return err
+}
+
+// Rekey encrypts the file of a table again with the current key, so that
+// older keys are no longer needed for it. The new file replaces the old
+// one by a rename, as in Compact. Tables that are not encrypted are left
+// alone.
+func (dm *DiskManager) Rekey(tableName string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return err
+	}
+
+	if ct := dm.compressed[tableName]; ct != nil {
+		if ct.cipher == nil {
+			return nil
+		}
+		ct.mutex.Lock()
+		defer ct.mutex.Unlock()
+
+		return dm.rewriteCompressed(tableName, file, ct, func(pageID int32, sealed []byte) ([]byte, error) {
+			data, err := ct.cipher.Open(nil, sealed, pageAD(tableName, pageID))
+			if err != nil {
+				return nil, err
+			}
+			return ct.cipher.Seal(nil, data, pageAD(tableName, pageID))
+		})
+	}
+
+	if !dm.encrypted[tableName] {
+		return nil
+	}
+
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	slots := (size - encryptedHeaderSize) / encryptedSlotSize
+
+	buf := make([]byte, encryptedHeaderSize, encryptedHeaderSize+slots*encryptedSlotSize)
+	copy(buf, encryptedMagic)
+	for pageID := int32(0); int64(pageID) < slots; pageID++ {
+		slot := make([]byte, encryptedSlotSize)
+		if _, err := file.ReadAt(slot, slotOffset(pageID)); err != nil {
+			return fmt.Errorf("failed to read page %d: %v", pageID, err)
+		}
+		if crypt.KeyID(slot) == 0 {
+			buf = append(buf, slot...)
+			continue
+		}
+
+		data, err := dm.cipher.Open(nil, slot, pageAD(tableName, pageID))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt page %d of table %s: %w", pageID, tableName, err)
+		}
+		if buf, err = dm.cipher.Seal(buf, data, pageAD(tableName, pageID)); err != nil {
+			return err
+		}
+	}
+
+	return dm.replaceFile(tableName, file, buf)
+}
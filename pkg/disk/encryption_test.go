@@ -0,0 +1,162 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T) (*crypt.KeyRing, *crypt.Cipher) {
+	t.Helper()
+
+	ring := crypt.NewKeyRing()
+	if err := ring.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	return ring, crypt.NewCipher(ring)
+}
+
+func TestEncryptedTable(t *testing.T) {
+	for _, compression := range []string{"", "flate"} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			fsys := vfs.NewMemFS()
+			ring, c := testCipher(t)
+			dm := NewDiskManagerFS("/db", fsys)
+			dm.SetCipher(c)
+			if err := dm.Open(); err != nil {
+				t.Fatalf("Failed to open disk manager: %v", err)
+			}
+			dm.SetCompression("t", compression)
+
+			dm.AllocatePages("t", 4)
+			if err := dm.WritePage("t", 0, testPage(0)); err != nil {
+				t.Fatalf("Failed to write page: %v", err)
+			}
+			if err := dm.WritePages("t", 2, append(testPage(2), testPage(3)...)); err != nil {
+				t.Fatalf("Failed to write pages: %v", err)
+			}
+			// Page 1 is left unwritten
+			if err := dm.WriteBatch("t", []PageWrite{{PageID: 3, Data: testPage(30)}}); err != nil {
+				t.Fatalf("Failed to write batch: %v", err)
+			}
+			dm.Sync()
+
+			check := func(dm *DiskManager) {
+				t.Helper()
+				want := [][]byte{testPage(0), make([]byte, PageSize), testPage(2), testPage(30)}
+				for pageID, expected := range want {
+					data, err := dm.ReadPage("t", int32(pageID))
+					if err != nil {
+						t.Fatalf("Failed to read page %d: %v", pageID, err)
+					}
+					if !bytes.Equal(data, expected) {
+						t.Errorf("Page %d does not match what was written", pageID)
+					}
+					err = dm.ViewPage("t", int32(pageID), func(data []byte) error {
+						if !bytes.Equal(data, expected) {
+							t.Errorf("View of page %d does not match what was written", pageID)
+						}
+						return nil
+					})
+					if err != nil {
+						t.Errorf("Failed to view page %d: %v", pageID, err)
+					}
+				}
+				if _, err := dm.ReadPage("t", 4); err != io.EOF {
+					t.Errorf("Expected io.EOF past the last page, got %v", err)
+				}
+			}
+			check(dm)
+			dm.Close()
+
+			data, _ := vfs.ReadFile(fsys, "/db/t.tbl")
+			if bytes.Contains(data, []byte("record 0 of page")) {
+				t.Errorf("Table file contains a page in plaintext")
+			}
+
+			dm = NewDiskManagerFS("/db", fsys)
+			dm.SetCipher(c)
+			check(dm)
+			if count := dm.GetPageCount("t"); count != 4 {
+				t.Errorf("Expected a page count of 4 after reopening, got %d", count)
+			}
+
+			// Rekeying leaves nothing that needs the old key
+			ring.Rotate(bytes.Repeat([]byte{2}, 32))
+			if err := dm.Rekey("t"); err != nil {
+				t.Fatalf("Rekey failed: %v", err)
+			}
+			ring.Remove(1)
+			check(dm)
+			dm.Close()
+
+			dm = NewDiskManagerFS("/db", fsys)
+			dm.SetCipher(c)
+			defer dm.Close()
+			check(dm)
+
+			if err := dm.Truncate("t"); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if count := dm.GetPageCount("t"); count != 0 {
+				t.Errorf("Expected an empty table after Truncate, got %d pages", count)
+			}
+		})
+	}
+}
+
+func TestEncryptedPageMoved(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	_, c := testCipher(t)
+	dm := NewDiskManagerFS("/db", fsys)
+	dm.SetCipher(c)
+	dm.Open()
+	dm.AllocatePages("t", 2)
+	dm.WritePages("t", 0, append(testPage(0), testPage(1)...))
+	dm.Close()
+
+	// Swap the slots of the two pages
+	file, _ := fsys.OpenFile("/db/t.tbl", 0)
+	slots := make([]byte, 2*encryptedSlotSize)
+	file.ReadAt(slots, encryptedHeaderSize)
+	file.WriteAt(append(slots[encryptedSlotSize:], slots[:encryptedSlotSize]...), encryptedHeaderSize)
+	file.Close()
+
+	dm = NewDiskManagerFS("/db", fsys)
+	dm.SetCipher(c)
+	defer dm.Close()
+	if _, err := dm.ReadPage("t", 0); !errors.Is(err, crypt.ErrWrongKey) {
+		t.Errorf("Expected a moved page to fail to decrypt, got %v", err)
+	}
+}
+
+func TestEncryptionMismatch(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	_, c := testCipher(t)
+
+	dm := NewDiskManagerFS("/db", fsys)
+	dm.SetCipher(c)
+	dm.Open()
+	dm.AllocatePage("encrypted")
+	dm.WritePage("encrypted", 0, testPage(0))
+	dm.Close()
+
+	dm = NewDiskManagerFS("/db", fsys)
+	dm.AllocatePage("plain")
+	dm.WritePage("plain", 0, testPage(0))
+	if _, err := dm.ReadPage("encrypted", 0); !errors.Is(err, crypt.ErrNoKey) {
+		t.Errorf("Expected ErrNoKey for an encrypted table without a cipher, got %v", err)
+	}
+	dm.Close()
+
+	dm = NewDiskManagerFS("/db", fsys)
+	dm.SetCipher(c)
+	defer dm.Close()
+	if _, err := dm.ReadPage("plain", 0); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("Expected a plain table to be rejected with a cipher, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// lzCodec is a small LZ77 codec in the LZ4 block format: each sequence is
+// a token holding the literal and match lengths, the literals, and a
+// two-byte offset back into the output. It trades ratio for speed against
+// flate.
+type lzCodec struct{}
+
+const (
+	lzMinMatch = 4
+	// The last bytes of the input are always literals, as in LZ4
+	lzLastLiterals = 5
+	lzHashBits     = 12
+)
+
+func (lzCodec) Name() string {
+	return "lz"
+}
+
+func (lzCodec) Compress(dst, src []byte) []byte {
+	var table [1 << lzHashBits]int32
+
+	anchor := 0
+	limit := len(src) - lzLastLiterals - lzMinMatch
+	for i := 0; i < limit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lzHashBits)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > 0xFFFF || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(src)-lzLastLiterals && src[ref+length] == src[i+length] {
+			length++
+		}
+		dst = lzSequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+
+	return lzSequence(dst, src[anchor:], 0, 0)
+}
+
+// lzSequence appends a sequence; the last one has no match.
+func lzSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-lzMinMatch, 15))
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lzAppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+
+	if length == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if length-lzMinMatch >= 15 {
+		dst = lzAppendLength(dst, length-lzMinMatch-15)
+	}
+	return dst
+}
+
+func lzAppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func (lzCodec) Decompress(dst, src []byte) error {
+	d, s := 0, 0
+	for s < len(src) {
+		token := src[s]
+		s++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var err error
+			if literals, s, err = lzReadLength(src, s, literals); err != nil {
+				return err
+			}
+		}
+		if s+literals > len(src) || d+literals > len(dst) {
+			return fmt.Errorf("lz: literals out of bounds")
+		}
+		copy(dst[d:], src[s:s+literals])
+		d += literals
+		s += literals
+
+		if s == len(src) {
+			break
+		}
+
+		if s+2 > len(src) {
+			return fmt.Errorf("lz: truncated offset")
+		}
+		offset := int(src[s]) | int(src[s+1])<<8
+		s += 2
+		if offset == 0 || offset > d {
+			return fmt.Errorf("lz: invalid offset %d", offset)
+		}
+
+		length := int(token & 15)
+		if length == 15 {
+			var err error
+			if length, s, err = lzReadLength(src, s, length); err != nil {
+				return err
+			}
+		}
+		length += lzMinMatch
+		if d+length > len(dst) {
+			return fmt.Errorf("lz: match out of bounds")
+		}
+		// The match may overlap the bytes it produces
+		for k := 0; k < length; k++ {
+			dst[d+k] = dst[d-offset+k]
+		}
+		d += length
+	}
+
+	if d != len(dst) {
+		return fmt.Errorf("lz: decompressed %d bytes, want %d", d, len(dst))
+	}
+	return nil
+}
+
+func lzReadLength(src []byte, s, n int) (int, int, error) {
+	for {
+		if s >= len(src) {
+			return 0, 0, fmt.Errorf("lz: truncated length")
+		}
+		b := src[s]
+		s++
+		n += int(b)
+		if b != 255 {
+			return n, s, nil
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package disk
+
+import (
+	"storage-layer/pkg/vfs"
+	"sync"
+)
+
+// mapping is a read-only mapping of a table file. Pages pinned by PinPage
+// keep it mapped after it is replaced or dropped, until they are released.
+type mapping struct {
+	data    []byte
+	mutex   sync.Mutex
+	pins    int
+	retired bool
+}
+
+func (m *mapping) pin() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pins++
+}
+
+func (m *mapping) unpin() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pins--
+	if m.pins == 0 && m.retired {
+		vfs.Unmap(m.data)
+	}
+}
+
+// retire unmaps the file once no page is pinned.
+func (m *mapping) retire() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.retired = true
+	if m.pins == 0 {
+		vfs.Unmap(m.data)
+	}
+}
+
+// SetMmap makes page reads come from a read-only memory mapping of each
+// table file instead of a read call. Writes still go through the file, and
+// the mapping shows them. A file that cannot be mapped is read as before.
+func (dm *DiskManager) SetMmap(enabled bool) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dm.mmap = enabled
+	if !enabled {
+		dm.unmapAll()
+	}
+}
+
+// mappedPage returns a page from the mapping of its table file, or nil if
+// the mapping does not cover it. It is called with dm.mutex held.
+func (dm *DiskManager) mappedPage(tableName string, pageID int32) []byte {
+	m := dm.maps[tableName]
+	if m == nil {
+		return nil
+	}
+	data := m.data
+	offset := int(pageID) * PageSize
+	if pageID < 0 || offset+PageSize > len(data) {
+		return nil
+	}
+	return data[offset : offset+PageSize : offset+PageSize]
+}
+
+// lockPage is lockFile for reading a page. In mmap mode it first maps the
+// file again if it has grown past the page since it was mapped.
+func (dm *DiskManager) lockPage(tableName string, pageID int32) error {
+	if _, err := dm.lockFile(tableName); err != nil {
+		return err
+	}
+	if !dm.mmap || dm.unmappable[tableName] || dm.mappedPage(tableName, pageID) != nil {
+		return nil
+	}
+	dm.mutex.RUnlock()
+
+	dm.mutex.Lock()
+	if dm.mmap && dm.mappedPage(tableName, pageID) == nil {
+		dm.remap(tableName)
+	}
+	dm.mutex.Unlock()
+
+	_, err := dm.lockFile(tableName)
+	return err
+}
+
+// remap maps the whole table file, if it has grown since it was last
+// mapped. A file that cannot be mapped is not tried again. It is called
+// with dm.mutex held exclusively, since readers may be using the old
+// mapping.
+func (dm *DiskManager) remap(tableName string) {
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return
+	}
+	if dm.compressed[tableName] != nil || dm.encrypted[tableName] {
+		// Pages are not where a mapping would find them
+		dm.unmappable[tableName] = true
+		return
+	}
+	size, err := file.Size()
+	if m := dm.maps[tableName]; err != nil || (m != nil && int(size) <= len(m.data)) {
+		return
+	}
+
+	data, err := vfs.Map(file, int(size))
+	if err != nil {
+		dm.unmappable[tableName] = true
+		return
+	}
+	dm.unmap(tableName)
+	dm.maps[tableName] = &mapping{data: data}
+}
+
+// unmap drops the mapping of a table file, once no page of it is pinned.
+// The file must not shrink while it is mapped, since reading past its end
+// through the mapping faults; the pages cut off must not be read again.
+func (dm *DiskManager) unmap(tableName string) {
+	if m, exists := dm.maps[tableName]; exists {
+		m.retire()
+		delete(dm.maps, tableName)
+	}
+}
+
+func (dm *DiskManager) unmapAll() {
+	for tableName := range dm.maps {
+		dm.unmap(tableName)
+	}
+	dm.unmappable = make(map[string]bool)
+}
+
+// PinPage returns a page in place in the mapping of its table file, with
+// the function that ends its use, or nil if the page is not mapped. The
+// page must not be modified. It stays readable until it is released, even
+// if the file is mapped again or no longer.
+func (dm *DiskManager) PinPage(tableName string, pageID int32) ([]byte, func(), error) {
+	if err := dm.lockPage(tableName, pageID); err != nil {
+		return nil, nil, err
+	}
+	defer dm.mutex.RUnlock()
+
+	data := dm.mappedPage(tableName, pageID)
+	if data == nil {
+		return nil, nil, nil
+	}
+	m := dm.maps[tableName]
+	m.pin()
+	return data, m.unpin, nil
+}
+
+// ViewPage calls fn with the contents of a page without copying them when
+// the file is mapped. fn must not modify data or keep it after returning.
+func (dm *DiskManager) ViewPage(tableName string, pageID int32, fn func(data []byte) error) error {
+	if err := dm.lockPage(tableName, pageID); err != nil {
+		return err
+	}
+	defer dm.mutex.RUnlock()
+
+	if data := dm.mappedPage(tableName, pageID); data != nil {
+		return fn(data)
+	}
+
+	file, err := dm.getFile(tableName)
+	if err != nil {
+		return err
+	}
+	if ct := dm.compressed[tableName]; ct != nil {
+		data, err := ct.readPage(file, pageID)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+	if dm.encrypted[tableName] {
+		data, err := dm.readEncrypted(tableName, file, pageID)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+	if ahead := dm.readAhead(tableName, file, pageID); ahead != nil {
+		return fn(ahead)
+	}
+
+	var data []byte
+	if dm.direct[tableName] {
+		buf := alignedPages.Get().(*[]byte)
+		defer alignedPages.Put(buf)
+		data = *buf
+	} else {
+		data = make([]byte, PageSize)
+	}
+
+	if _, err := file.ReadAt(data, int64(pageID)*PageSize); err != nil {
+		return err
+	}
+	return fn(data)
+}
@@ -0,0 +1,245 @@
+package disk
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "mmap_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	dm.SetMmap(true)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	write := func(pageID int32, fill byte) {
+		if err := dm.WritePage("t", pageID, bytes.Repeat([]byte{fill}, PageSize)); err != nil {
+			t.Fatalf("Failed to write page %d: %v", pageID, err)
+		}
+	}
+	check := func(pageID int32, fill byte) {
+		t.Helper()
+		data, err := dm.ReadPage("t", pageID)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageID, err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{fill}, PageSize)) {
+			t.Errorf("Page %d holds %d, want %d", pageID, data[0], fill)
+		}
+		err = dm.ViewPage("t", pageID, func(view []byte) error {
+			if !bytes.Equal(view, data) {
+				t.Errorf("ViewPage and ReadPage disagree on page %d", pageID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to view page %d: %v", pageID, err)
+		}
+	}
+
+	first, _ := dm.AllocatePages("t", 4)
+	for i := int32(0); i < 4; i++ {
+		write(first+i, byte(i+1))
+	}
+	check(first, 1)
+	if len(dm.maps["t"].data) != 4*PageSize {
+		t.Errorf("Expected a mapping of 4 pages, got %d bytes", len(dm.maps["t"].data))
+	}
+
+	// Writes show through the mapping, and the file is mapped again once it
+	// grows
+	write(first+1, 9)
+	check(first+1, 9)
+	more, _ := dm.AllocatePages("t", 4)
+	write(more+3, 8)
+	check(more+3, 8)
+	if len(dm.maps["t"].data) != 8*PageSize {
+		t.Errorf("Expected a mapping of 8 pages, got %d bytes", len(dm.maps["t"].data))
+	}
+
+	if err := dm.Truncate("t"); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if _, err := dm.ReadPage("t", first); err == nil {
+		t.Errorf("Expected an error reading a page of a truncated table")
+	}
+}
+
+// A pinned page stays readable while the file is mapped again and after
+// it is no longer mapped, and the old mapping goes with the last pin.
+func TestPinPage(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "mmap_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	dm.SetMmap(true)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	first, _ := dm.AllocatePages("t", 2)
+	if err := dm.WritePages("t", first, bytes.Repeat([]byte{7}, 2*PageSize)); err != nil {
+		t.Fatalf("Failed to write pages: %v", err)
+	}
+	data, release, err := dm.PinPage("t", first)
+	if err != nil || data == nil {
+		t.Fatalf("Expected the page to be mapped, got error %v", err)
+	}
+	old := dm.maps["t"]
+
+	more, _ := dm.AllocatePages("t", 2)
+	if err := dm.WritePages("t", more, make([]byte, 2*PageSize)); err != nil {
+		t.Fatalf("Failed to write pages: %v", err)
+	}
+	if again, releaseAgain, _ := dm.PinPage("t", more+1); again == nil {
+		t.Fatalf("Expected the grown file to be mapped again")
+	} else {
+		releaseAgain()
+	}
+	if dm.maps["t"] == old {
+		t.Fatalf("Expected a new mapping")
+	}
+
+	dm.SetMmap(false)
+	if !bytes.Equal(data, bytes.Repeat([]byte{7}, PageSize)) {
+		t.Errorf("Pinned page changed")
+	}
+	if old.pins != 1 || !old.retired {
+		t.Errorf("Expected the old mapping retired with one pin, got %d pins", old.pins)
+	}
+	release()
+	if old.pins != 0 {
+		t.Errorf("Expected no pins left, got %d", old.pins)
+	}
+
+	if data, _, err := dm.PinPage("t", first); err != nil || data != nil {
+		t.Errorf("Expected nothing pinned without mmap, got %d bytes (%v)", len(data), err)
+	}
+}
+
+func TestMmapFallback(t *testing.T) {
+	dm := NewDiskManagerFS("/db", vfs.NewMemFS())
+	dm.SetMmap(true)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	pageID, _ := dm.AllocatePage("t")
+	data := bytes.Repeat([]byte{3}, PageSize)
+	if err := dm.WritePage("t", pageID, data); err != nil {
+		t.Fatalf("WritePage failed: %v", err)
+	}
+	got, err := dm.ReadPage("t", pageID)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the page back, got error %v", err)
+	}
+	if !dm.unmappable["t"] {
+		t.Errorf("Expected the in-memory file to be marked unmappable")
+	}
+}
+
+const benchmarkPages = 2048
+
+func benchmarkDiskManager(b *testing.B, mmap bool) *DiskManager {
+	tempDir, err := os.MkdirTemp("", "read_bench")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %v", err)
+	}
+	b.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	dm := NewDiskManager(tempDir)
+	dm.SetMmap(mmap)
+	dm.SetDurability(Durability{Policy: SyncNone})
+	if err := dm.Open(); err != nil {
+		b.Fatalf("Failed to open disk manager: %v", err)
+	}
+	b.Cleanup(func() { dm.Close() })
+
+	first, _ := dm.AllocatePages("t", benchmarkPages)
+	if err := dm.WritePages("t", first, make([]byte, benchmarkPages*PageSize)); err != nil {
+		b.Fatalf("Failed to write pages: %v", err)
+	}
+	return dm
+}
+
+// BenchmarkReadPage compares ReadAt with copying out of the mapping, and
+// ViewPage and PinPage on the mapping, which copy nothing. The file stays
+// in the page cache, so the numbers show the cost of the read path, not of
+// the device.
+func BenchmarkReadPage(b *testing.B) {
+	for _, mode := range []string{"readat", "mmap", "mmap_view", "mmap_pin"} {
+		b.Run(mode, func(b *testing.B) {
+			dm := benchmarkDiskManager(b, mode != "readat")
+			rng := rand.New(rand.NewSource(1))
+			var sum byte
+
+			b.ReportAllocs()
+			b.SetBytes(PageSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pageID := int32(rng.Intn(benchmarkPages))
+				if mode == "mmap_view" {
+					err := dm.ViewPage("t", pageID, func(data []byte) error {
+						sum += data[100]
+						return nil
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				if mode == "mmap_pin" {
+					data, release, err := dm.PinPage("t", pageID)
+					if err != nil {
+						b.Fatal(err)
+					}
+					sum += data[100]
+					release()
+					continue
+				}
+
+				data, err := dm.ReadPage("t", pageID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sum += data[100]
+			}
+			_ = sum
+		})
+	}
+}
+
+func BenchmarkParallelReadPage(b *testing.B) {
+	for _, mode := range []string{"readat", "mmap"} {
+		b.Run(mode, func(b *testing.B) {
+			dm := benchmarkDiskManager(b, mode == "mmap")
+
+			b.SetBytes(PageSize)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if _, err := dm.ReadPage("t", int32(rng.Intn(benchmarkPages))); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
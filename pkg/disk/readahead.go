@@ -0,0 +1,174 @@
+package disk
+
+import "storage-layer/pkg/vfs"
+
+// readAheadTrigger is the number of consecutive pages a table must be read
+// in before read-ahead starts.
+const readAheadTrigger = 2
+
+// readAheadState follows the reads of one table. Windows are in page order
+// and never overlap.
+type readAheadState struct {
+	last    int32
+	run     int
+	windows []*readAheadWindow
+}
+
+// readAheadWindow is a multi-page read issued ahead of the reader. data
+// holds the pages that existed, and is set once done is closed.
+type readAheadWindow struct {
+	first int32
+	pages int32
+	data  []byte
+	err   error
+	done  chan struct{}
+}
+
+func (w *readAheadWindow) covers(pageID int32) bool {
+	return pageID >= w.first && pageID < w.first+w.pages
+}
+
+type ReadAheadStats struct {
+	// Reads is the number of multi-page reads issued, and Pages the number
+	// of page reads they served
+	Reads int64
+	Pages int64
+}
+
+// SetReadAhead sets how many pages are read in one go once a table is read
+// sequentially. Zero turns read-ahead off.
+func (dm *DiskManager) SetReadAhead(pages int) {
+	dm.raMutex.Lock()
+	defer dm.raMutex.Unlock()
+
+	dm.readAheadPages = int32(pages)
+	dm.readAheads = make(map[string]*readAheadState)
+}
+
+func (dm *DiskManager) ReadAheadStats() ReadAheadStats {
+	return ReadAheadStats{
+		Reads: dm.raReads.Load(),
+		Pages: dm.raPages.Load(),
+	}
+}
+
+// readAhead returns a page if a read-ahead window holds it, and keeps
+// windows in flight ahead of a sequential reader. The windows are read in
+// the background, without dm.mutex, since the reader holds it while it
+// waits for them. It is called with dm.mutex held.
+func (dm *DiskManager) readAhead(tableName string, file vfs.File, pageID int32) []byte {
+	dm.raMutex.Lock()
+
+	depth := dm.readAheadPages
+	if depth <= 0 {
+		dm.raMutex.Unlock()
+		return nil
+	}
+
+	st := dm.readAheads[tableName]
+	if st == nil {
+		st = &readAheadState{last: -1}
+		dm.readAheads[tableName] = st
+	}
+	switch pageID {
+	case st.last + 1:
+		st.run++
+	case st.last:
+	default:
+		st.run = 1
+	}
+	st.last = pageID
+
+	// Windows behind the reader are done with
+	var hit *readAheadWindow
+	windows := st.windows[:0]
+	for _, w := range st.windows {
+		if w.covers(pageID) {
+			hit = w
+		}
+		if w.first+w.pages > pageID {
+			windows = append(windows, w)
+		}
+	}
+	st.windows = windows
+
+	if hit != nil || st.run >= readAheadTrigger {
+		next := pageID + 1
+		if len(windows) > 0 {
+			if end := windows[len(windows)-1].first + windows[len(windows)-1].pages; end > next {
+				next = end
+			}
+		}
+		if next <= pageID+depth {
+			st.windows = append(st.windows, dm.startWindow(tableName, file, next, depth))
+		}
+	}
+	dm.raMutex.Unlock()
+
+	if hit == nil {
+		return nil
+	}
+
+	<-hit.done
+	offset := int(pageID-hit.first) * PageSize
+	if hit.err != nil || offset+PageSize > len(hit.data) {
+		return nil
+	}
+	dm.raPages.Add(1)
+	return hit.data[offset : offset+PageSize : offset+PageSize]
+}
+
+func (dm *DiskManager) startWindow(tableName string, file vfs.File, first, pages int32) *readAheadWindow {
+	w := &readAheadWindow{first: first, pages: pages, done: make(chan struct{})}
+	direct := dm.direct[tableName]
+	dm.raReads.Add(1)
+
+	dm.raReading.Add(1)
+	go func() {
+		defer dm.raReading.Done()
+		defer close(w.done)
+
+		var buf []byte
+		if direct {
+			buf = vfs.AlignedBuffer(int(pages) * PageSize)
+		} else {
+			buf = make([]byte, int(pages)*PageSize)
+		}
+
+		// The window ends where the file does
+		n, err := file.ReadAt(buf, int64(first)*PageSize)
+		if n == 0 && err != nil {
+			w.err = err
+			return
+		}
+		w.data = buf[:n-n%PageSize]
+	}()
+
+	return w
+}
+
+// dropReadAhead forgets the windows holding any of count pages from
+// firstPageID, since they are being overwritten. count -1 means all pages.
+func (dm *DiskManager) dropReadAhead(tableName string, firstPageID int32, count int) {
+	dm.raMutex.Lock()
+	defer dm.raMutex.Unlock()
+
+	st := dm.readAheads[tableName]
+	if st == nil {
+		return
+	}
+	if count < 0 {
+		delete(dm.readAheads, tableName)
+		return
+	}
+
+	end := firstPageID + int32(count)
+	windows := st.windows[:0]
+	for _, w := range st.windows {
+		if w.first < end && firstPageID < w.first+w.pages {
+			continue
+		}
+		windows = append(windows, w)
+	}
+	st.windows = windows
+}
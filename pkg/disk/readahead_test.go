@@ -0,0 +1,158 @@
+package disk
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func pageContent(pageID int32, version byte) []byte {
+	data := make([]byte, PageSize)
+	for i := range data {
+		data[i] = byte(pageID) + version + byte(i%13)
+	}
+	return data
+}
+
+func newReadAheadDiskManager(t *testing.T, depth int, pages int32) *DiskManager {
+	dm := NewDiskManagerFS("/db", vfs.NewMemFS())
+	dm.SetReadAhead(depth)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	t.Cleanup(func() { dm.Close() })
+
+	first, _ := dm.AllocatePages("t", int(pages))
+	for i := int32(0); i < pages; i++ {
+		if err := dm.WritePage("t", first+i, pageContent(i, 0)); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	return dm
+}
+
+func TestReadAhead(t *testing.T) {
+	dm := newReadAheadDiskManager(t, 8, 64)
+
+	for pageID := int32(0); pageID < 64; pageID++ {
+		data, err := dm.ReadPage("t", pageID)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageID, err)
+		}
+		if !bytes.Equal(data, pageContent(pageID, 0)) {
+			t.Fatalf("Page %d does not match", pageID)
+		}
+	}
+
+	// The first two pages are read alone, the rest ahead of the reader
+	stats := dm.ReadAheadStats()
+	if stats.Pages != 62 {
+		t.Errorf("Expected 62 pages served by read-ahead, got %d", stats.Pages)
+	}
+	if stats.Reads < 62/8 || stats.Reads > 62/8+2 {
+		t.Errorf("Expected about %d multi-page reads, got %d", 62/8, stats.Reads)
+	}
+
+	// Random reads do not start any
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		pageID := int32(rng.Intn(64))
+		if i%2 == 1 {
+			pageID = int32(63 - rng.Intn(32))
+		}
+		if _, err := dm.ReadPage("t", pageID); err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageID, err)
+		}
+	}
+	if got := dm.ReadAheadStats().Reads; got > stats.Reads+10 {
+		t.Errorf("Expected random reads to issue few multi-page reads, got %d more", got-stats.Reads)
+	}
+}
+
+func TestReadAheadSeesWrites(t *testing.T) {
+	dm := newReadAheadDiskManager(t, 8, 16)
+
+	// Reading pages 0 and 1 starts a window over pages 2 to 9
+	for pageID := int32(0); pageID < 2; pageID++ {
+		if _, err := dm.ReadPage("t", pageID); err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageID, err)
+		}
+	}
+	if err := dm.WritePage("t", 5, pageContent(5, 1)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	if err := dm.WriteBatch("t", []PageWrite{{PageID: 12, Data: pageContent(12, 1)}}); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	for pageID := int32(2); pageID < 16; pageID++ {
+		var version byte
+		if pageID == 5 || pageID == 12 {
+			version = 1
+		}
+		err := dm.ViewPage("t", pageID, func(data []byte) error {
+			if !bytes.Equal(data, pageContent(pageID, version)) {
+				t.Errorf("Page %d is stale", pageID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to view page %d: %v", pageID, err)
+		}
+	}
+
+	// Past the end of the file read-ahead has nothing, and the read fails
+	// as it would without it
+	last, _ := dm.AllocatePage("t")
+	if _, err := dm.ReadPage("t", last); err == nil {
+		t.Errorf("Expected an error reading a page that was never written")
+	}
+
+	if err := dm.Truncate("t"); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if _, err := dm.ReadPage("t", 3); err == nil {
+		t.Errorf("Expected an error reading a truncated page")
+	}
+}
+
+// BenchmarkSequentialRead reads a table file front to back with different
+// read-ahead depths. The file is in the page cache, so the gain shown is
+// in system calls; on a cold cache or a slow device it is larger.
+func BenchmarkSequentialRead(b *testing.B) {
+	const pages = 4096
+
+	tempDir, err := os.MkdirTemp("", "readahead_bench")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	if err := dm.Open(); err != nil {
+		b.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	first, _ := dm.AllocatePages("t", pages)
+	if err := dm.WritePages("t", first, make([]byte, pages*PageSize)); err != nil {
+		b.Fatalf("Failed to write pages: %v", err)
+	}
+
+	for _, depth := range []int{0, 8, 32, 128} {
+		b.Run(map[int]string{0: "off", 8: "8", 32: "32", 128: "128"}[depth], func(b *testing.B) {
+			dm.SetReadAhead(depth)
+			b.SetBytes(pages * PageSize)
+			for i := 0; i < b.N; i++ {
+				for pageID := int32(0); pageID < pages; pageID++ {
+					err := dm.ViewPage("t", pageID, func([]byte) error { return nil })
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
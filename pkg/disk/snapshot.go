@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// Snapshot is a copy-on-write view of the table files as they were when
+// BeginSnapshot was called. Pages overwritten afterwards have their old
+// contents preserved until the snapshot has read them.
+type Snapshot struct {
+	dm         *DiskManager
+	pageCounts map[string]int32
+	preserved  map[string]map[int32][]byte
+	copied     map[string]map[int32]bool
+	// mutex guards preserved and copied against concurrent page writes
+	mutex sync.Mutex
+}
+
+func TableFileName(tableName string) string {
+	return tableName + ".tbl"
+}
+
+func (dm *DiskManager) BeginSnapshot(tableNames []string) (*Snapshot, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.snapshot != nil {
+		return nil, fmt.Errorf("a snapshot is already in progress")
+	}
+
+	snap := &Snapshot{
+		dm:         dm,
+		pageCounts: make(map[string]int32),
+		preserved:  make(map[string]map[int32][]byte),
+		copied:     make(map[string]map[int32]bool),
+	}
+
+	for _, tableName := range tableNames {
+		if _, err := dm.getFile(tableName); err != nil {
+			return nil, err
+		}
+		snap.pageCounts[tableName] = dm.pageCounter[tableName]
+		snap.preserved[tableName] = make(map[int32][]byte)
+		snap.copied[tableName] = make(map[int32]bool)
+	}
+
+	dm.snapshot = snap
+	return snap, nil
+}
+
+func (s *Snapshot) PageCount(tableName string) int32 {
+	return s.pageCounts[tableName]
+}
+
+// ReadPage returns the page as it was when the snapshot began.
+func (s *Snapshot) ReadPage(tableName string, pageID int32) ([]byte, error) {
+	s.dm.mutex.Lock()
+	defer s.dm.mutex.Unlock()
+
+	if s.dm.snapshot != s {
+		return nil, fmt.Errorf("snapshot has been released")
+	}
+
+	count, exists := s.pageCounts[tableName]
+	if !exists || pageID >= count {
+		return nil, fmt.Errorf("page %d of table %s is not part of the snapshot", pageID, tableName)
+	}
+
+	if data, exists := s.preserved[tableName][pageID]; exists {
+		delete(s.preserved[tableName], pageID)
+		s.copied[tableName][pageID] = true
+		return data, nil
+	}
+
+	data, err := s.dm.readPage(tableName, pageID)
+	if err != nil {
+		return nil, err
+	}
+	s.copied[tableName][pageID] = true
+	return data, nil
+}
+
+func (s *Snapshot) Release() {
+	s.dm.mutex.Lock()
+	defer s.dm.mutex.Unlock()
+
+	if s.dm.snapshot == s {
+		s.dm.snapshot = nil
+	}
+}
+
+// preserve saves the current on-disk image of a page before it is
+// overwritten. Called with dm.mutex held, shared or exclusively.
+func (s *Snapshot) preserve(tableName string, pageID int32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count, exists := s.pageCounts[tableName]
+	if !exists || pageID >= count {
+		return nil
+	}
+	if s.copied[tableName][pageID] {
+		return nil
+	}
+	if _, exists := s.preserved[tableName][pageID]; exists {
+		return nil
+	}
+
+	data, err := s.dm.readPage(tableName, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to preserve page %d of %s: %v", pageID, filepath.Join(s.dm.basePath, TableFileName(tableName)), err)
+	}
+	s.preserved[tableName][pageID] = data
+	return nil
+}
@@ -0,0 +1,71 @@
+package disk
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestSnapshotPreservesOverwrittenPages(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "snapshot_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dm := NewDiskManager(tempDir)
+	if err := dm.Open(); err != nil {
+		t.Fatalf("Failed to open disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	tableName := "test_table"
+	oldData := bytes.Repeat([]byte{1}, PageSize)
+	newData := bytes.Repeat([]byte{2}, PageSize)
+
+	for i := 0; i < 2; i++ {
+		pageID, err := dm.AllocatePage(tableName)
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		if err := dm.WritePage(tableName, pageID, oldData); err != nil {
+			t.Fatalf("Failed to write page: %v", err)
+		}
+	}
+
+	snap, err := dm.BeginSnapshot([]string{tableName})
+	if err != nil {
+		t.Fatalf("Failed to begin snapshot: %v", err)
+	}
+	defer snap.Release()
+
+	if _, err := dm.BeginSnapshot([]string{tableName}); err == nil {
+		t.Errorf("Expected a second concurrent snapshot to fail")
+	}
+
+	// Page 0 is overwritten before the snapshot reads it, page 1 after
+	if err := dm.WritePage(tableName, 0, newData); err != nil {
+		t.Fatalf("Failed to overwrite page: %v", err)
+	}
+
+	for pageID := int32(0); pageID < snap.PageCount(tableName); pageID++ {
+		data, err := snap.ReadPage(tableName, pageID)
+		if err != nil {
+			t.Fatalf("Failed to read snapshot page %d: %v", pageID, err)
+		}
+		if !bytes.Equal(data, oldData) {
+			t.Errorf("Snapshot page %d does not hold the original contents", pageID)
+		}
+		if err := dm.WritePage(tableName, pageID, newData); err != nil {
+			t.Fatalf("Failed to overwrite page: %v", err)
+		}
+	}
+
+	current, err := dm.ReadPage(tableName, 0)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if !bytes.Equal(current, newData) {
+		t.Errorf("Live page does not hold the new contents")
+	}
+}
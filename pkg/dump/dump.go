@@ -0,0 +1,329 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/layer"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+)
+
+const (
+	FormatName = "storage-layer-dump"
+	// Version 2 added sequences
+	FormatVersion = 2
+)
+
+// Dump format: one JSON object per line.
+// A header line comes first, then one "table" line per table, then the
+// "row" lines of every table, then one "sequence" line per sequence.
+type entry struct {
+	Kind     string                   `json:"kind"`
+	Format   string                   `json:"format,omitempty"`
+	Version  int                      `json:"version,omitempty"`
+	Table    string                   `json:"table,omitempty"`
+	Schema   *record.Schema           `json:"schema,omitempty"`
+	Values   json.RawMessage          `json:"values,omitempty"`
+	Sequence string                   `json:"sequence,omitempty"`
+	Options  *catalog.SequenceOptions `json:"options,omitempty"`
+	// Last is the last value handed out by the sequence, if any
+	Last *int `json:"last,omitempty"`
+}
+
+// Dump writes the database as it is at the start of the dump. Writers are
+// not held up; what they change meanwhile is left out.
+func Dump(storage *layer.FileStorageLayer, w io.Writer) error {
+	snap, err := storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	tables := snap.ListTables()
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+
+	if err := encoder.Encode(entry{Kind: "header", Format: FormatName, Version: FormatVersion}); err != nil {
+		return err
+	}
+
+	schemas := make(map[string]record.Schema, len(tables))
+	for _, tableName := range tables {
+		schema, err := snap.GetSchema(tableName)
+		if err != nil {
+			return err
+		}
+		schemas[tableName] = schema
+	}
+
+	// Referenced tables come first so that restore can create them in order
+	tables = dependencyOrder(tables, schemas)
+
+	for _, tableName := range tables {
+		schema := schemas[tableName]
+		if err := encoder.Encode(entry{Kind: "table", Table: tableName, Schema: &schema}); err != nil {
+			return err
+		}
+	}
+
+	for _, tableName := range tables {
+		schema := schemas[tableName]
+
+		rows, err := snap.Scan(tableName)
+		if err != nil {
+			return fmt.Errorf("failed to scan table %s: %v", tableName, err)
+		}
+
+		for _, data := range rows {
+			values, err := record.Deserialize(schema, data)
+			if err != nil {
+				return fmt.Errorf("failed to deserialize row of table %s: %v", tableName, err)
+			}
+
+			rawRow, err := json.Marshal(encodeValues(values))
+			if err != nil {
+				return err
+			}
+
+			if err := encoder.Encode(entry{Kind: "row", Table: tableName, Values: rawRow}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Sequences come last so their values win over those advanced by the
+	// restored rows
+	for _, name := range snap.ListSequences() {
+		state, err := snap.GetSequence(name)
+		if err != nil {
+			return err
+		}
+
+		e := entry{Kind: "sequence", Sequence: name, Options: &state.Options}
+		if state.Called {
+			e.Last = &state.Last
+		}
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+// Restore loads a dump into a new storage directory, which must be empty
+// or not exist yet. The database is created with opts, so it is encrypted
+// if they have keys.
+func Restore(r io.Reader, path string, opts layer.Options) error {
+	fsys := opts.FileSystem
+	if fsys == nil {
+		fsys = vfs.OS{}
+	}
+	if names, err := fsys.List(path); err == nil && len(names) > 0 {
+		return fmt.Errorf("restore target %s is not empty", path)
+	}
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.OpenWithOptions(path, opts); err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	schemas := make(map[string]record.Schema)
+	sawHeader := false
+	var deferred []pendingRow
+
+	for line := 1; scanner.Scan(); line++ {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if !sawHeader {
+			if e.Kind != "header" || e.Format != FormatName {
+				return fmt.Errorf("line %d: not a %s file", line, FormatName)
+			}
+			if e.Version > FormatVersion {
+				return fmt.Errorf("unsupported dump version %d", e.Version)
+			}
+			sawHeader = true
+			continue
+		}
+
+		switch e.Kind {
+		case "table":
+			if e.Schema == nil {
+				return fmt.Errorf("line %d: table %s has no schema", line, e.Table)
+			}
+			if err := storage.CreateTable(e.Table, *e.Schema); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			schemas[e.Table] = *e.Schema
+
+		case "row":
+			schema, exists := schemas[e.Table]
+			if !exists {
+				return fmt.Errorf("line %d: row for unknown table %s", line, e.Table)
+			}
+
+			values, err := decodeValues(schema, e.Values)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+
+			data, err := record.Serialize(schema, values)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+
+			if _, err := storage.Insert(e.Table, data); err != nil {
+				// The referenced row may come later in the same table
+				var violation *layer.ConstraintViolation
+				if errors.As(err, &violation) && violation.Kind == layer.ConstraintForeignKey {
+					deferred = append(deferred, pendingRow{table: e.Table, data: data, line: line})
+					continue
+				}
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+
+		case "sequence":
+			if err := restoreSequence(storage, e); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+
+		default:
+			return fmt.Errorf("line %d: unknown entry kind %q", line, e.Kind)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !sawHeader {
+		return fmt.Errorf("dump is empty")
+	}
+
+	// Retry rows whose parents were not loaded yet until no more succeed
+	for len(deferred) > 0 {
+		var remaining []pendingRow
+		var lastErr error
+		for _, row := range deferred {
+			if _, err := storage.Insert(row.table, row.data); err != nil {
+				remaining = append(remaining, row)
+				lastErr = fmt.Errorf("line %d: %v", row.line, err)
+			}
+		}
+		if len(remaining) == len(deferred) {
+			return lastErr
+		}
+		deferred = remaining
+	}
+
+	return storage.Flush()
+}
+
+// restoreSequence creates a sequence unless it belongs to an AUTO_INCREMENT
+// column of a restored table, and sets its last value.
+func restoreSequence(storage *layer.FileStorageLayer, e entry) error {
+	if _, err := storage.GetSequence(e.Sequence); err != nil {
+		if e.Options == nil {
+			return fmt.Errorf("sequence %s has no options", e.Sequence)
+		}
+		if err := storage.CreateSequence(e.Sequence, *e.Options); err != nil {
+			return err
+		}
+	}
+
+	if e.Last == nil {
+		return nil
+	}
+	return storage.SetVal(e.Sequence, *e.Last)
+}
+
+type pendingRow struct {
+	table string
+	data  []byte
+	line  int
+}
+
+// dependencyOrder sorts tables so that every table comes after the tables
+// its foreign keys refer to.
+func dependencyOrder(tables []string, schemas map[string]record.Schema) []string {
+	ordered := make([]string, 0, len(tables))
+	visited := make(map[string]bool)
+
+	var visit func(tableName string)
+	visit = func(tableName string) {
+		if visited[tableName] {
+			return
+		}
+		visited[tableName] = true
+		for _, fk := range schemas[tableName].ForeignKeys {
+			if _, exists := schemas[fk.RefTable]; exists {
+				visit(fk.RefTable)
+			}
+		}
+		ordered = append(ordered, tableName)
+	}
+
+	for _, tableName := range tables {
+		visit(tableName)
+	}
+	return ordered
+}
+
+// JSON has no NaN or infinity, so those floats are written as strings.
+func encodeValues(values []interface{}) []interface{} {
+	encoded := make([]interface{}, len(values))
+	for i, value := range values {
+		if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			encoded[i] = fmt.Sprint(f)
+			continue
+		}
+		encoded[i] = value
+	}
+	return encoded
+}
+
+func decodeValues(schema record.Schema, raw json.RawMessage) ([]interface{}, error) {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if len(fields) != len(schema.Columns) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(schema.Columns), len(fields))
+	}
+
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		col := schema.Columns[i]
+
+		if string(field) == "null" {
+			continue
+		}
+
+		// Numbers are parsed from their literal text to avoid float rounding
+		text := string(field)
+		if len(field) > 0 && field[0] == '"' {
+			if err := json.Unmarshal(field, &text); err != nil {
+				return nil, err
+			}
+		}
+
+		value, err := record.ParseValue(col, text)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		values[i] = value
+	}
+
+	return values, nil
+}
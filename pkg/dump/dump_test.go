@@ -0,0 +1,258 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/layer"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "dump_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	targetDir := filepath.Join(tempDir, "target")
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+			{Name: "score", Type: record.TypeFloat, Nullable: true},
+		},
+	}
+	rows := [][]interface{}{
+		{1, "Alice", 0.1},
+		{-2, "Bob \"the builder\"\n", nil},
+		{3, "", math.Inf(-1)},
+	}
+
+	source := layer.NewFileStorageLayer()
+	if err := source.Open(sourceDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := source.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := source.CreateTable("empty", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for _, values := range rows {
+		data, err := record.Serialize(schema, values)
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		if _, err := source.Insert("users", data); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	opts := catalog.SequenceOptions{Start: 100, Increment: 10, Cache: 5}
+	if err := source.CreateSequence("tickets", opts); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := source.NextVal("tickets"); err != nil {
+			t.Fatalf("NextVal failed: %v", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := Dump(source, &archive); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	source.Close()
+
+	if err := Restore(bytes.NewReader(archive.Bytes()), targetDir, layer.DefaultOptions()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err := Restore(bytes.NewReader(archive.Bytes()), targetDir, layer.DefaultOptions()); err == nil {
+		t.Errorf("Expected restore into a non-empty directory to fail")
+	}
+
+	target := layer.NewFileStorageLayer()
+	if err := target.Open(targetDir); err != nil {
+		t.Fatalf("Failed to open restored storage: %v", err)
+	}
+	defer target.Close()
+
+	tables, err := target.ListTables()
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	if !reflect.DeepEqual(tables, []string{"empty", "users"}) {
+		t.Errorf("Unexpected restored tables: %v", tables)
+	}
+
+	restored, err := target.Scan("users", nil)
+	if err != nil {
+		t.Fatalf("Failed to scan restored table: %v", err)
+	}
+
+	var got [][]interface{}
+	for _, data := range restored {
+		values, err := record.Deserialize(schema, data)
+		if err != nil {
+			t.Fatalf("Failed to deserialize: %v", err)
+		}
+		got = append(got, values)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i][0].(int) < got[j][0].(int) })
+
+	want := [][]interface{}{rows[1], rows[0], rows[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored rows don't match: expected %v, got %v", want, got)
+	}
+
+	if next, err := target.NextVal("tickets"); err != nil || next != 120 {
+		t.Errorf("Expected the restored sequence to continue at 120, got %d (%v)", next, err)
+	}
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	schema := record.Schema{
+		Columns: []record.Column{{Name: "secret", Type: record.TypeString, Length: 50}},
+	}
+
+	source := layer.NewFileStorageLayer()
+	if err := source.OpenWithOptions("/source", layer.Options{FileSystem: fsys}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := source.CreateTable("secrets", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	data, _ := record.Serialize(schema, []interface{}{"swordfish"})
+	if _, err := source.Insert("secrets", data); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	var archive bytes.Buffer
+	if err := Dump(source, &archive); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	source.Close()
+
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	opts := layer.Options{FileSystem: fsys, Keys: keys}
+	if err := Restore(bytes.NewReader(archive.Bytes()), "/target", opts); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	plain := layer.NewFileStorageLayer()
+	if err := plain.OpenWithOptions("/target", layer.Options{FileSystem: fsys}); err == nil {
+		plain.Close()
+		t.Fatalf("Expected the restored database to need its keys")
+	}
+
+	target := layer.NewFileStorageLayer()
+	if err := target.OpenWithOptions("/target", opts); err != nil {
+		t.Fatalf("Failed to open restored storage: %v", err)
+	}
+	defer target.Close()
+	restored, err := target.Scan("secrets", nil)
+	if err != nil || len(restored) != 1 || !bytes.Equal(restored[0], data) {
+		t.Errorf("Expected the dumped row back, got %d rows (%v)", len(restored), err)
+	}
+}
+
+func TestDumpDuringWrites(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "dump_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyed := record.Schema{
+		Columns:    []record.Column{{Name: "id", Type: record.TypeInt}},
+		PrimaryKey: []string{"id"},
+	}
+	// Children refer to parents and to a table dumped between the two
+	childSchema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "parent_id", Type: record.TypeInt},
+			{Name: "middle_id", Type: record.TypeInt},
+		},
+		ForeignKeys: []record.ForeignKey{
+			{Columns: []string{"parent_id"}, RefTable: "parents", RefColumns: []string{"id"}},
+			{Columns: []string{"middle_id"}, RefTable: "middle", RefColumns: []string{"id"}},
+		},
+	}
+
+	source := layer.NewFileStorageLayer()
+	if err := source.OpenWithOptions("/db", layer.Options{FileSystem: vfs.NewMemFS()}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer source.Close()
+	for _, tableName := range []string{"parents", "middle"} {
+		if err := source.CreateTable(tableName, keyed); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	if err := source.CreateTable("children", childSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	data, _ := record.Serialize(keyed, []interface{}{0})
+	if _, err := source.Insert("middle", data); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	// Each parent is inserted with a child, while the dumps run
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			parent, _ := record.Serialize(keyed, []interface{}{i})
+			child, _ := record.Serialize(childSchema, []interface{}{i, i, 0})
+			if _, err := source.Insert("parents", parent); err != nil {
+				done <- err
+				return
+			}
+			if _, err := source.Insert("children", child); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	var archives []bytes.Buffer
+	for i := 0; i < 20; i++ {
+		var archive bytes.Buffer
+		if err := Dump(source, &archive); err != nil {
+			t.Fatalf("Dump failed: %v", err)
+		}
+		archives = append(archives, archive)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Writer failed: %v", err)
+	}
+
+	for i, archive := range archives {
+		targetDir := filepath.Join(tempDir, fmt.Sprintf("target%d", i))
+		if err := Restore(bytes.NewReader(archive.Bytes()), targetDir, layer.DefaultOptions()); err != nil {
+			t.Errorf("Dump %d cannot be restored: %v", i, err)
+		}
+	}
+}
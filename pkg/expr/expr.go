@@ -0,0 +1,430 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Expr is a compiled SQL-style expression over the columns of a row.
+//
+// Values are nil (NULL), int, float64, string or bool. NULL propagates
+// through operators and comparisons, and AND, OR and NOT follow three-valued
+// logic.
+type Expr interface {
+	Eval(row map[string]interface{}) (interface{}, error)
+	// Columns lists the column names the expression refers to
+	Columns() []string
+	String() string
+}
+
+type node interface {
+	eval(row map[string]interface{}) (interface{}, error)
+	columns(seen map[string]bool, names []string) []string
+}
+
+type compiled struct {
+	source string
+	root   node
+}
+
+func (c *compiled) Eval(row map[string]interface{}) (interface{}, error) {
+	return c.root.eval(row)
+}
+
+func (c *compiled) Columns() []string {
+	return c.root.columns(make(map[string]bool), nil)
+}
+
+func (c *compiled) String() string {
+	return c.source
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(row map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *literalNode) columns(seen map[string]bool, names []string) []string {
+	return names
+}
+
+type columnNode struct {
+	name string
+}
+
+func (n *columnNode) eval(row map[string]interface{}) (interface{}, error) {
+	value, exists := row[n.name]
+	if !exists {
+		return nil, fmt.Errorf("unknown column %s", n.name)
+	}
+	return value, nil
+}
+
+func (n *columnNode) columns(seen map[string]bool, names []string) []string {
+	if !seen[n.name] {
+		seen[n.name] = true
+		names = append(names, n.name)
+	}
+	return names
+}
+
+type arithmeticNode struct {
+	op          string
+	left, right node
+}
+
+func (n *arithmeticNode) eval(row map[string]interface{}) (interface{}, error) {
+	left, right, err := evalPair(n.left, n.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+
+	leftInt, leftIsInt := left.(int)
+	rightInt, rightIsInt := right.(int)
+	if leftIsInt && rightIsInt {
+		switch n.op {
+		case "+":
+			return leftInt + rightInt, nil
+		case "-":
+			return leftInt - rightInt, nil
+		case "*":
+			return leftInt * rightInt, nil
+		case "/", "%":
+			if rightInt == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if n.op == "/" {
+				return leftInt / rightInt, nil
+			}
+			return leftInt % rightInt, nil
+		}
+	}
+
+	leftFloat, ok := toFloat(left)
+	if !ok {
+		return nil, fmt.Errorf("operator %s needs numbers, got %T", n.op, left)
+	}
+	rightFloat, ok := toFloat(right)
+	if !ok {
+		return nil, fmt.Errorf("operator %s needs numbers, got %T", n.op, right)
+	}
+
+	switch n.op {
+	case "+":
+		return leftFloat + rightFloat, nil
+	case "-":
+		return leftFloat - rightFloat, nil
+	case "*":
+		return leftFloat * rightFloat, nil
+	case "/":
+		if rightFloat == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return leftFloat / rightFloat, nil
+	default:
+		if rightFloat == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(leftFloat, rightFloat), nil
+	}
+}
+
+func (n *arithmeticNode) columns(seen map[string]bool, names []string) []string {
+	return n.right.columns(seen, n.left.columns(seen, names))
+}
+
+type concatNode struct {
+	left, right node
+}
+
+func (n *concatNode) eval(row map[string]interface{}) (interface{}, error) {
+	left, right, err := evalPair(n.left, n.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+	return fmt.Sprint(left) + fmt.Sprint(right), nil
+}
+
+func (n *concatNode) columns(seen map[string]bool, names []string) []string {
+	return n.right.columns(seen, n.left.columns(seen, names))
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(row map[string]interface{}) (interface{}, error) {
+	left, right, err := evalPair(n.left, n.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+
+	cmp, err := compare(left, right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "=":
+		return cmp == 0, nil
+	case "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+func (n *compareNode) columns(seen map[string]bool, names []string) []string {
+	return n.right.columns(seen, n.left.columns(seen, names))
+}
+
+type isNullNode struct {
+	operand node
+	negate  bool
+}
+
+func (n *isNullNode) eval(row map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	return (value == nil) != n.negate, nil
+}
+
+func (n *isNullNode) columns(seen map[string]bool, names []string) []string {
+	return n.operand.columns(seen, names)
+}
+
+type logicalNode struct {
+	op          string
+	left, right node
+}
+
+func (n *logicalNode) eval(row map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, row)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalBool(n.right, row)
+	if err != nil {
+		return nil, err
+	}
+
+	// A decided operand wins over NULL: FALSE AND NULL is FALSE,
+	// TRUE OR NULL is TRUE
+	decisive := n.op == "OR"
+	if (left != nil && left.(bool) == decisive) || (right != nil && right.(bool) == decisive) {
+		return decisive, nil
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	return !decisive, nil
+}
+
+func (n *logicalNode) columns(seen map[string]bool, names []string) []string {
+	return n.right.columns(seen, n.left.columns(seen, names))
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(row map[string]interface{}) (interface{}, error) {
+	value, err := evalBool(n.operand, row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return !value.(bool), nil
+}
+
+func (n *notNode) columns(seen map[string]bool, names []string) []string {
+	return n.operand.columns(seen, names)
+}
+
+type function struct {
+	minArgs, maxArgs int
+	call             func(args []interface{}) (interface{}, error)
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(row map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	result, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return result, nil
+}
+
+func (n *callNode) columns(seen map[string]bool, names []string) []string {
+	for _, arg := range n.args {
+		names = arg.columns(seen, names)
+	}
+	return names
+}
+
+var functions = map[string]function{
+	"LENGTH": {1, 1, stringFunction(func(s string) interface{} { return len(s) })},
+	"UPPER":  {1, 1, stringFunction(func(s string) interface{} { return strings.ToUpper(s) })},
+	"LOWER":  {1, 1, stringFunction(func(s string) interface{} { return strings.ToLower(s) })},
+	"TRIM":   {1, 1, stringFunction(func(s string) interface{} { return strings.TrimSpace(s) })},
+	"ABS": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return nil, nil
+		case int:
+			if v < 0 {
+				return -v, nil
+			}
+			return v, nil
+		case float64:
+			return math.Abs(v), nil
+		}
+		return nil, fmt.Errorf("expected a number, got %T", args[0])
+	}},
+	"ROUND": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return nil, nil
+		case int:
+			return v, nil
+		case float64:
+			return math.Round(v), nil
+		}
+		return nil, fmt.Errorf("expected a number, got %T", args[0])
+	}},
+	"COALESCE": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+}
+
+func stringFunction(fn func(string) interface{}) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %T", args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+func evalPair(left, right node, row map[string]interface{}) (interface{}, interface{}, error) {
+	leftValue, err := left.eval(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	rightValue, err := right.eval(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leftValue, rightValue, nil
+}
+
+func evalBool(n node, row map[string]interface{}) (interface{}, error) {
+	value, err := n.eval(row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if _, ok := value.(bool); !ok {
+		return nil, fmt.Errorf("expected a boolean, got %T", value)
+	}
+	return value, nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func compare(left, right interface{}) (int, error) {
+	leftInt, leftIsInt := left.(int)
+	rightInt, rightIsInt := right.(int)
+	if leftIsInt && rightIsInt {
+		return compareInts(leftInt, rightInt), nil
+	}
+
+	if leftFloat, ok := toFloat(left); ok {
+		rightFloat, ok := toFloat(right)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", left, right)
+		}
+		return compareNumbers(leftFloat, rightFloat), nil
+	}
+
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), nil
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			if l == r {
+				return 0, nil
+			}
+			if !l {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("cannot compare %T with %T", left, right)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	row := map[string]interface{}{
+		"age":   30,
+		"price": 2.5,
+		"name":  "Alice",
+		"note":  nil,
+	}
+
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"7 / 2", 3},
+		{"7 % 4", 3},
+		{"-age + 1", -29},
+		{"price * 2", 5.0},
+		{"age >= 18 AND age < 65", true},
+		{"age = 30.0", true},
+		{"name <> 'Bob'", true},
+		{"name || '!'", "Alice!"},
+		{"'it''s'", "it's"},
+		{"LENGTH(name) > 0", true},
+		{"upper(name)", "ALICE"},
+		{"COALESCE(note, 'none')", "none"},
+		{"note IS NULL", true},
+		{"note IS NOT NULL", false},
+		{"note = 'x'", nil},
+		{"note = 'x' OR TRUE", true},
+		{"note = 'x' AND FALSE", false},
+		{"NOT note = 'x'", nil},
+		{"NOT (age > 40)", true},
+		{"ROUND(price)", 3.0},
+		{"ABS(-4)", 4},
+		{`"age" != 31`, true},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.source)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.source, err)
+			continue
+		}
+		got, err := e.Eval(row)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", tt.source, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %v (%T), want %v (%T)", tt.source, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	row := map[string]interface{}{"age": 30, "name": "Alice"}
+
+	for _, source := range []string{"age / 0", "age + name", "missing > 1", "name AND TRUE", "LENGTH(age)"} {
+		e, err := Parse(source)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", source, err)
+			continue
+		}
+		if _, err := e.Eval(row); err == nil {
+			t.Errorf("Expected Eval(%q) to fail", source)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{"", "1 +", "(1", "'open", "age IS 3", "NOPE(1)", "LENGTH()", "1 2", "a # b"} {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("Expected Parse(%q) to fail", source)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	e, err := Parse("price * qty + LENGTH(name) - price")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := []string{"price", "qty", "name"}
+	if got := e.Columns(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Columns() = %v, want %v", got, want)
+	}
+}
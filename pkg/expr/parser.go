@@ -0,0 +1,410 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Grammar, loosest binding first:
+//
+//	or         := and { OR and }
+//	and        := not { AND not }
+//	not        := NOT not | comparison
+//	comparison := concat [ ( = | <> | != | < | <= | > | >= ) concat | IS [NOT] NULL ]
+//	concat     := additive { || additive }
+//	additive   := term { ( + | - ) term }
+//	term       := unary { ( * | / | % ) unary }
+//	unary      := - unary | primary
+//	primary    := number | 'string' | NULL | TRUE | FALSE
+//	            | name | name ( [ or { , or } ] ) | ( or )
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse compiles the source of an expression.
+func Parse(source string) (Expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return &compiled{source: source, root: node}, nil
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+
+		case r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if runes[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, text: sb.String(), pos: start})
+
+		case r == '"':
+			start := i
+			end := strings.IndexRune(string(runes[i+1:]), '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at position %d", start)
+			}
+			name := []rune(string(runes[i+1:])[:end])
+			tokens = append(tokens, token{kind: tokenIdent, text: string(name), pos: start})
+			i += len(name) + 2
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+
+		default:
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "<=", ">=", "<>", "!=", "||":
+				tokens = append(tokens, token{kind: tokenOperator, text: two, pos: start})
+				i += 2
+				continue
+			}
+			if strings.ContainsRune("=<>+-*/%(),", r) {
+				tokens = append(tokens, token{kind: tokenOperator, text: string(r), pos: start})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *parser) isOperator(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokenOperator {
+		return false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expectOperator(op string) error {
+	if !p.isOperator(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d", op, tok.pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("IS") {
+		p.next()
+		negate := false
+		if p.isKeyword("NOT") {
+			p.next()
+			negate = true
+		}
+		if !p.isKeyword("NULL") {
+			return nil, fmt.Errorf("expected NULL after IS at position %d", p.peek().pos)
+		}
+		p.next()
+		return &isNullNode{operand: left, negate: negate}, nil
+	}
+
+	if p.isOperator("=", "<>", "!=", "<", "<=", ">", ">=") {
+		op := p.next().text
+		if op == "!=" {
+			op = "<>"
+		}
+		right, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseConcat() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("||") {
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = &concatNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("+", "-") {
+		op := p.next().text
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("*", "/", "%") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOperator("-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &arithmeticNode{op: "-", left: &literalNode{value: 0}, right: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenNumber:
+		if intVal, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return &literalNode{value: int(intVal)}, nil
+		}
+		floatVal, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return &literalNode{value: floatVal}, nil
+
+	case tokenString:
+		return &literalNode{value: tok.text}, nil
+
+	case tokenIdent:
+		switch strings.ToUpper(tok.text) {
+		case "NULL":
+			return &literalNode{value: nil}, nil
+		case "TRUE":
+			return &literalNode{value: true}, nil
+		case "FALSE":
+			return &literalNode{value: false}, nil
+		}
+
+		if !p.isOperator("(") {
+			return &columnNode{name: tok.text}, nil
+		}
+		p.next()
+
+		fn, exists := functions[strings.ToUpper(tok.text)]
+		if !exists {
+			return nil, fmt.Errorf("unknown function %s at position %d", tok.text, tok.pos)
+		}
+
+		var args []node
+		if !p.isOperator(")") {
+			for {
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if !p.isOperator(",") {
+					break
+				}
+				p.next()
+			}
+		}
+		if err := p.expectOperator(")"); err != nil {
+			return nil, err
+		}
+
+		if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+			return nil, fmt.Errorf("wrong number of arguments to %s", strings.ToUpper(tok.text))
+		}
+		return &callNode{name: strings.ToUpper(tok.text), fn: fn, args: args}, nil
+
+	case tokenOperator:
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOperator(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+
+	if tok.kind == tokenEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
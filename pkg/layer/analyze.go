@@ -0,0 +1,208 @@
+package layer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/record"
+	"time"
+)
+
+type AnalyzeOptions struct {
+	// SamplePages is the number of pages read; tables with fewer pages are
+	// read in full
+	SamplePages      int
+	HistogramBuckets int
+}
+
+func DefaultAnalyzeOptions() AnalyzeOptions {
+	return AnalyzeOptions{
+		SamplePages:      300,
+		HistogramBuckets: 10,
+	}
+}
+
+func (fsl *FileStorageLayer) Analyze(tableName string) (catalog.TableStatistics, error) {
+	return fsl.AnalyzeWithOptions(tableName, DefaultAnalyzeOptions())
+}
+
+// AnalyzeWithOptions samples the pages of a table, computes per-column
+// statistics and stores them in the catalog.
+func (fsl *FileStorageLayer) AnalyzeWithOptions(tableName string, opts AnalyzeOptions) (catalog.TableStatistics, error) {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	var stats catalog.TableStatistics
+
+	if !fsl.isOpen {
+		return stats, fmt.Errorf("storage layer is not open")
+	}
+
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return stats, err
+	}
+
+	pageCount := int(fsl.diskManager.GetPageCount(tableName))
+	pageIDs := samplePages(pageCount, opts.SamplePages)
+
+	var rows [][]interface{}
+	for _, pageID := range pageIDs {
+		f, err := fsl.getPage(tableName, int32(pageID))
+		if err != nil {
+			return stats, err
+		}
+
+		var records [][]byte
+		f.read(func(pg *page.Page) error {
+			for slotID := 0; slotID < pg.SlotCount(); slotID++ {
+				if data, err := pg.GetRecord(slotID); err == nil {
+					records = append(records, data)
+				}
+			}
+			return nil
+		})
+		f.release()
+
+		for _, data := range records {
+			values, err := record.Deserialize(schema, data)
+			if err != nil {
+				return stats, fmt.Errorf("failed to deserialize record on page %d: %v", pageID, err)
+			}
+			rows = append(rows, values)
+		}
+	}
+
+	stats = catalog.TableStatistics{
+		RowCount:     fsl.indexes[tableName].Count(),
+		PageCount:    pageCount,
+		SampledPages: len(pageIDs),
+		SampledRows:  len(rows),
+		AnalyzedAt:   time.Now().UTC(),
+	}
+
+	for i, col := range schema.Columns {
+		column := make([]interface{}, len(rows))
+		for j, values := range rows {
+			column[j] = values[i]
+		}
+		stats.Columns = append(stats.Columns, columnStatistics(col, column, stats.RowCount, opts.HistogramBuckets))
+	}
+
+	if err := fsl.catalog.SetStatistics(tableName, stats); err != nil {
+		return stats, fmt.Errorf("failed to store statistics: %v", err)
+	}
+
+	return stats, nil
+}
+
+func (fsl *FileStorageLayer) GetStatistics(tableName string) (catalog.TableStatistics, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return catalog.TableStatistics{}, fmt.Errorf("storage layer is not open")
+	}
+
+	stats, exists := fsl.catalog.GetStatistics(tableName)
+	if !exists {
+		return stats, fmt.Errorf("table %s has not been analyzed", tableName)
+	}
+	return stats, nil
+}
+
+// samplePages picks up to limit distinct page IDs, returned in physical order.
+func samplePages(pageCount, limit int) []int {
+	if limit <= 0 || pageCount <= limit {
+		pageIDs := make([]int, pageCount)
+		for i := range pageIDs {
+			pageIDs[i] = i
+		}
+		return pageIDs
+	}
+
+	pageIDs := rand.Perm(pageCount)[:limit]
+	sort.Ints(pageIDs)
+	return pageIDs
+}
+
+func columnStatistics(col record.Column, sample []interface{}, rowCount, buckets int) catalog.ColumnStatistics {
+	stats := catalog.ColumnStatistics{Name: col.Name}
+	if len(sample) == 0 {
+		return stats
+	}
+
+	var values []interface{}
+	nulls := 0
+	for _, value := range sample {
+		if value == nil {
+			nulls++
+			continue
+		}
+		// NaN and infinities have no JSON form and would break ordering
+		if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		values = append(values, value)
+	}
+	stats.NullFraction = float64(nulls) / float64(len(sample))
+
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.Slice(values, func(i, j int) bool { return record.Compare(values[i], values[j]) < 0 })
+	stats.Min = values[0]
+	stats.Max = values[len(values)-1]
+
+	// Count distinct values and how many were seen exactly once
+	distinct, singletons := 0, 0
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && record.Compare(values[i], values[j]) == 0 {
+			j++
+		}
+		distinct++
+		if j-i == 1 {
+			singletons++
+		}
+		i = j
+	}
+	stats.DistinctCount = estimateDistinct(len(values), distinct, singletons, len(sample), rowCount)
+
+	if buckets > 0 {
+		if buckets > len(values) {
+			buckets = len(values)
+		}
+		for b := 0; b <= buckets; b++ {
+			idx := b * (len(values) - 1) / buckets
+			stats.Histogram = append(stats.Histogram, values[idx])
+		}
+	}
+
+	return stats
+}
+
+// estimateDistinct scales the number of distinct values in the sample to
+// the whole table with the Haas-Stokes Duj1 estimator.
+func estimateDistinct(nonNull, distinct, singletons, sampleRows, rowCount int) float64 {
+	if sampleRows >= rowCount || nonNull == 0 {
+		return float64(distinct)
+	}
+
+	n := float64(nonNull)
+	// Scale the table size to the non-null part seen in the sample
+	total := float64(rowCount) * n / float64(sampleRows)
+
+	estimate := n * float64(distinct) / (n - float64(singletons) + float64(singletons)*n/total)
+	if estimate < float64(distinct) {
+		estimate = float64(distinct)
+	}
+	if estimate > total {
+		estimate = total
+	}
+	return math.Round(estimate)
+}
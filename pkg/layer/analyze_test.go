@@ -0,0 +1,91 @@
+package layer
+
+import (
+	"os"
+	"reflect"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "analyze_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "group", Type: record.TypeString, Length: 10, Nullable: false},
+			{Name: "score", Type: record.TypeFloat, Nullable: true},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	if err := storage.CreateTable("items", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	groups := []string{"a", "b", "c", "d"}
+	for i := 1; i <= 1000; i++ {
+		var score interface{}
+		if i%4 != 0 {
+			score = float64(i) / 10
+		}
+		data, err := record.Serialize(schema, []interface{}{i, groups[i%len(groups)], score})
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		if _, err := storage.Insert("items", data); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	stats, err := storage.AnalyzeWithOptions("items", AnalyzeOptions{SamplePages: 0, HistogramBuckets: 4})
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if stats.RowCount != 1000 || stats.SampledRows != 1000 {
+		t.Errorf("Expected 1000 rows, got %d (%d sampled)", stats.RowCount, stats.SampledRows)
+	}
+
+	id := stats.Columns[0]
+	if id.Min != 1 || id.Max != 1000 || id.DistinctCount != 1000 || id.NullFraction != 0 {
+		t.Errorf("Unexpected id statistics: %+v", id)
+	}
+	if len(id.Histogram) != 5 || id.Histogram[0] != 1 || id.Histogram[4] != 1000 {
+		t.Errorf("Unexpected id histogram: %v", id.Histogram)
+	}
+
+	if stats.Columns[1].DistinctCount != 4 {
+		t.Errorf("Expected 4 distinct groups, got %v", stats.Columns[1].DistinctCount)
+	}
+	if stats.Columns[2].NullFraction != 0.25 {
+		t.Errorf("Expected null fraction 0.25, got %v", stats.Columns[2].NullFraction)
+	}
+
+	// Statistics survive a restart with their original types
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	stored, err := reopened.GetStatistics("items")
+	if err != nil {
+		t.Fatalf("Failed to get statistics: %v", err)
+	}
+	if !reflect.DeepEqual(stored.Columns, stats.Columns) {
+		t.Errorf("Stored statistics differ: expected %+v, got %+v", stats.Columns, stored.Columns)
+	}
+}
@@ -0,0 +1,207 @@
+package layer
+
+import (
+	"fmt"
+	"path/filepath"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/vfs"
+)
+
+// Backup writes a consistent copy of the database to destDir while the
+// storage layer stays available. Dirty pages are flushed first, then the
+// table files are copied through a copy-on-write snapshot so that pages
+// flushed during the copy do not leak into the backup.
+func (fsl *FileStorageLayer) Backup(destDir string) error {
+	fsl.mutex.Lock()
+
+	if !fsl.isOpen {
+		fsl.mutex.Unlock()
+		return fmt.Errorf("storage layer is not open")
+	}
+
+	fsys := fsl.fs
+	if names, err := fsys.List(destDir); err == nil && len(names) > 0 {
+		fsl.mutex.Unlock()
+		return fmt.Errorf("backup target %s is not empty", destDir)
+	}
+	if err := fsys.MkdirAll(destDir); err != nil {
+		fsl.mutex.Unlock()
+		return err
+	}
+
+	if err := fsl.flush(); err != nil {
+		fsl.mutex.Unlock()
+		return fmt.Errorf("failed to checkpoint before backup: %v", err)
+	}
+
+	tables := fsl.catalog.ListTables()
+
+	catalogData, err := fsl.catalog.Encode()
+	if err != nil {
+		fsl.mutex.Unlock()
+		return err
+	}
+
+	indexData := make(map[string][]byte, len(tables))
+	recordCounts := make(map[string]int, len(tables))
+	compression := make(map[string]string, len(tables))
+	for _, tableName := range tables {
+		schema, err := fsl.catalog.GetSchema(tableName)
+		if err != nil {
+			fsl.mutex.Unlock()
+			return err
+		}
+		compression[tableName] = schema.Compression
+		data, err := fsl.indexes[tableName].Encode()
+		if err != nil {
+			fsl.mutex.Unlock()
+			return err
+		}
+		indexData[tableName] = data
+		recordCounts[tableName] = fsl.indexes[tableName].Count()
+	}
+
+	snap, err := fsl.diskManager.BeginSnapshot(tables)
+	fsl.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	for _, tableName := range tables {
+		if err := fsl.copyTable(snap, tableName, destDir, compression[tableName]); err != nil {
+			return fmt.Errorf("failed to copy table %s: %v", tableName, err)
+		}
+		if err := vfs.WriteFile(fsys, filepath.Join(destDir, bptree.IndexFileName(tableName)), indexData[tableName], true); err != nil {
+			return fmt.Errorf("failed to write index for table %s: %v", tableName, err)
+		}
+	}
+
+	if err := vfs.WriteFile(fsys, filepath.Join(destDir, catalog.MetaFileName), catalogData, true); err != nil {
+		return fmt.Errorf("failed to write catalog: %v", err)
+	}
+
+	if err := fsys.SyncDir(destDir); err != nil {
+		return err
+	}
+
+	return verifyBackup(fsys, destDir, fsl.keys, recordCounts)
+}
+
+// backupBatchPages is how many pages copyTable writes at a time.
+const backupBatchPages = 256
+
+// copyTable writes the pages of a table through a disk manager of its own,
+// so the copy has the compression and encryption of the original.
+func (fsl *FileStorageLayer) copyTable(snap *disk.Snapshot, tableName, destDir, compression string) error {
+	dest := disk.NewDiskManagerFS(destDir, fsl.fs)
+	if err := dest.SetCompression(tableName, compression); err != nil {
+		return err
+	}
+	dest.SetCipher(fsl.cipher)
+	// The copy is synced once, when it is complete
+	dest.SetDurability(disk.Durability{Policy: disk.SyncPerFlush})
+	if err := dest.Open(); err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	// The file exists even for an empty table
+	if _, err := dest.AllocatePages(tableName, 0); err != nil {
+		return err
+	}
+
+	var pages []disk.PageWrite
+	for pageID := int32(0); pageID < snap.PageCount(tableName); pageID++ {
+		data, err := snap.ReadPage(tableName, pageID)
+		if err != nil {
+			return err
+		}
+		pages = append(pages, disk.PageWrite{PageID: pageID, Data: data})
+
+		if len(pages) == backupBatchPages || pageID == snap.PageCount(tableName)-1 {
+			if err := dest.WriteBatch(tableName, pages); err != nil {
+				return err
+			}
+			pages = pages[:0]
+		}
+	}
+	return dest.Sync()
+}
+
+// verifyBackup checks that the catalog of the copy loads and that every
+// indexed record can be read back. The copy is read directly rather than
+// opened as a database, which would rebuild its system tables and flush it
+// on Close, so verification writes nothing.
+func verifyBackup(fsys vfs.FileSystem, destDir string, keys crypt.KeyProvider, recordCounts map[string]int) error {
+	c := crypt.NewCipher(keys)
+	cm := catalog.NewCatalogManagerFS(destDir, fsys)
+	cm.SetCipher(c)
+	if err := cm.Load(); err != nil {
+		return fmt.Errorf("backup verification failed: %v", err)
+	}
+
+	dm := disk.NewDiskManagerFS(destDir, fsys)
+	dm.SetCipher(c)
+	defer dm.Close()
+
+	tables := cm.ListTables()
+	if len(tables) != len(recordCounts) {
+		return fmt.Errorf("backup verification failed: expected %d tables, found %d", len(recordCounts), len(tables))
+	}
+
+	for _, tableName := range tables {
+		expected, exists := recordCounts[tableName]
+		if !exists {
+			return fmt.Errorf("backup verification failed: unexpected table %s", tableName)
+		}
+
+		schema, err := cm.GetSchema(tableName)
+		if err != nil {
+			return fmt.Errorf("backup verification failed: %v", err)
+		}
+		if err := dm.SetCompression(tableName, schema.Compression); err != nil {
+			return fmt.Errorf("backup verification failed: table %s: %v", tableName, err)
+		}
+
+		index := bptree.NewSimpleIndexFS(tableName, destDir, fsys)
+		index.SetCipher(c)
+		if err := index.Load(); err != nil {
+			return fmt.Errorf("backup verification failed: table %s: %v", tableName, err)
+		}
+		if index.Count() != expected {
+			return fmt.Errorf("backup verification failed: table %s has %d records, expected %d", tableName, index.Count(), expected)
+		}
+
+		if err := verifyRecords(dm, tableName, index.GetAllRecords()); err != nil {
+			return fmt.Errorf("backup verification failed: table %s %v", tableName, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyRecords reads records in physical order, loading each page once.
+func verifyRecords(dm *disk.DiskManager, tableName string, records map[int]bptree.RecordID) error {
+	var pg *page.Page
+	for _, recordID := range physicalOrder(records) {
+		rid := records[recordID]
+		if pg == nil || pg.PageID != rid.PageID {
+			data, err := dm.ReadPage(tableName, rid.PageID)
+			if err != nil {
+				return fmt.Errorf("record %d: %v", recordID, err)
+			}
+			if pg = page.LoadPage(rid.PageID, data); pg == nil {
+				return fmt.Errorf("record %d: failed to load page %d", recordID, rid.PageID)
+			}
+		}
+		if _, err := pg.GetRecord(rid.SlotID); err != nil {
+			return fmt.Errorf("record %d: %v", recordID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "backup_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(sourceDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	var recordIDs []int
+	for i := 0; i < 500; i++ {
+		data, err := record.Serialize(schema, []interface{}{i, "user"})
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		id, err := storage.Insert("users", data)
+		if err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+		recordIDs = append(recordIDs, id)
+	}
+
+	if err := storage.Backup(backupDir); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Changes after the backup must not show up in it
+	if err := storage.DeleteRecord("users", recordIDs[0]); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	if err := storage.Backup(backupDir); err == nil {
+		t.Errorf("Expected backup into a non-empty directory to fail")
+	}
+
+	restored := NewFileStorageLayer()
+	if err := restored.Open(backupDir); err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer restored.Close()
+
+	rows, err := restored.Scan("users", nil)
+	if err != nil {
+		t.Fatalf("Failed to scan backup: %v", err)
+	}
+	if len(rows) != len(recordIDs) {
+		t.Errorf("Expected %d rows in backup, got %d", len(recordIDs), len(rows))
+	}
+
+	if _, err := restored.Get("users", recordIDs[0]); err != nil {
+		t.Errorf("Record deleted after the backup is missing from it: %v", err)
+	}
+}
+
+func TestBackupVerificationReadOnly(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	name := string(make([]byte, 200))
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", Options{FileSystem: fsys}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, name})
+		if _, err := storage.Insert("users", data); err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+	}
+	if err := storage.Backup("/backup"); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	files := func() map[string]string {
+		names, err := fsys.List("/backup")
+		if err != nil {
+			t.Fatalf("Failed to list backup: %v", err)
+		}
+		contents := make(map[string]string)
+		for _, name := range names {
+			data, _ := vfs.ReadFile(fsys, filepath.Join("/backup", name))
+			contents[name] = string(data)
+		}
+		return contents
+	}
+
+	before := files()
+	counts := map[string]int{"users": 200}
+	if err := verifyBackup(fsys, "/backup", nil, counts); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	if !reflect.DeepEqual(files(), before) {
+		t.Errorf("Expected verification to leave the backup as it was")
+	}
+
+	// A page missing from the copy is noticed
+	file, _ := fsys.OpenFile("/backup/"+disk.TableFileName("users"), 0)
+	file.Truncate(disk.PageSize)
+	file.Close()
+	if err := verifyBackup(fsys, "/backup", nil, counts); err == nil {
+		t.Errorf("Expected verification of a truncated table to fail")
+	}
+}
@@ -0,0 +1,297 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+var bulkSchema = record.Schema{
+	Columns: []record.Column{
+		{Name: "id", Type: record.TypeInt, Nullable: false},
+		{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+	},
+}
+
+func makeRecords(t testing.TB, schema record.Schema, from, count int) [][]byte {
+	records := make([][]byte, count)
+	for i := range records {
+		data, err := record.Serialize(schema, []interface{}{from + i, fmt.Sprintf("user-%d", from+i)})
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		records[i] = data
+	}
+	return records
+}
+
+func openBulkStorage(t testing.TB, schema record.Schema) (*FileStorageLayer, string) {
+	tempDir, err := os.MkdirTemp("", "bulk_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	return storage, tempDir
+}
+
+func TestInsertBatch(t *testing.T) {
+	schema := bulkSchema
+	schema.PrimaryKey = []string{"id"}
+
+	storage, tempDir := openBulkStorage(t, schema)
+	defer os.RemoveAll(tempDir)
+	defer storage.Close()
+
+	ids, err := storage.InsertBatch("users", makeRecords(t, schema, 1, 500))
+	if err != nil {
+		t.Fatalf("InsertBatch failed: %v", err)
+	}
+	if len(ids) != 500 {
+		t.Fatalf("Expected 500 IDs, got %d", len(ids))
+	}
+
+	data, err := storage.Get("users", ids[499])
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if values, _ := record.Deserialize(schema, data); values[0] != 500 {
+		t.Errorf("Expected id 500, got %v", values)
+	}
+
+	// A duplicate key in the middle of a batch leaves the table unchanged
+	batch := makeRecords(t, schema, 501, 10)
+	batch = append(batch, makeRecords(t, schema, 42, 1)...)
+	var violation *ConstraintViolation
+	if _, err := storage.InsertBatch("users", batch); !errors.As(err, &violation) {
+		t.Fatalf("Expected a primary key violation, got %v", err)
+	}
+
+	rows, _ := storage.Scan("users", nil)
+	if len(rows) != 500 {
+		t.Errorf("Expected the failed batch to be rolled back, got %d rows", len(rows))
+	}
+	if _, _, err := storage.GetByPrimaryKey("users", 501); err == nil {
+		t.Errorf("Expected key 501 to be rolled back")
+	}
+	if _, err := storage.InsertBatch("users", makeRecords(t, schema, 501, 10)); err != nil {
+		t.Errorf("Expected the batch to succeed without the duplicate: %v", err)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	storage, tempDir := openBulkStorage(t, bulkSchema)
+	defer os.RemoveAll(tempDir)
+
+	if _, err := storage.BulkLoad("users", makeRecords(t, bulkSchema, 1, 10), BulkLoadOptions{FillFactor: 0}); err == nil {
+		t.Errorf("Expected a zero fill factor to be rejected")
+	}
+
+	existing, err := storage.Insert("users", makeRecords(t, bulkSchema, 0, 1)[0])
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	records := makeRecords(t, bulkSchema, 1, 2000)
+	ids, err := storage.BulkLoad("users", records, BulkLoadOptions{FillFactor: 0.5})
+	if err != nil {
+		t.Fatalf("BulkLoad failed: %v", err)
+	}
+	if len(ids) != 2000 || ids[0] != existing+1 || ids[1999] != existing+2000 {
+		t.Fatalf("Unexpected IDs: first %d, last %d", ids[0], ids[len(ids)-1])
+	}
+
+	// Pages are half full
+	results, _ := storage.ScanRecords("users", nil)
+	perPage := make(map[int32]int)
+	for _, result := range results[1:] {
+		perPage[result.RID.PageID] += len(result.Data) + page.SlotEntrySize
+	}
+	for pageID, used := range perPage {
+		if used > (page.PageSize-page.PageHeaderSize)/2 {
+			t.Errorf("Page %d holds %d bytes, more than the fill factor allows", pageID, used)
+		}
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	storage = NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	rows, err := storage.Scan("users", nil)
+	if err != nil || len(rows) != 2001 {
+		t.Fatalf("Expected 2001 rows after reopen, got %d (%v)", len(rows), err)
+	}
+	data, err := storage.Get("users", ids[1234])
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if values, _ := record.Deserialize(bulkSchema, data); values[0] != 1235 {
+		t.Errorf("Expected id 1235, got %v", values)
+	}
+}
+
+func TestBulkLoadChecksConstraints(t *testing.T) {
+	schema := bulkSchema
+	schema.PrimaryKey = []string{"id"}
+
+	storage, tempDir := openBulkStorage(t, schema)
+	defer os.RemoveAll(tempDir)
+	defer storage.Close()
+
+	records := makeRecords(t, schema, 1, 100)
+	records = append(records, records[10])
+
+	var violation *ConstraintViolation
+	if _, err := storage.BulkLoad("users", records, DefaultBulkLoadOptions()); !errors.As(err, &violation) {
+		t.Fatalf("Expected a duplicate key within the batch to be rejected, got %v", err)
+	}
+
+	if _, err := storage.BulkLoad("users", records[:100], DefaultBulkLoadOptions()); err != nil {
+		t.Fatalf("BulkLoad failed: %v", err)
+	}
+	if _, _, err := storage.GetByPrimaryKey("users", 77); err != nil {
+		t.Errorf("Expected key 77 to be indexed: %v", err)
+	}
+}
+
+func TestBulkLoadWriteFailure(t *testing.T) {
+	for _, compression := range []string{"", "flate"} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			fsys := vfs.NewFaultFS(1)
+			opts := Options{FileSystem: fsys}
+			schema := bulkSchema
+			schema.PrimaryKey = []string{"id"}
+			schema.Compression = compression
+
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions("/db", opts); err != nil {
+				t.Fatalf("Failed to open storage: %v", err)
+			}
+			if err := storage.CreateTable("users", schema); err != nil {
+				t.Fatalf("Failed to create table: %v", err)
+			}
+			if _, err := storage.InsertBatch("users", makeRecords(t, schema, 0, 100)); err != nil {
+				t.Fatalf("InsertBatch failed: %v", err)
+			}
+			if err := storage.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+
+			tablePath := "/db/" + disk.TableFileName("users")
+			size := func() int64 {
+				file, err := fsys.OpenFile(tablePath, 0)
+				if err != nil {
+					t.Fatalf("Failed to open table file: %v", err)
+				}
+				defer file.Close()
+				size, _ := file.Size()
+				return size
+			}
+			pageCount, fileSize := storage.diskManager.GetPageCount("users"), size()
+
+			// The first write of pages succeeds and the second fails
+			records := makeRecords(t, schema, 100, 60000)
+			fsys.InjectFault(vfs.Fault{Op: vfs.OpWrite, Path: disk.TableFileName("users"), After: 1, Err: errors.New("disk full")})
+			if _, err := storage.BulkLoad("users", records, DefaultBulkLoadOptions()); err == nil {
+				t.Fatalf("Expected BulkLoad to fail")
+			}
+			if got := storage.diskManager.GetPageCount("users"); got != pageCount {
+				t.Errorf("Expected the page count to go back to %d, got %d", pageCount, got)
+			}
+			if got := size(); got != fileSize {
+				t.Errorf("Expected the table file to go back to %d bytes, got %d", fileSize, got)
+			}
+
+			// The keys were released with the pages
+			if _, err := storage.BulkLoad("users", records[:1000], DefaultBulkLoadOptions()); err != nil {
+				t.Fatalf("BulkLoad after the failure failed: %v", err)
+			}
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Failed to close storage: %v", err)
+			}
+
+			reopened := NewFileStorageLayer()
+			if err := reopened.OpenWithOptions("/db", opts); err != nil {
+				t.Fatalf("Failed to reopen storage: %v", err)
+			}
+			defer reopened.Close()
+			rows, err := reopened.Scan("users", nil)
+			if err != nil || len(rows) != 1100 {
+				t.Errorf("Expected 1100 rows after reopen, got %d (%v)", len(rows), err)
+			}
+			if _, _, err := reopened.GetByPrimaryKey("users", 1099); err != nil {
+				t.Errorf("Expected key 1099 to be indexed: %v", err)
+			}
+			if _, _, err := reopened.GetByPrimaryKey("users", 1100); err == nil {
+				t.Errorf("Expected key 1100 of the failed load to be absent")
+			}
+		})
+	}
+}
+
+// The benchmarks load a table and close it, so the time includes writing
+// everything to disk.
+const benchmarkRows = 100000
+
+func benchmarkLoad(b *testing.B, load func(storage *FileStorageLayer, records [][]byte) error) {
+	records := makeRecords(b, bulkSchema, 0, benchmarkRows)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		storage, tempDir := openBulkStorage(b, bulkSchema)
+		b.StartTimer()
+
+		if err := load(storage, records); err != nil {
+			b.Fatalf("Load failed: %v", err)
+		}
+		if err := storage.Close(); err != nil {
+			b.Fatalf("Close failed: %v", err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(tempDir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	benchmarkLoad(b, func(storage *FileStorageLayer, records [][]byte) error {
+		for _, data := range records {
+			if _, err := storage.Insert("users", data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	benchmarkLoad(b, func(storage *FileStorageLayer, records [][]byte) error {
+		_, err := storage.InsertBatch("users", records)
+		return err
+	})
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	benchmarkLoad(b, func(storage *FileStorageLayer, records [][]byte) error {
+		_, err := storage.BulkLoad("users", records, DefaultBulkLoadOptions())
+		return err
+	})
+}
@@ -0,0 +1,261 @@
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/page"
+	"sync"
+	"time"
+)
+
+// checkpointer flushes in the background, so that a crash loses at most
+// the writes of one interval and no single flush grows large. A checkpoint
+// first writes the dirty pages in batches under the shared lock, while
+// reads and writes go on, and then flushes with fsl.mutex held exclusively
+// for what is left: the catalog, the indexes that changed and the pages
+// dirtied meanwhile. Pages and indexes only match as of a flush, so the
+// pages written ahead are journaled in the checkpoint journal to be rolled
+// back if the flush never happens. Both journals are truncated at the end
+// of every flush; there is no other log to trim.
+type checkpointer struct {
+	interval time.Duration
+	// full is signalled when the dirty pages reach the threshold or fill
+	// the page cache
+	full     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mutex sync.Mutex
+	stats CheckpointStats
+}
+
+const checkpointRetryDelay = time.Second
+
+// checkpointBatchPages is how many pages a checkpoint writes at a time.
+const checkpointBatchPages = 256
+
+type CheckpointStats struct {
+	Checkpoints int
+	LastAt      time.Time
+	// LastError is the error of the latest checkpoint, nil if it succeeded
+	LastError error
+}
+
+// startCheckpointer runs the checkpointer if the options ask for one. It is
+// called with fsl.mutex held at the end of Open.
+func (fsl *FileStorageLayer) startCheckpointer(opts Options) {
+	fsl.pages.full = nil
+	if opts.CheckpointInterval <= 0 && opts.DirtyPageThreshold <= 0 {
+		return
+	}
+
+	cp := &checkpointer{
+		interval: opts.CheckpointInterval,
+		full:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	fsl.pages.dirtyThreshold = int64(opts.DirtyPageThreshold)
+	fsl.pages.full = cp.full
+
+	fsl.checkpointer = cp
+	go fsl.runCheckpointer(cp)
+}
+
+func (fsl *FileStorageLayer) runCheckpointer(cp *checkpointer) {
+	defer close(cp.done)
+
+	var tick <-chan time.Time
+	if cp.interval > 0 {
+		ticker := time.NewTicker(cp.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case <-tick:
+		case <-cp.full:
+		}
+
+		if err := fsl.checkpoint(cp); err != nil {
+			// Pages stay dirty after a failed flush, so wait before
+			// retrying rather than flushing on every write
+			select {
+			case <-cp.stop:
+				return
+			case <-time.After(checkpointRetryDelay):
+			}
+		}
+	}
+}
+
+func (fsl *FileStorageLayer) checkpoint(cp *checkpointer) error {
+	fsl.mutex.RLock()
+	idle := !fsl.isOpen || (fsl.pages.dirtyPages() == 0 && !fsl.bulkWritten.Load())
+	fsl.mutex.RUnlock()
+	if idle {
+		return nil
+	}
+
+	err := fsl.writeDirtyPages()
+	if err == nil {
+		fsl.mutex.Lock()
+		if fsl.isOpen {
+			err = fsl.flush()
+		}
+		fsl.mutex.Unlock()
+	}
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	cp.stats.Checkpoints++
+	cp.stats.LastAt = time.Now()
+	cp.stats.LastError = err
+	return err
+}
+
+// writeDirtyPages writes the pages that are dirty now, a batch at a time,
+// ahead of a flush. Pages dirtied meanwhile are left to the flush.
+func (fsl *FileStorageLayer) writeDirtyPages() error {
+	fsl.mutex.RLock()
+	tables := make([]string, 0, len(fsl.indexes))
+	for tableName := range fsl.indexes {
+		tables = append(tables, tableName)
+	}
+	fsl.mutex.RUnlock()
+	sort.Strings(tables)
+
+	var frames []*frame
+	for _, tableName := range tables {
+		frames = append(frames, fsl.pages.dirtyFrames(tableName)...)
+	}
+
+	var err error
+	for start := 0; start < len(frames); start += checkpointBatchPages {
+		batch := frames[start:min(start+checkpointBatchPages, len(frames))]
+		if err == nil {
+			err = fsl.writePageBatch(batch)
+		}
+		for _, f := range batch {
+			f.release()
+		}
+	}
+	return err
+}
+
+// writePageBatch journals the old contents of a batch of pages and writes
+// the new ones, holding fsl.mutex shared so that no flush runs in between.
+// A page is marked clean only if it did not change while it was written.
+func (fsl *FileStorageLayer) writePageBatch(frames []*frame) error {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	// A replay of the failed flush's journal would undo the pages, so they
+	// wait for a flush that succeeds
+	if !fsl.isOpen || fsl.journalPending {
+		return nil
+	}
+
+	var written []*frame
+	var data [][]byte
+	for _, f := range frames {
+		// Dropped with its table
+		if !fsl.pages.cached(f) {
+			continue
+		}
+		f.read(func(pg *page.Page) error {
+			if pg.IsDirty() {
+				written = append(written, f)
+				data = append(data, append([]byte(nil), pg.GetData()...))
+			}
+			return nil
+		})
+	}
+
+	// Without syncs nothing survives a crash in a known state, as for a
+	// flush
+	if fsl.durability != disk.SyncNone {
+		entries := make([]journalEntry, len(written))
+		for i, f := range written {
+			entries[i] = journalEntry{name: disk.TableFileName(f.tableName), offset: int64(f.pageID) * disk.PageSize}
+
+			old, err := fsl.diskManager.ReadPage(f.tableName, f.pageID)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("failed to read page %d of table %s: %v", f.pageID, f.tableName, err)
+			}
+			entries[i].data = old
+		}
+		if err := fsl.appendCheckpointJournal(entries); err != nil {
+			return fmt.Errorf("failed to write checkpoint journal: %v", err)
+		}
+	}
+
+	var tables []string
+	batches := make(map[string][]disk.PageWrite)
+	for i, f := range written {
+		if _, exists := batches[f.tableName]; !exists {
+			tables = append(tables, f.tableName)
+		}
+		batches[f.tableName] = append(batches[f.tableName], disk.PageWrite{PageID: f.pageID, Data: data[i]})
+	}
+	for _, tableName := range tables {
+		if err := fsl.diskManager.WriteBatch(tableName, batches[tableName]); err != nil {
+			return fmt.Errorf("failed to write pages for table %s: %v", tableName, err)
+		}
+	}
+	// A flush clears the checkpoint journal once its own journal is
+	// written, so the pages must be durable by then
+	if err := fsl.diskManager.Sync(); err != nil {
+		return err
+	}
+
+	for i, f := range written {
+		f.write(func(pg *page.Page) error {
+			if pg.IsDirty() && bytes.Equal(pg.GetData(), data[i]) {
+				pg.SetClean()
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// stopCheckpointer waits for a running checkpoint to finish and stops the
+// checkpointer. It must be called without fsl.mutex held.
+func (fsl *FileStorageLayer) stopCheckpointer() {
+	fsl.mutex.RLock()
+	cp := fsl.checkpointer
+	fsl.mutex.RUnlock()
+
+	if cp == nil {
+		return
+	}
+	cp.stopOnce.Do(func() { close(cp.stop) })
+	<-cp.done
+}
+
+// CheckpointStats reports on the background checkpoints since the storage
+// layer was opened.
+func (fsl *FileStorageLayer) CheckpointStats() CheckpointStats {
+	fsl.mutex.RLock()
+	cp := fsl.checkpointer
+	fsl.mutex.RUnlock()
+
+	if cp == nil {
+		return CheckpointStats{}
+	}
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	return cp.stats
+}
@@ -0,0 +1,333 @@
+package layer
+
+import (
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var checkpointSchema = record.Schema{
+	Columns: []record.Column{
+		{Name: "id", Type: record.TypeInt},
+		{Name: "name", Type: record.TypeString, Length: 200},
+	},
+}
+
+func insertCheckpointRecords(t *testing.T, storage *FileStorageLayer, from, to int) {
+	name := string(make([]byte, 200))
+	for i := from; i < to; i++ {
+		data, _ := record.Serialize(checkpointSchema, []interface{}{i, name})
+		if _, err := storage.Insert("t", data); err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+	}
+}
+
+// waitFor polls until cond holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestCheckpointSurvivesCrash(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"threshold", Options{DirtyPageThreshold: 10}},
+		{"interval", Options{CheckpointInterval: 10 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := vfs.NewFaultFS(1)
+			opts := tt.opts
+			opts.FileSystem = fsys
+
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions(crashDir, opts); err != nil {
+				t.Fatalf("Failed to open storage: %v", err)
+			}
+			if err := storage.CreateTable("t", checkpointSchema); err != nil {
+				t.Fatalf("Failed to create table: %v", err)
+			}
+
+			// Over ten pages of records, and no explicit flush
+			insertCheckpointRecords(t, storage, 0, 300)
+			waitFor(t, "a checkpoint", func() bool {
+				return storage.CheckpointStats().Checkpoints > 0
+			})
+
+			// Below the threshold the last pages wait for the next
+			// interval, which the threshold test does not have
+			if tt.name == "interval" {
+				waitFor(t, "all pages to be written", func() bool {
+					return storage.pages.dirtyPages() == 0
+				})
+			}
+			storage.stopCheckpointer()
+			if err := storage.CheckpointStats().LastError; err != nil {
+				t.Fatalf("Checkpoint failed: %v", err)
+			}
+
+			fsys.Restart(false)
+
+			recovered := NewFileStorageLayer()
+			if err := recovered.OpenWithOptions(crashDir, Options{FileSystem: fsys}); err != nil {
+				t.Fatalf("Failed to reopen storage: %v", err)
+			}
+			defer recovered.Close()
+
+			records, err := recovered.Scan("t", nil)
+			if err != nil {
+				t.Fatalf("Failed to scan: %v", err)
+			}
+			if tt.name == "interval" && len(records) != 300 {
+				t.Errorf("Expected all 300 records after the crash, got %d", len(records))
+			}
+			if len(records) == 0 {
+				t.Errorf("Expected the checkpointed records after the crash")
+			}
+		})
+	}
+}
+
+func TestCheckpointerClose(t *testing.T) {
+	opts := Options{
+		FileSystem:         vfs.NewMemFS(),
+		CheckpointInterval: time.Millisecond,
+		DirtyPageThreshold: 1,
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("t", checkpointSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Writes keep going while checkpoints run
+	insertCheckpointRecords(t, storage, 0, 200)
+	cp := storage.checkpointer
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+	select {
+	case <-cp.done:
+	default:
+		t.Errorf("Expected the checkpointer to have stopped")
+	}
+	if err := storage.Close(); err != nil {
+		t.Errorf("Expected a second Close to succeed, got %v", err)
+	}
+	if storage.pages.dirtyPages() != 0 {
+		t.Errorf("Expected no dirty pages after Close, got %d", storage.pages.dirtyPages())
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	records, err := reopened.Scan("t", nil)
+	if err != nil || len(records) != 200 {
+		t.Errorf("Scanned %d records (%v), want 200", len(records), err)
+	}
+}
+
+func TestCheckpointerDefaults(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FileSystem = vfs.NewMemFS()
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if storage.checkpointer == nil {
+		t.Errorf("Expected a checkpointer with the default options")
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	opts.CheckpointInterval = 0
+	opts.DirtyPageThreshold = 0
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.CreateTable("t", checkpointSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	insertCheckpointRecords(t, storage, 0, 200)
+
+	if storage.checkpointer != nil {
+		t.Errorf("Expected no checkpointer with both settings zero")
+	}
+	if storage.pages.dirtyPages() == 0 {
+		t.Errorf("Expected the records to stay dirty until a flush")
+	}
+}
+
+// gatedFS holds up writes to table files while hold is set, until gate is
+// closed.
+type gatedFS struct {
+	vfs.FileSystem
+	hold    atomic.Bool
+	gate    chan struct{}
+	blocked chan struct{}
+}
+
+type gatedFile struct {
+	vfs.File
+	fsys  *gatedFS
+	table bool
+}
+
+func (g *gatedFS) OpenFile(name string, flag int) (vfs.File, error) {
+	file, err := g.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return gatedFile{file, g, strings.HasSuffix(name, ".tbl")}, nil
+}
+
+func (f gatedFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.table && f.fsys.hold.Load() {
+		select {
+		case f.fsys.blocked <- struct{}{}:
+		default:
+		}
+		<-f.fsys.gate
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestCheckpointWritesPagesAhead(t *testing.T) {
+	fsys := &gatedFS{FileSystem: vfs.NewMemFS(), gate: make(chan struct{}), blocked: make(chan struct{}, 1)}
+	opts := Options{FileSystem: fsys}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("t", checkpointSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	insertCheckpointRecords(t, storage, 0, 300)
+	dirty := storage.pages.dirtyPages()
+
+	fsys.hold.Store(true)
+	done := make(chan error, 1)
+	go func() { done <- storage.writeDirtyPages() }()
+	select {
+	case <-fsys.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the pages to be written")
+	}
+
+	// Records are read and updated while the pages are being written
+	name := string(make([]byte, 200))
+	for id := 1; id <= 10; id++ {
+		if _, err := storage.Get("t", id); err != nil {
+			t.Fatalf("Failed to get record %d: %v", id, err)
+		}
+		data, _ := record.Serialize(checkpointSchema, []interface{}{-id, name})
+		if err := storage.Update("t", id, data); err != nil {
+			t.Fatalf("Failed to update record %d: %v", id, err)
+		}
+	}
+
+	fsys.hold.Store(false)
+	close(fsys.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to write pages: %v", err)
+	}
+
+	// The page updated meanwhile is left to the flush
+	if got := storage.pages.dirtyPages(); got != 1 {
+		t.Errorf("Expected 1 of %d pages to stay dirty, got %d", dirty, got)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	data, err := reopened.Get("t", 1)
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	values, _ := record.Deserialize(checkpointSchema, data)
+	if values[0] != -1 {
+		t.Errorf("Expected the update made during the checkpoint, got %v", values[0])
+	}
+	records, err := reopened.Scan("t", nil)
+	if err != nil || len(records) != 300 {
+		t.Errorf("Scanned %d records (%v), want 300", len(records), err)
+	}
+}
+
+func TestCheckpointRollsBackPages(t *testing.T) {
+	fsys := vfs.NewFaultFS(1)
+	opts := Options{FileSystem: fsys}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(crashDir, opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("t", checkpointSchema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	insertCheckpointRecords(t, storage, 0, 300)
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// The index files still hold the deleted records, and know nothing of
+	// the new pages
+	for id := 1; id <= 300; id += 2 {
+		if err := storage.DeleteRecord("t", id); err != nil {
+			t.Fatalf("Failed to delete record %d: %v", id, err)
+		}
+	}
+	insertCheckpointRecords(t, storage, 300, 400)
+	if err := storage.writeDirtyPages(); err != nil {
+		t.Fatalf("Failed to write pages: %v", err)
+	}
+	if got := storage.pages.dirtyPages(); got != 0 {
+		t.Errorf("Expected every page written, %d are dirty", got)
+	}
+	pageCount := storage.diskManager.GetPageCount("t")
+
+	// A crash before the flush rolls the pages back
+	fsys.Restart(false)
+
+	recovered := NewFileStorageLayer()
+	if err := recovered.OpenWithOptions(crashDir, opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer recovered.Close()
+
+	records, err := recovered.Scan("t", nil)
+	if err != nil || len(records) != 300 {
+		t.Errorf("Scanned %d records (%v), want the 300 flushed", len(records), err)
+	}
+	if got := recovered.diskManager.GetPageCount("t"); got >= pageCount {
+		t.Errorf("Expected the new pages to be cut off, the table has %d of %d", got, pageCount)
+	}
+}
@@ -0,0 +1,94 @@
+package layer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+func TestCompressedTable(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "compression_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dbDir := filepath.Join(tempDir, "db")
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 50},
+		},
+		PrimaryKey:  []string{"id"},
+		Compression: "lz",
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(dbDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("bad", record.Schema{Columns: schema.Columns, Compression: "zstd"}); err == nil {
+		t.Errorf("Expected an unknown codec to be rejected")
+	}
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	ids := make([]int, 2000)
+	for i := range ids {
+		data, _ := record.Serialize(schema, []interface{}{i, fmt.Sprintf("user number %d", i)})
+		if ids[i], err = storage.Insert("users", data); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	stats, err := storage.CompressionStats("users")
+	if err != nil {
+		t.Fatalf("CompressionStats failed: %v", err)
+	}
+	if stats.Codec != "lz" || stats.Ratio() < 2 {
+		t.Errorf("Expected the table to compress at least 2x with lz, got %+v", stats)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// The backup keeps the compression, and both copies read back
+	backupDir := filepath.Join(tempDir, "backup")
+	for _, dir := range []string{dbDir, backupDir} {
+		storage := NewFileStorageLayer()
+		if err := storage.Open(dir); err != nil {
+			t.Fatalf("Failed to open %s: %v", dir, err)
+		}
+
+		s, err := storage.GetSchema("users")
+		if err != nil || s.Compression != "lz" {
+			t.Errorf("Expected the schema to keep its compression, got %q: %v", s.Compression, err)
+		}
+		for i, id := range ids {
+			data, err := storage.Get("users", id)
+			if err != nil {
+				t.Fatalf("Failed to get record %d from %s: %v", id, dir, err)
+			}
+			values, _ := record.Deserialize(schema, data)
+			if values[1] != fmt.Sprintf("user number %d", i) {
+				t.Fatalf("Record %d of %s has %v", id, dir, values[1])
+			}
+		}
+		if stats, _ := storage.CompressionStats("users"); stats.Codec != "lz" {
+			t.Errorf("Expected %s to be compressed, got %+v", dir, stats)
+		}
+
+		if dir == dbDir {
+			if err := storage.Backup(backupDir); err != nil {
+				t.Fatalf("Backup failed: %v", err)
+			}
+		}
+		storage.Close()
+	}
+}
@@ -0,0 +1,411 @@
+package layer
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReads runs readers against a cold cache while a writer
+// inserts, updates and flushes. Run it with -race.
+func TestConcurrentReads(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "concurrency_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 50},
+		},
+		PrimaryKey: []string{"id"},
+	}
+	const rows = 2000
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	for _, tableName := range []string{"users", "events"} {
+		if err := storage.CreateTable(tableName, schema); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	var records [][]byte
+	for i := 0; i < rows; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, fmt.Sprintf("user %d", i)})
+		records = append(records, data)
+	}
+	ids, err := storage.InsertBatch("users", records)
+	if err != nil {
+		t.Fatalf("Failed to insert records: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// Reopen so that the readers race to load the pages
+	storage = NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for r := 0; r < 16; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < 300; i++ {
+				n := rng.Intn(rows)
+				switch {
+				case i%100 == 99:
+					results, err := storage.ScanRecords("users", nil)
+					if err != nil || len(results) != rows {
+						errs <- fmt.Errorf("scan returned %d records: %v", len(results), err)
+						return
+					}
+					if _, err := storage.GetByRID("users", results[n].RID); err != nil {
+						errs <- fmt.Errorf("GetByRID: %v", err)
+						return
+					}
+				case i%2 == 0:
+					data, err := storage.Get("users", ids[n])
+					if err != nil || string(data) != string(records[n]) {
+						errs <- fmt.Errorf("Get(%d) = %v, %v", ids[n], data, err)
+						return
+					}
+				default:
+					_, data, err := storage.GetByPrimaryKey("users", n)
+					if err != nil || string(data) != string(records[n]) {
+						errs <- fmt.Errorf("GetByPrimaryKey(%d) = %v, %v", n, data, err)
+						return
+					}
+				}
+			}
+		}(int64(r))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 200; i++ {
+			data, _ := record.Serialize(schema, []interface{}{i, "event"})
+			if _, err := storage.Insert("events", data); err != nil {
+				errs <- fmt.Errorf("insert: %v", err)
+				return
+			}
+			// Rewriting a record in place dirties pages the readers use
+			if err := storage.Update("users", ids[i], records[i]); err != nil {
+				errs <- fmt.Errorf("update: %v", err)
+				return
+			}
+			if i%50 == 0 {
+				if err := storage.Flush(); err != nil {
+					errs <- fmt.Errorf("flush: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentWrites runs writers on the same and on different tables
+// while readers check that they never see a record under the wrong ID.
+// Run it with -race.
+func TestConcurrentWrites(t *testing.T) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	keyed := schema
+	keyed.PrimaryKey = []string{"id"}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", Options{FileSystem: vfs.NewMemFS()}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	tables := []string{"plain_a", "plain_b", "keyed"}
+	for _, tableName := range tables {
+		s := schema
+		if tableName == "keyed" {
+			s = keyed
+		}
+		if err := storage.CreateTable(tableName, s); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+
+	// Writers own disjoint ranges of the id column, so their models never
+	// overlap
+	encode := func(key int, rng *rand.Rand) []byte {
+		name := fmt.Sprintf("%d:%s", key, strings.Repeat("x", rng.Intn(150)))
+		data, _ := record.Serialize(schema, []interface{}{key, name})
+		return data
+	}
+	keyOf := func(data []byte) int {
+		values, _ := record.Deserialize(schema, data)
+		return values[0].(int)
+	}
+
+	const writers = 9
+	models := make([]map[int][]byte, writers)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	done := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			tableName := tables[w%len(tables)]
+			model := make(map[int][]byte)
+			models[w] = model
+			var ids []int
+
+			for i := 0; i < 300; i++ {
+				switch op := rng.Intn(10); {
+				case op < 5 || len(ids) == 0:
+					data := encode(w*10000+i, rng)
+					id, err := storage.Insert(tableName, data)
+					if err != nil {
+						errs <- fmt.Errorf("insert into %s: %v", tableName, err)
+						return
+					}
+					model[id] = data
+					ids = append(ids, id)
+				case op < 8:
+					id := ids[rng.Intn(len(ids))]
+					data := encode(keyOf(model[id]), rng)
+					if err := storage.Update(tableName, id, data); err != nil {
+						errs <- fmt.Errorf("update %s %d: %v", tableName, id, err)
+						return
+					}
+					model[id] = data
+				default:
+					n := rng.Intn(len(ids))
+					id := ids[n]
+					if err := storage.DeleteRecord(tableName, id); err != nil {
+						errs <- fmt.Errorf("delete %s %d: %v", tableName, id, err)
+						return
+					}
+					delete(model, id)
+					ids = append(ids[:n], ids[n+1:]...)
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				results, err := storage.ScanRecords(tables[r%len(tables)], nil)
+				if err != nil {
+					errs <- fmt.Errorf("scan: %v", err)
+					return
+				}
+				for _, result := range results {
+					data, err := storage.Get(tables[r%len(tables)], result.ID)
+					if err != nil {
+						continue
+					}
+					if keyOf(data) != keyOf(result.Data) {
+						errs <- fmt.Errorf("record %d changed key from %d to %d", result.ID, keyOf(result.Data), keyOf(data))
+						return
+					}
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i, tableName := range tables {
+		want := make(map[int][]byte)
+		for w := i; w < writers; w += len(tables) {
+			for id, data := range models[w] {
+				want[id] = data
+			}
+		}
+
+		results, err := storage.ScanRecords(tableName, nil)
+		if err != nil {
+			t.Fatalf("Failed to scan %s: %v", tableName, err)
+		}
+		if len(results) != len(want) {
+			t.Errorf("%s has %d records, want %d", tableName, len(results), len(want))
+		}
+		for _, result := range results {
+			if string(want[result.ID]) != string(result.Data) {
+				t.Errorf("%s record %d does not match the model", tableName, result.ID)
+			}
+		}
+	}
+}
+
+// BenchmarkConcurrentInserts compares writers sharing one table with
+// writers on a table each. Vary -cpu to see the scaling.
+func BenchmarkConcurrentInserts(b *testing.B) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 50},
+		},
+	}
+	data, _ := record.Serialize(schema, []interface{}{1, "benchmark record"})
+
+	for _, shared := range []bool{true, false} {
+		name := "table_each"
+		if shared {
+			name = "shared_table"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions("/db", Options{FileSystem: vfs.NewMemFS()}); err != nil {
+				b.Fatalf("Failed to open storage: %v", err)
+			}
+			defer storage.Close()
+
+			var next int64
+			var mutex sync.Mutex
+			tableFor := func() string {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				next++
+				tableName := "t"
+				if !shared {
+					tableName = fmt.Sprintf("t%d", next)
+				}
+				if !storage.catalogHas(tableName) {
+					storage.CreateTable(tableName, schema)
+				}
+				return tableName
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				tableName := tableFor()
+				for pb.Next() {
+					if _, err := storage.Insert(tableName, data); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func (fsl *FileStorageLayer) catalogHas(tableName string) bool {
+	tables, _ := fsl.ListTables()
+	for _, name := range tables {
+		if name == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+// TestConcurrentPageAllocation has writers fill one table until many pages
+// are allocated, so they keep racing to add pages and to insert into the
+// ones just added. Run it with -race.
+func TestConcurrentPageAllocation(t *testing.T) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 1000},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", Options{FileSystem: vfs.NewMemFS()}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.CreateTable("t", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	const writers, rows = 16, 100
+	name := strings.Repeat("x", 1000)
+	ids := make([][]int, writers)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rows; i++ {
+				data, _ := record.Serialize(schema, []interface{}{w*rows + i, name})
+				id, err := storage.Insert("t", data)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids[w] = append(ids[w], id)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	if pages := storage.diskManager.GetPageCount("t"); pages < writers {
+		t.Fatalf("Expected at least %d pages, got %d", writers, pages)
+	}
+	for w := range ids {
+		for i, id := range ids[w] {
+			data, err := storage.Get("t", id)
+			if err != nil {
+				t.Fatalf("Record %d of writer %d: %v", id, w, err)
+			}
+			values, _ := record.Deserialize(schema, data)
+			if values[0] != w*rows+i {
+				t.Fatalf("Record %d: expected key %d, got %v", id, w*rows+i, values[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package layer
+
+import (
+	"fmt"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/record"
+	"strings"
+)
+
+// Key indexes live in memory and are rebuilt from the table data when the
+// storage layer is opened. The primary key index, if any, comes first among
+// the unique indexes; foreign key indexes follow the order of
+// schema.ForeignKeys.
+func newKeyIndexes(tableName string, schema record.Schema) ([]*bptree.UniqueIndex, []*bptree.MultiIndex, error) {
+	var uniqueIndexes []*bptree.UniqueIndex
+	var foreignKeyIndexes []*bptree.MultiIndex
+
+	if len(schema.PrimaryKey) > 0 {
+		index, err := bptree.NewUniqueIndex(schema.PrimaryKeyName(tableName), schema, schema.PrimaryKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		uniqueIndexes = append(uniqueIndexes, index)
+	}
+
+	for i, columns := range schema.Unique {
+		index, err := bptree.NewUniqueIndex(schema.UniqueKeyName(tableName, i), schema, columns)
+		if err != nil {
+			return nil, nil, err
+		}
+		uniqueIndexes = append(uniqueIndexes, index)
+	}
+
+	for i, fk := range schema.ForeignKeys {
+		index, err := bptree.NewMultiIndex(schema.ForeignKeyName(tableName, i), schema, fk.Columns)
+		if err != nil {
+			return nil, nil, err
+		}
+		foreignKeyIndexes = append(foreignKeyIndexes, index)
+	}
+
+	return uniqueIndexes, foreignKeyIndexes, nil
+}
+
+func (fsl *FileStorageLayer) loadKeyIndexes(tableName string) error {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	uniqueIndexes, foreignKeyIndexes, err := newKeyIndexes(tableName, schema)
+	if err != nil {
+		return err
+	}
+	fsl.uniqueIndexes[tableName] = uniqueIndexes
+	fsl.foreignKeyIndexes[tableName] = foreignKeyIndexes
+
+	if len(uniqueIndexes) == 0 && len(foreignKeyIndexes) == 0 {
+		return nil
+	}
+
+	allRecords := fsl.indexes[tableName].GetAllRecords()
+	for _, recordID := range physicalOrder(allRecords) {
+		data, err := fsl.getRecord(tableName, allRecords[recordID])
+		if err != nil {
+			return err
+		}
+
+		values, err := record.Deserialize(schema, data)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", recordID, err)
+		}
+
+		if err := fsl.addKeys(tableName, values, recordID); err != nil {
+			return fmt.Errorf("record %d: %v", recordID, err)
+		}
+	}
+
+	return nil
+}
+
+// hasConstraints reports whether writes to a table need their rows decoded
+// for key, expression or referential checks.
+func (fsl *FileStorageLayer) hasConstraints(tableName string) bool {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err == nil && hasExpressions(schema) {
+		return true
+	}
+	return len(fsl.uniqueIndexes[tableName]) > 0 ||
+		len(fsl.foreignKeyIndexes[tableName]) > 0 ||
+		len(fsl.referencesTo(tableName)) > 0
+}
+
+func (fsl *FileStorageLayer) decodeRecord(tableName string, data []byte) ([]interface{}, error) {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := record.Deserialize(schema, data)
+	if err != nil {
+		return nil, fmt.Errorf("record does not match schema of table %s: %v", tableName, err)
+	}
+	return values, nil
+}
+
+// checkUnique reports a violation if another record already holds one of
+// the keys of values. recordID is the record being updated, or -1.
+func (fsl *FileStorageLayer) checkUnique(tableName string, values []interface{}, recordID int) error {
+	for i, index := range fsl.uniqueIndexes[tableName] {
+		key, ok := index.Key(values)
+		if !ok {
+			continue
+		}
+
+		existing, exists := index.Lookup(key)
+		if !exists || existing == recordID {
+			continue
+		}
+
+		kind := ConstraintUnique
+		if i == 0 && fsl.hasPrimaryKey(tableName) {
+			kind = ConstraintPrimaryKey
+		}
+
+		keyValues := index.KeyValues(values)
+		return &ConstraintViolation{
+			Kind:       kind,
+			Table:      tableName,
+			Constraint: index.Name(),
+			Columns:    index.Columns(),
+			Values:     keyValues,
+			Detail:     fmt.Sprintf("key (%s)=(%s) already exists in record %d", strings.Join(index.Columns(), ", "), formatKey(keyValues), existing),
+		}
+	}
+
+	return nil
+}
+
+func (fsl *FileStorageLayer) addKeys(tableName string, values []interface{}, recordID int) error {
+	for _, index := range fsl.uniqueIndexes[tableName] {
+		if key, ok := index.Key(values); ok {
+			if err := index.Insert(key, recordID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, index := range fsl.foreignKeyIndexes[tableName] {
+		if key, ok := index.Key(values); ok {
+			index.Insert(key, recordID)
+		}
+	}
+	return nil
+}
+
+func (fsl *FileStorageLayer) removeKeys(tableName string, values []interface{}, recordID int) {
+	for _, index := range fsl.uniqueIndexes[tableName] {
+		if key, ok := index.Key(values); ok {
+			index.Delete(key)
+		}
+	}
+	for _, index := range fsl.foreignKeyIndexes[tableName] {
+		if key, ok := index.Key(values); ok {
+			index.Delete(key, recordID)
+		}
+	}
+}
+
+func (fsl *FileStorageLayer) hasPrimaryKey(tableName string) bool {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	return err == nil && len(schema.PrimaryKey) > 0
+}
+
+// GetByPrimaryKey looks a record up by the values of its primary key
+// columns, in the order they are declared.
+func (fsl *FileStorageLayer) GetByPrimaryKey(tableName string, key ...interface{}) (int, []byte, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return -1, nil, fmt.Errorf("storage layer is not open")
+	}
+
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return -1, nil, err
+	}
+	if len(schema.PrimaryKey) == 0 {
+		return -1, nil, fmt.Errorf("table %s has no primary key", tableName)
+	}
+	if len(key) != len(schema.PrimaryKey) {
+		return -1, nil, fmt.Errorf("primary key of table %s has %d columns, got %d values", tableName, len(schema.PrimaryKey), len(key))
+	}
+
+	encoded, ok := bptree.EncodeKey(normalizeKey(schema, schema.PrimaryKey, key))
+	if !ok {
+		return -1, nil, fmt.Errorf("primary key values cannot be null")
+	}
+
+	recordID, exists := fsl.uniqueIndexes[tableName][0].Lookup(encoded)
+	if !exists {
+		return -1, nil, fmt.Errorf("no record with primary key (%s) in table %s", formatKey(key), tableName)
+	}
+
+	_, data, err := fsl.readRecord(tableName, recordID)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	return recordID, data, nil
+}
+
+// normalizeKey converts int key values given for FLOAT columns so that they
+// encode the same way as the stored values.
+func normalizeKey(schema record.Schema, columns []string, key []interface{}) []interface{} {
+	normalized := make([]interface{}, len(key))
+	for i, value := range key {
+		normalized[i] = value
+		col := schema.Columns[schema.ColumnIndex(columns[i])]
+		if intVal, ok := value.(int); ok && col.Type == record.TypeFloat {
+			normalized[i] = float64(intVal)
+		}
+	}
+	return normalized
+}
+
+func formatKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if value == nil {
+			parts[i] = "NULL"
+			continue
+		}
+		parts[i] = fmt.Sprint(value)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,119 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+func TestPrimaryKeyAndUniqueConstraints(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "constraints_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "email", Type: record.TypeString, Length: 50, Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"email"}},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	bad := schema
+	bad.PrimaryKey = []string{"email"}
+	if err := storage.CreateTable("bad", bad); err == nil {
+		t.Errorf("Expected a nullable primary key column to be rejected")
+	}
+
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	insert := func(values ...interface{}) (int, error) {
+		data, err := record.Serialize(schema, values)
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		return storage.Insert("users", data)
+	}
+
+	aliceID, err := insert(1, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if _, err := insert(2, nil); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if _, err := insert(3, nil); err != nil {
+		t.Errorf("Multiple NULLs in a unique column should be allowed: %v", err)
+	}
+
+	var violation *ConstraintViolation
+	_, err = insert(1, "other@example.com")
+	if !errors.As(err, &violation) || violation.Kind != ConstraintPrimaryKey {
+		t.Errorf("Expected a primary key violation, got %v", err)
+	}
+
+	_, err = insert(4, "alice@example.com")
+	if !errors.As(err, &violation) || violation.Kind != ConstraintUnique || violation.Constraint != "users_email_key" {
+		t.Errorf("Expected a unique violation, got %v", err)
+	}
+
+	// Updating a row to another row's key fails, keeping its own key works
+	data, _ := record.Serialize(schema, []interface{}{2, "alice@example.com"})
+	if err := storage.Update("users", aliceID+1, data); !errors.As(err, &violation) {
+		t.Errorf("Expected a unique violation on update, got %v", err)
+	}
+	data, _ = record.Serialize(schema, []interface{}{1, "alice@new.example.com"})
+	if err := storage.Update("users", aliceID, data); err != nil {
+		t.Errorf("Failed to update row keeping its primary key: %v", err)
+	}
+	if _, err := insert(5, "alice@example.com"); err != nil {
+		t.Errorf("Old unique value should be free after update: %v", err)
+	}
+
+	id, data, err := storage.GetByPrimaryKey("users", 1)
+	if err != nil || id != aliceID {
+		t.Fatalf("GetByPrimaryKey returned %d, %v", id, err)
+	}
+	values, _ := record.Deserialize(schema, data)
+	if values[1] != "alice@new.example.com" {
+		t.Errorf("Unexpected row for primary key 1: %v", values)
+	}
+
+	if err := storage.DeleteRecord("users", aliceID); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, _, err := storage.GetByPrimaryKey("users", 1); err == nil {
+		t.Errorf("Expected deleted primary key to be gone")
+	}
+	if _, err := insert(1, "alice@new.example.com"); err != nil {
+		t.Errorf("Keys of a deleted row should be reusable: %v", err)
+	}
+
+	// Unique indexes are rebuilt when the storage is reopened
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	storage = NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer storage.Close()
+
+	if _, err := insert(5, "x@example.com"); !errors.As(err, &violation) {
+		t.Errorf("Expected a primary key violation after reopen, got %v", err)
+	}
+	if _, _, err := storage.GetByPrimaryKey("users", 5); err != nil {
+		t.Errorf("GetByPrimaryKey after reopen failed: %v", err)
+	}
+}
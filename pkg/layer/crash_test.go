@@ -0,0 +1,374 @@
+package layer
+
+import (
+	"fmt"
+	"math/rand"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// The crash tests run a workload against a FaultFS, crash it at every
+// point a flush writes, and check the reopened database against a model of
+// what was flushed.
+
+const crashDir = "/db"
+
+var crashSchema = record.Schema{
+	Columns: []record.Column{
+		{Name: "id", Type: record.TypeInt},
+		{Name: "val", Type: record.TypeString, Length: 400},
+	},
+	PrimaryKey: []string{"id"},
+}
+
+// crashModel maps record IDs to the val column.
+type crashModel map[int]string
+
+func (m crashModel) clone() crashModel {
+	c := make(crashModel, len(m))
+	for id, val := range m {
+		c[id] = val
+	}
+	return c
+}
+
+// workloadResult is the model as of the last completed flush, and of the
+// flush that failed if the workload stopped in one.
+type workloadResult struct {
+	flushed crashModel
+	pending crashModel
+	err     error
+}
+
+// crashConfig is how the database of a crash test is stored.
+type crashConfig struct {
+	compression string
+	keys        crypt.KeyProvider
+	// checkpoint writes the dirty pages ahead of each flush, as the
+	// checkpointer does
+	checkpoint bool
+}
+
+func (c crashConfig) options(fsys vfs.FileSystem) Options {
+	return Options{FileSystem: fsys, Keys: c.keys}
+}
+
+// newCrashFS creates the items table.
+func newCrashFS(t *testing.T, seed int64, cfg crashConfig) *vfs.FaultFS {
+	t.Helper()
+
+	fsys := vfs.NewFaultFS(seed)
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(crashDir, cfg.options(fsys)); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	schema := crashSchema
+	schema.Compression = cfg.compression
+	if err := storage.CreateTable("items", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+	return fsys
+}
+
+// runWorkload inserts, updates and deletes records with a flush every few
+// operations and stops at the first error. It retries a failed flush
+// retries times. fault, if any, is injected once the database is open.
+func runWorkload(fsys *vfs.FaultFS, cfg crashConfig, seed int64, retries int, fault *vfs.Fault) workloadResult {
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(crashDir, cfg.options(fsys)); err != nil {
+		return workloadResult{flushed: crashModel{}, err: err}
+	}
+	if fault != nil {
+		fsys.InjectFault(*fault)
+	}
+
+	flush := func() error {
+		if cfg.checkpoint {
+			if err := storage.writeDirtyPages(); err != nil {
+				return err
+			}
+		}
+		return storage.Flush()
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	model := crashModel{}
+	result := workloadResult{flushed: crashModel{}}
+	nextKey := 0
+
+	randomVal := func() string {
+		return strings.Repeat(string(rune('a'+rng.Intn(26))), 10+rng.Intn(300))
+	}
+	pickID := func() int {
+		ids := make([]int, 0, len(model))
+		for id := range model {
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			return -1
+		}
+		// Map order is random; pick the smallest ID above a random bound
+		bound, best := rng.Intn(nextKey+1), -1
+		for _, id := range ids {
+			if id >= bound && (best < 0 || id < best) {
+				best = id
+			}
+		}
+		if best < 0 {
+			best = ids[0]
+			for _, id := range ids {
+				if id < best {
+					best = id
+				}
+			}
+		}
+		return best
+	}
+
+	for step := 0; step < 120; step++ {
+		var err error
+
+		switch op := rng.Intn(10); {
+		case step%15 == 14:
+			result.pending = model.clone()
+			err = flush()
+			for i := 0; err != nil && i < retries; i++ {
+				err = flush()
+			}
+			if err == nil {
+				result.flushed, result.pending = result.pending, nil
+			}
+		case op < 6:
+			nextKey++
+			val := randomVal()
+			data, _ := record.Serialize(crashSchema, []interface{}{nextKey, val})
+			var id int
+			if id, err = storage.Insert("items", data); err == nil {
+				model[id] = val
+			}
+		case op < 8:
+			id := pickID()
+			if id < 0 {
+				continue
+			}
+			val := randomVal()
+			data, _ := record.Serialize(crashSchema, []interface{}{recordKey(storage, id), val})
+			if err = storage.Update("items", id, data); err == nil {
+				model[id] = val
+			}
+		default:
+			id := pickID()
+			if id < 0 {
+				continue
+			}
+			if err = storage.DeleteRecord("items", id); err == nil {
+				delete(model, id)
+			}
+		}
+
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	result.pending = model.clone()
+	if result.err = storage.Close(); result.err == nil {
+		result.flushed, result.pending = result.pending, nil
+	}
+	return result
+}
+
+func recordKey(storage *FileStorageLayer, id int) int {
+	data, err := storage.Get("items", id)
+	if err != nil {
+		return -1
+	}
+	values, err := record.Deserialize(crashSchema, data)
+	if err != nil {
+		return -1
+	}
+	return values[0].(int)
+}
+
+// failedWith reports whether err came from target. Errors are wrapped with
+// %v on the way up, so only the message survives.
+func failedWith(err, target error) bool {
+	return err != nil && strings.Contains(err.Error(), target.Error())
+}
+
+func readModel(storage *FileStorageLayer) (crashModel, error) {
+	results, err := storage.ScanRecords("items", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	model := crashModel{}
+	for _, result := range results {
+		values, err := record.Deserialize(crashSchema, result.Data)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", result.ID, err)
+		}
+		model[result.ID] = values[1].(string)
+	}
+	return model, nil
+}
+
+func equalModels(a, b crashModel) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, val := range a {
+		if other, exists := b[id]; !exists || other != val {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRecovered reopens the database after a crash and checks that it
+// holds what was flushed, or what the interrupted flush was writing, and
+// that it still accepts writes.
+func checkRecovered(t *testing.T, fsys *vfs.FaultFS, cfg crashConfig, result workloadResult, label string) {
+	t.Helper()
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(crashDir, cfg.options(fsys)); err != nil {
+		t.Fatalf("%s: reopen failed: %v\n%s", label, err, fsys)
+	}
+
+	got, err := readModel(storage)
+	if err != nil {
+		t.Fatalf("%s: scan failed: %v", label, err)
+	}
+	if !equalModels(got, result.flushed) && (result.pending == nil || !equalModels(got, result.pending)) {
+		t.Fatalf("%s: recovered %d records, want the %d flushed (or %d pending) ones (workload error: %v)",
+			label, len(got), len(result.flushed), len(result.pending), result.err)
+	}
+
+	data, _ := record.Serialize(crashSchema, []interface{}{1 << 30, "after recovery"})
+	id, err := storage.Insert("items", data)
+	if err != nil {
+		t.Fatalf("%s: insert after recovery failed: %v", label, err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("%s: close after recovery failed: %v", label, err)
+	}
+
+	storage = NewFileStorageLayer()
+	if err := storage.OpenWithOptions(crashDir, cfg.options(fsys)); err != nil {
+		t.Fatalf("%s: second reopen failed: %v", label, err)
+	}
+	defer storage.Close()
+	if _, err := storage.Get("items", id); err != nil {
+		t.Fatalf("%s: record written after recovery is gone: %v", label, err)
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	testCrashRecovery(t, crashConfig{})
+}
+
+func TestCrashRecoveryCompressed(t *testing.T) {
+	testCrashRecovery(t, crashConfig{compression: "lz"})
+}
+
+func TestCrashRecoveryEncrypted(t *testing.T) {
+	testCrashRecovery(t, crashConfig{keys: testKeys(t)})
+}
+
+func TestCrashRecoveryCheckpoint(t *testing.T) {
+	testCrashRecovery(t, crashConfig{checkpoint: true})
+}
+
+func TestCrashRecoveryCheckpointCompressed(t *testing.T) {
+	testCrashRecovery(t, crashConfig{compression: "lz", checkpoint: true})
+}
+
+func TestCrashRecoveryCheckpointEncrypted(t *testing.T) {
+	testCrashRecovery(t, crashConfig{keys: testKeys(t), checkpoint: true})
+}
+
+func testCrashRecovery(t *testing.T, cfg crashConfig) {
+	const seed = 1
+
+	fsys := newCrashFS(t, seed, cfg)
+	start := fsys.Mutations()
+	if result := runWorkload(fsys, cfg, seed, 0, nil); result.err != nil {
+		t.Fatalf("Workload failed without faults: %v", result.err)
+	}
+	total := fsys.Mutations() - start
+
+	for k := 0; k < total; k++ {
+		fsys := newCrashFS(t, int64(k), cfg)
+		fsys.CrashAfter(k)
+		result := runWorkload(fsys, cfg, seed, 0, nil)
+		if !fsys.Crashed() {
+			t.Fatalf("crash point %d of %d was not reached", k, total)
+		}
+		if !failedWith(result.err, vfs.ErrCrashed) {
+			t.Fatalf("crash point %d: workload failed with %v, want a crash", k, result.err)
+		}
+
+		fsys.Restart(k%2 == 1)
+
+		// Crash again during recovery
+		if k%3 == 0 {
+			fsys.CrashAfter(k % 7)
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions(crashDir, cfg.options(fsys)); err == nil {
+				readModel(storage)
+			}
+			fsys.Restart(true)
+		}
+
+		checkRecovered(t, fsys, cfg, result, fmt.Sprintf("crash point %d", k))
+	}
+}
+
+func TestIOErrors(t *testing.T) {
+	const seed = 2
+
+	faults := []vfs.Fault{
+		{Op: vfs.OpWrite, Path: "*.tbl", Err: syscall.EIO},
+		{Op: vfs.OpWrite, Path: "*.idx", Err: syscall.ENOSPC},
+		{Op: vfs.OpWrite, Path: JournalFileName, Err: syscall.ENOSPC},
+		{Op: vfs.OpSync, Path: "*.tbl", Err: syscall.EIO},
+		{Op: vfs.OpSync, Path: JournalFileName, Err: syscall.EIO},
+		{Op: vfs.OpTruncate, Path: JournalFileName, Err: syscall.EIO},
+		{Op: vfs.OpRename, Err: syscall.ENOSPC},
+		{Op: vfs.OpSyncDir, Err: syscall.EIO},
+	}
+
+	for _, fault := range faults {
+		for _, after := range []int{0, 1, 5, 20} {
+			label := fmt.Sprintf("%s %s after %d", fault.Op, fault.Path, after)
+			fault.After = after
+
+			// A failed flush is retried and must then succeed in full
+			fsys := newCrashFS(t, seed, crashConfig{})
+			result := runWorkload(fsys, crashConfig{}, seed, 1, &fault)
+			if result.err != nil {
+				t.Fatalf("%s: workload failed despite a retry: %v", label, result.err)
+			}
+			fsys.Restart(false)
+			checkRecovered(t, fsys, crashConfig{}, result, label)
+
+			// Or the process dies right after the failed flush
+			fsys = newCrashFS(t, seed, crashConfig{})
+			result = runWorkload(fsys, crashConfig{}, seed, 0, &fault)
+			if result.err != nil && !failedWith(result.err, fault.Err) {
+				t.Fatalf("%s: workload failed with %v, want %v", label, result.err, fault.Err)
+			}
+			fsys.Restart(true)
+			checkRecovered(t, fsys, crashConfig{}, result, label+", then crash")
+		}
+	}
+}
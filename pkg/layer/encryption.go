@@ -0,0 +1,47 @@
+package layer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Rekey encrypts the whole database again with the current key of the key
+// provider, after which the keys rotated out of it are no longer needed.
+// Other operations wait until it is done.
+func (fsl *FileStorageLayer) Rekey() error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return fmt.Errorf("storage layer is not open")
+	}
+	if fsl.cipher == nil {
+		return fmt.Errorf("storage layer is not encrypted")
+	}
+
+	// The flush writes the catalog and every index with the current key,
+	// and leaves the journal empty
+	fsl.savedIndexes = make(map[string]savedIndex)
+	if err := fsl.flush(); err != nil {
+		return fmt.Errorf("failed to flush before rekeying: %v", err)
+	}
+
+	tables := make([]string, 0, len(fsl.indexes))
+	for tableName := range fsl.indexes {
+		tables = append(tables, tableName)
+	}
+	sort.Strings(tables)
+
+	for _, tableName := range tables {
+		if err := fsl.diskManager.Rekey(tableName); err != nil {
+			return fmt.Errorf("failed to rekey table %s: %v", tableName, err)
+		}
+	}
+
+	// The previous generation of the catalog, kept as a fallback, is still
+	// under the old key until it is replaced
+	if err := fsl.catalog.Save(); err != nil {
+		return fmt.Errorf("failed to save catalog: %v", err)
+	}
+	return nil
+}
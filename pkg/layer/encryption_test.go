@@ -0,0 +1,166 @@
+package layer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/record"
+	"strings"
+	"testing"
+)
+
+func testKeys(t *testing.T) *crypt.KeyRing {
+	t.Helper()
+
+	ring := crypt.NewKeyRing()
+	if err := ring.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	return ring
+}
+
+func openEncrypted(dir string, keys crypt.KeyProvider) (*FileStorageLayer, error) {
+	opts := DefaultOptions()
+	opts.Keys = keys
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(dir, opts); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func TestEncryption(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "encryption_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dbDir := filepath.Join(tempDir, "db")
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "secret_column", Type: record.TypeString, Length: 50},
+		},
+		PrimaryKey: []string{"id"},
+	}
+	compressed := schema
+	compressed.Compression = "flate"
+
+	keys := testKeys(t)
+	storage, err := openEncrypted(dbDir, keys)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	ids := make(map[string][]int)
+	insert := func(storage *FileStorageLayer, from, to int) {
+		t.Helper()
+		for _, tableName := range []string{"plain", "compressed"} {
+			for i := from; i < to; i++ {
+				data, _ := record.Serialize(schema, []interface{}{i, fmt.Sprintf("secret value %d", i)})
+				id, err := storage.Insert(tableName, data)
+				if err != nil {
+					t.Fatalf("Failed to insert: %v", err)
+				}
+				ids[tableName] = append(ids[tableName], id)
+			}
+		}
+	}
+	check := func(storage *FileStorageLayer) {
+		t.Helper()
+		for tableName, tableIDs := range ids {
+			for i, id := range tableIDs {
+				data, err := storage.Get(tableName, id)
+				if err != nil {
+					t.Fatalf("Failed to get record %d of %s: %v", id, tableName, err)
+				}
+				values, _ := record.Deserialize(schema, data)
+				if values[1] != fmt.Sprintf("secret value %d", i) {
+					t.Fatalf("Record %d of %s has %v", id, tableName, values[1])
+				}
+			}
+		}
+	}
+
+	storage.CreateTable("plain", schema)
+	storage.CreateTable("compressed", compressed)
+	insert(storage, 0, 500)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Nothing readable is left in the files
+	names, _ := os.ReadDir(dbDir)
+	for _, entry := range names {
+		data, _ := os.ReadFile(filepath.Join(dbDir, entry.Name()))
+		for _, plaintext := range []string{"secret value", "secret_column", "next_id"} {
+			if bytes.Contains(data, []byte(plaintext)) {
+				t.Errorf("%s contains %q in plaintext", entry.Name(), plaintext)
+			}
+		}
+	}
+
+	if _, err := openEncrypted(dbDir, nil); err == nil || !strings.Contains(err.Error(), crypt.ErrNoKey.Error()) {
+		t.Errorf("Expected opening without a key to fail for the missing key, got %v", err)
+	}
+	wrongKeys := crypt.NewKeyRing()
+	wrongKeys.Add(1, bytes.Repeat([]byte{2}, 32))
+	if _, err := openEncrypted(dbDir, wrongKeys); err == nil || !strings.Contains(err.Error(), crypt.ErrWrongKey.Error()) {
+		t.Errorf("Expected opening with the wrong key to fail for the key, got %v", err)
+	}
+
+	// Rotate, write under the new key, and rekey what is left under the
+	// old one
+	if _, err := keys.Rotate(bytes.Repeat([]byte{3}, 32)); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	storage, err = openEncrypted(dbDir, keys)
+	if err != nil {
+		t.Fatalf("Failed to reopen after rotating: %v", err)
+	}
+	check(storage)
+	insert(storage, 500, 600)
+	if err := storage.Rekey(); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if err := storage.Backup(filepath.Join(tempDir, "backup")); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	storage.Close()
+
+	if err := keys.Remove(1); err != nil {
+		t.Fatalf("Failed to remove the old key: %v", err)
+	}
+	for _, dir := range []string{dbDir, filepath.Join(tempDir, "backup")} {
+		storage, err := openEncrypted(dir, keys)
+		if err != nil {
+			t.Fatalf("Failed to open %s without the old key: %v", dir, err)
+		}
+		check(storage)
+		storage.Close()
+	}
+}
+
+func TestEncryptionRejectsPlaintext(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "encryption_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	storage.CreateTable("t", record.Schema{Columns: []record.Column{{Name: "id", Type: record.TypeInt}}})
+	storage.Close()
+
+	if _, err := openEncrypted(tempDir, testKeys(t)); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("Expected an unencrypted database to be rejected, got %v", err)
+	}
+	if err := storage.Rekey(); err == nil {
+		t.Errorf("Expected Rekey to fail on a closed storage layer")
+	}
+}
@@ -0,0 +1,23 @@
+package layer
+
+import "fmt"
+
+const (
+	ConstraintPrimaryKey = "PRIMARY KEY"
+	ConstraintUnique     = "UNIQUE"
+)
+
+// ConstraintViolation is returned when a write would break a constraint
+// declared in the table schema.
+type ConstraintViolation struct {
+	Kind       string
+	Table      string
+	Constraint string
+	Columns    []string
+	Values     []interface{}
+	Detail     string
+}
+
+func (e *ConstraintViolation) Error() string {
+	return fmt.Sprintf("%s constraint %s on table %s violated: %s", e.Kind, e.Constraint, e.Table, e.Detail)
+}
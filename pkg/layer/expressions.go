@@ -0,0 +1,207 @@
+package layer
+
+import (
+	"fmt"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/expr"
+	"storage-layer/pkg/record"
+)
+
+const ConstraintCheck = "CHECK"
+
+func hasExpressions(schema record.Schema) bool {
+	if len(schema.Checks) > 0 {
+		return true
+	}
+	for _, col := range schema.Columns {
+		if col.Default != "" || col.Generated != "" || col.AutoIncrement {
+			return true
+		}
+	}
+	return false
+}
+
+// compile parses an expression, caching it by its source. The schema was
+// validated when the table was created, so errors here are unexpected.
+func (fsl *FileStorageLayer) compile(source string) (expr.Expr, error) {
+	fsl.expressionsMutex.Lock()
+	defer fsl.expressionsMutex.Unlock()
+
+	if e, exists := fsl.expressions[source]; exists {
+		return e, nil
+	}
+
+	e, err := expr.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	fsl.expressions[source] = e
+	return e, nil
+}
+
+// completeRow fills in AUTO_INCREMENT values, defaults and generated
+// columns, enforces NOT NULL and evaluates the checks of a row about to be
+// written. provided tells which values were given by the caller; nil means
+// all of them. A NULL given for a NOT NULL column with a default also gets
+// the default, since the binary record format cannot leave a value out;
+// AUTO_INCREMENT columns get the next value for any NULL. The sequence
+// values used are added to taken, for the caller to give back if the row is
+// not written after all.
+func (fsl *FileStorageLayer) completeRow(tableName string, values []interface{}, provided []bool, taken *[]catalog.SequenceUse) ([]interface{}, error) {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	completed := make([]interface{}, len(values))
+	copy(completed, values)
+
+	for i, col := range schema.Columns {
+		if !col.AutoIncrement {
+			continue
+		}
+
+		sequenceName := catalog.SequenceName(tableName, col.Name)
+		if completed[i] == nil {
+			value, use, err := fsl.catalog.TakeNextVal(sequenceName)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", col.Name, err)
+			}
+			completed[i] = value
+			*taken = append(*taken, use)
+			continue
+		}
+
+		value, err := record.Coerce(col, completed[i])
+		if err != nil {
+			return nil, err
+		}
+		use, err := fsl.catalog.TakeAdvance(sequenceName, value.(int))
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		*taken = append(*taken, use)
+	}
+
+	for i, col := range schema.Columns {
+		if col.Default == "" {
+			continue
+		}
+		omitted := provided != nil && !provided[i]
+		if !omitted && (completed[i] != nil || col.Nullable) {
+			continue
+		}
+
+		e, err := fsl.compile(col.Default)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		if completed[i], err = e.Eval(nil); err != nil {
+			return nil, fmt.Errorf("default of column %s: %v", col.Name, err)
+		}
+	}
+
+	for i, col := range schema.Columns {
+		if completed[i], err = record.Coerce(col, completed[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	row := make(map[string]interface{}, len(schema.Columns))
+	for i, col := range schema.Columns {
+		if col.Generated == "" {
+			row[col.Name] = completed[i]
+		}
+	}
+
+	for i, col := range schema.Columns {
+		if col.Generated == "" {
+			continue
+		}
+
+		e, err := fsl.compile(col.Generated)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		value, err := e.Eval(row)
+		if err != nil {
+			return nil, fmt.Errorf("generated column %s: %v", col.Name, err)
+		}
+		if completed[i], err = record.Coerce(col, value); err != nil {
+			return nil, fmt.Errorf("generated column %s: %v", col.Name, err)
+		}
+	}
+
+	for i, col := range schema.Columns {
+		if completed[i] == nil && !col.Nullable {
+			return nil, fmt.Errorf("column %s cannot be null", col.Name)
+		}
+		row[col.Name] = completed[i]
+	}
+
+	for i, check := range schema.Checks {
+		e, err := fsl.compile(check.Expr)
+		if err != nil {
+			return nil, err
+		}
+		result, err := e.Eval(row)
+		if err != nil {
+			return nil, fmt.Errorf("check %s: %v", schema.CheckName(tableName, i), err)
+		}
+
+		switch result {
+		case nil, true:
+		case false:
+			return nil, &ConstraintViolation{
+				Kind:       ConstraintCheck,
+				Table:      tableName,
+				Constraint: schema.CheckName(tableName, i),
+				Columns:    e.Columns(),
+				Values:     pickColumns(schema, completed, e.Columns()),
+				Detail:     fmt.Sprintf("row fails %s", check.Expr),
+			}
+		default:
+			return nil, fmt.Errorf("check %s: expected a boolean, got %T", schema.CheckName(tableName, i), result)
+		}
+	}
+
+	return completed, nil
+}
+
+// InsertValues inserts a row given as column values. Omitted columns get
+// their default or next AUTO_INCREMENT value, or NULL if they have none.
+func (fsl *FileStorageLayer) InsertValues(tableName string, row map[string]interface{}) (int, error) {
+	unlock := fsl.lockWrite(tableName, false)
+	defer unlock()
+
+	if !fsl.isOpen {
+		return -1, fmt.Errorf("storage layer is not open")
+	}
+
+	if err := checkWritable(tableName); err != nil {
+		return -1, err
+	}
+
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return -1, err
+	}
+
+	values := make([]interface{}, len(schema.Columns))
+	provided := make([]bool, len(schema.Columns))
+	for name, value := range row {
+		i := schema.ColumnIndex(name)
+		if i < 0 {
+			return -1, fmt.Errorf("column %s does not exist in table %s", name, tableName)
+		}
+		values[i] = value
+		provided[i] = true
+	}
+
+	var taken []catalog.SequenceUse
+	id, err := fsl.insertValues(tableName, values, provided, nil, &taken)
+	if err != nil {
+		fsl.catalog.GiveBack(taken)
+	}
+	return id, err
+}
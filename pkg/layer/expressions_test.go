@@ -0,0 +1,143 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+func TestDefaultsChecksAndGeneratedColumns(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "expressions_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+			{Name: "qty", Type: record.TypeInt, Nullable: false, Default: "1"},
+			{Name: "price", Type: record.TypeFloat, Nullable: false},
+			{Name: "status", Type: record.TypeString, Length: 10, Nullable: true, Default: "'new'"},
+			{Name: "total", Type: record.TypeFloat, Nullable: false, Generated: "qty * price"},
+		},
+		Checks: []record.Check{
+			{Expr: "qty > 0"},
+			{Name: "name_not_empty", Expr: "LENGTH(TRIM(name)) > 0"},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	for _, bad := range []record.Column{
+		{Name: "x", Type: record.TypeInt, Default: "id + 1"},
+		{Name: "x", Type: record.TypeInt, Generated: "missing * 2"},
+		{Name: "x", Type: record.TypeInt, Generated: "total * 2"},
+		{Name: "x", Type: record.TypeInt, Default: "1 +"},
+	} {
+		badSchema := schema
+		badSchema.Columns = append(append([]record.Column{}, schema.Columns...), bad)
+		if err := storage.CreateTable("bad", badSchema); err == nil {
+			t.Errorf("Expected column %+v to be rejected", bad)
+		}
+	}
+
+	if err := storage.CreateTable("items", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	penID, err := storage.InsertValues("items", map[string]interface{}{"id": 1, "name": "pen", "price": 2})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	data, err := storage.Get("items", penID)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	values, _ := record.Deserialize(schema, data)
+	if values[2] != 1 || values[3] != 2.0 || values[4] != "new" || values[5] != 2.0 {
+		t.Errorf("Expected defaults and generated total, got %v", values)
+	}
+
+	// An explicit NULL in a nullable column is kept
+	id, err := storage.InsertValues("items", map[string]interface{}{"id": 2, "name": "ink", "qty": 3, "price": 1.5, "status": nil})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	data, _ = storage.Get("items", id)
+	values, _ = record.Deserialize(schema, data)
+	if values[4] != nil || values[5] != 4.5 {
+		t.Errorf("Expected NULL status and total 4.5, got %v", values)
+	}
+
+	// Binary records get the default for NULL in a NOT NULL column, and the
+	// generated value is always recomputed
+	raw, err := record.Serialize(schema, []interface{}{3, "cap", nil, 4.0, "old", 99.0})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	id, err = storage.Insert("items", raw)
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	data, _ = storage.Get("items", id)
+	values, _ = record.Deserialize(schema, data)
+	if values[2] != 1 || values[4] != "old" || values[5] != 4.0 {
+		t.Errorf("Expected qty 1, status old and total 4, got %v", values)
+	}
+
+	var violation *ConstraintViolation
+	_, err = storage.InsertValues("items", map[string]interface{}{"id": 4, "name": "cup", "qty": 0, "price": 1})
+	if !errors.As(err, &violation) || violation.Kind != ConstraintCheck || violation.Constraint != "items_check1" {
+		t.Errorf("Expected a check violation, got %v", err)
+	}
+
+	_, err = storage.InsertValues("items", map[string]interface{}{"id": 4, "name": "  ", "price": 1})
+	if !errors.As(err, &violation) || violation.Constraint != "name_not_empty" {
+		t.Errorf("Expected a name_not_empty violation, got %v", err)
+	}
+
+	if _, err := storage.InsertValues("items", map[string]interface{}{"id": 4, "price": 1}); err == nil {
+		t.Errorf("Expected a missing NOT NULL column without default to be rejected")
+	}
+	if _, err := storage.InsertValues("items", map[string]interface{}{"id": 4, "name": "x", "price": 1, "color": "red"}); err == nil {
+		t.Errorf("Expected an unknown column to be rejected")
+	}
+
+	// Updates are checked and recompute generated columns
+	raw, _ = record.Serialize(schema, []interface{}{1, "pen", -1, 2.0, "new", 2.0})
+	if err := storage.Update("items", penID, raw); !errors.As(err, &violation) {
+		t.Errorf("Expected a check violation on update, got %v", err)
+	}
+	raw, _ = record.Serialize(schema, []interface{}{1, "pen", 5, 2.0, "new", 2.0})
+	if err := storage.Update("items", penID, raw); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	data, _ = storage.Get("items", penID)
+	values, _ = record.Deserialize(schema, data)
+	if values[5] != 10.0 {
+		t.Errorf("Expected total 10 after update, got %v", values[5])
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// The expressions are kept in the catalog
+	storage = NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	_, err = storage.InsertValues("items", map[string]interface{}{"id": 5, "name": "bag", "qty": -2, "price": 1})
+	if !errors.As(err, &violation) {
+		t.Errorf("Expected a check violation after reopen, got %v", err)
+	}
+}
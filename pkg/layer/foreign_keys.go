@@ -0,0 +1,304 @@
+package layer
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/record"
+	"strings"
+)
+
+const ConstraintForeignKey = "FOREIGN KEY"
+
+// reference is a foreign key of child pointing at another table.
+type reference struct {
+	child   string
+	fkIndex int
+	fk      record.ForeignKey
+}
+
+func (fsl *FileStorageLayer) referencesTo(parent string) []reference {
+	var refs []reference
+
+	tables := fsl.catalog.ListTables()
+	sort.Strings(tables)
+
+	for _, child := range tables {
+		schema, err := fsl.catalog.GetSchema(child)
+		if err != nil {
+			continue
+		}
+		for i, fk := range schema.ForeignKeys {
+			if fk.RefTable == parent {
+				refs = append(refs, reference{child: child, fkIndex: i, fk: fk})
+			}
+		}
+	}
+
+	return refs
+}
+
+// checkForeignKeys verifies that every non-NULL foreign key of a row points
+// at an existing parent row.
+func (fsl *FileStorageLayer) checkForeignKeys(tableName string, values []interface{}) error {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	for i, fk := range schema.ForeignKeys {
+		key := pickColumns(schema, values, fk.Columns)
+		if _, ok := bptree.EncodeKey(key); !ok {
+			continue
+		}
+
+		// A row may reference itself
+		if fk.RefTable == tableName && keysEqual(key, pickColumns(schema, values, fk.RefColumns)) {
+			continue
+		}
+
+		refSchema, err := fsl.catalog.GetSchema(fk.RefTable)
+		if err != nil {
+			return err
+		}
+
+		index := fsl.uniqueIndexFor(fk.RefTable, fk.RefColumns)
+		if index == nil {
+			return fmt.Errorf("no unique index on %s(%s)", fk.RefTable, strings.Join(fk.RefColumns, ", "))
+		}
+
+		parentRow := make([]interface{}, len(refSchema.Columns))
+		for j, refName := range fk.RefColumns {
+			parentRow[refSchema.ColumnIndex(refName)] = key[j]
+		}
+
+		encoded, _ := index.Key(parentRow)
+		if _, exists := index.Lookup(encoded); !exists {
+			return &ConstraintViolation{
+				Kind:       ConstraintForeignKey,
+				Table:      tableName,
+				Constraint: schema.ForeignKeyName(tableName, i),
+				Columns:    fk.Columns,
+				Values:     key,
+				Detail: fmt.Sprintf("key (%s)=(%s) is not present in table %s",
+					strings.Join(fk.Columns, ", "), formatKey(key), fk.RefTable),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (fsl *FileStorageLayer) uniqueIndexFor(tableName string, columns []string) *bptree.UniqueIndex {
+	for _, index := range fsl.uniqueIndexes[tableName] {
+		if (record.Schema{PrimaryKey: index.Columns()}).IsUniqueKey(columns) {
+			return index
+		}
+	}
+	return nil
+}
+
+// applyReferentialActions handles the rows of other tables that reference
+// a parent row which is being deleted (newValues is nil) or updated. With
+// apply false it only reports whether the change is allowed, so callers run
+// it once to check and once to apply, and a RESTRICT anywhere in a cascade
+// leaves every table untouched. visited holds the rows already handled as
+// "table#id", which stops cycles in self-referencing tables.
+func (fsl *FileStorageLayer) applyReferentialActions(tableName string, oldValues, newValues []interface{}, apply bool, visited map[string]bool) error {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range fsl.referencesTo(tableName) {
+		oldKey := pickColumns(schema, oldValues, ref.fk.RefColumns)
+		encoded, ok := bptree.EncodeKey(oldKey)
+		if !ok {
+			continue
+		}
+
+		var newKey []interface{}
+		action := ref.fk.OnDelete
+		if newValues != nil {
+			newKey = pickColumns(schema, newValues, ref.fk.RefColumns)
+			if keysEqual(oldKey, newKey) {
+				continue
+			}
+			action = ref.fk.OnUpdate
+		}
+
+		childSchema, err := fsl.catalog.GetSchema(ref.child)
+		if err != nil {
+			return err
+		}
+
+		for _, childID := range fsl.foreignKeyIndexes[ref.child][ref.fkIndex].Lookup(encoded) {
+			visitKey := fmt.Sprintf("%s#%d", ref.child, childID)
+			if visited[visitKey] {
+				continue
+			}
+
+			if action == "" || action == record.ActionRestrict {
+				verb := "deleted"
+				if newValues != nil {
+					verb = "updated"
+				}
+				return &ConstraintViolation{
+					Kind:       ConstraintForeignKey,
+					Table:      ref.child,
+					Constraint: childSchema.ForeignKeyName(ref.child, ref.fkIndex),
+					Columns:    ref.fk.Columns,
+					Values:     oldKey,
+					Detail: fmt.Sprintf("key (%s)=(%s) of table %s cannot be %s, it is referenced by record %d of table %s",
+						strings.Join(ref.fk.RefColumns, ", "), formatKey(oldKey), tableName, verb, childID, ref.child),
+				}
+			}
+
+			visited[visitKey] = true
+
+			childValues, err := fsl.readValues(ref.child, childID)
+			if err != nil {
+				return err
+			}
+
+			if action == record.ActionCascade && newValues == nil {
+				if err := fsl.applyReferentialActions(ref.child, childValues, nil, apply, visited); err != nil {
+					return err
+				}
+				if apply {
+					if err := fsl.deleteRow(ref.child, childID, childValues); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			// CASCADE on update copies the new key, SET NULL clears it
+			updated := make([]interface{}, len(childValues))
+			copy(updated, childValues)
+			for j, colName := range ref.fk.Columns {
+				if action == record.ActionCascade {
+					updated[childSchema.ColumnIndex(colName)] = newKey[j]
+				} else {
+					updated[childSchema.ColumnIndex(colName)] = nil
+				}
+			}
+
+			// A check only looks at the completed row, so it gives back
+			// what completing it took
+			var taken []catalog.SequenceUse
+			updated, err = fsl.completeRow(ref.child, updated, nil, &taken)
+			if !apply || err != nil {
+				fsl.catalog.GiveBack(taken)
+			}
+			if err != nil {
+				return err
+			}
+			if err := fsl.checkUnique(ref.child, updated, childID); err != nil {
+				return err
+			}
+			if err := fsl.applyReferentialActions(ref.child, childValues, updated, apply, visited); err != nil {
+				return err
+			}
+			if apply {
+				if err := fsl.writeRow(ref.child, childID, childValues, updated); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func visitedSet(tableName string, recordID int) map[string]bool {
+	return map[string]bool{fmt.Sprintf("%s#%d", tableName, recordID): true}
+}
+
+func (fsl *FileStorageLayer) readValues(tableName string, recordID int) ([]interface{}, error) {
+	_, data, err := fsl.readRecord(tableName, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsl.decodeRecord(tableName, data)
+}
+
+// deleteRow removes a record and its index entries without running any
+// constraint checks.
+func (fsl *FileStorageLayer) deleteRow(tableName string, recordID int, values []interface{}) error {
+	rid, exists := fsl.indexes[tableName].Search(recordID)
+	if !exists {
+		return fmt.Errorf("record %d not found", recordID)
+	}
+
+	f, err := fsl.getPage(tableName, rid.PageID)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	if err := fsl.indexes[tableName].Delete(recordID); err != nil {
+		return err
+	}
+
+	if err := f.write(func(pg *page.Page) error { return pg.DeleteRecord(rid.SlotID) }); err != nil {
+		return err
+	}
+
+	fsl.removeKeys(tableName, values, recordID)
+	return nil
+}
+
+// writeRow replaces a record and its index entries without running any
+// constraint checks.
+func (fsl *FileStorageLayer) writeRow(tableName string, recordID int, oldValues, newValues []interface{}) error {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	data, err := record.Serialize(schema, newValues)
+	if err != nil {
+		return err
+	}
+
+	rid, exists := fsl.indexes[tableName].Search(recordID)
+	if !exists {
+		return fmt.Errorf("record %d not found", recordID)
+	}
+
+	oldData, err := record.Serialize(schema, oldValues)
+	if err != nil {
+		return err
+	}
+
+	if err := fsl.updateRecord(tableName, recordID, rid, oldData, data); err != nil {
+		return err
+	}
+
+	fsl.removeKeys(tableName, oldValues, recordID)
+	return fsl.addKeys(tableName, newValues, recordID)
+}
+
+func pickColumns(schema record.Schema, values []interface{}, columns []string) []interface{} {
+	picked := make([]interface{}, len(columns))
+	for i, name := range columns {
+		picked[i] = values[schema.ColumnIndex(name)]
+	}
+	return picked
+}
+
+func keysEqual(a, b []interface{}) bool {
+	for i := range a {
+		if (a[i] == nil) != (b[i] == nil) {
+			return false
+		}
+		if a[i] != nil && record.Compare(a[i], b[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"storage-layer/pkg/record"
+	"testing"
+)
+
+func TestForeignKeys(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "foreign_keys_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	departments := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 20},
+		},
+		PrimaryKey: []string{"id"},
+	}
+	employees := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "dept_id", Type: record.TypeInt},
+			{Name: "manager_id", Type: record.TypeInt, Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+		ForeignKeys: []record.ForeignKey{
+			{Columns: []string{"dept_id"}, RefTable: "departments", RefColumns: []string{"id"},
+				OnDelete: record.ActionCascade, OnUpdate: record.ActionCascade},
+			{Columns: []string{"manager_id"}, RefTable: "employees", RefColumns: []string{"id"},
+				OnDelete: record.ActionSetNull},
+		},
+	}
+	projects := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "dept_id", Type: record.TypeInt},
+		},
+		ForeignKeys: []record.ForeignKey{
+			{Columns: []string{"dept_id"}, RefTable: "departments", RefColumns: []string{"id"}},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.CreateTable("projects", projects); err == nil {
+		t.Errorf("Expected a foreign key to a missing table to be rejected")
+	}
+	for _, table := range []struct {
+		name   string
+		schema record.Schema
+	}{{"departments", departments}, {"employees", employees}, {"projects", projects}} {
+		if err := storage.CreateTable(table.name, table.schema); err != nil {
+			t.Fatalf("Failed to create table %s: %v", table.name, err)
+		}
+	}
+
+	ids := make(map[string]int)
+	insert := func(tableName string, schema record.Schema, values ...interface{}) error {
+		data, err := record.Serialize(schema, values)
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		id, err := storage.Insert(tableName, data)
+		if err == nil {
+			ids[fmt.Sprintf("%s%v", tableName, values[0])] = id
+		}
+		return err
+	}
+	get := func(tableName string, schema record.Schema, key int) []interface{} {
+		_, data, err := storage.GetByPrimaryKey(tableName, key)
+		if err != nil {
+			return nil
+		}
+		values, _ := record.Deserialize(schema, data)
+		return values
+	}
+
+	mustInsert := func(tableName string, schema record.Schema, values ...interface{}) {
+		if err := insert(tableName, schema, values...); err != nil {
+			t.Fatalf("Failed to insert into %s: %v", tableName, err)
+		}
+	}
+
+	mustInsert("departments", departments, 1, "Sales")
+	mustInsert("departments", departments, 2, "Research")
+	mustInsert("employees", employees, 10, 1, nil)
+	mustInsert("employees", employees, 11, 1, 10)
+	mustInsert("employees", employees, 12, 1, 12) // manages themselves
+	mustInsert("employees", employees, 20, 2, 11)
+	mustInsert("projects", projects, 100, 2)
+
+	var violation *ConstraintViolation
+	if err := insert("employees", employees, 13, 3, nil); !errors.As(err, &violation) || violation.Kind != ConstraintForeignKey {
+		t.Errorf("Expected a foreign key violation for a missing department, got %v", err)
+	}
+
+	// RESTRICT from projects blocks the delete, and the cascade to
+	// employees must not have been applied either
+	if err := storage.DeleteRecord("departments", ids["departments2"]); !errors.As(err, &violation) {
+		t.Errorf("Expected delete of a referenced department to fail, got %v", err)
+	}
+	if get("employees", employees, 20) == nil {
+		t.Errorf("Employee 20 was deleted by a failed cascade")
+	}
+
+	// ON UPDATE CASCADE rewrites the employees of department 1
+	data, _ := record.Serialize(departments, []interface{}{5, "Sales"})
+	if err := storage.Update("departments", ids["departments1"], data); err != nil {
+		t.Fatalf("Failed to update department key: %v", err)
+	}
+	if values := get("employees", employees, 11); values == nil || values[1] != 5 {
+		t.Errorf("Expected employee 11 to move to department 5, got %v", values)
+	}
+
+	// Deleting employee 10 sets manager_id of employee 11 to NULL
+	if err := storage.DeleteRecord("employees", ids["employees10"]); err != nil {
+		t.Fatalf("Failed to delete employee: %v", err)
+	}
+	if values := get("employees", employees, 11); values == nil || values[2] != nil {
+		t.Errorf("Expected manager of employee 11 to be NULL, got %v", values)
+	}
+
+	// ON DELETE CASCADE removes the remaining employees of department 5
+	if err := storage.DeleteRecord("departments", ids["departments1"]); err != nil {
+		t.Fatalf("Failed to delete department: %v", err)
+	}
+	if get("employees", employees, 11) != nil || get("employees", employees, 12) != nil {
+		t.Errorf("Expected employees of the deleted department to be gone")
+	}
+	if get("employees", employees, 20) == nil {
+		t.Errorf("Employee of another department was deleted")
+	}
+}
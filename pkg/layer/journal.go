@@ -0,0 +1,476 @@
+package layer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/vfs"
+	"sync"
+)
+
+// JournalFileName holds everything a flush writes until it has all reached
+// the table and index files. A crash during a flush then leaves either the
+// state before the flush or, once the journal is replayed, the state after
+// it, and a torn page write is repaired by the replay.
+const JournalFileName = "flush.journal"
+
+// CheckpointJournalFileName holds the old contents of the pages a
+// checkpoint writes ahead of its flush, which are newer than the index
+// files until the flush is done. A crash before then rolls them back to
+// the state of the last flush. It is a run of journals, one per batch of
+// pages; an entry without data is a page past the end of its file.
+const CheckpointJournalFileName = "checkpoint.journal"
+
+var journalMagic = []byte("SLJ1")
+
+// encryptedJournalMagic starts a journal whose body is sealed. The
+// checksum covers the sealed body, so a torn journal is told apart from
+// one written under another key.
+var encryptedJournalMagic = []byte("SLJE")
+
+var journalCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// journalHeaderSize covers the magic, the body length and the body checksum.
+const journalHeaderSize = 16
+
+// journalEntry is a write to a file in the database directory: a page at
+// offset, or the whole file if whole is set.
+type journalEntry struct {
+	name   string
+	offset int64
+	whole  bool
+	data   []byte
+}
+
+// savedIndex is an index as its file holds it.
+type savedIndex struct {
+	index   *bptree.SimpleIndex
+	version uint64
+}
+
+// flushEntries collects the dirty pages and the indexes that changed since
+// they were saved, and returns the frames of the pages.
+func (fsl *FileStorageLayer) flushEntries() ([]journalEntry, []*frame, error) {
+	tables := make([]string, 0, len(fsl.indexes))
+	for tableName := range fsl.indexes {
+		tables = append(tables, tableName)
+	}
+	sort.Strings(tables)
+
+	var entries []journalEntry
+	var flushed []*frame
+	for _, tableName := range tables {
+		for _, f := range fsl.pages.loadedFrames(tableName) {
+			f.read(func(pg *page.Page) error {
+				if pg.IsDirty() {
+					entries = append(entries, journalEntry{
+						name:   disk.TableFileName(tableName),
+						offset: int64(pg.PageID) * disk.PageSize,
+						data:   append([]byte(nil), pg.GetData()...),
+					})
+					flushed = append(flushed, f)
+				}
+				return nil
+			})
+		}
+	}
+
+	for _, tableName := range tables {
+		index := fsl.indexes[tableName]
+		if fsl.savedIndexes[tableName] == (savedIndex{index, index.Version()}) {
+			continue
+		}
+		data, err := index.Encode()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode index for table %s: %v", tableName, err)
+		}
+		entries = append(entries, journalEntry{name: bptree.IndexFileName(tableName), whole: true, data: data})
+	}
+
+	return entries, flushed, nil
+}
+
+// encodeJournal returns the entries as a journal to be stored under name.
+func encodeJournal(name string, entries []journalEntry, c *crypt.Cipher) ([]byte, error) {
+	var body bytes.Buffer
+	for _, entry := range entries {
+		kind := byte('P')
+		if entry.whole {
+			kind = 'F'
+		}
+		body.WriteByte(kind)
+		binary.Write(&body, binary.LittleEndian, uint16(len(entry.name)))
+		body.WriteString(entry.name)
+		binary.Write(&body, binary.LittleEndian, entry.offset)
+		binary.Write(&body, binary.LittleEndian, uint32(len(entry.data)))
+		body.Write(entry.data)
+	}
+
+	magic, sealed := journalMagic, body.Bytes()
+	if c != nil {
+		var err error
+		if sealed, err = c.Seal(nil, sealed, []byte(name)); err != nil {
+			return nil, err
+		}
+		magic = encryptedJournalMagic
+	}
+
+	data := make([]byte, journalHeaderSize, journalHeaderSize+len(sealed))
+	copy(data, magic)
+	binary.LittleEndian.PutUint64(data[4:12], uint64(len(sealed)))
+	binary.LittleEndian.PutUint32(data[12:16], crc32.Checksum(sealed, journalCRC))
+	return append(data, sealed...), nil
+}
+
+// decodeJournal returns the entries of a complete journal, or false for an
+// empty, torn or otherwise damaged one. A complete journal that does not
+// decrypt is an error.
+func decodeJournal(name string, data []byte, c *crypt.Cipher) ([]journalEntry, bool, error) {
+	if len(data) < journalHeaderSize {
+		return nil, false, nil
+	}
+	encrypted := bytes.Equal(data[:4], encryptedJournalMagic)
+	if !encrypted && !bytes.Equal(data[:4], journalMagic) {
+		return nil, false, nil
+	}
+	length := binary.LittleEndian.Uint64(data[4:12])
+	if length > uint64(len(data)-journalHeaderSize) {
+		return nil, false, nil
+	}
+	body := data[journalHeaderSize : journalHeaderSize+int(length)]
+	if crc32.Checksum(body, journalCRC) != binary.LittleEndian.Uint32(data[12:16]) {
+		return nil, false, nil
+	}
+
+	switch {
+	case encrypted && c == nil:
+		return nil, false, fmt.Errorf("%s: %v", name, crypt.ErrNoKey)
+	case !encrypted && c != nil:
+		return nil, false, fmt.Errorf("%s is not encrypted", name)
+	case encrypted:
+		var err error
+		if body, err = c.Open(nil, body, []byte(name)); err != nil {
+			return nil, false, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	var entries []journalEntry
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, false, nil
+		}
+		kind := body[0]
+		nameLen := int(binary.LittleEndian.Uint16(body[1:3]))
+		body = body[3:]
+		if len(body) < nameLen+12 {
+			return nil, false, nil
+		}
+		entry := journalEntry{name: string(body[:nameLen]), whole: kind == 'F'}
+		body = body[nameLen:]
+		entry.offset = int64(binary.LittleEndian.Uint64(body[:8]))
+		dataLen := int(binary.LittleEndian.Uint32(body[8:12]))
+		body = body[12:]
+		if len(body) < dataLen {
+			return nil, false, nil
+		}
+		entry.data = body[:dataLen]
+		body = body[dataLen:]
+		entries = append(entries, entry)
+	}
+	return entries, true, nil
+}
+
+// writeJournal makes the entries durable in the journal. Once it returns
+// the flush survives a crash.
+func (fsl *FileStorageLayer) writeJournal(entries []journalEntry) error {
+	path := filepath.Join(fsl.basePath, JournalFileName)
+
+	file, err := fsl.fs.OpenFile(path, os.O_CREATE|os.O_EXCL)
+	created := err == nil
+	if os.IsExist(err) {
+		file, err = fsl.fs.OpenFile(path, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := encodeJournal(JournalFileName, entries, fsl.cipher)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if created {
+		return fsl.fs.SyncDir(fsl.basePath)
+	}
+	return nil
+}
+
+// applyJournal writes the entries to their files. Pages go through the
+// disk manager, so a running backup snapshot sees them and the sync policy
+// applies, in one batch per table. The batches are written concurrently,
+// so under group commit they share one group.
+func (fsl *FileStorageLayer) applyJournal(entries []journalEntry) error {
+	var tables []string
+	batches := make(map[string][]disk.PageWrite)
+
+	for _, entry := range entries {
+		if entry.whole {
+			if err := vfs.WriteFile(fsl.fs, filepath.Join(fsl.basePath, entry.name), entry.data, true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tableName := entry.name[:len(entry.name)-len(filepath.Ext(entry.name))]
+		if _, exists := batches[tableName]; !exists {
+			tables = append(tables, tableName)
+		}
+		batches[tableName] = append(batches[tableName], disk.PageWrite{
+			PageID: int32(entry.offset / disk.PageSize),
+			Data:   entry.data,
+		})
+	}
+
+	errs := make([]error, len(tables))
+	var wg sync.WaitGroup
+	for i, tableName := range tables {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fsl.diskManager.WriteBatch(tableName, batches[tableName])
+		}()
+	}
+	wg.Wait()
+	for i, tableName := range tables {
+		if errs[i] != nil {
+			return fmt.Errorf("failed to write pages for table %s: %v", tableName, errs[i])
+		}
+	}
+	if err := fsl.diskManager.Sync(); err != nil {
+		return err
+	}
+
+	return fsl.fs.SyncDir(fsl.basePath)
+}
+
+func (fsl *FileStorageLayer) clearJournal() error {
+	file, err := fsl.fs.OpenFile(filepath.Join(fsl.basePath, JournalFileName), 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// recoverJournal replays the journal of a flush that was interrupted by a
+// crash, or else rolls back the pages of an interrupted checkpoint. It
+// runs before the indexes are loaded, and writes the pages through the
+// disk manager like a flush, so compressed tables get them in their own
+// format.
+func (fsl *FileStorageLayer) recoverJournal() error {
+	path := filepath.Join(fsl.basePath, JournalFileName)
+	data, err := vfs.ReadFile(fsl.fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// A damaged journal was never complete, so its flush never started
+	// writing the table files
+	entries, ok, err := decodeJournal(JournalFileName, data, fsl.cipher)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := fsl.applyJournal(entries); err != nil {
+			return err
+		}
+		// The replay may have grown table files past the page counts read
+		// when they were opened, so they are opened again
+		if err := fsl.diskManager.Close(); err != nil {
+			return err
+		}
+	}
+
+	// The checkpoint journal is cleared before the flush journal, so the
+	// pages it holds were written after the last flush unless that flush
+	// was just replayed
+	if err := fsl.recoverCheckpoint(!ok); err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+	return vfs.WriteFile(fsl.fs, path, nil, true)
+}
+
+// appendCheckpointJournal makes the old contents of a batch of pages
+// durable before the checkpoint overwrites them. A journal that failed to
+// append is overwritten by the next one.
+func (fsl *FileStorageLayer) appendCheckpointJournal(entries []journalEntry) error {
+	path := filepath.Join(fsl.basePath, CheckpointJournalFileName)
+
+	file, err := fsl.fs.OpenFile(path, os.O_CREATE|os.O_EXCL)
+	created := err == nil
+	if os.IsExist(err) {
+		file, err = fsl.fs.OpenFile(path, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := encodeJournal(CheckpointJournalFileName, entries, fsl.cipher)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, fsl.checkpointJournalSize); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if created {
+		if err := fsl.fs.SyncDir(fsl.basePath); err != nil {
+			return err
+		}
+	}
+
+	fsl.checkpointJournalSize += int64(len(data))
+	return nil
+}
+
+// clearCheckpointJournal forgets the pages of a checkpoint once a flush
+// has made them part of the state it recovers to.
+func (fsl *FileStorageLayer) clearCheckpointJournal() error {
+	if fsl.checkpointJournalSize == 0 {
+		return nil
+	}
+
+	file, err := fsl.fs.OpenFile(filepath.Join(fsl.basePath, CheckpointJournalFileName), 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	fsl.checkpointJournalSize = 0
+	return nil
+}
+
+// recoverCheckpoint restores the pages a checkpoint wrote if rollBack is
+// set, and clears the checkpoint journal. Each page gets the oldest
+// contents journaled for it, and a table is cut back to the first page
+// that was past its end.
+func (fsl *FileStorageLayer) recoverCheckpoint(rollBack bool) error {
+	path := filepath.Join(fsl.basePath, CheckpointJournalFileName)
+	data, err := vfs.ReadFile(fsl.fs, path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	batches := make(map[string][]disk.PageWrite)
+	pageCounts := make(map[string]int32)
+	type pageKey struct {
+		name   string
+		offset int64
+	}
+	seen := make(map[pageKey]bool)
+
+	for rest := data; rollBack && len(rest) > 0; {
+		// A damaged journal ends the run: its pages were never written
+		entries, ok, err := decodeJournal(CheckpointJournalFileName, rest, fsl.cipher)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		rest = rest[journalHeaderSize+binary.LittleEndian.Uint64(rest[4:12]):]
+
+		for _, entry := range entries {
+			key := pageKey{entry.name, entry.offset}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			tableName := entry.name[:len(entry.name)-len(filepath.Ext(entry.name))]
+			if _, exists := batches[tableName]; !exists {
+				tables = append(tables, tableName)
+				batches[tableName] = nil
+				pageCounts[tableName] = -1
+			}
+			pageID := int32(entry.offset / disk.PageSize)
+			if len(entry.data) == 0 {
+				if count := pageCounts[tableName]; count < 0 || pageID < count {
+					pageCounts[tableName] = pageID
+				}
+				continue
+			}
+			batches[tableName] = append(batches[tableName], disk.PageWrite{PageID: pageID, Data: entry.data})
+		}
+	}
+
+	for _, tableName := range tables {
+		count := pageCounts[tableName]
+
+		var pages []disk.PageWrite
+		for _, pw := range batches[tableName] {
+			if count < 0 || pw.PageID < count {
+				pages = append(pages, pw)
+			}
+		}
+		if len(pages) > 0 {
+			if err := fsl.diskManager.WriteBatch(tableName, pages); err != nil {
+				return fmt.Errorf("failed to roll back pages of table %s: %v", tableName, err)
+			}
+		}
+		if count >= 0 && count < fsl.diskManager.GetPageCount(tableName) {
+			// A compressed table is only cut at the end of its file, where
+			// compaction puts the pages to drop
+			if err := fsl.diskManager.Compact(tableName); err != nil {
+				return fmt.Errorf("failed to roll back pages of table %s: %v", tableName, err)
+			}
+			if err := fsl.diskManager.TruncatePages(tableName, count); err != nil {
+				return fmt.Errorf("failed to roll back pages of table %s: %v", tableName, err)
+			}
+		}
+	}
+	if err := fsl.diskManager.Sync(); err != nil {
+		return err
+	}
+
+	return vfs.WriteFile(fsl.fs, path, nil, true)
+}
@@ -0,0 +1,77 @@
+package layer
+
+// Locks are taken in this order:
+//
+//   - fsl.mutex is shared by reads and writes and by a checkpoint writing
+//     a batch of pages, and exclusive for schema changes, flushes and
+//     writes to tables linked by foreign keys, whose referential actions
+//     reach into other tables.
+//   - A table latch is shared by writes that touch a single record, and
+//     exclusive for writes that check keys or expressions and for batches.
+//   - A record latch serializes updates and deletes of one record ID.
+//   - The allocation latch makes a page added by insertRecord visible to
+//     other writers together with its cached frame.
+//   - A frame latch guards the contents of a cached page.
+//
+// The indexes are hash maps that lock themselves, so there is no traversal
+// to latch; the catalog and the disk manager lock themselves too.
+
+const recordLatches = 64
+
+type writeScope int
+
+const (
+	scopeRecord writeScope = iota
+	scopeTable
+	scopeDatabase
+)
+
+// writeScope decides how much of the database a write to tableName has to
+// lock. batch asks for the table to itself.
+func (fsl *FileStorageLayer) writeScope(tableName string, batch bool) writeScope {
+	if !fsl.isOpen || fsl.tableLatches[tableName] == nil {
+		return scopeDatabase
+	}
+	if len(fsl.foreignKeyIndexes[tableName]) > 0 || len(fsl.referencesTo(tableName)) > 0 {
+		return scopeDatabase
+	}
+	if batch || fsl.hasConstraints(tableName) {
+		return scopeTable
+	}
+	return scopeRecord
+}
+
+// lockWrite takes the locks for a write to tableName and returns the
+// function releasing them.
+func (fsl *FileStorageLayer) lockWrite(tableName string, batch bool) func() {
+	fsl.mutex.RLock()
+
+	switch fsl.writeScope(tableName, batch) {
+	case scopeDatabase:
+		fsl.mutex.RUnlock()
+		fsl.mutex.Lock()
+		return fsl.mutex.Unlock
+	case scopeTable:
+		latch := fsl.tableLatches[tableName]
+		latch.Lock()
+		return func() {
+			latch.Unlock()
+			fsl.mutex.RUnlock()
+		}
+	default:
+		latch := fsl.tableLatches[tableName]
+		latch.RLock()
+		return func() {
+			latch.RUnlock()
+			fsl.mutex.RUnlock()
+		}
+	}
+}
+
+// lockRecord serializes writers of one record. Records share latches, so
+// the holder must not wait for another record's latch.
+func (fsl *FileStorageLayer) lockRecord(recordID int) func() {
+	latch := &fsl.recordLatches[uint(recordID)%recordLatches]
+	latch.Lock()
+	return latch.Unlock
+}
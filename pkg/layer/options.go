@@ -0,0 +1,59 @@
+package layer
+
+import (
+	"storage-layer/pkg/crypt"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/vfs"
+	"time"
+)
+
+// Options configure a storage layer when it is opened.
+type Options struct {
+	// FileSystem holds the table, index and catalog files
+	FileSystem vfs.FileSystem
+	// Durability decides when the pages a flush writes are synced:
+	// disk.SyncPerWrite syncs each run of consecutive pages as it is
+	// written, disk.SyncPerFlush each table file once at the end, and
+	// disk.SyncGroupCommit the table files together in one group.
+	// disk.SyncNone syncs nothing, skipping the flush journal and the
+	// syncs of the catalog and index files too.
+	Durability disk.Durability
+	// DirectIO opens the table files with O_DIRECT on Linux, so pages are
+	// cached once, by the storage layer, rather than also by the operating
+	// system. It is ignored where O_DIRECT is unavailable or rejected.
+	DirectIO bool
+	// Mmap reads table pages through memory mappings of the table files,
+	// saving a read call and a buffer per page loaded. It suits read-mostly
+	// data; writes take the usual path.
+	Mmap bool
+	// ReadAheadPages is how many pages a sequential reader of a table file
+	// gets read ahead of it in one go. Zero turns read-ahead off.
+	ReadAheadPages int
+	// BufferPoolPages is how many pages are cached in memory, zero for no
+	// limit. Dirty pages stay cached until they are flushed, so the cache
+	// can exceed it in between; a checkpointer is woken when it does.
+	BufferPoolPages int
+	// Keys, if set, encrypt the table, index and catalog files and the
+	// flush journal with AES-GCM. A database written with keys can only be
+	// opened with a provider that still has them; see Rekey.
+	Keys crypt.KeyProvider
+
+	// A background checkpointer flushes every CheckpointInterval, and as
+	// soon as DirtyPageThreshold pages are dirty. Zero turns either off;
+	// with both off, pages are only written by Flush and Close.
+	CheckpointInterval time.Duration
+	DirtyPageThreshold int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		FileSystem: vfs.OS{},
+		Durability: disk.DefaultDurability(),
+
+		ReadAheadPages:  32,
+		BufferPoolPages: 8192,
+
+		CheckpointInterval: 30 * time.Second,
+		DirtyPageThreshold: 4096,
+	}
+}
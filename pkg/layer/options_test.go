@@ -0,0 +1,259 @@
+package layer
+
+import (
+	"os"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	opts := Options{FileSystem: fsys}
+	dir := "/storage-layer-memfs-test/db"
+	defer func() {
+		if _, err := os.Stat("/storage-layer-memfs-test"); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing on disk, got %v", err)
+		}
+	}()
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 50},
+		},
+		PrimaryKey: []string{"id"},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions(dir, opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, "user"})
+		if _, err := storage.Insert("users", data); err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+	}
+	if err := storage.Backup("/storage-layer-memfs-test/backup"); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	for _, path := range []string{dir, "/storage-layer-memfs-test/backup"} {
+		reopened := NewFileStorageLayer()
+		if err := reopened.OpenWithOptions(path, opts); err != nil {
+			t.Fatalf("Failed to reopen %s: %v", path, err)
+		}
+		records, err := reopened.Scan("users", nil)
+		if err != nil || len(records) != 300 {
+			t.Errorf("%s: scanned %d records (%v), want 300", path, len(records), err)
+		}
+		if _, _, err := reopened.GetByPrimaryKey("users", 299); err != nil {
+			t.Errorf("%s: lookup by primary key failed: %v", path, err)
+		}
+		reopened.Close()
+	}
+}
+
+// syncCounter counts the file syncs made through it.
+type syncCounter struct {
+	vfs.FileSystem
+	syncs atomic.Int64
+}
+
+type countedFile struct {
+	vfs.File
+	fsys *syncCounter
+}
+
+func (c *syncCounter) OpenFile(name string, flag int) (vfs.File, error) {
+	file, err := c.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return countedFile{file, c}, nil
+}
+
+func (f countedFile) Sync() error {
+	f.fsys.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestDurability(t *testing.T) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	name := string(make([]byte, 200))
+
+	for _, policy := range []disk.SyncPolicy{disk.SyncPerWrite, disk.SyncPerFlush, disk.SyncGroupCommit, disk.SyncNone} {
+		t.Run(policy.String(), func(t *testing.T) {
+			fsys := &syncCounter{FileSystem: vfs.NewMemFS()}
+			opts := Options{FileSystem: fsys, Durability: disk.Durability{Policy: policy}}
+
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions("/db", opts); err != nil {
+				t.Fatalf("Failed to open storage: %v", err)
+			}
+			ids := make(map[string][]int)
+			for _, tableName := range []string{"a", "b"} {
+				if err := storage.CreateTable(tableName, schema); err != nil {
+					t.Fatalf("Failed to create table: %v", err)
+				}
+				for i := 0; i < 1000; i++ {
+					data, _ := record.Serialize(schema, []interface{}{i, name})
+					id, err := storage.Insert(tableName, data)
+					if err != nil {
+						t.Fatalf("Failed to insert record: %v", err)
+					}
+					ids[tableName] = append(ids[tableName], id)
+				}
+			}
+
+			// Over a hundred dirty pages in a run per file: the catalog,
+			// the journal twice, and each table and index file once,
+			// system tables included
+			fsys.syncs.Store(0)
+			if err := storage.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			want := int64(3 + 2*(2+len(catalog.SystemTables())))
+			if policy == disk.SyncNone {
+				want = 0
+			}
+			if got := fsys.syncs.Load(); got != want {
+				t.Errorf("Expected %d syncs for the flush, got %d", want, got)
+			}
+
+			// Every other page of each table dirty, so each page is a
+			// write of its own
+			pages := make(map[string]map[int32]bool)
+			for tableName, tableIDs := range ids {
+				pages[tableName] = make(map[int32]bool)
+				for i, id := range tableIDs {
+					rid, _ := storage.indexes[tableName].Search(id)
+					if rid.PageID%2 != 0 || pages[tableName][rid.PageID] {
+						continue
+					}
+					pages[tableName][rid.PageID] = true
+					data, _ := record.Serialize(schema, []interface{}{-i, name})
+					if err := storage.Update(tableName, id, data); err != nil {
+						t.Fatalf("Failed to update record: %v", err)
+					}
+				}
+			}
+			dirty := len(pages["a"]) + len(pages["b"])
+			// A group is committed by its window, long enough to notice, or
+			// once both tables have joined it
+			storage.diskManager.SetDurability(disk.Durability{
+				Policy:      policy,
+				GroupWindow: 10 * time.Second,
+				GroupBytes:  int64(len(pages["a"])+1) * disk.PageSize,
+			})
+
+			fsys.syncs.Store(0)
+			start := time.Now()
+			if err := storage.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			// The catalog, the journal twice, and the writes to the tables.
+			// The updates moved no records, so no index file is written.
+			files := int64(3)
+			want = map[disk.SyncPolicy]int64{
+				disk.SyncPerWrite:    files + int64(dirty),
+				disk.SyncPerFlush:    files + 2,
+				disk.SyncGroupCommit: files + 2,
+				disk.SyncNone:        0,
+			}[policy]
+			if got := fsys.syncs.Load(); got != want {
+				t.Errorf("Expected %d syncs for %d pages apart, got %d", want, dirty, got)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Flush took %v, expected both tables in one full group", elapsed)
+			}
+			storage.diskManager.SetDurability(opts.Durability)
+
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Failed to close storage: %v", err)
+			}
+			reopened := NewFileStorageLayer()
+			if err := reopened.OpenWithOptions("/db", opts); err != nil {
+				t.Fatalf("Failed to reopen storage: %v", err)
+			}
+			defer reopened.Close()
+			for _, tableName := range []string{"a", "b"} {
+				records, err := reopened.Scan(tableName, nil)
+				if err != nil || len(records) != 1000 {
+					t.Errorf("%s: scanned %d records (%v), want 1000", tableName, len(records), err)
+				}
+			}
+		})
+	}
+}
+
+func TestIOModes(t *testing.T) {
+	modes := map[string]func(*Options){
+		"direct": func(opts *Options) { opts.DirectIO = true },
+		"mmap":   func(opts *Options) { opts.Mmap = true },
+		"both":   func(opts *Options) { opts.DirectIO, opts.Mmap = true, true },
+	}
+
+	for name, setMode := range modes {
+		t.Run(name, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "io_mode_test")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			schema := record.Schema{
+				Columns: []record.Column{
+					{Name: "id", Type: record.TypeInt},
+					{Name: "name", Type: record.TypeString, Length: 50},
+				},
+			}
+			opts := DefaultOptions()
+			setMode(&opts)
+
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions(tempDir, opts); err != nil {
+				t.Fatalf("Failed to open storage: %v", err)
+			}
+			if err := storage.CreateTable("users", schema); err != nil {
+				t.Fatalf("Failed to create table: %v", err)
+			}
+			for i := 0; i < 500; i++ {
+				data, _ := record.Serialize(schema, []interface{}{i, "user"})
+				if _, err := storage.Insert("users", data); err != nil {
+					t.Fatalf("Failed to insert record %d: %v", i, err)
+				}
+			}
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Failed to close storage: %v", err)
+			}
+
+			reopened := NewFileStorageLayer()
+			if err := reopened.OpenWithOptions(tempDir, opts); err != nil {
+				t.Fatalf("Failed to reopen storage: %v", err)
+			}
+			defer reopened.Close()
+
+			records, err := reopened.Scan("users", nil)
+			if err != nil || len(records) != 500 {
+				t.Errorf("Scanned %d records (%v), want 500", len(records), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package layer
+
+import (
+	"container/list"
+	"sort"
+	"storage-layer/pkg/page"
+	"sync"
+	"sync/atomic"
+)
+
+// frame holds a cached page. Its latch is held shared while records are
+// read from the page and exclusively while the page changes.
+type frame struct {
+	latch sync.RWMutex
+	page  *page.Page
+	// loaded is closed once page or err is set
+	loaded chan struct{}
+	err    error
+	pages  *pageTable
+
+	// The fields below are guarded by the page table mutex. pins counts the
+	// callers of get that have not released the frame, and element is its
+	// place in the eviction list while it is clean.
+	tableName string
+	pageID    int32
+	pins      int
+	element   *list.Element
+}
+
+// release ends the use of a frame returned by get.
+func (f *frame) release() {
+	pt := f.pages
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	f.pins--
+	if f.pins == 0 && pt.frames[f.tableName][f.pageID] != f {
+		// Removed while in use
+		f.discard()
+	}
+	pt.evict()
+}
+
+// discard ends the use of a removed frame's page, which may still be shared
+// with the disk manager. It is called with pt.mutex held.
+func (f *frame) discard() {
+	if f.page != nil {
+		f.page.Release()
+	}
+}
+
+func (f *frame) read(fn func(pg *page.Page) error) error {
+	f.latch.RLock()
+	defer f.latch.RUnlock()
+
+	return fn(f.page)
+}
+
+func (f *frame) write(fn func(pg *page.Page) error) error {
+	f.latch.Lock()
+	defer f.latch.Unlock()
+
+	wasDirty := f.page.IsDirty()
+	err := fn(f.page)
+	if dirty := f.page.IsDirty(); dirty != wasDirty {
+		f.pages.dirtied(f, dirty)
+	}
+	return err
+}
+
+func (f *frame) getRecord(slotID int) ([]byte, error) {
+	f.latch.RLock()
+	defer f.latch.RUnlock()
+
+	return f.page.GetRecord(slotID)
+}
+
+// pageTable caches the pages of all tables. Frames are looked up under the
+// table mutex but loaded outside it, so a reader waits only for the page it
+// needs, and two readers missing the same page load it once.
+//
+// Past capacity, the least recently used frames are evicted, but only clean
+// frames nobody has pinned: dirty pages may only reach the disk through a
+// journaled flush or checkpoint, so they stay cached until the next one,
+// and the table holds more than capacity frames meanwhile.
+type pageTable struct {
+	frames map[string]map[int32]*frame
+	mutex  sync.Mutex
+	// capacity is the number of frames kept, zero for no limit. clean lists
+	// the clean frames, most recently used first.
+	capacity int
+	size     int
+	clean    *list.List
+
+	// dirty counts the cached pages that are dirty. Once it reaches
+	// dirtyThreshold, or dirty frames keep the table over capacity, a
+	// signal goes to full, if set.
+	dirty          atomic.Int64
+	dirtyThreshold int64
+	full           chan struct{}
+}
+
+func newPageTable(capacity int) *pageTable {
+	return &pageTable{
+		frames:   make(map[string]map[int32]*frame),
+		capacity: capacity,
+		clean:    list.New(),
+	}
+}
+
+// dirtied moves a frame whose page became dirty or clean in or out of the
+// eviction list.
+func (pt *pageTable) dirtied(f *frame, dirty bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if pt.frames[f.tableName][f.pageID] != f {
+		// Dropped with its table
+		return
+	}
+	if dirty {
+		pt.markDirty(f)
+		return
+	}
+
+	pt.dirty.Add(-1)
+	f.element = pt.clean.PushFront(f)
+	pt.evict()
+}
+
+func (pt *pageTable) markDirty(f *frame) {
+	if f.element != nil {
+		pt.clean.Remove(f.element)
+		f.element = nil
+	}
+
+	n := pt.dirty.Add(1)
+	if pt.dirtyThreshold > 0 && n >= pt.dirtyThreshold {
+		pt.signalFull()
+	}
+}
+
+func (pt *pageTable) signalFull() {
+	if pt.full == nil {
+		return
+	}
+	select {
+	case pt.full <- struct{}{}:
+	default:
+	}
+}
+
+func (pt *pageTable) dirtyPages() int {
+	return int(pt.dirty.Load())
+}
+
+// frameCount returns the number of frames cached.
+func (pt *pageTable) frameCount() int {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	return pt.size
+}
+
+// evict removes clean, unpinned frames until the table is within capacity.
+// It is called with pt.mutex held.
+func (pt *pageTable) evict() {
+	if pt.capacity <= 0 {
+		return
+	}
+
+	for e := pt.clean.Back(); e != nil && pt.size > pt.capacity; {
+		f := e.Value.(*frame)
+		prev := e.Prev()
+		// Only frames still loading are pinned without a page
+		if f.pins == 0 {
+			pt.remove(f)
+		}
+		e = prev
+	}
+
+	// What is left over is dirty, or pinned for a moment
+	if pt.size > pt.capacity {
+		pt.signalFull()
+	}
+}
+
+// remove forgets a frame. It is called with pt.mutex held.
+func (pt *pageTable) remove(f *frame) {
+	if f.element != nil {
+		pt.clean.Remove(f.element)
+		f.element = nil
+	}
+	delete(pt.frames[f.tableName], f.pageID)
+	pt.size--
+	if f.pins == 0 {
+		f.discard()
+	}
+}
+
+// add caches a new frame, replacing any frame of the same page. It is
+// called with pt.mutex held.
+func (pt *pageTable) add(tableName string, pageID int32, f *frame) {
+	if old := pt.frames[tableName][pageID]; old != nil {
+		pt.remove(old)
+	}
+	if pt.frames[tableName] == nil {
+		pt.frames[tableName] = make(map[int32]*frame)
+	}
+	f.tableName, f.pageID = tableName, pageID
+	pt.frames[tableName][pageID] = f
+	pt.size++
+}
+
+// get returns the frame of a page, calling load if it is not cached. The
+// frame is pinned until the caller releases it.
+func (pt *pageTable) get(tableName string, pageID int32, load func() (*page.Page, error)) (*frame, error) {
+	pt.mutex.Lock()
+	f, exists := pt.frames[tableName][pageID]
+	if exists {
+		if f.element != nil {
+			pt.clean.MoveToFront(f.element)
+		}
+	} else {
+		f = &frame{loaded: make(chan struct{}), pages: pt}
+		pt.add(tableName, pageID, f)
+	}
+	f.pins++
+	pt.mutex.Unlock()
+
+	if exists {
+		<-f.loaded
+		if f.err != nil {
+			f.release()
+			return nil, f.err
+		}
+		return f, nil
+	}
+
+	f.page, f.err = load()
+	pt.mutex.Lock()
+	if f.err != nil {
+		// Forget the failure so that the next reader tries again
+		if pt.frames[tableName][pageID] == f {
+			pt.remove(f)
+		}
+		f.pins--
+	} else if pt.frames[tableName][pageID] == f {
+		f.element = pt.clean.PushFront(f)
+		pt.evict()
+	}
+	pt.mutex.Unlock()
+	close(f.loaded)
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f, nil
+}
+
+// put caches a page that is not on disk yet.
+func (pt *pageTable) put(tableName string, pg *page.Page) {
+	f := &frame{page: pg, loaded: make(chan struct{}), pages: pt}
+	close(f.loaded)
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.add(tableName, pg.PageID, f)
+	if pg.IsDirty() {
+		pt.markDirty(f)
+	} else {
+		f.element = pt.clean.PushFront(f)
+	}
+	pt.evict()
+}
+
+// drop forgets the cached pages of a table.
+func (pt *pageTable) drop(tableName string) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	for _, f := range pt.frames[tableName] {
+		// A page still loading is clean
+		select {
+		case <-f.loaded:
+		default:
+			continue
+		}
+		if f.err == nil && f.page.IsDirty() {
+			pt.dirty.Add(-1)
+		}
+		if f.element != nil {
+			pt.clean.Remove(f.element)
+			f.element = nil
+		}
+		pt.size--
+		if f.pins == 0 {
+			f.discard()
+		}
+	}
+	delete(pt.frames, tableName)
+}
+
+// dropAll forgets every cached page.
+func (pt *pageTable) dropAll() {
+	pt.mutex.Lock()
+	tables := make([]string, 0, len(pt.frames))
+	for tableName := range pt.frames {
+		tables = append(tables, tableName)
+	}
+	pt.mutex.Unlock()
+
+	for _, tableName := range tables {
+		pt.drop(tableName)
+	}
+}
+
+// dirtyFrames returns the frames of a table holding a dirty page, in page
+// order, pinned until the caller releases them.
+func (pt *pageTable) dirtyFrames(tableName string) []*frame {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	var result []*frame
+	for _, f := range pt.frames[tableName] {
+		select {
+		case <-f.loaded:
+		default:
+			continue
+		}
+		// A loaded page is on the eviction list while it is clean
+		if f.err == nil && f.element == nil {
+			f.pins++
+			result = append(result, f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].pageID < result[j].pageID })
+	return result
+}
+
+// cached reports whether f is still the frame of its page.
+func (pt *pageTable) cached(f *frame) bool {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	return pt.frames[f.tableName][f.pageID] == f
+}
+
+// loadedFrames returns the frames of a table holding a page, in page order.
+// The frames are not pinned: it is only called by flush, with the storage
+// layer locked exclusively, so nothing loads or evicts frames meanwhile.
+func (pt *pageTable) loadedFrames(tableName string) []*frame {
+	pt.mutex.Lock()
+	pageIDs := make([]int32, 0, len(pt.frames[tableName]))
+	frames := make(map[int32]*frame, len(pt.frames[tableName]))
+	for pageID, f := range pt.frames[tableName] {
+		pageIDs = append(pageIDs, pageID)
+		frames[pageID] = f
+	}
+	pt.mutex.Unlock()
+
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+
+	result := make([]*frame, 0, len(pageIDs))
+	for _, pageID := range pageIDs {
+		f := frames[pageID]
+		<-f.loaded
+		if f.err == nil {
+			result = append(result, f)
+		}
+	}
+	return result
+}
@@ -0,0 +1,157 @@
+package layer
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"testing"
+)
+
+func TestPageCacheCapacity(t *testing.T) {
+	const capacity = 16
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	name := string(make([]byte, 200))
+	opts := Options{FileSystem: vfs.NewMemFS(), BufferPoolPages: capacity}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("big", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	var ids []int
+	for i := 0; i < 2000; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, name})
+		id, err := storage.Insert("big", data)
+		if err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	pageCount := int(storage.diskManager.GetPageCount("big"))
+	if pageCount <= 4*capacity {
+		t.Fatalf("Expected a table much bigger than the cache, got %d pages", pageCount)
+	}
+
+	// New pages are dirty, so they stay cached until the flush
+	if got := storage.pages.frameCount(); got < pageCount {
+		t.Errorf("Expected the %d dirty pages to stay cached, got %d frames", pageCount, got)
+	}
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := storage.pages.frameCount(); got > capacity {
+		t.Errorf("Expected at most %d frames once flushed, got %d", capacity, got)
+	}
+
+	// A pinned frame survives a scan of the whole table
+	pinned, err := storage.getPage("big", 0)
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	records, err := storage.Scan("big", nil)
+	if err != nil || len(records) != 2000 {
+		t.Fatalf("Scanned %d records (%v), want 2000", len(records), err)
+	}
+	if got := storage.pages.frameCount(); got > capacity {
+		t.Errorf("Expected at most %d frames after a scan, got %d", capacity, got)
+	}
+	if again, _ := storage.getPage("big", 0); again != pinned {
+		t.Errorf("Expected the pinned frame to stay cached")
+	} else {
+		again.release()
+	}
+	pinned.release()
+
+	for i, id := range ids {
+		data, _ := record.Serialize(schema, []interface{}{-i, name})
+		if err := storage.Update("big", id, data); err != nil {
+			t.Fatalf("Failed to update record %d: %v", id, err)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+	for i, id := range ids {
+		data, err := reopened.Get("big", id)
+		if err != nil {
+			t.Fatalf("Failed to get record %d: %v", id, err)
+		}
+		values, _ := record.Deserialize(schema, data)
+		if values[0] != -i {
+			t.Fatalf("Record %d: expected id %d, got %v", id, -i, values[0])
+		}
+	}
+	if got := reopened.pages.frameCount(); got > capacity {
+		t.Errorf("Expected at most %d frames after reading every record, got %d", capacity, got)
+	}
+}
+
+// BenchmarkPageLoad reads records through a cache too small to hold them,
+// so nearly every read loads its page. With mmap the page is not copied.
+func BenchmarkPageLoad(b *testing.B) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	const rows = 20000
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			tempDir, err := os.MkdirTemp("", "page_load_bench")
+			if err != nil {
+				b.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			opts := DefaultOptions()
+			opts.Mmap = mmap
+			opts.BufferPoolPages = 16
+			storage := NewFileStorageLayer()
+			if err := storage.OpenWithOptions(tempDir, opts); err != nil {
+				b.Fatalf("Failed to open storage: %v", err)
+			}
+			defer storage.Close()
+			if err := storage.CreateTable("t", schema); err != nil {
+				b.Fatalf("Failed to create table: %v", err)
+			}
+			records := make([][]byte, rows)
+			for i := range records {
+				records[i], _ = record.Serialize(schema, []interface{}{i, strings.Repeat("x", 200)})
+			}
+			ids, err := storage.BulkLoad("t", records, DefaultBulkLoadOptions())
+			if err != nil {
+				b.Fatalf("Failed to load: %v", err)
+			}
+			if err := storage.Flush(); err != nil {
+				b.Fatalf("Failed to flush: %v", err)
+			}
+
+			rng := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.Get("t", ids[rng.Intn(rows)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package layer
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/page"
+)
+
+// ScanResult is a record found by ScanRecords together with its logical ID
+// and its physical location.
+type ScanResult struct {
+	ID   int
+	RID  bptree.RecordID
+	Data []byte
+}
+
+// ScanRecords is Scan, but keeps the IDs of the matching records so they
+// can be updated or deleted afterwards. Results are in ID order.
+func (fsl *FileStorageLayer) ScanRecords(tableName string, filter func([]byte) bool) ([]ScanResult, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return nil, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.scan(tableName, filter)
+}
+
+func (fsl *FileStorageLayer) scan(tableName string, filter func([]byte) bool) ([]ScanResult, error) {
+	if !fsl.catalog.TableExists(tableName) {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	allRecords := fsl.indexes[tableName].GetAllRecords()
+
+	// Records are read in physical order, so the pages are read
+	// sequentially, and returned in ID order
+	ids := physicalOrder(allRecords)
+
+	var results []ScanResult
+	for _, id := range ids {
+		// The record may have moved or gone since the index was copied
+		rid, recordData, err := fsl.readRecord(tableName, id)
+		if err != nil {
+			continue
+		}
+
+		if filter == nil || filter(recordData) {
+			results = append(results, ScanResult{ID: id, RID: rid, Data: recordData})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results, nil
+}
+
+// physicalOrder returns the record IDs ordered by where their records are
+// stored.
+func physicalOrder(records map[int]bptree.RecordID) []int {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := records[ids[i]], records[ids[j]]
+		if a.PageID != b.PageID {
+			return a.PageID < b.PageID
+		}
+		return a.SlotID < b.SlotID
+	})
+	return ids
+}
+
+// GetByRID reads the record stored at a physical location, whether or not
+// a logical ID points at it.
+func (fsl *FileStorageLayer) GetByRID(tableName string, rid bptree.RecordID) ([]byte, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return nil, fmt.Errorf("storage layer is not open")
+	}
+
+	if !fsl.catalog.TableExists(tableName) {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	f, err := fsl.getRIDPage(tableName, rid)
+	if err != nil {
+		return nil, err
+	}
+	defer f.release()
+
+	return f.getRecord(rid.SlotID)
+}
+
+// UpdateByRID overwrites the record stored at a physical location. If a
+// logical ID points at it the update is checked like Update, but the record
+// must keep its size so that it stays at rid.
+func (fsl *FileStorageLayer) UpdateByRID(tableName string, rid bptree.RecordID, updatedRecord []byte) error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return fmt.Errorf("storage layer is not open")
+	}
+
+	if err := checkWritable(tableName); err != nil {
+		return err
+	}
+
+	if !fsl.catalog.TableExists(tableName) {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	if recordID, exists := fsl.indexes[tableName].SearchRID(rid); exists {
+		return fsl.update(tableName, recordID, rid, updatedRecord, true)
+	}
+
+	f, err := fsl.getRIDPage(tableName, rid)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	return f.write(func(pg *page.Page) error { return pg.UpdateRecord(rid.SlotID, updatedRecord) })
+}
+
+// DeleteByRID removes the record stored at a physical location. If a
+// logical ID points at it the delete is handled like DeleteRecord,
+// otherwise only the slot is freed.
+func (fsl *FileStorageLayer) DeleteByRID(tableName string, rid bptree.RecordID) error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return fmt.Errorf("storage layer is not open")
+	}
+
+	if err := checkWritable(tableName); err != nil {
+		return err
+	}
+
+	if !fsl.catalog.TableExists(tableName) {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	if recordID, exists := fsl.indexes[tableName].SearchRID(rid); exists {
+		return fsl.delete(tableName, recordID, rid)
+	}
+
+	f, err := fsl.getRIDPage(tableName, rid)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	return f.write(func(pg *page.Page) error { return pg.DeleteRecord(rid.SlotID) })
+}
+
+func (fsl *FileStorageLayer) getRIDPage(tableName string, rid bptree.RecordID) (*frame, error) {
+	if rid.PageID < 0 || rid.PageID >= fsl.diskManager.GetPageCount(tableName) {
+		return nil, fmt.Errorf("page %d does not exist in table %s", rid.PageID, tableName)
+	}
+	if rid.SlotID < 0 {
+		return nil, fmt.Errorf("slot %d does not exist", rid.SlotID)
+	}
+
+	return fsl.getPage(tableName, rid.PageID)
+}
@@ -0,0 +1,174 @@
+package layer
+
+import (
+	"os"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"testing"
+)
+
+func TestScanRecordsAndRIDAccess(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "records_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	var ids []int
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		data, _ := record.Serialize(schema, []interface{}{i + 1, name})
+		id, err := storage.Insert("users", data)
+		if err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Find the rows with an even id, then change them through their IDs
+	evenID := func(data []byte) bool {
+		values, err := record.Deserialize(schema, data)
+		return err == nil && values[0].(int)%2 == 0
+	}
+	matches, err := storage.ScanRecords("users", evenID)
+	if err != nil {
+		t.Fatalf("ScanRecords failed: %v", err)
+	}
+	if len(matches) != 2 || matches[0].ID != ids[1] || matches[1].ID != ids[3] {
+		t.Fatalf("Unexpected scan results: %+v", matches)
+	}
+
+	for _, match := range matches {
+		values, _ := record.Deserialize(schema, match.Data)
+		data, _ := record.Serialize(schema, []interface{}{values[0], "EVEN"})
+		if err := storage.Update("users", match.ID, data); err != nil {
+			t.Errorf("Failed to update record %d: %v", match.ID, err)
+		}
+	}
+
+	all, err := storage.ScanRecords("users", nil)
+	if err != nil || len(all) != 4 {
+		t.Fatalf("Expected 4 records, got %d (%v)", len(all), err)
+	}
+
+	// Physical access agrees with logical access
+	rid := all[0].RID
+	data, err := storage.GetByRID("users", rid)
+	if err != nil {
+		t.Fatalf("GetByRID failed: %v", err)
+	}
+	if values, _ := record.Deserialize(schema, data); values[1] != "alice" {
+		t.Errorf("Expected alice at %+v, got %v", rid, values)
+	}
+
+	data, _ = record.Serialize(schema, []interface{}{1, "ALICE"})
+	if err := storage.UpdateByRID("users", rid, data); err != nil {
+		t.Fatalf("UpdateByRID failed: %v", err)
+	}
+	data, _ = storage.Get("users", all[0].ID)
+	if values, _ := record.Deserialize(schema, data); values[1] != "ALICE" {
+		t.Errorf("Expected the update to be visible through the ID, got %v", values)
+	}
+
+	data, _ = record.Serialize(schema, []interface{}{1, "a much longer name"})
+	if err := storage.UpdateByRID("users", rid, data); err == nil {
+		t.Errorf("Expected UpdateByRID to refuse moving the record")
+	}
+
+	if err := storage.DeleteByRID("users", rid); err != nil {
+		t.Fatalf("DeleteByRID failed: %v", err)
+	}
+	if _, err := storage.Get("users", all[0].ID); err == nil {
+		t.Errorf("Expected the record to be gone after DeleteByRID")
+	}
+	if _, err := storage.GetByRID("users", rid); err == nil {
+		t.Errorf("Expected GetByRID of a deleted slot to fail")
+	}
+
+	if _, err := storage.GetByRID("users", bptree.RecordID{PageID: 99, SlotID: 0}); err == nil {
+		t.Errorf("Expected GetByRID of a missing page to fail")
+	}
+}
+
+func TestScanReadsPagesInOrder(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	opts := Options{FileSystem: fsys, ReadAheadPages: 8}
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("t", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	var ids []int
+	for i := 0; i < 1000; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, "short"})
+		id, err := storage.Insert("t", data)
+		if err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	// Growing the early records moves them to the last pages, so ID order
+	// and physical order differ
+	for i := 0; i < 100; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, strings.Repeat("x", 150)})
+		if err := storage.Update("t", ids[i], data); err != nil {
+			t.Fatalf("Failed to update record %d: %v", ids[i], err)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	before := reopened.diskManager.ReadAheadStats()
+	results, err := reopened.ScanRecords("t", nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(results) != 1000 {
+		t.Fatalf("Expected 1000 records, got %d", len(results))
+	}
+	for i, result := range results {
+		if result.ID != ids[i] {
+			t.Fatalf("Expected record %d at position %d, got %d", ids[i], i, result.ID)
+		}
+	}
+
+	stats := reopened.diskManager.ReadAheadStats()
+	pages := reopened.diskManager.GetPageCount("t")
+	if served := stats.Pages - before.Pages; served < int64(pages)-2 {
+		t.Errorf("Expected read-ahead to serve all but the first pages of %d, got %d", pages, served)
+	}
+}
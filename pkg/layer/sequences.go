@@ -0,0 +1,61 @@
+package layer
+
+import (
+	"fmt"
+	"storage-layer/pkg/catalog"
+)
+
+func (fsl *FileStorageLayer) CreateSequence(name string, opts catalog.SequenceOptions) error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.CreateSequence(name, opts)
+}
+
+func (fsl *FileStorageLayer) NextVal(name string) (int, error) {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return 0, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.NextVal(name)
+}
+
+func (fsl *FileStorageLayer) SetVal(name string, value int) error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.SetVal(name, value)
+}
+
+func (fsl *FileStorageLayer) GetSequence(name string) (catalog.SequenceState, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return catalog.SequenceState{}, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.GetSequence(name)
+}
+
+func (fsl *FileStorageLayer) ListSequences() ([]string, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return nil, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.ListSequences(), nil
+}
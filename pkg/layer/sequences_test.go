@@ -0,0 +1,220 @@
+package layer
+
+import (
+	"fmt"
+	"os"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func TestSequences(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "sequences_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	if err := storage.CreateSequence("bad", catalog.SequenceOptions{Start: 1, Cache: 1}); err == nil {
+		t.Errorf("Expected a zero increment to be rejected")
+	}
+
+	opts := catalog.SequenceOptions{Start: 10, Increment: 5, Cache: 4}
+	if err := storage.CreateSequence("orders", opts); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+	if err := storage.CreateSequence("orders", opts); err == nil {
+		t.Errorf("Expected a duplicate sequence to be rejected")
+	}
+
+	for _, want := range []int{10, 15, 20} {
+		if got, err := storage.NextVal("orders"); err != nil || got != want {
+			t.Fatalf("NextVal = %d (%v), want %d", got, err, want)
+		}
+	}
+
+	// Reopening without closing simulates a crash: the cached values up to
+	// 25 may have been handed out, so the sequence continues after them
+	crashed := NewFileStorageLayer()
+	if err := crashed.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	if got, err := crashed.NextVal("orders"); err != nil || got != 30 {
+		t.Errorf("NextVal after crash = %d (%v), want 30", got, err)
+	}
+
+	if err := crashed.SetVal("orders", 100); err != nil {
+		t.Fatalf("SetVal failed: %v", err)
+	}
+	if got, err := crashed.NextVal("orders"); err != nil || got != 105 {
+		t.Errorf("NextVal after SetVal = %d (%v), want 105", got, err)
+	}
+	if _, err := crashed.NextVal("missing"); err == nil {
+		t.Errorf("Expected NextVal of an unknown sequence to fail")
+	}
+	crashed.Close()
+}
+
+func TestAutoIncrement(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "auto_increment_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false, AutoIncrement: true},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+		},
+		PrimaryKey: []string{"id"},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	bad := record.Schema{Columns: []record.Column{{Name: "id", Type: record.TypeFloat, AutoIncrement: true}}}
+	if err := storage.CreateTable("bad", bad); err == nil {
+		t.Errorf("Expected a FLOAT AUTO_INCREMENT column to be rejected")
+	}
+
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	idOf := func(recordID int) int {
+		data, err := storage.Get("users", recordID)
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		values, _ := record.Deserialize(schema, data)
+		return values[0].(int)
+	}
+
+	recordID, err := storage.InsertValues("users", map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if id := idOf(recordID); id != 1 {
+		t.Errorf("Expected id 1, got %d", id)
+	}
+
+	data, _ := record.Serialize(schema, []interface{}{nil, "bob"})
+	if recordID, err = storage.Insert("users", data); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if id := idOf(recordID); id != 2 {
+		t.Errorf("Expected id 2, got %d", id)
+	}
+
+	// An explicit value moves the sequence past it
+	if _, err := storage.InsertValues("users", map[string]interface{}{"id": 50, "name": "carol"}); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if recordID, err = storage.InsertValues("users", map[string]interface{}{"name": "dave"}); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if id := idOf(recordID); id != 51 {
+		t.Errorf("Expected id 51, got %d", id)
+	}
+	storage.Close()
+
+	storage = NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	if recordID, err = storage.InsertValues("users", map[string]interface{}{"name": "erin"}); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if id := idOf(recordID); id <= 51 {
+		t.Errorf("Expected an id above 51 after reopen, got %d", id)
+	}
+}
+
+// Rows that are rejected give back the AUTO_INCREMENT values they took, so
+// the next row gets the value after the last one written.
+func TestRejectedRowsGiveBackSequenceValues(t *testing.T) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false, AutoIncrement: true},
+			{Name: "name", Type: record.TypeString, Length: 50, Nullable: false},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"name"}},
+		Checks:     []record.Check{{Expr: "LENGTH(name) > 0"}},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", Options{FileSystem: vfs.NewMemFS()}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	row := func(id interface{}, name string) []byte {
+		data, err := record.Serialize(schema, []interface{}{id, name})
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		return data
+	}
+	next := 1
+	expectNext := func(step string) {
+		t.Helper()
+		name := fmt.Sprintf("user%d", next)
+		recordID, err := storage.Insert("users", row(nil, name))
+		if err != nil {
+			t.Fatalf("%s: failed to insert: %v", step, err)
+		}
+		data, _ := storage.Get("users", recordID)
+		values, _ := record.Deserialize(schema, data)
+		if values[0] != next {
+			t.Errorf("%s: expected id %d, got %v", step, next, values[0])
+		}
+		next++
+	}
+
+	expectNext("first insert")
+
+	if _, err := storage.Insert("users", row(nil, "")); err == nil {
+		t.Fatalf("Expected the check to reject an empty name")
+	}
+	expectNext("failed insert")
+
+	if _, err := storage.InsertValues("users", map[string]interface{}{"id": 100, "name": "user1"}); err == nil {
+		t.Fatalf("Expected a duplicate name to be rejected")
+	}
+	expectNext("failed insert of an explicit id")
+
+	if _, err := storage.InsertBatch("users", [][]byte{row(nil, "a"), row(nil, "")}); err == nil {
+		t.Fatalf("Expected the batch to be rejected")
+	}
+	expectNext("failed batch")
+
+	if _, err := storage.BulkLoad("users", [][]byte{row(nil, "a"), row(nil, "b"), row(nil, "")}, DefaultBulkLoadOptions()); err == nil {
+		t.Fatalf("Expected the bulk load to be rejected")
+	}
+	expectNext("failed bulk load")
+
+	if err := storage.Update("users", 0, row(200, "")); err == nil {
+		t.Fatalf("Expected the update to be rejected")
+	}
+	expectNext("failed update")
+
+	if _, inserted, err := storage.Upsert("users", []string{"name"}, row(nil, "user1"), DoNothing); err != nil || inserted {
+		t.Fatalf("Expected the upsert to keep the existing row, got inserted=%v (%v)", inserted, err)
+	}
+	expectNext("upsert that did nothing")
+}
@@ -0,0 +1,149 @@
+package layer
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/bptree"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/disk"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/record"
+)
+
+// ReadSnapshot is a read-only view of the whole database as it was when
+// Snapshot was called: the schemas, the rows of every table and the
+// sequences all match one another, while writers carry on. The pages are
+// kept like those of a backup, so a snapshot holds the disk manager's one
+// copy-on-write snapshot until it is released.
+type ReadSnapshot struct {
+	tables    []string
+	schemas   map[string]record.Schema
+	records   map[string]map[int]bptree.RecordID
+	sequences map[string]catalog.SequenceState
+	scanned   map[string]bool
+	snap      *disk.Snapshot
+}
+
+func (fsl *FileStorageLayer) Snapshot() (*ReadSnapshot, error) {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	if !fsl.isOpen {
+		return nil, fmt.Errorf("storage layer is not open")
+	}
+
+	// The snapshot reads pages from disk, so they have to be there
+	if err := fsl.flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush before snapshot: %v", err)
+	}
+
+	s := &ReadSnapshot{
+		tables:    fsl.catalog.ListTables(),
+		schemas:   make(map[string]record.Schema),
+		records:   make(map[string]map[int]bptree.RecordID),
+		sequences: make(map[string]catalog.SequenceState),
+		scanned:   make(map[string]bool),
+	}
+	sort.Strings(s.tables)
+	for _, tableName := range s.tables {
+		schema, err := fsl.catalog.GetSchema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		s.schemas[tableName] = schema
+		s.records[tableName] = fsl.indexes[tableName].GetAllRecords()
+	}
+	for _, name := range fsl.catalog.ListSequences() {
+		state, err := fsl.catalog.GetSequence(name)
+		if err != nil {
+			return nil, err
+		}
+		s.sequences[name] = state
+	}
+
+	snap, err := fsl.diskManager.BeginSnapshot(s.tables)
+	if err != nil {
+		return nil, err
+	}
+	s.snap = snap
+	return s, nil
+}
+
+// Release ends the snapshot, after which it can no longer be scanned.
+func (s *ReadSnapshot) Release() {
+	s.snap.Release()
+}
+
+func (s *ReadSnapshot) ListTables() []string {
+	return append([]string(nil), s.tables...)
+}
+
+func (s *ReadSnapshot) GetSchema(tableName string) (record.Schema, error) {
+	schema, exists := s.schemas[tableName]
+	if !exists {
+		return record.Schema{}, fmt.Errorf("table %s does not exist", tableName)
+	}
+	return schema, nil
+}
+
+// Scan returns the records of a table in ID order. Each table can be
+// scanned once: a page read from the snapshot is no longer preserved.
+func (s *ReadSnapshot) Scan(tableName string) ([][]byte, error) {
+	records, exists := s.records[tableName]
+	if !exists {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+	if s.scanned[tableName] {
+		return nil, fmt.Errorf("table %s has already been scanned", tableName)
+	}
+	s.scanned[tableName] = true
+
+	data := make(map[int][]byte, len(records))
+	var pg *page.Page
+	for _, recordID := range physicalOrder(records) {
+		rid := records[recordID]
+		if pg == nil || pg.PageID != rid.PageID {
+			pageData, err := s.snap.ReadPage(tableName, rid.PageID)
+			if err != nil {
+				return nil, err
+			}
+			if pg = page.LoadPage(rid.PageID, pageData); pg == nil {
+				return nil, fmt.Errorf("failed to load page %d of table %s", rid.PageID, tableName)
+			}
+		}
+		recordData, err := pg.GetRecord(rid.SlotID)
+		if err != nil {
+			return nil, fmt.Errorf("record %d of table %s: %v", recordID, tableName, err)
+		}
+		data[recordID] = recordData
+	}
+
+	ids := make([]int, 0, len(data))
+	for id := range data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	results := make([][]byte, len(ids))
+	for i, id := range ids {
+		results[i] = data[id]
+	}
+	return results, nil
+}
+
+func (s *ReadSnapshot) ListSequences() []string {
+	names := make([]string, 0, len(s.sequences))
+	for name := range s.sequences {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ReadSnapshot) GetSequence(name string) (catalog.SequenceState, error) {
+	state, exists := s.sequences[name]
+	if !exists {
+		return catalog.SequenceState{}, fmt.Errorf("sequence %s does not exist", name)
+	}
+	return state, nil
+}
@@ -0,0 +1,85 @@
+package layer
+
+import (
+	"reflect"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"testing"
+)
+
+func TestReadSnapshot(t *testing.T) {
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 200},
+		},
+	}
+	name := string(make([]byte, 200))
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", Options{FileSystem: vfs.NewMemFS()}); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.CreateTable("t", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := storage.CreateSequence("seq", catalog.DefaultSequenceOptions()); err != nil {
+		t.Fatalf("Failed to create sequence: %v", err)
+	}
+	var ids []int
+	for i := 0; i < 100; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, name})
+		id, err := storage.Insert("t", data)
+		if err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	before, _ := storage.Scan("t", nil)
+
+	snap, err := storage.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	// Changes after the snapshot, flushed over the pages it covers
+	data, _ := record.Serialize(schema, []interface{}{-1, name})
+	if err := storage.Update("t", ids[0], data); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if err := storage.DeleteRecord("t", ids[1]); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := storage.Insert("t", data); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if _, err := storage.NextVal("seq"); err != nil {
+		t.Fatalf("NextVal failed: %v", err)
+	}
+	if err := storage.CreateTable("later", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if tables := snap.ListTables(); !reflect.DeepEqual(tables, []string{"t"}) {
+		t.Errorf("Expected only table t in the snapshot, got %v", tables)
+	}
+	rows, err := snap.Scan("t")
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if !reflect.DeepEqual(rows, before) {
+		t.Errorf("Expected the %d rows from before the snapshot, got %d rows", len(before), len(rows))
+	}
+	if _, err := snap.Scan("t"); err == nil {
+		t.Errorf("Expected a second scan of the same table to fail")
+	}
+	if state, _ := snap.GetSequence("seq"); state.Called {
+		t.Errorf("Expected the sequence as it was, got %+v", state)
+	}
+}
@@ -2,33 +2,73 @@ package layer
 
 import (
 	"fmt"
+	"sort"
 	"storage-layer/pkg/bptree"
 	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/crypt"
 	"storage-layer/pkg/disk"
+	"storage-layer/pkg/expr"
 	"storage-layer/pkg/page"
 	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
 	"sync"
+	"sync/atomic"
 )
 
 type FileStorageLayer struct {
-	basePath    string
-	diskManager *disk.DiskManager
-	catalog     *catalog.CatalogManager
-	pageCache   map[string]map[int32]*page.Page
-	indexes     map[string]*bptree.SimpleIndex
-	isOpen      bool
-	mutex       sync.RWMutex
+	basePath   string
+	fs         vfs.FileSystem
+	durability disk.SyncPolicy
+	// cipher encrypts everything written to disk with keys, or is nil
+	keys          crypt.KeyProvider
+	cipher        *crypt.Cipher
+	diskManager   *disk.DiskManager
+	catalog       *catalog.CatalogManager
+	pages         *pageTable
+	indexes       map[string]*bptree.SimpleIndex
+	uniqueIndexes map[string][]*bptree.UniqueIndex
+	// foreignKeyIndexes are on the referencing columns of each foreign key
+	foreignKeyIndexes map[string][]*bptree.MultiIndex
+	// expressions caches parsed defaults, generated columns and checks
+	expressions      map[string]expr.Expr
+	expressionsMutex sync.Mutex
+	tableLatches     map[string]*sync.RWMutex
+	recordLatches    [recordLatches]sync.Mutex
+	allocationLatch  sync.RWMutex
+	// savedIndexes are the indexes as of the last flush, whose files need
+	// writing again only once they change
+	savedIndexes map[string]savedIndex
+	// bulkWritten is set when a bulk load has written pages around the
+	// page cache since the last flush
+	bulkWritten  atomic.Bool
+	checkpointer *checkpointer
+	// journalPending is set while a failed flush may have left a complete
+	// journal behind, whose replay would undo pages written since
+	journalPending bool
+	// checkpointJournalSize is where the next batch of a checkpoint is
+	// journaled, zero when no pages were written since the last flush
+	checkpointJournalSize int64
+	isOpen                bool
+	mutex                 sync.RWMutex
 }
 
 func NewFileStorageLayer() *FileStorageLayer {
 	return &FileStorageLayer{
-		pageCache: make(map[string]map[int32]*page.Page),
-		indexes:   make(map[string]*bptree.SimpleIndex),
-		isOpen:    false,
+		pages:             newPageTable(0),
+		indexes:           make(map[string]*bptree.SimpleIndex),
+		uniqueIndexes:     make(map[string][]*bptree.UniqueIndex),
+		foreignKeyIndexes: make(map[string][]*bptree.MultiIndex),
+		expressions:       make(map[string]expr.Expr),
+		tableLatches:      make(map[string]*sync.RWMutex),
+		isOpen:            false,
 	}
 }
 
 func (fsl *FileStorageLayer) Open(path string) error {
+	return fsl.OpenWithOptions(path, DefaultOptions())
+}
+
+func (fsl *FileStorageLayer) OpenWithOptions(path string, opts Options) error {
 	fsl.mutex.Lock()
 	defer fsl.mutex.Unlock()
 
@@ -36,42 +76,92 @@ func (fsl *FileStorageLayer) Open(path string) error {
 		return fmt.Errorf("storage layer is already open")
 	}
 
+	if opts.FileSystem == nil {
+		opts.FileSystem = vfs.OS{}
+	}
+
 	fsl.basePath = path
-	fsl.diskManager = disk.NewDiskManager(path)
-	fsl.catalog = catalog.NewCatalogManager(path)
+	fsl.fs = opts.FileSystem
+	fsl.pages = newPageTable(opts.BufferPoolPages)
+	fsl.durability = opts.Durability.Policy
+	if fsl.durability == disk.SyncNone {
+		fsl.fs = vfs.NoSync(fsl.fs)
+	}
+	fsl.diskManager = disk.NewDiskManagerFS(path, fsl.fs)
+	fsl.diskManager.SetDurability(opts.Durability)
+	fsl.diskManager.SetDirectIO(opts.DirectIO)
+	fsl.diskManager.SetMmap(opts.Mmap)
+	fsl.diskManager.SetReadAhead(opts.ReadAheadPages)
+	fsl.keys = opts.Keys
+	fsl.cipher = crypt.NewCipher(opts.Keys)
+	fsl.diskManager.SetCipher(fsl.cipher)
+	fsl.catalog = catalog.NewCatalogManagerFS(path, fsl.fs)
+	fsl.catalog.SetCipher(fsl.cipher)
+	fsl.savedIndexes = make(map[string]savedIndex)
+	fsl.journalPending = false
+	fsl.checkpointJournalSize = 0
 
 	if err := fsl.diskManager.Open(); err != nil {
 		return fmt.Errorf("failed to open disk manager: %v", err)
 	}
 
+	// The catalog is saved before any flush that depends on it, so it is
+	// complete before the journal is replayed, and says which new table
+	// files the replay creates compressed
 	if err := fsl.catalog.Load(); err != nil {
 		return fmt.Errorf("failed to load catalog: %v", err)
 	}
 
 	for _, tableName := range fsl.catalog.ListTables() {
-		index := bptree.NewSimpleIndex(tableName, path)
+		schema, _ := fsl.catalog.GetSchema(tableName)
+		if err := fsl.diskManager.SetCompression(tableName, schema.Compression); err != nil {
+			return fmt.Errorf("invalid compression for table %s: %v", tableName, err)
+		}
+	}
+
+	if err := fsl.recoverJournal(); err != nil {
+		return fmt.Errorf("failed to recover flush journal: %v", err)
+	}
+
+	for _, tableName := range fsl.catalog.ListTables() {
+		index := fsl.newIndex(tableName)
 		if err := index.Load(); err != nil {
 			return fmt.Errorf("failed to load index for table %s: %v", tableName, err)
 		}
 		fsl.indexes[tableName] = index
-		fsl.pageCache[tableName] = make(map[int32]*page.Page)
+		fsl.savedIndexes[tableName] = savedIndex{index, index.Version()}
+		fsl.tableLatches[tableName] = &sync.RWMutex{}
+
+		if err := fsl.loadKeyIndexes(tableName); err != nil {
+			return fmt.Errorf("failed to build key indexes for table %s: %v", tableName, err)
+		}
+	}
+
+	if err := fsl.refreshSystemTables(); err != nil {
+		return err
 	}
 
 	fsl.isOpen = true
+	fsl.startCheckpointer(opts)
 	return nil
 }
 
 func (fsl *FileStorageLayer) Close() error {
+	fsl.stopCheckpointer()
+
 	fsl.mutex.Lock()
 	defer fsl.mutex.Unlock()
 
 	if !fsl.isOpen {
 		return nil
 	}
+	fsl.checkpointer = nil
 
-	if err := fsl.Flush(); err != nil {
+	if err := fsl.flush(); err != nil {
 		return fmt.Errorf("failed to flush during close: %v", err)
 	}
+	// Clean pages may still be shared with the file mappings
+	fsl.pages.dropAll()
 
 	if err := fsl.diskManager.Close(); err != nil {
 		return fmt.Errorf("failed to close disk manager: %v", err)
@@ -89,30 +179,157 @@ func (fsl *FileStorageLayer) CreateTable(tableName string, schema record.Schema)
 		return fmt.Errorf("storage layer is not open")
 	}
 
+	uniqueIndexes, foreignKeyIndexes, err := newKeyIndexes(tableName, schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema for table %s: %v", tableName, err)
+	}
+	if err := disk.ValidCompression(schema.Compression); err != nil {
+		return fmt.Errorf("invalid schema for table %s: %v", tableName, err)
+	}
+	if err := fsl.checkSystemRows(tableName, schema); err != nil {
+		return fmt.Errorf("invalid schema for table %s: %v", tableName, err)
+	}
+
 	if err := fsl.catalog.CreateTable(tableName, schema); err != nil {
 		return err
 	}
+	if err := fsl.diskManager.SetCompression(tableName, schema.Compression); err != nil {
+		return err
+	}
 
-	index := bptree.NewSimpleIndex(tableName, fsl.basePath)
+	index := fsl.newIndex(tableName)
 	fsl.indexes[tableName] = index
-	fsl.pageCache[tableName] = make(map[int32]*page.Page)
+	fsl.uniqueIndexes[tableName] = uniqueIndexes
+	fsl.foreignKeyIndexes[tableName] = foreignKeyIndexes
+	fsl.tableLatches[tableName] = &sync.RWMutex{}
+	fsl.pages.drop(tableName)
 
-	return nil
+	return fsl.refreshSystemTables()
+}
+
+func (fsl *FileStorageLayer) newIndex(tableName string) *bptree.SimpleIndex {
+	index := bptree.NewSimpleIndexFS(tableName, fsl.basePath, fsl.fs)
+	index.SetCipher(fsl.cipher)
+	return index
+}
+
+func (fsl *FileStorageLayer) GetSchema(tableName string) (record.Schema, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return record.Schema{}, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.GetSchema(tableName)
+}
+
+// CatalogVersion returns a counter that every schema change increments.
+func (fsl *FileStorageLayer) CatalogVersion() (uint64, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return 0, fmt.Errorf("storage layer is not open")
+	}
+
+	return fsl.catalog.Version(), nil
+}
+
+// CompressionStats reports how the pages of a table are stored on disk, as
+// of the last flush.
+func (fsl *FileStorageLayer) CompressionStats(tableName string) (disk.CompressionStats, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return disk.CompressionStats{}, fmt.Errorf("storage layer is not open")
+	}
+	if !fsl.catalog.TableExists(tableName) {
+		return disk.CompressionStats{}, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	return fsl.diskManager.CompressionStats(tableName)
+}
+
+func (fsl *FileStorageLayer) ListTables() ([]string, error) {
+	fsl.mutex.RLock()
+	defer fsl.mutex.RUnlock()
+
+	if !fsl.isOpen {
+		return nil, fmt.Errorf("storage layer is not open")
+	}
+
+	tables := fsl.catalog.ListTables()
+	sort.Strings(tables)
+	return tables, nil
 }
 
 func (fsl *FileStorageLayer) Insert(tableName string, recordData []byte) (int, error) {
-	fsl.mutex.Lock()
-	defer fsl.mutex.Unlock()
+	unlock := fsl.lockWrite(tableName, false)
+	defer unlock()
 
 	if !fsl.isOpen {
 		return -1, fmt.Errorf("storage layer is not open")
 	}
 
+	if err := checkWritable(tableName); err != nil {
+		return -1, err
+	}
+
 	if !fsl.catalog.TableExists(tableName) {
 		return -1, fmt.Errorf("table %s does not exist", tableName)
 	}
 
-	pageID, slotID, err := fsl.insertRecord(tableName, recordData)
+	if !fsl.hasConstraints(tableName) {
+		return fsl.insertRow(tableName, recordData, nil, nil)
+	}
+
+	values, err := fsl.decodeRecord(tableName, recordData)
+	if err != nil {
+		return -1, err
+	}
+	var taken []catalog.SequenceUse
+	id, err := fsl.insertValues(tableName, values, nil, nil, &taken)
+	if err != nil {
+		fsl.catalog.GiveBack(taken)
+	}
+	return id, err
+}
+
+// insertValues completes a row, checks its constraints and inserts it. The
+// sequence values it uses are added to taken, see completeRow.
+func (fsl *FileStorageLayer) insertValues(tableName string, values []interface{}, provided []bool, hint *int32, taken *[]catalog.SequenceUse) (int, error) {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return -1, err
+	}
+
+	values, err = fsl.completeRow(tableName, values, provided, taken)
+	if err != nil {
+		return -1, err
+	}
+
+	recordData, err := record.Serialize(schema, values)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := fsl.checkUnique(tableName, values, -1); err != nil {
+		return -1, err
+	}
+	if err := fsl.checkForeignKeys(tableName, values); err != nil {
+		return -1, err
+	}
+
+	return fsl.insertRow(tableName, recordData, values, hint)
+}
+
+// insertRow stores a record and indexes it. values is the decoded record
+// if the table has key indexes to maintain. hint is passed on to
+// insertRecord.
+func (fsl *FileStorageLayer) insertRow(tableName string, recordData []byte, values []interface{}, hint *int32) (int, error) {
+	pageID, slotID, err := fsl.insertRecord(tableName, recordData, hint)
 	if err != nil {
 		return -1, err
 	}
@@ -127,6 +344,12 @@ func (fsl *FileStorageLayer) Insert(tableName string, recordData []byte) (int, e
 		return -1, fmt.Errorf("failed to insert into index: %v", err)
 	}
 
+	if values != nil {
+		if err := fsl.addKeys(tableName, values, recordID); err != nil {
+			return -1, err
+		}
+	}
+
 	return recordID, nil
 }
 
@@ -138,63 +361,202 @@ func (fsl *FileStorageLayer) Get(tableName string, recordID int) ([]byte, error)
 		return nil, fmt.Errorf("storage layer is not open")
 	}
 
-	rid, exists := fsl.indexes[tableName].Search(recordID)
-	if !exists {
-		return nil, fmt.Errorf("record %d not found", recordID)
-	}
+	_, data, err := fsl.readRecord(tableName, recordID)
+	return data, err
+}
 
-	page, err := fsl.getPage(tableName, rid.PageID)
-	if err != nil {
-		return nil, err
+// readRecord reads a record by ID without holding any write lock. A writer
+// may move or delete the record while it is read, so the read is repeated
+// until the index still points where the record was read from.
+func (fsl *FileStorageLayer) readRecord(tableName string, recordID int) (bptree.RecordID, []byte, error) {
+	index := fsl.indexes[tableName]
+	if index == nil {
+		return bptree.RecordID{}, nil, fmt.Errorf("table %s does not exist", tableName)
 	}
 
-	return page.GetRecord(rid.SlotID)
+	rid, exists := index.Search(recordID)
+	for {
+		if !exists {
+			return bptree.RecordID{}, nil, fmt.Errorf("record %d not found", recordID)
+		}
+
+		data, err := fsl.getRecord(tableName, rid)
+
+		current, stillExists := index.Search(recordID)
+		if stillExists && current == rid {
+			return rid, data, err
+		}
+		rid, exists = current, stillExists
+	}
 }
 
 func (fsl *FileStorageLayer) Update(tableName string, recordID int, updatedRecord []byte) error {
-	fsl.mutex.Lock()
-	defer fsl.mutex.Unlock()
+	unlock := fsl.lockWrite(tableName, false)
+	defer unlock()
+	defer fsl.lockRecord(recordID)()
 
 	if !fsl.isOpen {
 		return fmt.Errorf("storage layer is not open")
 	}
 
+	if err := checkWritable(tableName); err != nil {
+		return err
+	}
+
 	rid, exists := fsl.indexes[tableName].Search(recordID)
 	if !exists {
 		return fmt.Errorf("record %d not found", recordID)
 	}
 
-	page, err := fsl.getPage(tableName, rid.PageID)
+	return fsl.update(tableName, recordID, rid, updatedRecord, false)
+}
+
+// update replaces a record after checking its constraints. With inPlace set
+// it fails instead of moving a record whose size changed.
+func (fsl *FileStorageLayer) update(tableName string, recordID int, rid bptree.RecordID, updatedRecord []byte, inPlace bool) (err error) {
+	var taken []catalog.SequenceUse
+	defer func() {
+		if err != nil {
+			fsl.catalog.GiveBack(taken)
+		}
+	}()
+
+	oldRecord, err := fsl.getRecord(tableName, rid)
+	if err != nil {
+		return err
+	}
+
+	var oldValues, newValues []interface{}
+	if fsl.hasConstraints(tableName) {
+		if oldValues, err = fsl.decodeRecord(tableName, oldRecord); err != nil {
+			return err
+		}
+		if newValues, err = fsl.decodeRecord(tableName, updatedRecord); err != nil {
+			return err
+		}
+		if newValues, err = fsl.completeRow(tableName, newValues, nil, &taken); err != nil {
+			return err
+		}
+		schema, err := fsl.catalog.GetSchema(tableName)
+		if err != nil {
+			return err
+		}
+		if updatedRecord, err = record.Serialize(schema, newValues); err != nil {
+			return err
+		}
+		if err := fsl.checkUnique(tableName, newValues, recordID); err != nil {
+			return err
+		}
+		if err := fsl.checkForeignKeys(tableName, newValues); err != nil {
+			return err
+		}
+		if err := fsl.applyReferentialActions(tableName, oldValues, newValues, false, visitedSet(tableName, recordID)); err != nil {
+			return err
+		}
+	}
+
+	if inPlace && len(oldRecord) != len(updatedRecord) {
+		return fmt.Errorf("record %d changed size from %d to %d bytes and cannot be updated in place", recordID, len(oldRecord), len(updatedRecord))
+	}
+
+	if err := fsl.updateRecord(tableName, recordID, rid, oldRecord, updatedRecord); err != nil {
+		return err
+	}
+	// The row is written, so its values are kept whatever happens next
+	taken = nil
+
+	if newValues != nil {
+		fsl.removeKeys(tableName, oldValues, recordID)
+		if err := fsl.addKeys(tableName, newValues, recordID); err != nil {
+			return err
+		}
+		return fsl.applyReferentialActions(tableName, oldValues, newValues, true, visitedSet(tableName, recordID))
+	}
+
+	return nil
+}
+
+func (fsl *FileStorageLayer) updateRecord(tableName string, recordID int, rid bptree.RecordID, oldRecord, updatedRecord []byte) error {
+	f, err := fsl.getPage(tableName, rid.PageID)
 	if err != nil {
 		return err
 	}
+	defer f.release()
+
+	if len(oldRecord) == len(updatedRecord) {
+		return f.write(func(pg *page.Page) error {
+			return pg.UpdateRecord(rid.SlotID, updatedRecord)
+		})
+	}
 
-	return page.UpdateRecord(rid.SlotID, updatedRecord)
+	// The record changed size, so it moves to wherever it fits. The new copy
+	// is written before the old one is removed so a failure loses nothing,
+	// and the index points at it before the old slot can be reused, so a
+	// concurrent reader notices the move.
+	newPageID, newSlotID, err := fsl.insertRecord(tableName, updatedRecord, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fsl.indexes[tableName].Update(recordID, bptree.RecordID{
+		PageID: newPageID,
+		SlotID: newSlotID,
+	}); err != nil {
+		return err
+	}
+
+	return f.write(func(pg *page.Page) error { return pg.DeleteRecord(rid.SlotID) })
 }
 
 func (fsl *FileStorageLayer) DeleteRecord(tableName string, recordID int) error {
-	fsl.mutex.Lock()
-	defer fsl.mutex.Unlock()
+	unlock := fsl.lockWrite(tableName, false)
+	defer unlock()
+	defer fsl.lockRecord(recordID)()
 
 	if !fsl.isOpen {
 		return fmt.Errorf("storage layer is not open")
 	}
 
+	if err := checkWritable(tableName); err != nil {
+		return err
+	}
+
 	rid, exists := fsl.indexes[tableName].Search(recordID)
 	if !exists {
 		return fmt.Errorf("record %d not found", recordID)
 	}
 
-	page, err := fsl.getPage(tableName, rid.PageID)
+	return fsl.delete(tableName, recordID, rid)
+}
+
+func (fsl *FileStorageLayer) delete(tableName string, recordID int, rid bptree.RecordID) error {
+	if fsl.hasConstraints(tableName) {
+		values, err := fsl.readValues(tableName, recordID)
+		if err != nil {
+			return err
+		}
+		if err := fsl.applyReferentialActions(tableName, values, nil, false, visitedSet(tableName, recordID)); err != nil {
+			return err
+		}
+		if err := fsl.applyReferentialActions(tableName, values, nil, true, visitedSet(tableName, recordID)); err != nil {
+			return err
+		}
+		return fsl.deleteRow(tableName, recordID, values)
+	}
+
+	f, err := fsl.getPage(tableName, rid.PageID)
 	if err != nil {
 		return err
 	}
+	defer f.release()
 
-	if err := page.DeleteRecord(rid.SlotID); err != nil {
+	// The ID goes first, so readers holding rid see that it is gone before
+	// the slot can be reused
+	if err := fsl.indexes[tableName].Delete(recordID); err != nil {
 		return err
 	}
 
-	return fsl.indexes[tableName].Delete(recordID)
+	return f.write(func(pg *page.Page) error { return pg.DeleteRecord(rid.SlotID) })
 }
 
 func (fsl *FileStorageLayer) Scan(tableName string, filter func([]byte) bool) ([][]byte, error) {
@@ -205,35 +567,27 @@ func (fsl *FileStorageLayer) Scan(tableName string, filter func([]byte) bool) ([
 		return nil, fmt.Errorf("storage layer is not open")
 	}
 
-	if !fsl.catalog.TableExists(tableName) {
-		return nil, fmt.Errorf("table %s does not exist", tableName)
+	matches, err := fsl.scan(tableName, filter)
+	if err != nil {
+		return nil, err
 	}
 
 	var results [][]byte
-
-	allRecords := fsl.indexes[tableName].GetAllRecords()
-
-	for _, rid := range allRecords {
-
-		page, err := fsl.getPage(tableName, rid.PageID)
-		if err != nil {
-			continue
-		}
-
-		recordData, err := page.GetRecord(rid.SlotID)
-		if err != nil {
-			continue
-		}
-
-		if filter == nil || filter(recordData) {
-			results = append(results, recordData)
-		}
+	for _, match := range matches {
+		results = append(results, match.Data)
 	}
 
 	return results, nil
 }
 
 func (fsl *FileStorageLayer) Flush() error {
+	fsl.mutex.Lock()
+	defer fsl.mutex.Unlock()
+
+	return fsl.flush()
+}
+
+func (fsl *FileStorageLayer) flush() error {
 	if !fsl.isOpen {
 		return fmt.Errorf("storage layer is not open")
 	}
@@ -242,83 +596,143 @@ func (fsl *FileStorageLayer) Flush() error {
 		return fmt.Errorf("failed to save catalog: %v", err)
 	}
 
-	for _, index := range fsl.indexes {
-		if err := index.Save(); err != nil {
-			return fmt.Errorf("failed to save index: %v", err)
-		}
+	// Pages stay dirty until the whole flush is done, so a failed flush is
+	// retried in full by the next one
+	entries, flushed, err := fsl.flushEntries()
+	if err != nil {
+		return err
 	}
 
-	for tableName, pages := range fsl.pageCache {
-		for pageID, page := range pages {
-			if page.IsDirty() {
-				if err := fsl.diskManager.WritePage(tableName, pageID, page.GetData()); err != nil {
-					return fmt.Errorf("failed to write page %d for table %s: %v", pageID, tableName, err)
-				}
-				page.SetClean()
-			}
+	// Without syncs nothing survives a crash in a known state, so the
+	// journal would be written for nothing
+	journaled := fsl.durability != disk.SyncNone
+	if journaled {
+		fsl.journalPending = true
+		if err := fsl.writeJournal(entries); err != nil {
+			return fmt.Errorf("failed to write flush journal: %v", err)
 		}
 	}
+	if err := fsl.applyJournal(entries); err != nil {
+		return err
+	}
+	// The pages a checkpoint wrote ahead of this flush now match the index
+	// files. Its journal goes first, as recovery only rolls them back when
+	// there is no flush journal to replay.
+	if err := fsl.clearCheckpointJournal(); err != nil {
+		return fmt.Errorf("failed to clear checkpoint journal: %v", err)
+	}
+	if journaled {
+		if err := fsl.clearJournal(); err != nil {
+			return fmt.Errorf("failed to clear flush journal: %v", err)
+		}
+	}
+	fsl.journalPending = false
+
+	for _, f := range flushed {
+		f.write(func(pg *page.Page) error {
+			pg.SetClean()
+			return nil
+		})
+	}
+	for tableName, index := range fsl.indexes {
+		fsl.savedIndexes[tableName] = savedIndex{index, index.Version()}
+	}
+	fsl.bulkWritten.Store(false)
 
 	return nil
 }
 
-func (fsl *FileStorageLayer) getPage(tableName string, pageID int32) (*page.Page, error) {
+// getPage returns the frame of a page, pinned until it is released.
+func (fsl *FileStorageLayer) getPage(tableName string, pageID int32) (*frame, error) {
+	return fsl.pages.get(tableName, pageID, func() (*page.Page, error) {
+		// A mapped page is shared until it is first changed
+		data, release, err := fsl.diskManager.PinPage(tableName, pageID)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			return page.SharePage(pageID, data, release), nil
+		}
 
-	if pages, exists := fsl.pageCache[tableName]; exists {
-		if page, exists := pages[pageID]; exists {
-			return page, nil
+		// Otherwise it is copied out of the disk manager's buffer
+		var pg *page.Page
+		err = fsl.diskManager.ViewPage(tableName, pageID, func(data []byte) error {
+			if pg = page.LoadPage(pageID, data); pg == nil {
+				return fmt.Errorf("failed to load page %d", pageID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-	}
+		return pg, nil
+	})
+}
 
-	data, err := fsl.diskManager.ReadPage(tableName, pageID)
+func (fsl *FileStorageLayer) getRecord(tableName string, rid bptree.RecordID) ([]byte, error) {
+	f, err := fsl.getPage(tableName, rid.PageID)
 	if err != nil {
 		return nil, err
 	}
+	defer f.release()
 
-	pg := page.LoadPage(pageID, data)
-	if pg == nil {
-		return nil, fmt.Errorf("failed to load page %d", pageID)
-	}
-
-	if fsl.pageCache[tableName] == nil {
-		fsl.pageCache[tableName] = make(map[int32]*page.Page)
-	}
-	fsl.pageCache[tableName][pageID] = pg
-
-	return pg, nil
+	return f.getRecord(rid.SlotID)
 }
 
-func (fsl *FileStorageLayer) insertRecord(tableName string, recordData []byte) (int32, int, error) {
-
+// insertRecord stores a record in the first page with room for it. If hint
+// is given the search starts at that page, and hint is moved to the page
+// used, so a series of inserts does not rescan the full pages.
+func (fsl *FileStorageLayer) insertRecord(tableName string, recordData []byte, hint *int32) (int32, int, error) {
+	fsl.allocationLatch.RLock()
 	pageCount := fsl.diskManager.GetPageCount(tableName)
+	fsl.allocationLatch.RUnlock()
+
+	start := int32(0)
+	if hint != nil {
+		start = *hint
+	}
 
-	for pageID := int32(0); pageID < pageCount; pageID++ {
-		page, err := fsl.getPage(tableName, pageID)
+	for pageID := start; pageID < pageCount; pageID++ {
+		f, err := fsl.getPage(tableName, pageID)
 		if err != nil {
 			continue
 		}
 
-		slotID, err := page.InsertRecord(recordData)
+		var slotID int
+		err = f.write(func(pg *page.Page) error {
+			slotID, err = pg.InsertRecord(recordData)
+			return err
+		})
+		f.release()
 		if err == nil {
+			if hint != nil {
+				*hint = pageID
+			}
 			return pageID, slotID, nil
 		}
 	}
 
+	// Other writers only see the new page once it is cached, so none of
+	// them loads it from disk, where it has not been written yet
+	fsl.allocationLatch.Lock()
 	newPageID, err := fsl.diskManager.AllocatePage(tableName)
 	if err != nil {
+		fsl.allocationLatch.Unlock()
 		return -1, -1, err
 	}
 
 	newPage := page.NewPage(newPageID)
 	slotID, err := newPage.InsertRecord(recordData)
 	if err != nil {
+		fsl.allocationLatch.Unlock()
 		return -1, -1, err
 	}
 
-	if fsl.pageCache[tableName] == nil {
-		fsl.pageCache[tableName] = make(map[int32]*page.Page)
-	}
-	fsl.pageCache[tableName][newPageID] = newPage
+	fsl.pages.put(tableName, newPage)
+	fsl.allocationLatch.Unlock()
 
+	if hint != nil {
+		*hint = newPageID
+	}
 	return newPageID, slotID, nil
 }
@@ -0,0 +1,206 @@
+package layer
+
+import (
+	"fmt"
+	"sort"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/page"
+	"storage-layer/pkg/record"
+	"strings"
+	"sync"
+)
+
+// System tables are ordinary heap tables describing the catalog. They are
+// read-only for users and rebuilt from the catalog when the storage layer
+// is opened and after every schema change, so they never disagree with it.
+// The catalog file stays the source of truth; the system tables only make
+// it scannable.
+
+func checkWritable(tableName string) error {
+	if catalog.IsSystemTable(tableName) {
+		return fmt.Errorf("system table %s is read-only", tableName)
+	}
+	return nil
+}
+
+func (fsl *FileStorageLayer) refreshSystemTables() error {
+	schemas, err := fsl.catalogSchemas()
+	if err != nil {
+		return err
+	}
+	rows := systemRows(schemas)
+
+	for _, tableName := range catalog.SystemTables() {
+		if err := fsl.rebuildSystemTable(tableName, rows[tableName]); err != nil {
+			return fmt.Errorf("failed to rebuild system table %s: %v", tableName, err)
+		}
+	}
+	return nil
+}
+
+// checkSystemRows fails if the system tables could not describe the catalog
+// once tableName is added with schema. It runs before the catalog is saved,
+// as a catalog that cannot be described could not be opened again.
+func (fsl *FileStorageLayer) checkSystemRows(tableName string, schema record.Schema) error {
+	schemas, err := fsl.catalogSchemas()
+	if err != nil {
+		return err
+	}
+	schemas[tableName] = schema
+
+	rows := systemRows(schemas)
+	for _, systemTable := range catalog.SystemTables() {
+		systemSchema, err := fsl.catalog.GetSchema(systemTable)
+		if err != nil {
+			return err
+		}
+
+		keys := make(map[string]bool)
+		for _, values := range rows[systemTable] {
+			data, err := record.Serialize(systemSchema, values)
+			if err != nil {
+				return fmt.Errorf("cannot be described in %s: %v", systemTable, err)
+			}
+			if len(data) > page.MaxRecordSize {
+				return fmt.Errorf("cannot be described in %s: row of %d bytes does not fit in a page", systemTable, len(data))
+			}
+
+			key := fmt.Sprintf("%#v", keyValues(systemSchema, values))
+			if keys[key] {
+				return fmt.Errorf("duplicate %s in %s: %v", strings.Join(systemSchema.PrimaryKey, ", "), systemTable, keyValues(systemSchema, values))
+			}
+			keys[key] = true
+		}
+	}
+	return nil
+}
+
+func keyValues(schema record.Schema, values []interface{}) []interface{} {
+	key := make([]interface{}, len(schema.PrimaryKey))
+	for i, name := range schema.PrimaryKey {
+		key[i] = values[schema.ColumnIndex(name)]
+	}
+	return key
+}
+
+// catalogSchemas returns the schemas of the user and system tables. A user
+// table named like a system table predates the reservation and would be
+// overwritten, so it is an error.
+func (fsl *FileStorageLayer) catalogSchemas() (map[string]record.Schema, error) {
+	schemas := make(map[string]record.Schema)
+	for _, tableName := range fsl.catalog.ListTables() {
+		if catalog.IsSystemTable(tableName) {
+			return nil, fmt.Errorf("table %s has the name of a system table", tableName)
+		}
+		schema, err := fsl.catalog.GetSchema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		schemas[tableName] = schema
+	}
+	for _, tableName := range catalog.SystemTables() {
+		schema, err := fsl.catalog.GetSchema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		schemas[tableName] = schema
+	}
+	return schemas, nil
+}
+
+// rebuildSystemTable replaces the contents of a system table. The old index
+// file is never loaded, so a crash before the next flush leaves nothing
+// stale behind.
+func (fsl *FileStorageLayer) rebuildSystemTable(tableName string, rows [][]interface{}) error {
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return err
+	}
+
+	if err := fsl.diskManager.Truncate(tableName); err != nil {
+		return err
+	}
+	fsl.pages.drop(tableName)
+	if fsl.tableLatches[tableName] == nil {
+		fsl.tableLatches[tableName] = &sync.RWMutex{}
+	}
+	fsl.indexes[tableName] = fsl.newIndex(tableName)
+
+	uniqueIndexes, foreignKeyIndexes, err := newKeyIndexes(tableName, schema)
+	if err != nil {
+		return err
+	}
+	fsl.uniqueIndexes[tableName] = uniqueIndexes
+	fsl.foreignKeyIndexes[tableName] = foreignKeyIndexes
+
+	hint := int32(0)
+	for _, values := range rows {
+		data, err := record.Serialize(schema, values)
+		if err != nil {
+			return err
+		}
+		if _, err := fsl.insertRow(tableName, data, values, &hint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// systemRows describes every table in schemas in name order. Indexes have
+// the names of their constraints, as reported in ConstraintViolation.
+func systemRows(schemas map[string]record.Schema) map[string][][]interface{} {
+	tables := make([]string, 0, len(schemas))
+	for tableName := range schemas {
+		tables = append(tables, tableName)
+	}
+	sort.Strings(tables)
+
+	rows := make(map[string][][]interface{})
+	for _, tableName := range tables {
+		schema := schemas[tableName]
+
+		rows[catalog.TablesTable] = append(rows[catalog.TablesTable], []interface{}{
+			tableName, len(schema.Columns), flag(catalog.IsSystemTable(tableName)),
+		})
+
+		for i, col := range schema.Columns {
+			rows[catalog.ColumnsTable] = append(rows[catalog.ColumnsTable], []interface{}{
+				tableName, i + 1, col.Name, string(col.Type), col.Length, flag(col.Nullable),
+				optional(col.Default), optional(col.Generated), flag(col.AutoIncrement),
+			})
+		}
+
+		if len(schema.PrimaryKey) > 0 {
+			rows[catalog.IndexesTable] = append(rows[catalog.IndexesTable], []interface{}{
+				schema.PrimaryKeyName(tableName), tableName, "PRIMARY KEY", strings.Join(schema.PrimaryKey, ","), nil, nil,
+			})
+		}
+		for i, columns := range schema.Unique {
+			rows[catalog.IndexesTable] = append(rows[catalog.IndexesTable], []interface{}{
+				schema.UniqueKeyName(tableName, i), tableName, "UNIQUE", strings.Join(columns, ","), nil, nil,
+			})
+		}
+		for i, fk := range schema.ForeignKeys {
+			rows[catalog.IndexesTable] = append(rows[catalog.IndexesTable], []interface{}{
+				schema.ForeignKeyName(tableName, i), tableName, ConstraintForeignKey, strings.Join(fk.Columns, ","),
+				fk.RefTable, strings.Join(fk.RefColumns, ","),
+			})
+		}
+	}
+
+	return rows
+}
+
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,275 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/record"
+	"strings"
+	"testing"
+)
+
+func TestSystemTables(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "system_tables_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	users := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "email", Type: record.TypeString, Length: 64},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"email"}},
+	}
+	orders := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, AutoIncrement: true},
+			{Name: "user_id", Type: record.TypeInt, Nullable: true},
+			{Name: "status", Type: record.TypeString, Length: 16, Default: "'new'"},
+		},
+		PrimaryKey:  []string{"id"},
+		ForeignKeys: []record.ForeignKey{{Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}}},
+	}
+	if err := storage.CreateTable("users", users); err != nil {
+		t.Fatalf("Failed to create users: %v", err)
+	}
+	if err := storage.CreateTable("orders", orders); err != nil {
+		t.Fatalf("Failed to create orders: %v", err)
+	}
+	if err := storage.CreateTable(catalog.TablesTable, users); err == nil {
+		t.Errorf("Expected a reserved table name to be rejected")
+	}
+
+	tables, _ := storage.ListTables()
+	if len(tables) != 2 {
+		t.Errorf("ListTables = %v, want only the user tables", tables)
+	}
+
+	check := func(storage *FileStorageLayer) {
+		t.Helper()
+
+		names := scanColumn(t, storage, catalog.TablesTable, "name")
+		want := []interface{}{"__columns", "__indexes", "__tables", "orders", "users"}
+		if !equalValues(names, want) {
+			t.Errorf("__tables names = %v, want %v", names, want)
+		}
+
+		columns := scanRows(t, storage, catalog.ColumnsTable)
+		var status map[string]interface{}
+		for _, row := range columns {
+			if row["table_name"] == "orders" && row["name"] == "status" {
+				status = row
+			}
+		}
+		if status == nil || status["position"] != 3 || status["type"] != "STRING" || status["default"] != "'new'" || status["nullable"] != 0 {
+			t.Errorf("orders.status in __columns = %v", status)
+		}
+
+		indexes := scanColumn(t, storage, catalog.IndexesTable, "name")
+		for _, name := range []string{"users_pkey", "users_email_key", "orders_pkey", "orders_user_id_fkey"} {
+			found := false
+			for _, got := range indexes {
+				found = found || got == name
+			}
+			if !found {
+				t.Errorf("__indexes is missing %s: %v", name, indexes)
+			}
+		}
+	}
+	check(storage)
+
+	// Indexes have the names their constraints are reported under
+	constraintOf := func(err error) string {
+		var violation *ConstraintViolation
+		if !errors.As(err, &violation) {
+			t.Fatalf("Expected a constraint violation, got %v", err)
+		}
+		return violation.Constraint
+	}
+	if _, err := storage.Insert("users", mustSerialize(t, users, 1, "a@example.com")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	_, err = storage.Insert("users", mustSerialize(t, users, 1, "b@example.com"))
+	pkey := constraintOf(err)
+	_, err = storage.Insert("users", mustSerialize(t, users, 2, "a@example.com"))
+	key := constraintOf(err)
+	_, err = storage.Insert("orders", mustSerialize(t, orders, 1, 9, "new"))
+	fkey := constraintOf(err)
+	indexes := scanColumn(t, storage, catalog.IndexesTable, "name")
+	for _, name := range []string{pkey, key, fkey} {
+		found := false
+		for _, got := range indexes {
+			found = found || got == name
+		}
+		if !found {
+			t.Errorf("Constraint %s is not in __indexes: %v", name, indexes)
+		}
+	}
+
+	if _, err := storage.Insert(catalog.TablesTable, nil); err == nil {
+		t.Errorf("Expected writes to a system table to be rejected")
+	}
+	if err := storage.DeleteRecord(catalog.TablesTable, 1); err == nil {
+		t.Errorf("Expected deletes from a system table to be rejected")
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+// Schema changes the system tables cannot describe are rejected before the
+// catalog is saved, so the database still opens afterwards.
+func TestSystemTablesDescribeEverySchema(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "system_tables_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+
+	schema := func(unique string, def string) record.Schema {
+		return record.Schema{
+			Columns: []record.Column{
+				{Name: "id", Type: record.TypeInt},
+				{Name: unique, Type: record.TypeString, Length: 8000, Default: def},
+			},
+			PrimaryKey: []string{"id"},
+			Unique:     [][]string{{unique}},
+		}
+	}
+	longDefault := "'" + strings.Repeat("x", 2000) + "'"
+
+	// Unique keys on a(b_c) and a_b(c) have the same name, in different
+	// tables
+	if err := storage.CreateTable("a", schema("b_c", longDefault)); err != nil {
+		t.Fatalf("Failed to create a: %v", err)
+	}
+	if err := storage.CreateTable("a_b", schema("c", "")); err != nil {
+		t.Fatalf("Failed to create a_b: %v", err)
+	}
+	// Not reserved, unlike the system table names
+	if err := storage.CreateTable("__mine", schema("c", "")); err != nil {
+		t.Fatalf("Failed to create __mine: %v", err)
+	}
+	if _, err := storage.Insert("__mine", mustSerialize(t, schema("c", ""), 1, "x")); err != nil {
+		t.Errorf("Failed to insert into __mine: %v", err)
+	}
+
+	if err := storage.CreateTable("huge", schema("c", "'"+strings.Repeat("x", 5000)+"'")); err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("Expected a default too long for __columns to be rejected, got %v", err)
+	}
+	named := schema("c", "")
+	named.ForeignKeys = []record.ForeignKey{{Name: "named_pkey", Columns: []string{"id"}, RefTable: "a", RefColumns: []string{"id"}}}
+	if err := storage.CreateTable("named", named); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Expected a foreign key named like another index to be rejected, got %v", err)
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.Open(tempDir); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+
+	tables := scanColumn(t, reopened, catalog.TablesTable, "name")
+	want := []interface{}{"__columns", "__indexes", "__mine", "__tables", "a", "a_b"}
+	if !equalValues(tables, want) {
+		t.Errorf("__tables names = %v, want %v", tables, want)
+	}
+	var keyTables []interface{}
+	for _, row := range scanRows(t, reopened, catalog.IndexesTable) {
+		if row["name"] == "a_b_c_key" {
+			keyTables = append(keyTables, row["table_name"])
+		}
+	}
+	if !equalValues(keyTables, []interface{}{"a", "a_b"}) {
+		t.Errorf("Expected a_b_c_key in tables a and a_b, got %v", keyTables)
+	}
+	for _, row := range scanRows(t, reopened, catalog.ColumnsTable) {
+		if row["table_name"] == "a" && row["name"] == "b_c" && row["default"] != longDefault {
+			t.Errorf("Default of a.b_c was not kept in full")
+		}
+	}
+}
+
+func mustSerialize(t *testing.T, schema record.Schema, values ...interface{}) []byte {
+	t.Helper()
+
+	data, err := record.Serialize(schema, values)
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	return data
+}
+
+func scanRows(t *testing.T, storage *FileStorageLayer, tableName string) []map[string]interface{} {
+	t.Helper()
+
+	schema, err := storage.GetSchema(tableName)
+	if err != nil {
+		t.Fatalf("Failed to get schema of %s: %v", tableName, err)
+	}
+	records, err := storage.Scan(tableName, nil)
+	if err != nil {
+		t.Fatalf("Failed to scan %s: %v", tableName, err)
+	}
+
+	var rows []map[string]interface{}
+	for _, data := range records {
+		values, err := record.Deserialize(schema, data)
+		if err != nil {
+			t.Fatalf("Failed to decode %s row: %v", tableName, err)
+		}
+		row := make(map[string]interface{})
+		for i, col := range schema.Columns {
+			row[col.Name] = values[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func scanColumn(t *testing.T, storage *FileStorageLayer, tableName, column string) []interface{} {
+	t.Helper()
+
+	var values []interface{}
+	for _, row := range scanRows(t, storage, tableName) {
+		values = append(values, row[column])
+	}
+	return values
+}
+
+func equalValues(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
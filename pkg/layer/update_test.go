@@ -0,0 +1,80 @@
+package layer
+
+import (
+	"storage-layer/pkg/record"
+	"storage-layer/pkg/vfs"
+	"strings"
+	"testing"
+)
+
+// An update that changes the size of a record moves it: the new copy goes
+// wherever it fits, the index follows it under the same ID and the old
+// slot is freed.
+func TestUpdateMovesResizedRecord(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	opts := Options{FileSystem: fsys}
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt},
+			{Name: "name", Type: record.TypeString, Length: 2000},
+		},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	if err := storage.CreateTable("t", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	// Page 0 is nearly full, so the grown record cannot stay there
+	var ids []int
+	for i := 0; i < 3; i++ {
+		data, _ := record.Serialize(schema, []interface{}{i, strings.Repeat("a", 1200)})
+		id, err := storage.Insert("t", data)
+		if err != nil {
+			t.Fatalf("Failed to insert record %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+
+	oldRID, _ := storage.indexes["t"].Search(ids[0])
+	grown, _ := record.Serialize(schema, []interface{}{0, strings.Repeat("b", 1900)})
+	if err := storage.Update("t", ids[0], grown); err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+	newRID, _ := storage.indexes["t"].Search(ids[0])
+	if newRID.PageID == oldRID.PageID {
+		t.Errorf("Expected the grown record to move off page %d", oldRID.PageID)
+	}
+	if _, err := storage.GetByRID("t", oldRID); err == nil {
+		t.Errorf("Expected the old slot to be freed")
+	}
+
+	// Shrinking changes the size too, and the record moves to the room
+	// left on page 0
+	shrunk, _ := record.Serialize(schema, []interface{}{0, "c"})
+	if err := storage.Update("t", ids[0], shrunk); err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+	if rid, _ := storage.indexes["t"].Search(ids[0]); rid.PageID != 0 {
+		t.Errorf("Expected the shrunk record on page 0, got page %d", rid.PageID)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	reopened := NewFileStorageLayer()
+	if err := reopened.OpenWithOptions("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+	records, err := reopened.Scan("t", nil)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d (%v)", len(records), err)
+	}
+	data, err := reopened.Get("t", ids[0])
+	if err != nil || string(data) != string(shrunk) {
+		t.Errorf("Expected the shrunk record under ID %d (%v)", ids[0], err)
+	}
+}
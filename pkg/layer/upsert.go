@@ -0,0 +1,94 @@
+package layer
+
+import (
+	"fmt"
+	"storage-layer/pkg/catalog"
+	"storage-layer/pkg/record"
+	"strings"
+)
+
+// ConflictAction says what Upsert does when a row with the same key exists.
+type ConflictAction int
+
+const (
+	// DoUpdate replaces the existing row with the new one
+	DoUpdate ConflictAction = iota
+	// DoNothing keeps the existing row
+	DoNothing
+)
+
+// Upsert inserts a record, or handles it with onConflict if a record with
+// the same values in keyColumns exists. keyColumns must be the primary key
+// or a unique key. It returns the ID of the inserted or existing record and
+// whether the record was inserted.
+func (fsl *FileStorageLayer) Upsert(tableName string, keyColumns []string, recordData []byte, onConflict ConflictAction) (id int, inserted bool, err error) {
+	unlock := fsl.lockWrite(tableName, true)
+	defer unlock()
+
+	var taken []catalog.SequenceUse
+	defer func() {
+		if err != nil {
+			fsl.catalog.GiveBack(taken)
+		}
+	}()
+
+	if !fsl.isOpen {
+		return -1, false, fmt.Errorf("storage layer is not open")
+	}
+
+	if err := checkWritable(tableName); err != nil {
+		return -1, false, err
+	}
+
+	if onConflict != DoUpdate && onConflict != DoNothing {
+		return -1, false, fmt.Errorf("unknown conflict action %d", onConflict)
+	}
+
+	schema, err := fsl.catalog.GetSchema(tableName)
+	if err != nil {
+		return -1, false, err
+	}
+
+	index := fsl.uniqueIndexFor(tableName, keyColumns)
+	if index == nil {
+		return -1, false, fmt.Errorf("columns (%s) are not a primary or unique key of table %s", strings.Join(keyColumns, ", "), tableName)
+	}
+
+	values, err := fsl.decodeRecord(tableName, recordData)
+	if err != nil {
+		return -1, false, err
+	}
+
+	// The key may come from a default or generated column
+	values, err = fsl.completeRow(tableName, values, nil, &taken)
+	if err != nil {
+		return -1, false, err
+	}
+
+	key, ok := index.Key(values)
+	existingID, exists := index.Lookup(key)
+	if !ok || !exists {
+		id, err := fsl.insertValues(tableName, values, nil, nil, &taken)
+		return id, err == nil, err
+	}
+
+	// The new row is dropped, and with it what completing it took
+	if onConflict == DoNothing {
+		fsl.catalog.GiveBack(taken)
+		return existingID, false, nil
+	}
+
+	rid, found := fsl.indexes[tableName].Search(existingID)
+	if !found {
+		return -1, false, fmt.Errorf("record %d not found", existingID)
+	}
+
+	data, err := record.Serialize(schema, values)
+	if err != nil {
+		return -1, false, err
+	}
+	if err := fsl.update(tableName, existingID, rid, data, false); err != nil {
+		return -1, false, err
+	}
+	return existingID, false, nil
+}
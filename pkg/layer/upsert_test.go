@@ -0,0 +1,106 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"storage-layer/pkg/record"
+	"sync"
+	"testing"
+)
+
+func TestUpsert(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "upsert_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	schema := record.Schema{
+		Columns: []record.Column{
+			{Name: "id", Type: record.TypeInt, Nullable: false},
+			{Name: "email", Type: record.TypeString, Length: 50, Nullable: false},
+			{Name: "visits", Type: record.TypeInt, Nullable: false},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"email"}},
+	}
+
+	storage := NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.CreateTable("users", schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	upsert := func(keyColumns []string, onConflict ConflictAction, values ...interface{}) (int, bool, error) {
+		data, err := record.Serialize(schema, values)
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		return storage.Upsert("users", keyColumns, data, onConflict)
+	}
+	visits := func(recordID int) interface{} {
+		data, err := storage.Get("users", recordID)
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		values, _ := record.Deserialize(schema, data)
+		return values[2]
+	}
+
+	if _, _, err := upsert([]string{"visits"}, DoUpdate, 1, "a@example.com", 1); err == nil {
+		t.Errorf("Expected a non-unique key to be rejected")
+	}
+
+	id, inserted, err := upsert([]string{"id"}, DoUpdate, 1, "a@example.com", 1)
+	if err != nil || !inserted {
+		t.Fatalf("Expected an insert, got inserted=%v err=%v", inserted, err)
+	}
+
+	sameID, inserted, err := upsert([]string{"id"}, DoUpdate, 1, "a@example.com", 2)
+	if err != nil || inserted || sameID != id {
+		t.Fatalf("Expected an update of record %d, got %d inserted=%v err=%v", id, sameID, inserted, err)
+	}
+	if v := visits(id); v != 2 {
+		t.Errorf("Expected 2 visits after the update, got %v", v)
+	}
+
+	sameID, inserted, err = upsert([]string{"email"}, DoNothing, 7, "a@example.com", 99)
+	if err != nil || inserted || sameID != id {
+		t.Fatalf("Expected DO NOTHING to return record %d, got %d inserted=%v err=%v", id, sameID, inserted, err)
+	}
+	if v := visits(id); v != 2 {
+		t.Errorf("Expected DO NOTHING to keep the row, got %v visits", v)
+	}
+
+	// Updating through the email key may not steal another row's id
+	if _, _, err := upsert([]string{"id"}, DoUpdate, 2, "b@example.com", 1); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	var violation *ConstraintViolation
+	if _, _, err := upsert([]string{"email"}, DoUpdate, 2, "a@example.com", 5); !errors.As(err, &violation) {
+		t.Errorf("Expected a primary key violation, got %v", err)
+	}
+
+	// Concurrent upserts of the same key end up as one row
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _ := record.Serialize(schema, []interface{}{3, "c@example.com", i})
+			if _, _, err := storage.Upsert("users", []string{"id"}, data, DoUpdate); err != nil {
+				t.Errorf("Concurrent upsert failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rows, err := storage.Scan("users", nil)
+	if err != nil || len(rows) != 3 {
+		t.Errorf("Expected 3 rows, got %d (%v)", len(rows), err)
+	}
+}
@@ -28,15 +28,21 @@ const (
 	SlotEntrySize  = 4
 )
 
+// MaxRecordSize is the largest record that fits in an empty page.
+const MaxRecordSize = PageSize - PageHeaderSize - SlotEntrySize
+
 type Page struct {
 	PageID int32
-	Data   [PageSize]byte
+	Data   []byte
 	dirty  bool
+	// release is set while Data is shared, see SharePage
+	release func()
 }
 
 func NewPage(pageID int32) *Page {
 	page := &Page{
 		PageID: pageID,
+		Data:   make([]byte, PageSize),
 		dirty:  true,
 	}
 
@@ -60,12 +66,44 @@ func LoadPage(pageID int32, data []byte) *Page {
 
 	page := &Page{
 		PageID: pageID,
+		Data:   append([]byte(nil), data...),
 		dirty:  false,
 	}
-	copy(page.Data[:], data)
 	return page
 }
 
+// SharePage is LoadPage without the copy: the page reads data in place
+// until its first change, when it copies it and calls release. Release
+// calls it for a page dropped unchanged. data must not change meanwhile.
+func SharePage(pageID int32, data []byte, release func()) *Page {
+	if len(data) != PageSize {
+		return nil
+	}
+
+	return &Page{
+		PageID:  pageID,
+		Data:    data,
+		release: release,
+	}
+}
+
+// Release ends the use of the data of a shared page. The page must not be
+// used afterwards.
+func (p *Page) Release() {
+	if p.release != nil {
+		p.release()
+		p.release = nil
+	}
+}
+
+// own copies shared data before the page changes.
+func (p *Page) own() {
+	if p.release != nil {
+		p.Data = append([]byte(nil), p.Data...)
+		p.Release()
+	}
+}
+
 func (p *Page) readHeader() PageHeader {
 	var header PageHeader
 	header.PageID = int32(binary.LittleEndian.Uint32(p.Data[0:4]))
@@ -78,6 +116,7 @@ func (p *Page) readHeader() PageHeader {
 }
 
 func (p *Page) writeHeader(header PageHeader) {
+	p.own()
 	binary.LittleEndian.PutUint32(p.Data[0:4], uint32(header.PageID))
 	binary.LittleEndian.PutUint16(p.Data[4:6], uint16(header.SlotCount))
 	binary.LittleEndian.PutUint16(p.Data[6:8], uint16(header.FreeStart))
@@ -96,6 +135,7 @@ func (p *Page) readSlot(slotID int) SlotEntry {
 }
 
 func (p *Page) writeSlot(slotID int, slot SlotEntry) {
+	p.own()
 	offset := PageHeaderSize + slotID*SlotEntrySize
 	binary.LittleEndian.PutUint16(p.Data[offset:offset+2], uint16(slot.Offset))
 	binary.LittleEndian.PutUint16(p.Data[offset+2:offset+4], uint16(slot.Size))
@@ -127,6 +167,7 @@ func (p *Page) InsertRecord(record []byte) (int, error) {
 	}
 
 	recordOffset := int(header.FreeEnd) - recordSize
+	p.own()
 	copy(p.Data[recordOffset:recordOffset+recordSize], record)
 
 	slot := SlotEntry{
@@ -181,6 +222,7 @@ func (p *Page) UpdateRecord(slotID int, newRecord []byte) error {
 		return fmt.Errorf("record size mismatch: expected %d, got %d", slot.Size, len(newRecord))
 	}
 
+	p.own()
 	copy(p.Data[slot.Offset:slot.Offset+slot.Size], newRecord)
 	p.dirty = true
 	return nil
@@ -203,6 +245,10 @@ func (p *Page) DeleteRecord(slotID int) error {
 	return nil
 }
 
+func (p *Page) SlotCount() int {
+	return int(p.readHeader().SlotCount)
+}
+
 func (p *Page) IsDirty() bool {
 	return p.dirty
 }
@@ -212,5 +258,5 @@ func (p *Page) SetClean() {
 }
 
 func (p *Page) GetData() []byte {
-	return p.Data[:]
+	return p.Data
 }
@@ -0,0 +1,52 @@
+package record
+
+import "strings"
+
+// Compare orders two non-nil values of the same column type. NULLs sort
+// before every other value.
+func Compare(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch x := a.(type) {
+	case int:
+		switch y := b.(type) {
+		case int:
+			return compareOrdered(x, y)
+		case float64:
+			return compareOrdered(float64(x), y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int:
+			return compareOrdered(x, float64(y))
+		case float64:
+			return compareOrdered(x, y)
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+
+	return 0
+}
+
+func compareOrdered[T int | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,108 @@
+package record
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseValue converts the textual form of a value into the Go type expected
+// by Serialize for the given column.
+func ParseValue(col Column, text string) (interface{}, error) {
+	switch col.Type {
+	case TypeInt:
+		intVal, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %q", text)
+		}
+		if intVal < math.MinInt32 || intVal > math.MaxInt32 {
+			return nil, fmt.Errorf("int %d out of range", intVal)
+		}
+		return int(intVal), nil
+
+	case TypeFloat:
+		floatVal, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %q", text)
+		}
+		return floatVal, nil
+
+	case TypeString:
+		if len(text) > col.Length {
+			return nil, fmt.Errorf("string too long: max %d, got %d", col.Length, len(text))
+		}
+		return text, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported column type: %s", col.Type)
+	}
+}
+
+// FormatValue is the inverse of ParseValue.
+func FormatValue(col Column, value interface{}) (string, error) {
+	switch col.Type {
+	case TypeInt:
+		intVal, ok := value.(int)
+		if !ok {
+			return "", fmt.Errorf("expected int, got %T", value)
+		}
+		return strconv.Itoa(intVal), nil
+
+	case TypeFloat:
+		floatVal, ok := value.(float64)
+		if !ok {
+			return "", fmt.Errorf("expected float64, got %T", value)
+		}
+		return strconv.FormatFloat(floatVal, 'g', -1, 64), nil
+
+	case TypeString:
+		strVal, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("expected string, got %T", value)
+		}
+		return strVal, nil
+
+	default:
+		return "", fmt.Errorf("unsupported column type: %s", col.Type)
+	}
+}
+
+// Coerce converts a computed value to the Go type of the column. INT
+// columns accept integral floats and FLOAT columns accept ints.
+func Coerce(col Column, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case TypeInt:
+		switch v := value.(type) {
+		case int:
+			if v < math.MinInt32 || v > math.MaxInt32 {
+				return nil, fmt.Errorf("int %d out of range", v)
+			}
+			return v, nil
+		case float64:
+			if v != math.Trunc(v) || v < math.MinInt32 || v > math.MaxInt32 {
+				return nil, fmt.Errorf("%v is not a valid int", v)
+			}
+			return int(v), nil
+		}
+
+	case TypeFloat:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+
+	case TypeString:
+		if strVal, ok := value.(string); ok {
+			return strVal, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot store %T in %s column %s", value, col.Type, col.Name)
+}
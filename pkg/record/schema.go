@@ -0,0 +1,228 @@
+package record
+
+import (
+	"fmt"
+	"storage-layer/pkg/expr"
+	"strings"
+)
+
+func (s Schema) ColumnIndex(name string) int {
+	for i, col := range s.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate checks that the schema is well formed and that its constraints
+// refer to existing columns.
+func (s Schema) Validate() error {
+	if len(s.Columns) == 0 {
+		return fmt.Errorf("schema has no columns")
+	}
+
+	seen := make(map[string]bool)
+	for _, col := range s.Columns {
+		if col.Name == "" {
+			return fmt.Errorf("column name cannot be empty")
+		}
+		if seen[col.Name] {
+			return fmt.Errorf("duplicate column %s", col.Name)
+		}
+		seen[col.Name] = true
+
+		switch col.Type {
+		case TypeInt, TypeFloat:
+		case TypeString:
+			if col.Length <= 0 || col.Length > 65535 {
+				return fmt.Errorf("column %s: string length must be between 1 and 65535", col.Name)
+			}
+		default:
+			return fmt.Errorf("column %s: unsupported column type: %s", col.Name, col.Type)
+		}
+	}
+
+	if err := s.validateExpressions(); err != nil {
+		return err
+	}
+
+	if len(s.PrimaryKey) > 0 {
+		if err := s.validateKey(s.PrimaryKey); err != nil {
+			return fmt.Errorf("primary key: %v", err)
+		}
+		for _, name := range s.PrimaryKey {
+			if s.Columns[s.ColumnIndex(name)].Nullable {
+				return fmt.Errorf("primary key column %s cannot be nullable", name)
+			}
+		}
+	}
+
+	for _, key := range s.Unique {
+		if err := s.validateKey(key); err != nil {
+			return fmt.Errorf("unique constraint: %v", err)
+		}
+	}
+
+	for _, fk := range s.ForeignKeys {
+		if err := s.validateKey(fk.Columns); err != nil {
+			return fmt.Errorf("foreign key: %v", err)
+		}
+		if fk.RefTable == "" {
+			return fmt.Errorf("foreign key on (%s) has no referenced table", strings.Join(fk.Columns, ", "))
+		}
+		if len(fk.RefColumns) != len(fk.Columns) {
+			return fmt.Errorf("foreign key on (%s) references %d columns", strings.Join(fk.Columns, ", "), len(fk.RefColumns))
+		}
+
+		for _, action := range []ReferentialAction{fk.OnDelete, fk.OnUpdate} {
+			switch action {
+			case "", ActionRestrict, ActionCascade:
+			case ActionSetNull:
+				for _, name := range fk.Columns {
+					if !s.Columns[s.ColumnIndex(name)].Nullable {
+						return fmt.Errorf("foreign key column %s must be nullable for SET NULL", name)
+					}
+				}
+			default:
+				return fmt.Errorf("unknown referential action %q", action)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s Schema) validateExpressions() error {
+	for _, col := range s.Columns {
+		if col.Default != "" && col.Generated != "" {
+			return fmt.Errorf("column %s cannot have both a default and a generated value", col.Name)
+		}
+		if col.AutoIncrement {
+			if col.Type != TypeInt {
+				return fmt.Errorf("column %s: only INT columns can be AUTO_INCREMENT", col.Name)
+			}
+			if col.Default != "" || col.Generated != "" {
+				return fmt.Errorf("column %s: AUTO_INCREMENT columns cannot have a default or generated value", col.Name)
+			}
+		}
+
+		if col.Default != "" {
+			e, err := expr.Parse(col.Default)
+			if err != nil {
+				return fmt.Errorf("column %s: invalid default: %v", col.Name, err)
+			}
+			if len(e.Columns()) > 0 {
+				return fmt.Errorf("column %s: default cannot refer to columns", col.Name)
+			}
+		}
+
+		if col.Generated != "" {
+			e, err := expr.Parse(col.Generated)
+			if err != nil {
+				return fmt.Errorf("column %s: invalid generated expression: %v", col.Name, err)
+			}
+			for _, name := range e.Columns() {
+				i := s.ColumnIndex(name)
+				if i < 0 {
+					return fmt.Errorf("column %s: generated expression refers to unknown column %s", col.Name, name)
+				}
+				if s.Columns[i].Generated != "" {
+					return fmt.Errorf("column %s: generated expression cannot refer to generated column %s", col.Name, name)
+				}
+			}
+		}
+	}
+
+	for i, check := range s.Checks {
+		e, err := expr.Parse(check.Expr)
+		if err != nil {
+			return fmt.Errorf("check %d: %v", i+1, err)
+		}
+		for _, name := range e.Columns() {
+			if s.ColumnIndex(name) < 0 {
+				return fmt.Errorf("check %d refers to unknown column %s", i+1, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsUniqueKey reports whether columns, in any order, form the primary key
+// or one of the unique keys.
+func (s Schema) IsUniqueKey(columns []string) bool {
+	if sameColumns(s.PrimaryKey, columns) {
+		return true
+	}
+	for _, key := range s.Unique {
+		if sameColumns(key, columns) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, name := range a {
+		found := false
+		for _, other := range b {
+			if name == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// PrimaryKeyName returns the name of the primary key.
+func (s Schema) PrimaryKeyName(tableName string) string {
+	return tableName + "_pkey"
+}
+
+// UniqueKeyName returns the name of the i-th unique key.
+func (s Schema) UniqueKeyName(tableName string, i int) string {
+	return tableName + "_" + strings.Join(s.Unique[i], "_") + "_key"
+}
+
+// ForeignKeyName returns the name of the i-th foreign key.
+func (s Schema) ForeignKeyName(tableName string, i int) string {
+	fk := s.ForeignKeys[i]
+	if fk.Name != "" {
+		return fk.Name
+	}
+	return tableName + "_" + strings.Join(fk.Columns, "_") + "_fkey"
+}
+
+// CheckName returns the name of the i-th check constraint.
+func (s Schema) CheckName(tableName string, i int) string {
+	if s.Checks[i].Name != "" {
+		return s.Checks[i].Name
+	}
+	return fmt.Sprintf("%s_check%d", tableName, i+1)
+}
+
+func (s Schema) validateKey(columns []string) error {
+	if len(columns) == 0 {
+		return fmt.Errorf("no columns given")
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range columns {
+		if s.ColumnIndex(name) < 0 {
+			return fmt.Errorf("column %s does not exist", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("column %s listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
@@ -19,10 +19,50 @@ type Column struct {
 	Type     ColumnType
 	Length   int // Max length for strings
 	Nullable bool
+	// Default is an expression used when no value is given
+	Default string `json:",omitempty"`
+	// Generated is an expression over other columns that computes the value
+	Generated string `json:",omitempty"`
+	// AutoIncrement INT columns take the next value of a sequence when no
+	// value is given
+	AutoIncrement bool `json:",omitempty"`
 }
 
 type Schema struct {
-	Columns []Column
+	Columns     []Column
+	PrimaryKey  []string     `json:",omitempty"`
+	Unique      [][]string   `json:",omitempty"`
+	ForeignKeys []ForeignKey `json:",omitempty"`
+	Checks      []Check      `json:",omitempty"`
+	// Compression names the codec the table's pages are stored with, or
+	// is empty for none
+	Compression string `json:",omitempty"`
+}
+
+// Check is a boolean expression every row must satisfy. Rows for which it
+// is NULL pass, as in SQL.
+type Check struct {
+	Name string `json:",omitempty"`
+	Expr string
+}
+
+type ReferentialAction string
+
+const (
+	ActionRestrict ReferentialAction = "RESTRICT"
+	ActionCascade  ReferentialAction = "CASCADE"
+	ActionSetNull  ReferentialAction = "SET NULL"
+)
+
+// ForeignKey makes Columns refer to RefColumns of RefTable, which must be
+// its primary key or a unique key. Empty actions mean RESTRICT.
+type ForeignKey struct {
+	Name       string `json:",omitempty"`
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+	OnDelete   ReferentialAction `json:",omitempty"`
+	OnUpdate   ReferentialAction `json:",omitempty"`
 }
 
 // Record serialization format:
@@ -41,7 +81,8 @@ func Serialize(schema Schema, values []interface{}) ([]byte, error) {
 		value := values[i]
 
 		if value == nil {
-			if !col.Nullable {
+			// The storage layer fills in defaults and generated values
+			if !col.Nullable && col.Default == "" && col.Generated == "" && !col.AutoIncrement {
 				return nil, fmt.Errorf("column %s cannot be null", col.Name)
 			}
 
@@ -143,7 +184,7 @@ func deserializeField(col Column, data []byte) (interface{}, int, error) {
 		if len(data) < 4 {
 			return nil, 0, fmt.Errorf("insufficient data for int")
 		}
-		value := int(binary.LittleEndian.Uint32(data[0:4]))
+		value := int(int32(binary.LittleEndian.Uint32(data[0:4])))
 		return value, 4, nil
 
 	case TypeFloat:
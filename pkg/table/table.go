@@ -0,0 +1,308 @@
+package table
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"storage-layer/pkg/layer"
+	"storage-layer/pkg/record"
+	"strconv"
+	"strings"
+)
+
+// Table maps rows of a stored table to values of the struct type T.
+//
+// Columns are declared with struct tags:
+//
+//	type User struct {
+//		ID   int     `db:"id"`
+//		Name string  `db:"name,len=50"`
+//		Age  *int    `db:"age,nullable"`
+//	}
+//
+// Fields without a db tag, or tagged "-", are not stored. Nullable columns
+// must use pointer fields so that NULL can be told apart from a zero value.
+type Table[T any] struct {
+	storage *layer.FileStorageLayer
+	name    string
+	schema  record.Schema
+	fields  []fieldInfo
+}
+
+type fieldInfo struct {
+	index   []int
+	pointer bool
+}
+
+// SchemaOf derives the record schema described by the tags of T.
+func SchemaOf[T any]() (record.Schema, error) {
+	schema, _, err := describe(reflect.TypeOf((*T)(nil)).Elem())
+	return schema, err
+}
+
+// Create creates the table from the schema of T.
+func Create[T any](storage *layer.FileStorageLayer, name string) (*Table[T], error) {
+	schema, fields, err := describe(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storage.CreateTable(name, schema); err != nil {
+		return nil, err
+	}
+
+	return &Table[T]{storage: storage, name: name, schema: schema, fields: fields}, nil
+}
+
+// Open binds T to an existing table. The schema of T must match the one in
+// the catalog column for column.
+func Open[T any](storage *layer.FileStorageLayer, name string) (*Table[T], error) {
+	schema, fields, err := describe(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := storage.GetSchema(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := compareSchemas(schema, stored); err != nil {
+		return nil, fmt.Errorf("type %s does not match table %s: %v", reflect.TypeOf((*T)(nil)).Elem(), name, err)
+	}
+
+	return &Table[T]{storage: storage, name: name, schema: stored, fields: fields}, nil
+}
+
+func (t *Table[T]) Name() string {
+	return t.name
+}
+
+func (t *Table[T]) Schema() record.Schema {
+	return t.schema
+}
+
+func (t *Table[T]) Insert(row T) (int, error) {
+	data, err := t.encode(row)
+	if err != nil {
+		return -1, err
+	}
+	return t.storage.Insert(t.name, data)
+}
+
+func (t *Table[T]) Get(id int) (T, error) {
+	var row T
+
+	data, err := t.storage.Get(t.name, id)
+	if err != nil {
+		return row, err
+	}
+	return t.decode(data)
+}
+
+func (t *Table[T]) Update(id int, row T) error {
+	data, err := t.encode(row)
+	if err != nil {
+		return err
+	}
+	return t.storage.Update(t.name, id, data)
+}
+
+func (t *Table[T]) Delete(id int) error {
+	return t.storage.DeleteRecord(t.name, id)
+}
+
+// Scan returns every row for which filter returns true, or all rows if
+// filter is nil.
+func (t *Table[T]) Scan(filter func(T) bool) ([]T, error) {
+	rows, err := t.storage.Scan(t.name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []T
+	for _, data := range rows {
+		row, err := t.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if filter == nil || filter(row) {
+			results = append(results, row)
+		}
+	}
+	return results, nil
+}
+
+func (t *Table[T]) encode(row T) ([]byte, error) {
+	value := reflect.ValueOf(row)
+	values := make([]interface{}, len(t.fields))
+
+	for i, field := range t.fields {
+		fieldValue := value.FieldByIndex(field.index)
+		if field.pointer {
+			if fieldValue.IsNil() {
+				continue
+			}
+			fieldValue = fieldValue.Elem()
+		}
+
+		switch fieldValue.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// INT columns hold 32 bits
+			n := fieldValue.Int()
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("column %s: %d out of range", t.schema.Columns[i].Name, n)
+			}
+			values[i] = int(n)
+		case reflect.Float32, reflect.Float64:
+			values[i] = fieldValue.Float()
+		case reflect.String:
+			values[i] = fieldValue.String()
+		}
+	}
+
+	return record.Serialize(t.schema, values)
+}
+
+func (t *Table[T]) decode(data []byte) (T, error) {
+	var row T
+
+	values, err := record.Deserialize(t.schema, data)
+	if err != nil {
+		return row, err
+	}
+
+	value := reflect.ValueOf(&row).Elem()
+	for i, field := range t.fields {
+		if values[i] == nil {
+			continue
+		}
+
+		fieldValue := value.FieldByIndex(field.index)
+		if field.pointer {
+			fieldValue.Set(reflect.New(fieldValue.Type().Elem()))
+			fieldValue = fieldValue.Elem()
+		}
+
+		switch v := values[i].(type) {
+		case int:
+			if fieldValue.OverflowInt(int64(v)) {
+				return row, fmt.Errorf("column %s: %d does not fit in %s", t.schema.Columns[i].Name, v, fieldValue.Type())
+			}
+			fieldValue.SetInt(int64(v))
+		case float64:
+			if fieldValue.OverflowFloat(v) {
+				return row, fmt.Errorf("column %s: %v does not fit in %s", t.schema.Columns[i].Name, v, fieldValue.Type())
+			}
+			fieldValue.SetFloat(v)
+		case string:
+			fieldValue.SetString(v)
+		}
+	}
+
+	return row, nil
+}
+
+func describe(typ reflect.Type) (record.Schema, []fieldInfo, error) {
+	var schema record.Schema
+	var fields []fieldInfo
+
+	if typ.Kind() != reflect.Struct {
+		return schema, nil, fmt.Errorf("%s is not a struct type", typ)
+	}
+
+	for _, field := range reflect.VisibleFields(typ) {
+		tag, ok := field.Tag.Lookup("db")
+		if !ok || tag == "-" || !field.IsExported() {
+			continue
+		}
+
+		col, err := parseTag(tag)
+		if err != nil {
+			return schema, nil, fmt.Errorf("field %s: %v", field.Name, err)
+		}
+		if col.Name == "" {
+			col.Name = field.Name
+		}
+		if schema.ColumnIndex(col.Name) >= 0 {
+			return schema, nil, fmt.Errorf("field %s: duplicate column %s", field.Name, col.Name)
+		}
+
+		fieldType := field.Type
+		pointer := fieldType.Kind() == reflect.Pointer
+		if pointer {
+			fieldType = fieldType.Elem()
+		}
+		if pointer != col.Nullable {
+			return schema, nil, fmt.Errorf("field %s: nullable columns need a pointer field and pointer fields must be nullable", field.Name)
+		}
+
+		switch fieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			col.Type = record.TypeInt
+		case reflect.Float32, reflect.Float64:
+			col.Type = record.TypeFloat
+		case reflect.String:
+			col.Type = record.TypeString
+			if col.Length <= 0 {
+				return schema, nil, fmt.Errorf("field %s: string columns need a len option", field.Name)
+			}
+		default:
+			return schema, nil, fmt.Errorf("field %s: unsupported type %s", field.Name, field.Type)
+		}
+
+		schema.Columns = append(schema.Columns, col)
+		fields = append(fields, fieldInfo{index: field.Index, pointer: pointer})
+	}
+
+	if len(schema.Columns) == 0 {
+		return schema, nil, fmt.Errorf("%s has no db-tagged fields", typ)
+	}
+
+	return schema, fields, nil
+}
+
+func parseTag(tag string) (record.Column, error) {
+	parts := strings.Split(tag, ",")
+	col := record.Column{Name: strings.TrimSpace(parts[0])}
+
+	for _, option := range parts[1:] {
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "nullable":
+			col.Nullable = true
+		case strings.HasPrefix(option, "len="):
+			length, err := strconv.Atoi(strings.TrimPrefix(option, "len="))
+			if err != nil || length <= 0 {
+				return col, fmt.Errorf("invalid length in %q", option)
+			}
+			col.Length = length
+		default:
+			return col, fmt.Errorf("unknown tag option %q", option)
+		}
+	}
+
+	return col, nil
+}
+
+func compareSchemas(expected, stored record.Schema) error {
+	if len(expected.Columns) != len(stored.Columns) {
+		return fmt.Errorf("expected %d columns, table has %d", len(expected.Columns), len(stored.Columns))
+	}
+
+	for i, col := range expected.Columns {
+		other := stored.Columns[i]
+		switch {
+		case col.Name != other.Name:
+			return fmt.Errorf("column %d is %s, expected %s", i, other.Name, col.Name)
+		case col.Type != other.Type:
+			return fmt.Errorf("column %s has type %s, expected %s", col.Name, other.Type, col.Type)
+		case col.Type == record.TypeString && col.Length != other.Length:
+			return fmt.Errorf("column %s has length %d, expected %d", col.Name, other.Length, col.Length)
+		case col.Nullable != other.Nullable:
+			return fmt.Errorf("column %s nullability differs", col.Name)
+		}
+	}
+
+	return nil
+}
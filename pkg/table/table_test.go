@@ -0,0 +1,175 @@
+package table
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"storage-layer/pkg/layer"
+	"testing"
+)
+
+type user struct {
+	ID    int     `db:"id"`
+	Name  string  `db:"name,len=50"`
+	Age   *int    `db:"age,nullable"`
+	Score float64 `db:"score"`
+	Note  string  // not stored
+	Email *string `db:"-"`
+}
+
+type wrongUser struct {
+	ID   int    `db:"id"`
+	Name string `db:"name,len=20"`
+}
+
+func TestTypedTable(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "table_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	users, err := Create[user](storage, "users")
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	age := 30
+	alice := user{ID: 1, Name: "Alice", Age: &age, Score: 9.5}
+	bob := user{ID: 2, Name: "Bob", Score: 7}
+
+	aliceID, err := users.Insert(alice)
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	bobID, err := users.Insert(bob)
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	got, err := users.Get(aliceID)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if !reflect.DeepEqual(got, alice) {
+		t.Errorf("Expected %+v, got %+v", alice, got)
+	}
+
+	// A longer name changes the record size
+	bob.Name = "Robert the Second"
+	bob.Age = &age
+	if err := users.Update(bobID, bob); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	got, err = users.Get(bobID)
+	if err != nil {
+		t.Fatalf("Failed to get updated row: %v", err)
+	}
+	if !reflect.DeepEqual(got, bob) {
+		t.Errorf("Expected %+v, got %+v", bob, got)
+	}
+
+	rows, err := users.Scan(func(u user) bool { return u.Score > 8 })
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Name != "Alice" {
+		t.Errorf("Unexpected scan result: %+v", rows)
+	}
+
+	if _, err := Open[user](storage, "users"); err != nil {
+		t.Errorf("Failed to reopen with the same type: %v", err)
+	}
+	if _, err := Open[wrongUser](storage, "users"); err == nil {
+		t.Errorf("Expected a schema mismatch error")
+	}
+}
+
+func TestSchemaOfRejectsBadTags(t *testing.T) {
+	type missingLength struct {
+		Name string `db:"name"`
+	}
+	type nullableValue struct {
+		Age int `db:"age,nullable"`
+	}
+	type unknownOption struct {
+		ID int `db:"id,primary"`
+	}
+
+	if _, err := SchemaOf[missingLength](); err == nil {
+		t.Errorf("Expected an error for a string without len")
+	}
+	if _, err := SchemaOf[nullableValue](); err == nil {
+		t.Errorf("Expected an error for a nullable non-pointer field")
+	}
+	if _, err := SchemaOf[unknownOption](); err == nil {
+		t.Errorf("Expected an error for an unknown tag option")
+	}
+}
+
+func TestIntRange(t *testing.T) {
+	type wide struct {
+		ID    int64   `db:"id"`
+		Score float64 `db:"score"`
+	}
+	type narrow struct {
+		ID    int8    `db:"id"`
+		Score float32 `db:"score"`
+	}
+
+	tempDir, err := os.MkdirTemp("", "table_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := layer.NewFileStorageLayer()
+	if err := storage.Open(tempDir); err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
+	rows, err := Create[wide](storage, "rows")
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := rows.Insert(wide{ID: 1 << 40}); err == nil {
+		t.Errorf("Expected a value past 32 bits to be rejected rather than truncated")
+	}
+	if _, err := rows.Insert(wide{ID: math.MinInt32 - 1}); err == nil {
+		t.Errorf("Expected a value below 32 bits to be rejected rather than truncated")
+	}
+
+	small, err := rows.Insert(wide{ID: 100, Score: 1.5})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	large, err := rows.Insert(wide{ID: 1000})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	huge, err := rows.Insert(wide{ID: 1, Score: math.MaxFloat64})
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	narrowRows, err := Open[narrow](storage, "rows")
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if got, err := narrowRows.Get(small); err != nil || got.ID != 100 || got.Score != 1.5 {
+		t.Errorf("Expected {100 1.5}, got %+v (%v)", got, err)
+	}
+	if got, err := narrowRows.Get(large); err == nil {
+		t.Errorf("Expected 1000 not to fit in an int8, got %+v", got)
+	}
+	if got, err := narrowRows.Get(huge); err == nil {
+		t.Errorf("Expected MaxFloat64 not to fit in a float32, got %+v", got)
+	}
+}
@@ -0,0 +1,27 @@
+package vfs
+
+import "unsafe"
+
+// DirectAlignment is the alignment O_DIRECT needs for buffers, offsets and
+// lengths. It covers the logical block size of common devices.
+const DirectAlignment = 4096
+
+// DirectSupported reports whether O_DIRECT means anything on this
+// platform.
+const DirectSupported = O_DIRECT != 0
+
+// AlignedBuffer returns a zeroed buffer of size bytes starting on a
+// DirectAlignment boundary.
+func AlignedBuffer(size int) []byte {
+	buf := make([]byte, size+DirectAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (DirectAlignment - 1)); rem != 0 {
+		offset = DirectAlignment - rem
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+// IsAligned reports whether buf starts on a DirectAlignment boundary.
+func IsAligned(buf []byte) bool {
+	return len(buf) == 0 || uintptr(unsafe.Pointer(&buf[0]))&(DirectAlignment-1) == 0
+}
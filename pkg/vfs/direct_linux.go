@@ -0,0 +1,10 @@
+//go:build linux
+
+package vfs
+
+import "syscall"
+
+// O_DIRECT makes OS.OpenFile bypass the page cache. Reads and writes of
+// such a file must be aligned to DirectAlignment. The in-memory file
+// systems ignore it.
+const O_DIRECT = syscall.O_DIRECT
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package vfs
+
+// O_DIRECT is not available here, so files are always opened buffered.
+const O_DIRECT = 0
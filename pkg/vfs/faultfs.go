@@ -0,0 +1,448 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SectorSize is the unit in which FaultFS tears unsynced writes on a crash.
+const SectorSize = 512
+
+// ErrCrashed is returned by every operation of a FaultFS after its crash
+// point is reached, and by files opened before a restart.
+var ErrCrashed = errors.New("simulated crash")
+
+// Op names an operation for fault injection.
+type Op string
+
+const (
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpSync     Op = "sync"
+	OpTruncate Op = "truncate"
+	OpRemove   Op = "remove"
+	OpRename   Op = "rename"
+	OpSyncDir  Op = "syncdir"
+)
+
+// Fault fails an operation. It skips the first After matching operations
+// and fails the next one with Err.
+type Fault struct {
+	Op Op
+	// Path matches the base name of the file with filepath.Match; empty
+	// matches every file
+	Path  string
+	After int
+	Err   error
+}
+
+// FaultFS is an in-memory file system that simulates what survives a
+// crash. Written data is durable only after Sync, and created, renamed or
+// removed names only after SyncDir of their directory. A failed Sync, like
+// on Linux, drops the unsynced data of the file.
+type FaultFS struct {
+	dirs    map[string]bool
+	files   map[string]*faultNode
+	durable map[string]*faultNode
+	faults  []*Fault
+	// crashAt is the number of mutating operations after which the file
+	// system goes down, or -1
+	crashAt    int
+	mutations  int
+	down       bool
+	generation int
+	rng        *rand.Rand
+	mutex      sync.Mutex
+}
+
+type faultNode struct {
+	data   []byte
+	synced []byte
+}
+
+type faultFile struct {
+	fsys       *FaultFS
+	name       string
+	node       *faultNode
+	generation int
+	closed     bool
+}
+
+// NewFaultFS returns an empty FaultFS. seed drives the tearing of writes.
+func NewFaultFS(seed int64) *FaultFS {
+	return &FaultFS{
+		dirs:    map[string]bool{".": true, string(filepath.Separator): true},
+		files:   make(map[string]*faultNode),
+		durable: make(map[string]*faultNode),
+		crashAt: -1,
+		rng:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// InjectFault adds a fault. Each fault fires once.
+func (f *FaultFS) InjectFault(fault Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// CrashAfter makes the file system go down once n more mutating operations
+// have succeeded. Until Restart every operation then fails with ErrCrashed.
+func (f *FaultFS) CrashAfter(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.crashAt = f.mutations + n
+}
+
+// Mutations counts the operations that changed the file system so far.
+func (f *FaultFS) Mutations() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.mutations
+}
+
+// Crashed reports whether the crash point set by CrashAfter was reached.
+func (f *FaultFS) Crashed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.down
+}
+
+// Restart simulates a power loss and reboot: only durable names and synced
+// data remain. With tear set, each sector written since the last sync
+// independently survives or not. Files opened before fail with ErrCrashed.
+func (f *FaultFS) Restart(tear bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names := make([]string, 0, len(f.durable))
+	for name := range f.durable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f.files = make(map[string]*faultNode, len(f.durable))
+	for _, name := range names {
+		node := f.durable[name]
+		data := node.synced
+		if tear {
+			data = f.tear(node.synced, node.data)
+		}
+		node.data = append([]byte(nil), data...)
+		node.synced = append([]byte(nil), data...)
+		f.files[name] = node
+	}
+
+	f.faults = nil
+	f.crashAt = -1
+	f.down = false
+	f.generation++
+}
+
+// tear returns the synced data with a random subset of the sectors that
+// changed since.
+func (f *FaultFS) tear(synced, current []byte) []byte {
+	result := append([]byte(nil), synced...)
+	for off := 0; off < len(current); off += SectorSize {
+		end := off + SectorSize
+		if end > len(current) {
+			end = len(current)
+		}
+		if end <= len(synced) && string(synced[off:end]) == string(current[off:end]) {
+			continue
+		}
+		if f.rng.Intn(2) == 0 {
+			continue
+		}
+		if len(result) < end {
+			result = append(result, make([]byte, end-len(result))...)
+		}
+		copy(result[off:end], current[off:end])
+	}
+	return result
+}
+
+// begin checks the state of the file system and the injected faults before
+// an operation. Called with f.mutex held.
+func (f *FaultFS) begin(op Op, name string) error {
+	if f.down {
+		return ErrCrashed
+	}
+
+	for i, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+		if fault.Path != "" {
+			if ok, _ := filepath.Match(fault.Path, filepath.Base(name)); !ok {
+				continue
+			}
+		}
+		if fault.After > 0 {
+			fault.After--
+			continue
+		}
+		f.faults = append(f.faults[:i], f.faults[i+1:]...)
+		return &fs.PathError{Op: string(op), Path: name, Err: fault.Err}
+	}
+
+	if op != OpRead {
+		if f.crashAt >= 0 && f.mutations >= f.crashAt {
+			f.down = true
+			return ErrCrashed
+		}
+		f.mutations++
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int) (File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	node, exists := f.files[name]
+
+	op := OpRead
+	if !exists || flag&os.O_TRUNC != 0 {
+		op = OpOpen
+	}
+	if err := f.begin(op, name); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, notExist("open", name)
+	case !exists:
+		if !f.dirs[filepath.Dir(name)] {
+			return nil, notExist("open", name)
+		}
+		node = &faultNode{}
+		f.files[name] = node
+	case flag&os.O_TRUNC != 0:
+		node.data = nil
+	}
+
+	return &faultFile{fsys: f, name: name, node: node, generation: f.generation}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if err := f.begin(OpRemove, name); err != nil {
+		return err
+	}
+	if _, exists := f.files[name]; !exists {
+		return notExist("remove", name)
+	}
+	delete(f.files, name)
+	return nil
+}
+
+func (f *FaultFS) Rename(oldName, newName string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	if err := f.begin(OpRename, oldName); err != nil {
+		return err
+	}
+	node, exists := f.files[oldName]
+	if !exists {
+		return notExist("rename", oldName)
+	}
+	if !f.dirs[filepath.Dir(newName)] {
+		return notExist("rename", newName)
+	}
+
+	delete(f.files, oldName)
+	f.files[newName] = node
+	return nil
+}
+
+func (f *FaultFS) List(dir string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if err := f.begin(OpRead, dir); err != nil {
+		return nil, err
+	}
+	if !f.dirs[dir] {
+		return nil, notExist("open", dir)
+	}
+
+	var names []string
+	for name := range f.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MkdirAll creates directories durably; the storage layer never removes
+// them, so they are not part of the crash model.
+func (f *FaultFS) MkdirAll(dir string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.down {
+		return ErrCrashed
+	}
+	for dir = filepath.Clean(dir); !f.dirs[dir]; dir = filepath.Dir(dir) {
+		f.dirs[dir] = true
+	}
+	return nil
+}
+
+func (f *FaultFS) SyncDir(dir string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if err := f.begin(OpSyncDir, dir); err != nil {
+		return err
+	}
+	if !f.dirs[dir] {
+		return notExist("sync", dir)
+	}
+
+	for name := range f.durable {
+		if filepath.Dir(name) == dir {
+			delete(f.durable, name)
+		}
+	}
+	for name, node := range f.files {
+		if filepath.Dir(name) == dir {
+			f.durable[name] = node
+		}
+	}
+	return nil
+}
+
+// String lists the files with their current and synced sizes, for test
+// failure messages.
+func (f *FaultFS) String() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var lines []string
+	for name, node := range f.files {
+		_, durable := f.durable[name]
+		lines = append(lines, fmt.Sprintf("%s: %d bytes, %d synced, durable name %v", name, len(node.data), len(node.synced), durable))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (ff *faultFile) begin(op Op) error {
+	if ff.closed {
+		return fs.ErrClosed
+	}
+	if ff.generation != ff.fsys.generation {
+		return ErrCrashed
+	}
+	return ff.fsys.begin(op, ff.name)
+}
+
+func (ff *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	ff.fsys.mutex.Lock()
+	defer ff.fsys.mutex.Unlock()
+
+	if err := ff.begin(OpRead); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(ff.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, ff.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ff *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	ff.fsys.mutex.Lock()
+	defer ff.fsys.mutex.Unlock()
+
+	if err := ff.begin(OpWrite); err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > int64(len(ff.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, ff.node.data)
+		ff.node.data = grown
+	}
+	return copy(ff.node.data[off:], p), nil
+}
+
+func (ff *faultFile) Sync() error {
+	ff.fsys.mutex.Lock()
+	defer ff.fsys.mutex.Unlock()
+
+	if err := ff.begin(OpSync); err != nil {
+		if !errors.Is(err, ErrCrashed) && !errors.Is(err, fs.ErrClosed) {
+			// The kernel drops the dirty pages of a failed sync
+			ff.node.data = append([]byte(nil), ff.node.synced...)
+		}
+		return err
+	}
+	ff.node.synced = append([]byte(nil), ff.node.data...)
+	return nil
+}
+
+func (ff *faultFile) Truncate(size int64) error {
+	ff.fsys.mutex.Lock()
+	defer ff.fsys.mutex.Unlock()
+
+	if err := ff.begin(OpTruncate); err != nil {
+		return err
+	}
+	if size <= int64(len(ff.node.data)) {
+		ff.node.data = append([]byte(nil), ff.node.data[:size]...)
+		return nil
+	}
+	grown := make([]byte, size)
+	copy(grown, ff.node.data)
+	ff.node.data = grown
+	return nil
+}
+
+func (ff *faultFile) Size() (int64, error) {
+	ff.fsys.mutex.Lock()
+	defer ff.fsys.mutex.Unlock()
+
+	if err := ff.begin(OpRead); err != nil {
+		return 0, err
+	}
+	return int64(len(ff.node.data)), nil
+}
+
+func (ff *faultFile) Close() error {
+	if ff.closed {
+		return fs.ErrClosed
+	}
+	ff.closed = true
+	return nil
+}
@@ -0,0 +1,224 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MemFS keeps files in memory. Like on Unix, a file that is removed or
+// replaced stays readable through handles opened before.
+type MemFS struct {
+	files map[string]*memData
+	dirs  map[string]bool
+	mutex sync.Mutex
+}
+
+type memData struct {
+	data  []byte
+	mutex sync.RWMutex
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	closed bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, string(filepath.Separator): true},
+	}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) OpenFile(name string, flag int) (File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	data, exists := m.files[name]
+
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, notExist("open", name)
+	case !exists:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, notExist("open", name)
+		}
+		data = &memData{}
+		m.files[name] = data
+	case flag&os.O_TRUNC != 0:
+		data.mutex.Lock()
+		data.data = nil
+		data.mutex.Unlock()
+	}
+
+	return &memFile{name: name, data: data}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if _, exists := m.files[name]; !exists {
+		return notExist("remove", name)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	data, exists := m.files[oldName]
+	if !exists {
+		return notExist("rename", oldName)
+	}
+	if !m.dirs[filepath.Dir(newName)] {
+		return notExist("rename", newName)
+	}
+
+	delete(m.files, oldName)
+	m.files[newName] = data
+	return nil
+}
+
+func (m *MemFS) List(dir string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, notExist("open", dir)
+	}
+
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemFS) MkdirAll(dir string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for dir = filepath.Clean(dir); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, exists := m.files[dir]; exists {
+			return fmt.Errorf("mkdir %s: not a directory", dir)
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) SyncDir(dir string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.dirs[filepath.Clean(dir)] {
+		return notExist("sync", dir)
+	}
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("read %s: negative offset", f.name)
+	}
+
+	f.data.mutex.RLock()
+	defer f.data.mutex.RUnlock()
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("write %s: negative offset", f.name)
+	}
+
+	f.data.mutex.Lock()
+	defer f.data.mutex.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.data.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data.data)
+		f.data.data = grown
+	}
+	return copy(f.data.data[off:], p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+
+	f.data.mutex.Lock()
+	defer f.data.mutex.Unlock()
+
+	if size <= int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+		return nil
+	}
+	grown := make([]byte, size)
+	copy(grown, f.data.data)
+	f.data.data = grown
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	f.data.mutex.RLock()
+	defer f.data.mutex.RUnlock()
+
+	return int64(len(f.data.data)), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,19 @@
+package vfs
+
+// Mappable is implemented by files that can be mapped into memory. Only
+// OS files on platforms with mmap are.
+type Mappable interface {
+	File
+	// Map maps the first size bytes of the file read-only. The mapping
+	// follows later writes to the file and stays valid after Close, until
+	// Unmap. Reading past the end of the file through it faults.
+	Map(size int) ([]byte, error)
+}
+
+// Map maps a file if it supports it.
+func Map(file File, size int) ([]byte, error) {
+	if m, ok := file.(Mappable); ok {
+		return m.Map(size)
+	}
+	return nil, errMapUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package vfs
+
+import "errors"
+
+var errMapUnsupported = errors.New("memory mapping is not supported on this platform")
+
+func (f osFile) Map(size int) ([]byte, error) {
+	return nil, errMapUnsupported
+}
+
+func Unmap(data []byte) error {
+	return errMapUnsupported
+}
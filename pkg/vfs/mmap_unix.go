@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package vfs
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errMapUnsupported = errors.New("file cannot be memory-mapped")
+
+func (f osFile) Map(size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func Unmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,36 @@
+package vfs
+
+// NoSync returns a file system that never syncs: Sync and SyncDir succeed
+// without doing anything. It suits scratch data that need not survive a
+// crash.
+func NoSync(fsys FileSystem) FileSystem {
+	return noSyncFS{fsys}
+}
+
+type noSyncFS struct {
+	FileSystem
+}
+
+func (fsys noSyncFS) OpenFile(name string, flag int) (File, error) {
+	file, err := fsys.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return noSyncFile{file}, nil
+}
+
+func (noSyncFS) SyncDir(dir string) error {
+	return nil
+}
+
+type noSyncFile struct {
+	File
+}
+
+func (noSyncFile) Sync() error {
+	return nil
+}
+
+func (f noSyncFile) Map(size int) ([]byte, error) {
+	return Map(f.File, size)
+}
@@ -0,0 +1,145 @@
+// Package vfs is the file system the storage layer writes to. OS stores
+// files on disk; MemFS keeps them in memory for tests.
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+	Close() error
+}
+
+type FileSystem interface {
+	// OpenFile opens a file for reading and writing. flag takes the os
+	// flags O_CREATE, O_EXCL and O_TRUNC, and O_DIRECT.
+	OpenFile(name string, flag int) (File, error)
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	// List returns the names of the files in dir, sorted.
+	List(dir string) ([]string, error)
+	MkdirAll(dir string) error
+	// SyncDir makes the creation, renaming and removal of files in dir
+	// durable.
+	SyncDir(dir string) error
+}
+
+// ReadFile reads a whole file. Errors for a missing file satisfy
+// os.IsNotExist.
+func ReadFile(fsys FileSystem, name string) ([]byte, error) {
+	file, err := fsys.OpenFile(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile replaces the contents of a file, creating it if needed. With
+// sync set the data is durable when it returns.
+func WriteFile(fsys FileSystem, name string, data []byte, sync bool) error {
+	file, err := fsys.OpenFile(name, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// Exists reports whether a file exists.
+func Exists(fsys FileSystem, name string) (bool, error) {
+	names, err := fsys.List(filepath.Dir(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(names, filepath.Base(name))
+	return i < len(names) && names[i] == filepath.Base(name), nil
+}
+
+// OS is the file system of the operating system.
+type OS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (OS) OpenFile(name string, flag int) (File, error) {
+	file, err := os.OpenFile(name, flag|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (OS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (OS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (OS) SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
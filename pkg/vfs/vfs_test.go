@@ -0,0 +1,173 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileSystems(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "vfs_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	t.Run("OS", func(t *testing.T) { testFileSystem(t, OS{}, filepath.Join(tempDir, "db")) })
+	t.Run("MemFS", func(t *testing.T) { testFileSystem(t, NewMemFS(), "/db") })
+}
+
+func testFileSystem(t *testing.T, fsys FileSystem, dir string) {
+	name := filepath.Join(dir, "a.tbl")
+
+	if _, err := fsys.OpenFile(name, os.O_CREATE); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing directory to fail with not exist, got %v", err)
+	}
+	if err := fsys.MkdirAll(dir); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if _, err := ReadFile(fsys, name); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file to fail with not exist, got %v", err)
+	}
+
+	file, err := fsys.OpenFile(name, os.O_CREATE)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if size, err := file.Size(); err != nil || size != 11 {
+		t.Errorf("Size = %d (%v), want 11", size, err)
+	}
+
+	buf := make([]byte, 8)
+	if n, err := file.ReadAt(buf, 6); n != 5 || err == nil {
+		t.Errorf("ReadAt past the end = %d, %v; want 5 and EOF", n, err)
+	}
+
+	if err := file.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if data, err := ReadFile(fsys, name); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile = %q (%v), want hello", data, err)
+	}
+
+	if _, err := fsys.OpenFile(name, os.O_CREATE|os.O_EXCL); !os.IsExist(err) {
+		t.Errorf("Expected O_EXCL on an existing file to fail, got %v", err)
+	}
+
+	other := filepath.Join(dir, "b.idx")
+	if err := WriteFile(fsys, other, []byte("{}"), true); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if names, err := fsys.List(dir); err != nil || len(names) != 2 || names[0] != "a.tbl" || names[1] != "b.idx" {
+		t.Errorf("List = %v (%v)", names, err)
+	}
+
+	renamed := filepath.Join(dir, "c.idx")
+	if err := fsys.Rename(other, renamed); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if exists, _ := Exists(fsys, other); exists {
+		t.Errorf("Expected %s to be gone after rename", other)
+	}
+	if data, err := ReadFile(fsys, renamed); err != nil || string(data) != "{}" {
+		t.Errorf("ReadFile after rename = %q (%v)", data, err)
+	}
+
+	if err := fsys.Remove(renamed); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := fsys.Remove(renamed); !os.IsNotExist(err) {
+		t.Errorf("Expected removing a missing file to fail with not exist, got %v", err)
+	}
+	if err := fsys.SyncDir(dir); err != nil {
+		t.Errorf("SyncDir failed: %v", err)
+	}
+}
+
+func TestFaultFSCrash(t *testing.T) {
+	fsys := NewFaultFS(1)
+	if err := fsys.MkdirAll("/db"); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	if err := WriteFile(fsys, "/db/synced", []byte("old"), true); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := fsys.SyncDir("/db"); err != nil {
+		t.Fatalf("SyncDir failed: %v", err)
+	}
+	if err := WriteFile(fsys, "/db/synced", []byte("new"), false); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := WriteFile(fsys, "/db/unlinked", []byte("data"), true); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	fsys.Restart(false)
+
+	if data, err := ReadFile(fsys, "/db/synced"); err != nil || string(data) != "old" {
+		t.Errorf("After a crash synced = %q (%v), want the synced contents", data, err)
+	}
+	if exists, _ := Exists(fsys, "/db/unlinked"); exists {
+		t.Errorf("Expected a file without a synced directory entry to be lost")
+	}
+
+	fsys.InjectFault(Fault{Op: OpSync, Err: syscall.EIO})
+	file, _ := fsys.OpenFile("/db/synced", 0)
+	file.WriteAt([]byte("bad"), 0)
+	if err := file.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Sync = %v, want EIO", err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Errorf("Expected the fault to fire once, got %v", err)
+	}
+	if data, _ := ReadFile(fsys, "/db/synced"); string(data) != "old" {
+		t.Errorf("Expected a failed sync to drop the unsynced write, got %q", data)
+	}
+
+	fsys.CrashAfter(1)
+	if _, err := file.WriteAt([]byte("x"), 0); err != nil {
+		t.Errorf("Expected the write before the crash point to succeed, got %v", err)
+	}
+	if _, err := file.WriteAt([]byte("y"), 0); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected a crash, got %v", err)
+	}
+	if _, err := ReadFile(fsys, "/db/synced"); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected reads to fail after the crash, got %v", err)
+	}
+
+	fsys.Restart(false)
+	if _, err := file.ReadAt(make([]byte, 1), 0); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected files opened before the restart to fail, got %v", err)
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{1, 4096, 3 * 4096} {
+		buf := AlignedBuffer(size)
+		if len(buf) != size || cap(buf) != size {
+			t.Errorf("AlignedBuffer(%d) has length %d and capacity %d", size, len(buf), cap(buf))
+		}
+		if !IsAligned(buf) {
+			t.Errorf("AlignedBuffer(%d) is not aligned", size)
+		}
+		if size > 1 && IsAligned(buf[1:]) {
+			t.Errorf("Expected an offset buffer to be unaligned")
+		}
+	}
+}